@@ -0,0 +1,210 @@
+// Package audit records every change pugo makes, to the cdb, newerpol, or by
+// sending email, as structured events in an append-only JSON lines file.
+// Recording is best effort: a failure to write the audit log is logged but
+// never fails the change being recorded.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Actions recorded
+const (
+	ActionAdminAdd    = "admin-add"
+	ActionAdminRemove = "admin-remove"
+	ActionSiteChange  = "site-change"
+	ActionSiteRemove  = "site-remove"
+	ActionSiteArchive = "site-archive"
+	ActionSiteRestore = "site-restore"
+	ActionCommit      = "commit"
+	ActionPush        = "push"
+	ActionTag         = "tag"
+	ActionGrantFinish = "grant-finish"
+	ActionGrantReset  = "grant-reset"
+	ActionGrantBlock  = "grant-block"
+	ActionEmailSent   = "email-sent"
+	ActionAPIRequest  = "api-request"
+)
+
+type Event struct {
+	Time time.Time `json:"time"`
+	// The run id and command of the pugo invocation making the change
+	RunId   string `json:"run_id,omitempty"`
+	Command string `json:"command,omitempty"`
+	// The user running pugo
+	User string `json:"user"`
+	// The pugo serve API client the change was made for, if any
+	Client string `json:"client,omitempty"`
+	Action string `json:"action"`
+	// The site and login affected, where applicable
+	Site  string `json:"site,omitempty"`
+	Login string `json:"login,omitempty"`
+	// Action specific detail, e.g. a commit hash or the field changed
+	Detail string `json:"detail,omitempty"`
+}
+
+type QueryOptions struct {
+	// If non-zero, only return events at or after this time
+	Since time.Time
+	// If set, only return events for this site
+	Site string
+	// If set, only return events made by, or affecting, this user, API
+	// client or login
+	User string
+	// If set, only return events with this action
+	Action string
+}
+
+var run struct {
+	mu      sync.Mutex
+	runId   string
+	command string
+	client  string
+	user    string
+}
+
+// SetRun sets the run id and command recorded with subsequent events
+func SetRun(runId string, command string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.runId = runId
+	run.command = command
+}
+
+// SetClient sets the pugo serve API client recorded with subsequent events,
+// for runs made on a client's behalf
+func SetClient(client string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.client = client
+}
+
+// FileName returns the path of the audit log: audit.file from config, or
+// .pugo-audit.jsonl in the user's home directory
+func FileName() (string, error) {
+	if fn := viper.GetString("audit.file"); fn != "" {
+		return homedir.Expand(fn)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("audit: %v", err)
+	}
+	return filepath.Join(home, ".pugo-audit.jsonl"), nil
+}
+
+// Record appends an event to the audit log, filling in the time, run and
+// user
+func Record(e Event) {
+	run.mu.Lock()
+	if run.user == "" {
+		run.user = "unknown"
+		if u, err := user.Current(); err == nil {
+			run.user = u.Username
+		}
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.RunId = run.runId
+	e.Command = run.command
+	e.User = run.user
+	if e.Client == "" {
+		e.Client = run.client
+	}
+	run.mu.Unlock()
+
+	if err := write(e); err != nil {
+		log.Warnf("audit: Unable to record %s: %v", e.Action, err)
+	}
+}
+
+func write(e Event) error {
+	fn, err := FileName()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Each event is appended with a single write so concurrent runs don't
+	// interleave lines
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query reads the events in the audit log matching opts, oldest first. A
+// missing log has no events.
+func Query(opts *QueryOptions) ([]Event, error) {
+	fn, err := FileName()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partially written line shouldn't hide the rest of the log
+			log.Warnf("audit: Skipping invalid event at %s:%d: %v", fn, line, err)
+			continue
+		}
+		if opts.matches(&e) {
+			events = append(events, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit: Reading %s: %v", fn, err)
+	}
+
+	return events, nil
+}
+
+func (opts *QueryOptions) matches(e *Event) bool {
+	if !opts.Since.IsZero() && e.Time.Before(opts.Since) {
+		return false
+	}
+	if opts.Site != "" && e.Site != opts.Site {
+		return false
+	}
+	if opts.User != "" && e.User != opts.User && e.Client != opts.User && e.Login != opts.User {
+		return false
+	}
+	if opts.Action != "" && e.Action != opts.Action {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package cdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AddSite adds a new site to the cdb, to be written by the next CommitSites
+// along with any other changed sites. Fails if the site's name or id is
+// already used by another site.
+func AddSite(site *Site) error {
+	if site.name == "" || strings.ContainsAny(site.name, "/\\") || !isSiteFileName(site.name+".yaml") {
+		return fmt.Errorf("cdb: '%s' is not a valid site name", site.name)
+	}
+	if site.Id <= 0 {
+		return fmt.Errorf("cdb: Site %s has no id", site.name)
+	}
+	if other, err := GetSiteByName(site.name); err != nil {
+		return err
+	} else if other != nil {
+		return fmt.Errorf("cdb: Can't add %s as the name is used by %s", site.name, other.Name())
+	}
+	if other, err := GetSiteById(site.Id); err != nil {
+		return err
+	} else if other != nil {
+		return fmt.Errorf("cdb: Can't add %s as id %d is used by %s", site.name, site.Id, other.Name())
+	}
+
+	defaults, err := loadDefaults()
+	if err != nil {
+		return err
+	}
+	site.defaults = defaults
+
+	// A cdb being built from scratch may not have a sites directory yet
+	if err := os.MkdirAll(filepath.Join(conf.Path, "sites"), 0755); err != nil {
+		return fmt.Errorf("cdb: %v", err)
+	}
+
+	site.MarkAsChanged()
+	sitesCache.mu.Lock()
+	addToCache(site)
+	sitesCache.mu.Unlock()
+	return nil
+}
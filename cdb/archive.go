@@ -0,0 +1,243 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/hooks"
+	"github.com/icunion/pugo/webhooks"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sites removed with archiving are moved to the archive directory of the cdb
+// rather than deleted, keeping their history and allowing them to be
+// restored. Files in the archive aren't loaded as sites.
+const archiveDir = "archive"
+
+// RemoveSites deletes sites from the cdb, or with archive set moves them to
+// the archive directory, then commits and pushes as CommitSites does. Other
+// changed sites aren't saved, so should be committed first.
+func RemoveSites(ctx context.Context, sites []*Site, archive bool, opts *CommitSitesOptions) (*CommitSitesResult, error) {
+	result := &CommitSitesResult{}
+
+	if err := ensureSitesCacheLoaded(); err != nil {
+		return result, err
+	}
+	wt, err := GetWorktree(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if err := checkManaged(sites); err != nil {
+		return result, err
+	}
+	if !opts.AllowProtected {
+		if err := checkProtected(sites); err != nil {
+			return result, err
+		}
+	}
+
+	action := "Removing"
+	if archive {
+		action = "Archiving"
+	}
+	if opts.DryRun {
+		log.Warn("cdb: Performing dry run - sites will not be removed.")
+		for _, site := range sites {
+			log.Infof("cdb: Dry run, %s %s skipped", strings.ToLower(action), site.Name())
+		}
+		result.SitesChanged = len(sites)
+		return result, nil
+	}
+
+	if _, err := signingKey(); err != nil {
+		return result, err
+	}
+	var names []string
+	for _, site := range sites {
+		names = append(names, site.Name())
+	}
+	err = hooks.Run(ctx, hooks.PreCommit, map[string]interface{}{
+		"message": opts.Message,
+		"sites":   names,
+		"branch":  conf.Branch,
+	})
+	if err != nil {
+		return result, fmt.Errorf("cdb: %w", err)
+	}
+
+	for _, site := range sites {
+		log.Infof("cdb: %s %s", action, site.Name())
+		if archive {
+			_, err = wt.Move(site.FileNameRepo(), archiveFileNameRepo(site.Name()))
+		} else {
+			_, err = wt.Remove(site.FileNameRepo())
+		}
+		if err != nil {
+			return result, fmt.Errorf("cdb: %s %s: %v", action, site.Name(), err)
+		}
+		removeFromCache(site)
+		result.SitesChanged++
+	}
+
+	var events []webhooks.Event
+	err = commitAndPush(ctx, wt, opts, result.SitesChanged, result, func(hash string, message string) {
+		events = []webhooks.Event{{Event: webhooks.EventCommit, Commit: hash, Message: message, Sites: names}}
+		for _, name := range names {
+			e := audit.Event{Action: audit.ActionSiteRemove, Site: name, Detail: hash}
+			if archive {
+				e.Action = audit.ActionSiteArchive
+			}
+			audit.Record(e)
+		}
+		audit.Record(audit.Event{Action: audit.ActionCommit, Detail: fmt.Sprintf("%s %s", hash, message)})
+	})
+	if err == nil {
+		sendEvents(ctx, events, result)
+	}
+	return result, err
+}
+
+// RestoreSite moves an archived site back into the cdb, then commits and
+// pushes as CommitSites does. It fails if the site's name or id is now used
+// by another site.
+func RestoreSite(ctx context.Context, name string, opts *CommitSitesOptions) (*Site, *CommitSitesResult, error) {
+	result := &CommitSitesResult{}
+
+	if !isArchived(name) {
+		return nil, result, fmt.Errorf("cdb: No archived site %s", name)
+	}
+	yamlData, err := ioutil.ReadFile(filepath.Join(conf.Path, archiveDir, name+".yaml"))
+	if err != nil {
+		return nil, result, fmt.Errorf("cdb: Reading archived %s: %v", name, err)
+	}
+	defaults, err := loadDefaults()
+	if err != nil {
+		return nil, result, err
+	}
+	site, err := parseSite(name+".yaml", yamlData, defaults, conf.Strict)
+	if err != nil {
+		return nil, result, err
+	}
+
+	if other, err := GetSiteByName(name); err != nil {
+		return nil, result, err
+	} else if other != nil {
+		return nil, result, fmt.Errorf("cdb: Can't restore %s as the name is used by %s", name, other.Name())
+	}
+	if other, err := GetSiteById(site.Id); err != nil {
+		return nil, result, err
+	} else if other != nil {
+		return nil, result, fmt.Errorf("cdb: Can't restore %s as id %d is used by %s", name, site.Id, other.Name())
+	}
+
+	wt, err := GetWorktree(ctx)
+	if err != nil {
+		return nil, result, err
+	}
+	if opts.DryRun {
+		log.Warn("cdb: Performing dry run - site will not be restored.")
+		result.SitesChanged = 1
+		return site, result, nil
+	}
+
+	if _, err := signingKey(); err != nil {
+		return nil, result, err
+	}
+	err = hooks.Run(ctx, hooks.PreCommit, map[string]interface{}{
+		"message": opts.Message,
+		"sites":   []string{name},
+		"branch":  conf.Branch,
+	})
+	if err != nil {
+		return nil, result, fmt.Errorf("cdb: %w", err)
+	}
+
+	log.Infof("cdb: Restoring %s", name)
+	if _, err := wt.Move(archiveFileNameRepo(name), site.FileNameRepo()); err != nil {
+		return nil, result, fmt.Errorf("cdb: Restoring %s: %v", name, err)
+	}
+	sitesCache.mu.Lock()
+	addToCache(site)
+	sitesCache.mu.Unlock()
+	result.SitesChanged = 1
+
+	var events []webhooks.Event
+	err = commitAndPush(ctx, wt, opts, result.SitesChanged, result, func(hash string, message string) {
+		events = []webhooks.Event{{Event: webhooks.EventCommit, Commit: hash, Message: message, Sites: []string{name}}}
+		audit.Record(audit.Event{Action: audit.ActionSiteRestore, Site: name, Detail: hash})
+		audit.Record(audit.Event{Action: audit.ActionCommit, Detail: fmt.Sprintf("%s %s", hash, message)})
+	})
+	if err == nil {
+		sendEvents(ctx, events, result)
+	}
+	return site, result, err
+}
+
+// ArchivedSiteNames returns the names of the sites in the archive, sorted
+func ArchivedSiteNames() ([]string, error) {
+	if conf.Path == "" {
+		return nil, ErrPathNotConfigured
+	}
+	dirEnts, err := ioutil.ReadDir(filepath.Join(conf.Path, archiveDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+
+	var names []string
+	for _, entry := range dirEnts {
+		if filepath.Ext(entry.Name()) == ".yaml" {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isArchived reports whether name is an archived site. As names come from the
+// command line they mustn't escape the archive directory.
+func isArchived(name string) bool {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(conf.Path, archiveDir, name+".yaml"))
+	return err == nil
+}
+
+func archiveFileNameRepo(name string) string {
+	return path.Join(archiveDir, name+".yaml")
+}
+
+// removeFromCache removes a deleted site from the cache
+func removeFromCache(site *Site) {
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+
+	if sitesCache.byId[site.Id] == site {
+		delete(sitesCache.byId, site.Id)
+	}
+	for name, s := range sitesCache.byName {
+		if s == site {
+			delete(sitesCache.byName, name)
+		}
+	}
+	// Callers may hold the previous slice, so don't modify it in place
+	slice := make([]*Site, 0, len(sitesCache.slice))
+	for _, s := range sitesCache.slice {
+		if s != site {
+			slice = append(slice, s)
+		}
+	}
+	sitesCache.slice = slice
+}
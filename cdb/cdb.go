@@ -1,18 +1,35 @@
 package cdb
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/hooks"
+	"github.com/icunion/pugo/progress"
+	"github.com/icunion/pugo/tracing"
+	"github.com/icunion/pugo/webhooks"
+
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 )
 
 type CommitSitesOptions struct {
@@ -30,34 +47,165 @@ type CommitSitesOptions struct {
 	ForceUpdateTree bool
 	// If set commit but don't push to origin
 	NoPush bool
+	// If set protected sites may be changed. Only set by commands changing
+	// sites named explicitly, run with --force
+	AllowProtected bool
+	// If set stage the changes but don't commit them, leaving them to be
+	// committed with others by CommitStaged
+	NoCommit bool
+	// Access changes to append to the ledger in the same commit
+	Ledger []LedgerEntry
+	// If set commit to a new branch and open a pull or merge request for
+	// it into the cdb branch (see cdb.review), rather than pushing to the
+	// cdb branch, for cdbs which require changes to be reviewed
+	ReviewMode bool
+	// If set commit even though site files were skipped in tolerant mode,
+	// for commands which only change sites they loaded and report the
+	// files skipped as failures
+	AllowLoadErrors bool
+
+	// The parents of the commit, if not just HEAD, e.g. for a merge
+	parents []plumbing.Hash
+	// In review mode, the commit the cdb branch is reset to once the
+	// commit is moved to its own branch, and the open review branch it
+	// was stacked on, if any
+	reviewBase      plumbing.Hash
+	reviewStackedOn string
+}
+
+type CommitSitesResult struct {
+	// The number of changed sites saved (or which would have been saved
+	// in a dry run)
+	SitesChanged int
+	// The hash of the commit created, empty if no commit was made
+	Commit string
+	// Whether the commit was pushed to origin
+	Pushed bool
+	// In review mode, the branch committed to and the URL of the pull or
+	// merge request opened for it
+	ReviewBranch string
+	ReviewURL    string
+	// The outcome of pushing to each of cdb.push_remotes
+	RemotePushes []RemotePush
 }
 
 type sitesCacheStruct struct {
+	mu        sync.Mutex
 	byId      map[int]*Site
 	byName    map[string]*Site
 	initOnce  sync.Once
 	initError error
 	slice     []*Site
+	// Whether every site has been loaded, rather than only those looked up
+	// in lazy mode
+	complete bool
+	// Site files skipped in tolerant mode
+	loadErrors []*LoadError
+	// Defaults applied to every site, see DefaultsFileName
+	defaultsOnce  sync.Once
+	defaults      *siteDefaults
+	defaultsError error
+	// Checksums of the site files, see manifestFile
+	manifestOnce  sync.Once
+	manifest      manifest
+	manifestError error
+	// Timings of the last full load, see GetLoadStats
+	loadStats *LoadStats
 }
 
 var sitesCache sitesCacheStruct
 
-func init() {
-	viper.SetDefault("cdb.branch", "master")
-	viper.SetDefault("cdb.author.name", "pugo")
-	viper.SetDefault("cdb.author.email", "pugo@example.com")
+// In lazy mode sites are loaded as they are looked up rather than all at
+// once, see EnableLazyLoading
+var lazyLoading bool
+
+// In tolerant mode site files which can't be loaded are skipped rather than
+// failing the load, see EnableTolerantLoading
+var tolerantLoading bool
+
+// LoadError is a site file skipped in tolerant mode
+type LoadError struct {
+	FileName string
+	Err      error
+}
+
+func (e *LoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// ErrPathNotConfigured is returned when cdb.path is missing from config
+var ErrPathNotConfigured = errors.New("cdb: cdb.path missing in config")
+
+// The cdb configuration, set by Configure
+var conf = &config.Cdb{}
+
+// The id of the pugo run, recorded in provenance and commit messages, see
+// SetRunId
+var runId string
+
+// The trailer of commit messages recording the run which made the commit
+const runTrailer = "Pugo-Run"
+
+// SetRunId sets the id of the pugo run recorded in sites' provenance when
+// they are saved, and in the Pugo-Run trailer of commit messages
+func SetRunId(id string) {
+	runId = id
+}
+
+// Configure sets the cdb location and commit settings. It must be called
+// before any other cdb function. Any sites already loaded are discarded, so
+// calling it again switches to another cdb.
+func Configure(c *config.Cdb) {
+	// Keep using the temporary worktree for the rest of the run
+	if tempWorktree != "" && c.Bare == conf.Bare && c.Ephemeral == conf.Ephemeral && c.URL == conf.URL {
+		c.Path = tempWorktree
+	}
+	conf = c
+	sitesCache = sitesCacheStruct{}
+	productionBranch = ""
+	lease.branch, lease.hash = "", plumbing.ZeroHash
+	cachedSigningKey = nil
 }
 
-func CommitSites(opts *CommitSitesOptions) error {
+// CommitSites saves changed sites to the working tree, commits them, and
+// pushes to origin. If ctx is cancelled while pulling or pushing the
+// operation is abandoned, however once sites are being saved the commit is
+// always completed so the working tree is left clean.
+func CommitSites(ctx context.Context, opts *CommitSitesOptions) (result *CommitSitesResult, err error) {
+	ctx, span := tracing.Start(ctx, "cdb.CommitSites", attribute.String("message", opts.Message), attribute.Bool("dry_run", opts.DryRun))
+	defer tracing.End(span, &err)
+
+	result = &CommitSitesResult{}
+
 	if err := ensureSitesCacheLoaded(); err != nil {
-		return err
+		return result, err
+	}
+	// Sites skipped in tolerant mode may be the ones which needed changing,
+	// so only commit a partial view of the cdb if the command reports them
+	if n := len(LoadErrors()); n > 0 && !opts.AllowLoadErrors {
+		return result, fmt.Errorf("cdb: Not committing as %d site files could not be loaded", n)
+	}
+
+	if opts.ReviewMode && conf.Review.Provider == "" {
+		return result, fmt.Errorf("cdb: Review mode needs cdb.review.provider to be set")
+	}
+
+	// Changes staged with --no-commit only persist in a checkout at
+	// cdb.path
+	if opts.NoCommit && tempWorktree != "" {
+		return result, fmt.Errorf("cdb: --no-commit can't be used with cdb.bare or --ephemeral")
 	}
 
 	// Ensure correct branch is checked out, clean, and any upstream
-	// changes merged
-	wt, err := GetWorktree()
+	// changes merged. Changes already staged with --no-commit may only be
+	// added to, not committed under this command's message
+	wt, err := getWorktree(ctx, opts.NoCommit || opts.DryRun)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	if opts.DryRun {
@@ -65,32 +213,109 @@ func CommitSites(opts *CommitSitesOptions) error {
 		if opts.ForceUpdateTree {
 			log.Warn("cdb: ForceUpdateTree in effect - working tree will be updated but not committed.")
 		}
-	} else {
-		if opts.NoPush {
-			log.Warn("cdb: NoPush enabled - changes will be committed but not pushed to origin.")
-		}
+	} else if opts.NoCommit {
+		log.Warn("cdb: NoCommit enabled - changes will be staged but not committed.")
+	} else if opts.NoPush {
+		log.Warn("cdb: NoPush enabled - changes will be committed but not pushed.")
 	}
 
-	// Determine sites to process
+	// Once sites start being written to the working tree we see the commit
+	// through, so bail out now if cancelled. Only the push is interruptible
+	// after this point.
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("cdb: Aborting before saving sites: %w", err)
+	}
+
+	// Determine sites to process. In lazy mode only the sites looked up
+	// are loaded, but they are the only ones which can have changed.
+	loaded := loadedSites()
 	siteIds := opts.Ids
 	if siteIds == nil {
 		siteIds = make(map[int]bool)
-		for id, _ := range sitesCache.byId {
+		for id, _ := range loaded {
 			siteIds[id] = true
 		}
 	}
 
-	// Output sites to work tree
-	errors := make(chan error, len(sitesCache.byId))
-	filesToStage := make(chan string, len(sitesCache.byId))
+	// Sites excluded by cdb.managed_sites are never changed
+	var changed []*Site
+	for id, inSet := range siteIds {
+		if site := loaded[id]; inSet && site != nil && site.Changed() {
+			changed = append(changed, site)
+		}
+	}
+	if err := checkManaged(changed); err != nil {
+		return result, err
+	}
+	if !opts.AllowProtected {
+		if err := checkProtected(changed); err != nil {
+			return result, err
+		}
+	}
+
+	if !opts.DryRun && !opts.NoCommit {
+		if _, err := signingKey(); err != nil {
+			return result, err
+		}
+	}
+
+	// Run pre-commit hooks before touching the working tree so a failing
+	// hook leaves it clean
+	if !opts.DryRun {
+		var names []string
+		for _, site := range changed {
+			names = append(names, site.Name())
+		}
+		if len(names) > 0 {
+			err := hooks.Run(ctx, hooks.PreCommit, map[string]interface{}{
+				"message": opts.Message,
+				"sites":   names,
+				"branch":  conf.Branch,
+			})
+			if err != nil {
+				return result, fmt.Errorf("cdb: %w", err)
+			}
+		}
+	}
+
+	// Output sites to work tree, using a pool of conf.Concurrency workers
+	errors := make(chan error, len(loaded))
+	toSave := make(chan *Site)
 	var wg sync.WaitGroup
+	var saved atomic.Int32
+
+	// Changes to each site, recorded in the audit log once committed
+	var pendingMu sync.Mutex
+	pending := make(map[string][]FieldChange)
+
+	workers := conf.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range toSave {
+				ok, err := saveSite(site, opts, func(changes []FieldChange) {
+					pendingMu.Lock()
+					pending[site.Name()] = changes
+					pendingMu.Unlock()
+				})
+				if ok {
+					saved.Add(1)
+				}
+				errors <- err
+			}
+		}()
+	}
 
 	sitesChanged := 0
 	for id, inSet := range siteIds {
 		if !inSet {
 			continue
 		}
-		site := sitesCache.byId[id]
+		site := loaded[id]
 		if site == nil {
 			log.Debugf("cdb: Site Id %d not found, skipping", id)
 			continue
@@ -100,55 +325,67 @@ func CommitSites(opts *CommitSitesOptions) error {
 			continue
 		}
 		sitesChanged++
-		wg.Add(1)
-		go func(site *Site) {
-			var err error
-			defer wg.Done()
-			if !opts.DryRun || opts.ForceUpdateTree {
-				log.Debugf("cdb: Saving %s", site.Name())
-				err = site.Save()
-				if err == nil {
-					filesToStage <- site.FileNameRepo()
-				}
-			} else {
-				log.Debugf("cdb: Dry run, skipping save of %s", site.Name())
-				err = nil
-			}
-			errors <- err
-		}(site)
+		toSave <- site
 	}
+	close(toSave)
 
 	go func() {
 		wg.Wait()
 		close(errors)
-		close(filesToStage)
 	}()
 
 	for err := range errors {
 		if err != nil {
-			return err
+			return result, err
 		}
 	}
 
+	result.SitesChanged = sitesChanged
 	if !opts.DryRun || opts.ForceUpdateTree {
 		log.Infof("cdb: %d changed sites saved to working tree", sitesChanged)
 	} else {
 		log.Infof("cdb: Dry run, %d changed sites not saved to working tree", sitesChanged)
 	}
 
-	// Stage files
+	// Stage files. go-git computes the status of the whole working tree for
+	// each file added and the index can't be updated concurrently, so rather
+	// than adding files one at a time they are staged together: the working
+	// tree was clean before saving, so the only changes in sites are the
+	// files just saved.
 	stagedFiles := 0
 	if !opts.DryRun {
-		log.Debug("cdb: Staging files")
-		for fn := range filesToStage {
-			log.Debugf("cdb: Staging %s", fn)
-			if _, err := wt.Add(fn); err != nil {
-				return fmt.Errorf("cdb: Staging %s: %v", fn, err)
+		stagedFiles = int(saved.Load())
+		if stagedFiles > 0 {
+			if err := wt.AddGlob(path.Join("sites", "*.yaml")); err != nil {
+				return result, fmt.Errorf("cdb: Staging sites: %v", err)
+			}
+		}
+		if len(opts.Ledger) > 0 {
+			if err := appendLedger(wt, opts.Ledger); err != nil {
+				return result, err
 			}
-			stagedFiles++
 		}
 	}
 
+	if opts.NoCommit && !opts.DryRun {
+		if stagedFiles == 0 && len(opts.Ledger) == 0 {
+			log.Info("cdb: No changes to stage")
+			return result, nil
+		}
+		if err := updateManifest(wt); err != nil {
+			return result, err
+		}
+		repo, err := openRepo()
+		if err != nil {
+			return result, err
+		}
+		if err := recordStaged(repo, wt, opts.Message, pending); err != nil {
+			return result, err
+		}
+		log.Infof("cdb: %d changed sites staged but not committed, commit them with pugo commit", sitesChanged)
+		return result, nil
+	}
+
 	// If working tree is clean after staging files don't bother to commit
 	if err := checkWorktreeClean(wt); err == nil {
 		if stagedFiles == 0 {
@@ -156,9 +393,27 @@ func CommitSites(opts *CommitSitesOptions) error {
 		} else {
 			log.Warnf("cdb: Working tree is clean after staging %d sites, skipping commit", stagedFiles)
 		}
-		return nil
+		return result, nil
 	}
 
+	var events []webhooks.Event
+	if err := commitAndPush(ctx, wt, opts, sitesChanged, result, func(hash string, message string) {
+		auditCommit(pending, hash, message)
+		events = commitEvents(pending, hash, message)
+	}); err != nil {
+		return result, err
+	}
+	sendEvents(ctx, events, result)
+
+	return result, nil
+}
+
+// commitAndPush commits the changes staged in wt and, unless performing a
+// dry run or NoPush is set, pushes to origin and runs post-push hooks.
+// recordCommit is passed the hash and message of the commit so it can be
+// recorded in the audit log. The commit and whether it was pushed are set
+// in result.
+func commitAndPush(ctx context.Context, wt *git.Worktree, opts *CommitSitesOptions, sitesChanged int, result *CommitSitesResult, recordCommit func(hash string, message string)) error {
 	// Commit changes
 	message := opts.Message
 	if message == "" {
@@ -168,55 +423,204 @@ func CommitSites(opts *CommitSitesOptions) error {
 	if opts.Cmd != "" {
 		cmd = cmd + " " + opts.Cmd
 	}
-	src := viper.GetString("newerpol.name")
-	if src == "" {
-		src = viper.GetString("newerpol.database")
+	commitMessage := fmt.Sprintf("sites: %s. Sites changed: %d (cmd=%s, src=%s)", message, sitesChanged, cmd, conf.Source)
+	if runId != "" {
+		commitMessage += fmt.Sprintf("\n\n%s: %s", runTrailer, runId)
 	}
-	commitMessage := fmt.Sprintf("sites: %s. Sites changed: %d (cmd=%s, src=%s)", message, sitesChanged, cmd, src)
 	log.Debugf("cdb: Commit message is '%s'", commitMessage)
 
 	if !opts.DryRun {
+		var err error
+		if wt, err = catchUpLease(ctx, wt, opts); err != nil {
+			return err
+		}
+		if opts.ReviewMode && !opts.NoPush {
+			if wt, err = stackOnOpenReview(ctx, wt, opts); err != nil {
+				return err
+			}
+		}
+		if err := updateManifest(wt); err != nil {
+			return err
+		}
+		signKey, err := signingKey()
+		if err != nil {
+			return err
+		}
 		log.Info("cdb: Creating commit")
-		_, err := wt.Commit(commitMessage, &git.CommitOptions{
+		hash, err := wt.Commit(commitMessage, &git.CommitOptions{
 			Author: &object.Signature{
-				Name:  viper.GetString("cdb.author.name"),
-				Email: viper.GetString("cdb.author.email"),
+				Name:  conf.Author.Name,
+				Email: conf.Author.Email,
 				When:  time.Now(),
 			},
+			Parents: opts.parents,
+			SignKey: signKey,
 		})
 		if err != nil {
 			return fmt.Errorf("cdb: Creating commit: %v", err)
 		}
+		result.Commit = hash.String()
+		recordCommit(result.Commit, commitMessage)
 	} else {
 		log.Info("cdb: Dry run, not committing")
 	}
 
-	// Push to origins
-	if !opts.DryRun && !opts.NoPush {
-		log.Infof("cdb: Pushing to origin/%s", viper.GetString("cdb.branch"))
-		repo, err := git.PlainOpen(viper.GetString("cdb.path"))
-		if err != nil {
-			return fmt.Errorf("cdb: Opening repo at %s: %v", viper.GetString("cdb.path"), err)
-		}
-		if err := repo.Push(&git.PushOptions{}); err != nil {
-			return fmt.Errorf("cdb: Pushing to origin/%s: %v", viper.GetString("cdb.branch"), err)
-		}
-	} else {
-		if opts.DryRun {
-			log.Debug("cdb: Dry run, not pushing")
-		} else {
-			log.Debug("cdb: NoPush enabled, not pushing")
+	// Push to origin
+	if opts.DryRun {
+		log.Debug("cdb: Dry run, not pushing")
+		return nil
+	}
+	if opts.ReviewMode {
+		return pushForReview(ctx, opts, result, commitMessage)
+	}
+	if opts.NoPush {
+		log.Debug("cdb: NoPush enabled, not pushing")
+		return nil
+	}
+	return push(ctx, opts, result)
+}
+
+// push pushes the configured branch to origin. Only that branch is pushed,
+// so other local branches which are behind origin don't cause it to fail.
+// Fails with ErrRemoteMoved if origin's branch has moved on since it was
+// pulled, rather than risk overwriting the changes made there.
+func push(ctx context.Context, opts *CommitSitesOptions, result *CommitSitesResult) (err error) {
+	log.Infof("cdb: Pushing to %s/%s", remoteName(), conf.Branch)
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	if err := checkLease(ctx, repo); err != nil {
+		return err
+	}
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", conf.Branch, conf.Branch))
+	_, pushSpan := tracing.Start(ctx, "cdb.push")
+	err = gitRetryPolicy().Do(ctx, "cdb push", func(ctx context.Context) error {
+		err := repo.PushContext(ctx, &git.PushOptions{RemoteName: remoteName(), RefSpecs: []gitconfig.RefSpec{refSpec}, Auth: auth()})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
 		}
+		return err
+	})
+	tracing.End(pushSpan, &err)
+	if err != nil {
+		return fmt.Errorf("cdb: Pushing to %s/%s: %v", remoteName(), conf.Branch, err)
 	}
+	result.Pushed = true
+	if ref, err := repo.Reference(plumbing.NewBranchReferenceName(conf.Branch), true); err == nil {
+		setLease(ref.Hash())
+	}
+	audit.Record(audit.Event{
+		Action: audit.ActionPush,
+		Detail: fmt.Sprintf("%s to %s/%s", result.Commit, remoteName(), conf.Branch),
+	})
+	result.RemotePushes = pushMirrors(ctx, repo, []gitconfig.RefSpec{refSpec}, conf.Branch)
 
+	err = hooks.Run(ctx, hooks.PostPush, map[string]interface{}{
+		"message": opts.Message,
+		"commit":  result.Commit,
+		"branch":  conf.Branch,
+	})
+	if err != nil {
+		log.Warnf("cdb: %v", err)
+	}
 	return nil
 }
 
+// EnableLazyLoading switches to loading sites as they are looked up, for
+// commands which only touch one or two sites. GetSiteByName loads just the
+// named site's file, and GetSiteById uses an index of site ids kept in the
+// repo's git directory, falling back to loading every site if the id isn't
+// in the index or the index is out of date. GetAllSites loads every site.
+// Must be called before any sites are loaded.
+func EnableLazyLoading() {
+	lazyLoading = true
+}
+
+// EnableTolerantLoading switches to skipping site files which can't be
+// loaded, rather than failing, so that a single malformed file doesn't stop
+// read-only commands working. The files skipped are returned by LoadErrors,
+// and CommitSites refuses to commit while there are any unless
+// AllowLoadErrors is set. Must be called before any sites are loaded.
+func EnableTolerantLoading() {
+	tolerantLoading = true
+}
+
+// The number of slowest site files recorded in LoadStats
+const slowestSiteFiles = 5
+
+// LoadStats describes how long loading every site took, by phase, so
+// regressions in load time on large cdbs are visible
+type LoadStats struct {
+	// Sites loaded, and site files which couldn't be loaded in tolerant
+	// mode
+	Sites  int
+	Errors int
+	// Listing the sites directory
+	Scan time.Duration
+	// Reading and parsing site files, concurrently
+	Parse time.Duration
+	// Adding sites to the cache, and writing the site index
+	Index time.Duration
+	// The site files which took longest to read and parse, slowest first
+	Slowest []FileTiming
+}
+
+// FileTiming is how long a single site file took to read and parse
+type FileTiming struct {
+	FileName string
+	Duration time.Duration
+}
+
+// Total returns the time taken by every phase
+func (s *LoadStats) Total() time.Duration {
+	return s.Scan + s.Parse + s.Index
+}
+
+func (s *LoadStats) log() {
+	log.Debugf("cdb: Loaded %d sites (%d errors) in %v: scan %v, parse %v, index %v",
+		s.Sites, s.Errors, s.Total().Round(time.Millisecond), s.Scan.Round(time.Microsecond), s.Parse.Round(time.Microsecond), s.Index.Round(time.Microsecond))
+	if len(s.Slowest) > 0 {
+		slowest := make([]string, 0, len(s.Slowest))
+		for _, t := range s.Slowest {
+			slowest = append(slowest, fmt.Sprintf("%s (%v)", t.FileName, t.Duration.Round(time.Microsecond)))
+		}
+		log.Debugf("cdb: Slowest site files: %s", strings.Join(slowest, ", "))
+	}
+}
+
+// GetLoadStats returns the timings of the last time every site was loaded
+// in this run, or nil if they haven't been
+func GetLoadStats() *LoadStats {
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+
+	return sitesCache.loadStats
+}
+
+// LoadErrors returns the site files skipped in tolerant mode so far, sorted by
+// file name
+func LoadErrors() []*LoadError {
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+
+	loadErrors := append([]*LoadError(nil), sitesCache.loadErrors...)
+	sort.Slice(loadErrors, func(i, j int) bool {
+		return loadErrors[i].FileName < loadErrors[j].FileName
+	})
+	return loadErrors
+}
+
 func GetAllSites() ([]*Site, error) {
 	if err := ensureSitesCacheLoaded(); err != nil {
 		return nil, err
 	}
 
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+	if err := loadAllSites(); err != nil {
+		return nil, err
+	}
 	return sitesCache.slice, nil
 }
 
@@ -225,6 +629,27 @@ func GetSiteById(id int) (*Site, error) {
 		return nil, err
 	}
 
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+	if site := sitesCache.byId[id]; site != nil || sitesCache.complete {
+		return site, nil
+	}
+
+	// Try the site the index says has the id, checking the index is right
+	if name, ok := readSiteIndex().Names[id]; ok {
+		site, err := loadSiteByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if site != nil && site.Id == id {
+			return site, nil
+		}
+		log.Debugf("cdb: Site index out of date for id %d, loading all sites", id)
+	}
+
+	if err := loadAllSites(); err != nil {
+		return nil, err
+	}
 	return sitesCache.byId[id], nil
 }
 
@@ -233,17 +658,115 @@ func GetSiteByName(name string) (*Site, error) {
 		return nil, err
 	}
 
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+	if site := sitesCache.byName[name]; site != nil || sitesCache.complete {
+		return site, nil
+	}
+	site, err := loadSiteByName(name)
+	if err != nil || site != nil {
+		return site, err
+	}
+
+	// The name may be an alias. If the index is current it lists every
+	// alias, otherwise every site must be checked.
+	index := readSiteIndex()
+	if index.current() {
+		target, ok := index.Aliases[name]
+		if !ok {
+			return nil, nil
+		}
+		site, err := loadSiteByName(target)
+		if err != nil {
+			return nil, err
+		}
+		if site != nil && site.HasAlias(name) {
+			return site, nil
+		}
+	}
+	log.Debugf("cdb: Site index out of date for %s, loading all sites", name)
+
+	if err := loadAllSites(); err != nil {
+		return nil, err
+	}
 	return sitesCache.byName[name], nil
 }
 
-func GetWorktree() (*git.Worktree, error) {
-	if viper.GetString("cdb.path") == "" {
-		return nil, fmt.Errorf("cdb: cdb.path missing in config")
+// loadedSites returns the sites loaded so far keyed by id
+func loadedSites() map[int]*Site {
+	sitesCache.mu.Lock()
+	defer sitesCache.mu.Unlock()
+
+	loaded := make(map[int]*Site, len(sitesCache.byId))
+	for id, site := range sitesCache.byId {
+		loaded[id] = site
+	}
+	return loaded
+}
+
+// ChangedSites returns the loaded sites with unsaved changes which
+// CommitSites would save given ids, i.e. those in ids or all if it is nil
+func ChangedSites(ids map[int]bool) []*Site {
+	var changed []*Site
+	for id, site := range loadedSites() {
+		if (ids == nil || ids[id]) && site.Changed() {
+			changed = append(changed, site)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Name() < changed[j].Name()
+	})
+	return changed
+}
+
+// saveSite saves a changed site to the working tree, returning whether it
+// was saved. Unless performing a dry run the site's pending changes are
+// first passed to recordChanges for the audit log.
+func saveSite(site *Site, opts *CommitSitesOptions, recordChanges func([]FieldChange)) (bool, error) {
+	if !opts.DryRun {
+		changes, err := site.PendingChanges()
+		if err != nil {
+			log.Warnf("cdb: Unable to determine changes to %s for audit log: %v", site.Name(), err)
+		}
+		recordChanges(changes)
+	}
+	if opts.DryRun && !opts.ForceUpdateTree {
+		log.Debugf("cdb: Dry run, skipping save of %s", site.Name())
+		return false, nil
 	}
 
-	repo, err := git.PlainOpen(viper.GetString("cdb.path"))
+	log.Debugf("cdb: Saving %s", site.Name())
+	if conf.Provenance {
+		cmd := "pugo"
+		if opts.Cmd != "" {
+			cmd = cmd + " " + opts.Cmd
+		}
+		site.Provenance = &Provenance{By: cmd, Run: runId, At: time.Now().UTC().Truncate(time.Second)}
+	}
+	if err := site.Save(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetWorktree opens the cdb worktree, ensuring it is clean, has the
+// configured branch checked out, and is up-to-date with origin. Fails with
+// ErrChangesStaged if changes staged with --no-commit are pending.
+func GetWorktree(ctx context.Context) (*git.Worktree, error) {
+	return getWorktree(ctx, false)
+}
+
+// getWorktree opens the cdb worktree as GetWorktree, but if allowStaged is
+// set and changes staged with --no-commit are pending, the worktree is
+// opened as it is, with only those changes, rather than pulled: the changes
+// are moved onto origin when they are committed
+func getWorktree(ctx context.Context, allowStaged bool) (_ *git.Worktree, err error) {
+	ctx, span := tracing.Start(ctx, "cdb.GetWorktree")
+	defer tracing.End(span, &err)
+
+	repo, err := openRepo()
 	if err != nil {
-		return nil, fmt.Errorf("cdb: Opening repo at %s: %v", viper.GetString("cdb.path"), err)
+		return nil, err
 	}
 
 	wt, err := repo.Worktree()
@@ -251,6 +774,21 @@ func GetWorktree() (*git.Worktree, error) {
 		return nil, fmt.Errorf("cdb: Opening worktree: %v", err)
 	}
 
+	staged, err := GetStagedChanges()
+	if err != nil {
+		return nil, err
+	}
+	if staged != nil {
+		if !allowStaged {
+			return nil, ErrChangesStaged
+		}
+		if err := checkOnlyStaged(wt, staged); err != nil {
+			return nil, err
+		}
+		log.Infof("cdb: %d changes staged with --no-commit, not pulling until they are committed", len(staged.Messages))
+		return wt, nil
+	}
+
 	if err = checkWorktreeClean(wt); err != nil {
 		return nil, err
 	}
@@ -261,36 +799,159 @@ func GetWorktree() (*git.Worktree, error) {
 	}
 
 	// Ensure correct branch checked out
-	currentBranch := filepath.Base(string(h.Name()))
-	if currentBranch != viper.GetString("cdb.branch") {
-		log.Infof("cdb: Current branch is '%s', checking out '%s'", currentBranch, viper.GetString("cdb.branch"))
+	currentBranch := path.Base(string(h.Name()))
+	if currentBranch != conf.Branch {
+		log.Infof("cdb: Current branch is '%s', checking out '%s'", currentBranch, conf.Branch)
+		if err := ensureBranch(ctx, repo); err != nil {
+			return nil, err
+		}
 		err = wt.Checkout(&git.CheckoutOptions{
-			Branch: plumbing.NewBranchReferenceName(viper.GetString("cdb.branch")),
+			Branch: plumbing.NewBranchReferenceName(conf.Branch),
 		})
 		if err != nil {
-			return nil, fmt.Errorf("cdb: Checking out branch '%s': %v", viper.GetString("cdb.branch"), err)
+			return nil, fmt.Errorf("cdb: Checking out branch '%s': %v", conf.Branch, err)
 		}
 		h, err = repo.Head()
 		if err != nil {
 			return nil, fmt.Errorf("cdb: %v", err)
 		}
-		currentBranch = filepath.Base(string(h.Name()))
+		currentBranch = path.Base(string(h.Name()))
+	}
+
+	// A new staging branch is created on origin when it is first pushed
+	if productionBranch != "" {
+		onOrigin, err := onOrigin(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		if !onOrigin {
+			log.Infof("cdb: Branch '%s' isn't on %s yet, not pulling", currentBranch, remoteName())
+			return wt, nil
+		}
 	}
 
 	// Pull to ensure branch up-to-date
 	log.Infof("cdb: Git pulling branch '%s'", currentBranch)
-	err = wt.Pull(&git.PullOptions{
-		RemoteName:    "origin",
-		ReferenceName: plumbing.NewBranchReferenceName(viper.GetString("cdb.branch")),
-		SingleBranch:  true,
+	err = gitRetryPolicy().Do(ctx, "cdb pull", func(ctx context.Context) error {
+		err := wt.PullContext(ctx, &git.PullOptions{
+			RemoteName:    remoteName(),
+			ReferenceName: plumbing.NewBranchReferenceName(conf.Branch),
+			SingleBranch:  true,
+			Auth:          auth(),
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
 	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
+	if err != nil {
 		return nil, fmt.Errorf("cdb: Pulling branch '%s': %v", currentBranch, err)
 	}
+	if remote, err := remoteHead(repo); err == nil {
+		setLease(remote)
+	}
 
 	return wt, nil
 }
 
+// auditCommit records a commit, and the changes to each site it contains, in
+// the audit log
+func auditCommit(pending map[string][]FieldChange, hash string, message string) {
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, change := range pending[name] {
+			if change.Field != "admins" {
+				audit.Record(audit.Event{
+					Action: audit.ActionSiteChange,
+					Site:   name,
+					Detail: fmt.Sprintf("%s: %s -> %s", change.Field, change.Before, change.After),
+				})
+				continue
+			}
+			var before, after []string
+			json.Unmarshal(change.Before, &before)
+			json.Unmarshal(change.After, &after)
+			for _, login := range stringsDifference(after, before) {
+				audit.Record(audit.Event{Action: audit.ActionAdminAdd, Site: name, Login: login, Detail: hash})
+			}
+			for _, login := range stringsDifference(before, after) {
+				audit.Record(audit.Event{Action: audit.ActionAdminRemove, Site: name, Login: login, Detail: hash})
+			}
+		}
+	}
+	audit.Record(audit.Event{Action: audit.ActionCommit, Detail: fmt.Sprintf("%s %s", hash, message)})
+}
+
+// commitEvents returns the webhook events for a commit: one for each admin
+// added or removed, then one for the commit itself
+func commitEvents(pending map[string][]FieldChange, hash string, message string) []webhooks.Event {
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var events []webhooks.Event
+	for _, name := range names {
+		for _, change := range pending[name] {
+			if change.Field != "admins" {
+				continue
+			}
+			var before, after []string
+			json.Unmarshal(change.Before, &before)
+			json.Unmarshal(change.After, &after)
+			for _, login := range stringsDifference(after, before) {
+				events = append(events, webhooks.Event{Event: webhooks.EventAdminAdd, Site: name, Login: login, Commit: hash})
+			}
+			for _, login := range stringsDifference(before, after) {
+				events = append(events, webhooks.Event{Event: webhooks.EventAdminRemove, Site: name, Login: login, Commit: hash})
+			}
+		}
+	}
+	return append(events, webhooks.Event{Event: webhooks.EventCommit, Commit: hash, Message: message, Sites: names})
+}
+
+// sendEvents sends the webhook events for a commit once it has been pushed,
+// or committed with NoPush, so receivers never see changes which are then
+// lost
+func sendEvents(ctx context.Context, events []webhooks.Event, result *CommitSitesResult) {
+	for i := range events {
+		events[i].Pushed = result.Pushed
+	}
+	webhooks.Send(ctx, events)
+}
+
+// stringsDifference returns the strings in a but not b
+func stringsDifference(a, b []string) []string {
+	inB := make(map[string]bool)
+	for _, s := range b {
+		inB[s] = true
+	}
+	var diff []string
+	for _, s := range a {
+		if !inB[s] {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
+
+// auth returns HTTP basic auth credentials for the cdb remote if
+// cdb.auth.username is configured, otherwise nil so go-git falls back to its
+// defaults (e.g. SSH agent)
+func auth() transport.AuthMethod {
+	if conf.Auth.Username == "" {
+		return nil
+	}
+	return &http.BasicAuth{
+		Username: conf.Auth.Username,
+		Password: conf.Auth.Password,
+	}
+}
+
 func checkWorktreeClean(wt *git.Worktree) error {
 	status, err := wt.Status()
 	if err != nil {
@@ -305,59 +966,166 @@ func checkWorktreeClean(wt *git.Worktree) error {
 
 func ensureSitesCacheLoaded() error {
 	sitesCache.initOnce.Do(func() {
-		sitesCache.initError = initSitesCache()
+		if conf.Path == "" {
+			sitesCache.initError = ErrPathNotConfigured
+			return
+		}
+		sitesCache.byId = make(map[int]*Site)
+		sitesCache.byName = make(map[string]*Site)
+		if !lazyLoading {
+			sitesCache.initError = loadAllSites()
+		}
 	})
 	return sitesCache.initError
 }
 
-func initSitesCache() error {
-	if viper.GetString("cdb.path") == "" {
-		return fmt.Errorf("cdb: cdb.path missing in config")
+// loadAllSites loads every site not already loaded, and updates the site
+// index. Must be called with the cache locked, or before it is shared.
+func loadAllSites() error {
+	if sitesCache.complete {
+		return nil
 	}
+	stats := &LoadStats{}
+	start := time.Now()
 
-	sitesDir := path.Join(viper.GetString("cdb.path"), "sites")
+	// A cdb being built from scratch may not have any sites yet
+	sitesDir := filepath.Join(conf.Path, "sites")
 	dirEnts, err := ioutil.ReadDir(sitesDir)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("cdb: %v", err)
 	}
 
+	// Only YAML files are sites. In lazy mode sites already loaded are
+	// kept, as they may have been changed.
+	var siteFileNames []string
+	for _, entry := range dirEnts {
+		name := entry.Name()
+		if !isSiteFileName(name) {
+			continue
+		}
+		if site := sitesCache.byName[strings.TrimSuffix(name, ".yaml")]; site == nil || site.Name()+".yaml" != name {
+			siteFileNames = append(siteFileNames, name)
+		}
+	}
+	stats.Scan = time.Since(start)
+
 	type item struct {
-		site *Site
-		err  error
+		fileName string
+		site     *Site
+		err      error
+		duration time.Duration
 	}
-	ch := make(chan item, len(dirEnts))
+	ch := make(chan item, len(siteFileNames))
 
-	for _, entry := range dirEnts {
+	start = time.Now()
+	for _, siteFileName := range siteFileNames {
 		go func(siteFileName string) {
 			log.Debugf("cdb: Loading %s", siteFileName)
-			var it item
-
-			// Ensure file under consideration is a YAML file, skip if not
-			_, fn := path.Split(siteFileName)
-			if path.Ext(fn) != ".yaml" {
-				ch <- it
-				return
-			}
-
+			it := item{fileName: siteFileName}
+			loadStart := time.Now()
 			it.site, it.err = LoadSite(siteFileName)
+			it.duration = time.Since(loadStart)
 			ch <- it
-		}(entry.Name())
+		}(siteFileName)
 	}
 
-	sitesCache.byId = make(map[int]*Site)
-	sitesCache.byName = make(map[string]*Site)
+	loaded := progress.New("cdb: Loading sites", len(siteFileNames))
+	defer loaded.Finish()
 
-	for range dirEnts {
+	items := make([]item, 0, len(siteFileNames))
+	for range siteFileNames {
 		it := <-ch
-		if it.err != nil {
+		loaded.Add(1)
+		if it.err != nil && !tolerantLoading {
 			return it.err
 		}
-		if it.site != nil {
-			sitesCache.byId[it.site.Id] = it.site
-			sitesCache.byName[it.site.name] = it.site
-			sitesCache.slice = append(sitesCache.slice, it.site)
+		items = append(items, it)
+		stats.Slowest = append(stats.Slowest, FileTiming{FileName: it.fileName, Duration: it.duration})
+	}
+	stats.Parse = time.Since(start)
+
+	start = time.Now()
+	for _, it := range items {
+		if it.err != nil {
+			log.Warnf("cdb: Skipping %s: %v", it.fileName, it.err)
+			sitesCache.loadErrors = append(sitesCache.loadErrors, &LoadError{FileName: it.fileName, Err: it.err})
+			stats.Errors++
+			continue
 		}
+		addToCache(it.site)
+		stats.Sites++
 	}
+	sitesCache.complete = true
+	warnExpiry(sitesCache.slice)
 
+	writeSiteIndex(sitesCache.slice)
+	stats.Index = time.Since(start)
+
+	sort.Slice(stats.Slowest, func(i, j int) bool {
+		return stats.Slowest[i].Duration > stats.Slowest[j].Duration
+	})
+	if len(stats.Slowest) > slowestSiteFiles {
+		stats.Slowest = stats.Slowest[:slowestSiteFiles]
+	}
+	stats.log()
+	sitesCache.loadStats = stats
 	return nil
 }
+
+// warnExpiry warns of sites with invalid expiry dates, and of expired sites
+// which haven't been expired with pugo expire
+func warnExpiry(sites []*Site) {
+	var expired []string
+	for _, site := range sites {
+		if _, err := site.ExpiryTime(); err != nil {
+			log.Warn(err)
+			continue
+		}
+		if site.Expired() && !site.Disabled && len(site.Admins) > 0 {
+			log.Debugf("cdb: %s expired on %s", site.Name(), site.Expiry)
+			expired = append(expired, site.Name())
+		}
+	}
+	if len(expired) > 0 {
+		log.Warnf("cdb: %d sites have expired but still have admins", len(expired))
+	}
+}
+
+// loadSiteByName loads a single site, returning nil if it doesn't exist. Must
+// be called with the cache locked.
+func loadSiteByName(name string) (*Site, error) {
+	if site := sitesCache.byName[name]; site != nil && site.name == name {
+		return site, nil
+	}
+	// Names come from the command line, so mustn't escape the sites
+	// directory
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || !isSiteFileName(name+".yaml") {
+		return nil, nil
+	}
+	if _, err := os.Stat(filepath.Join(conf.Path, "sites", name+".yaml")); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	log.Debugf("cdb: Loading %s.yaml", name)
+	site, err := LoadSite(name + ".yaml")
+	if err != nil {
+		return nil, err
+	}
+	addToCache(site)
+	return site, nil
+}
+
+// addToCache adds a loaded site to the cache. Must be called with the cache
+// locked.
+func addToCache(site *Site) {
+	sitesCache.byId[site.Id] = site
+	sitesCache.byName[site.name] = site
+	sitesCache.slice = append(sitesCache.slice, site)
+
+	// Names take precedence over aliases, whichever site is loaded first
+	for _, alias := range site.Aliases {
+		if other := sitesCache.byName[alias]; other == nil || other.name != alias {
+			sitesCache.byName[alias] = site
+		}
+	}
+}
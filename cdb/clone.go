@@ -0,0 +1,112 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// ErrAlreadyCloned is returned by Clone when cdb.path is already a checkout
+var ErrAlreadyCloned = errors.New("cdb: cdb.path is already a git repo")
+
+// ErrURLNotConfigured is returned by Clone when cdb.url is missing from
+// config
+var ErrURLNotConfigured = errors.New("cdb: cdb.url missing in config")
+
+// Clone clones cdb.url into cdb.path and checks out the configured branch.
+// cdb.path must be missing or an empty directory. Other branches, such as a
+// staging branch, are fetched too so they can be checked out later.
+func Clone(ctx context.Context) error {
+	if conf.Path == "" {
+		return ErrPathNotConfigured
+	}
+	if conf.URL == "" {
+		return ErrURLNotConfigured
+	}
+	empty, err := emptyOrMissing(conf.Path)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if _, err := git.PlainOpen(conf.Path); err == nil {
+			return ErrAlreadyCloned
+		}
+		return fmt.Errorf("cdb: Can't clone into %s as it isn't empty", conf.Path)
+	}
+
+	log.Infof("cdb: Cloning %s into %s", conf.URL, conf.Path)
+	err = gitRetryPolicy().Do(ctx, "cdb clone", func(ctx context.Context) error {
+		// Start afresh after a failed attempt
+		if err := clearDir(conf.Path); err != nil {
+			return err
+		}
+		_, err := git.PlainCloneContext(ctx, conf.Path, false, &git.CloneOptions{
+			URL:           conf.URL,
+			RemoteName:    remoteName(),
+			Auth:          auth(),
+			ReferenceName: plumbing.NewBranchReferenceName(conf.Branch),
+		})
+		return err
+	})
+	if err != nil {
+		clearDir(conf.Path)
+		return fmt.Errorf("cdb: Cloning %s: %v", conf.URL, err)
+	}
+	sitesCache = sitesCacheStruct{}
+	return nil
+}
+
+// EnsureRepo clones the cdb into cdb.path on first use, if it is missing or
+// empty and cdb.url is set, so setting up a new host needs no manual clone.
+// It does nothing with cdb.bare or cdb.ephemeral, which don't use cdb.path.
+// Returns whether the cdb was cloned.
+func EnsureRepo(ctx context.Context) (bool, error) {
+	if tempWorktree != "" || conf.Bare != "" || conf.Ephemeral || conf.Path == "" || conf.URL == "" {
+		return false, nil
+	}
+	empty, err := emptyOrMissing(conf.Path)
+	if err != nil || !empty {
+		return false, err
+	}
+	if err := Clone(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// emptyOrMissing reports whether dir doesn't exist or is an empty directory
+func emptyOrMissing(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cdb: %v", err)
+	}
+	return len(entries) == 0, nil
+}
+
+// clearDir removes the contents of dir, leaving it in place. Only used on a
+// directory which was empty before cloning into it.
+func clearDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package cdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultsFileName is a file in the sites directory whose fields apply to
+// every site which doesn't set them itself, e.g. the default PHP version.
+// Files in the sites directory starting with an underscore aren't sites.
+const DefaultsFileName = "_defaults.yaml"
+
+// siteDefaults are the fields set in the defaults file
+type siteDefaults struct {
+	yamlData []byte
+	// The JSON encoded value of each field set
+	fields map[string]json.RawMessage
+}
+
+// Fields set by NewSite from cdb.defaults
+var configuredDefaultFields = map[string]bool{"php": true, "passenger": true, "subpaths": true, "disabled": true}
+
+// Fields which identify a site can't have defaults
+var noDefaultFields = map[string]bool{"id": true, "full-name": true, "email": true}
+
+// isSiteFileName reports whether a file in the sites directory is a site
+func isSiteFileName(fn string) bool {
+	return filepath.Ext(fn) == ".yaml" && !strings.HasPrefix(fn, "_")
+}
+
+// loadDefaults returns the site defaults, reading the defaults file the first
+// time it is called. Returns nil if there is no defaults file.
+func loadDefaults() (*siteDefaults, error) {
+	sitesCache.defaultsOnce.Do(func() {
+		sitesCache.defaults, sitesCache.defaultsError = readDefaults()
+	})
+	return sitesCache.defaults, sitesCache.defaultsError
+}
+
+func readDefaults() (*siteDefaults, error) {
+	yamlData, err := ioutil.ReadFile(filepath.Join(conf.Path, "sites", DefaultsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading %s: %v", DefaultsFileName, err)
+	}
+	if err := verifyManifest(DefaultsFileName, yamlData); err != nil {
+		return nil, err
+	}
+
+	site := NewSite()
+	if err := unmarshalSite(yamlData, site, conf.Strict); err != nil {
+		return nil, fmt.Errorf("cdb: Unmarshalling %s: %v", DefaultsFileName, err)
+	}
+	keys, err := topLevelKeys(yamlData)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Unmarshalling %s: %v", DefaultsFileName, err)
+	}
+
+	defaults := &siteDefaults{yamlData: yamlData, fields: make(map[string]json.RawMessage)}
+	for key := range keys {
+		if noDefaultFields[key] {
+			return nil, fmt.Errorf("cdb: %s: %s can't have a default", DefaultsFileName, key)
+		}
+		value, err := site.Field(key)
+		if err != nil {
+			return nil, fmt.Errorf("cdb: %s: %v", DefaultsFileName, err)
+		}
+		defaults.fields[key] = value
+	}
+	return defaults, nil
+}
+
+// topLevelKeys returns the keys of a YAML mapping
+func topLevelKeys(yamlData []byte) (map[string]bool, error) {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(yamlData, &m); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(m))
+	for key := range m {
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// marshal encodes the site for saving. Fields the site's file didn't set
+// are omitted if they still have their default value, so changing the
+// defaults file continues to change them. Fields overriding a default,
+// either from the defaults file or cdb.defaults, are always written, even if
+// empty. Must be called with the site locked.
+func (s *Site) marshal() ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(s); err != nil {
+		return nil, err
+	}
+	var content []*yaml.Node
+	written := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if _, ok := s.defaultFields()[key]; (ok || configuredDefaultFields[key]) && !s.explicit[key] {
+			isDefault, err := s.hasDefault(key)
+			if err != nil {
+				return nil, err
+			}
+			if isDefault {
+				continue
+			}
+		}
+		written[key] = true
+		content = append(content, node.Content[i], node.Content[i+1])
+	}
+
+	// Empty values are omitted when encoding, but mustn't be replaced by
+	// a default when the site is next loaded
+	for _, key := range FieldNames() {
+		if written[key] {
+			continue
+		}
+		isDefault, err := s.hasDefault(key)
+		if err != nil {
+			return nil, err
+		}
+		if isDefault {
+			continue
+		}
+		v, err := s.field(key)
+		if err != nil {
+			return nil, err
+		}
+		var value yaml.Node
+		if err := value.Encode(v.Interface()); err != nil {
+			return nil, err
+		}
+		written[key] = true
+		content = append(content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &value)
+	}
+
+	node.Content = content
+	s.explicit = written
+	return yaml.Marshal(&node)
+}
+
+// defaultFields returns the fields set by the defaults file the site was
+// loaded with, if any
+func (s *Site) defaultFields() map[string]json.RawMessage {
+	if s.defaults == nil {
+		return nil
+	}
+	return s.defaults.fields
+}
+
+// hasDefault reports whether a field has its default value: the value given
+// by the defaults file if it sets the field, otherwise that of a new site.
+// Must be called with the site locked.
+func (s *Site) hasDefault(name string) (bool, error) {
+	v, err := s.field(name)
+	if err != nil {
+		return false, err
+	}
+	value, err := json.Marshal(v.Interface())
+	if err != nil {
+		return false, err
+	}
+
+	def, ok := s.defaultFields()[name]
+	if !ok {
+		dv, err := NewSite().field(name)
+		if err != nil {
+			return false, err
+		}
+		if def, err = json.Marshal(dv.Interface()); err != nil {
+			return false, err
+		}
+	}
+	return string(value) == string(def), nil
+}
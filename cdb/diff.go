@@ -0,0 +1,338 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	fdiff "gopkg.in/src-d/go-git.v4/plumbing/format/diff"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/utils/diff"
+)
+
+// Number of lines of context shown around changes
+const diffContextLines = 3
+
+// DiffWorktree writes a unified diff of the site files in the working tree
+// against a commit (HEAD if base is empty). If names is non-empty only the
+// named sites are included.
+func DiffWorktree(ctx context.Context, w io.Writer, base string, names []string) error {
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		base = "HEAD"
+	}
+	tree, err := resolveTree(repo, base)
+	if err != nil {
+		return err
+	}
+
+	// Compare every site file in either the commit or the working tree, as
+	// the status of files in the working tree is relative to the index
+	// rather than an arbitrary commit
+	files := make(map[string]bool)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if isSiteFile(f.Name, names) {
+			files[f.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cdb: Reading tree of %s: %v", base, err)
+	}
+	dirEnts, err := ioutil.ReadDir(filepath.Join(conf.Path, "sites"))
+	if err != nil {
+		return fmt.Errorf("cdb: %v", err)
+	}
+	for _, entry := range dirEnts {
+		if fn := path.Join("sites", entry.Name()); isSiteFile(fn, names) {
+			files[fn] = true
+		}
+	}
+
+	var patches []fdiff.FilePatch
+	for _, fn := range sortedKeys(files) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("cdb: %w", err)
+		}
+
+		var from, to *string
+		if f, err := tree.File(fn); err == nil {
+			contents, err := f.Contents()
+			if err != nil {
+				return fmt.Errorf("cdb: Reading %s at %s: %v", fn, base, err)
+			}
+			from = &contents
+		} else if err != object.ErrFileNotFound {
+			return fmt.Errorf("cdb: Reading %s at %s: %v", fn, base, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(conf.Path, filepath.FromSlash(fn)))
+		if err == nil {
+			contents := string(data)
+			to = &contents
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("cdb: Reading %s: %v", fn, err)
+		}
+
+		if patch := newFilePatch(fn, from, to); patch != nil {
+			patches = append(patches, patch)
+		}
+	}
+
+	return encodePatches(w, patches)
+}
+
+// DiffCommits writes a unified diff of the site files changed between two
+// commits. If names is non-empty only the named sites are included.
+func DiffCommits(ctx context.Context, w io.Writer, fromRev, toRev string, names []string) error {
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	fromTree, err := resolveTree(repo, fromRev)
+	if err != nil {
+		return err
+	}
+	toTree, err := resolveTree(repo, toRev)
+	if err != nil {
+		return err
+	}
+
+	changes, err := object.DiffTreeContext(ctx, fromTree, toTree)
+	if err != nil {
+		return fmt.Errorf("cdb: Diffing %s..%s: %v", fromRev, toRev, err)
+	}
+
+	var patches []fdiff.FilePatch
+	for _, change := range changes {
+		fn := change.To.Name
+		if fn == "" {
+			fn = change.From.Name
+		}
+		if !isSiteFile(fn, names) {
+			continue
+		}
+
+		fromFile, toFile, err := change.Files()
+		if err != nil {
+			return fmt.Errorf("cdb: Reading %s: %v", fn, err)
+		}
+		var from, to *string
+		for _, f := range []struct {
+			file     *object.File
+			contents **string
+		}{{fromFile, &from}, {toFile, &to}} {
+			if f.file == nil {
+				continue
+			}
+			contents, err := f.file.Contents()
+			if err != nil {
+				return fmt.Errorf("cdb: Reading %s: %v", fn, err)
+			}
+			*f.contents = &contents
+		}
+
+		if patch := newFilePatch(fn, from, to); patch != nil {
+			patches = append(patches, patch)
+		}
+	}
+	sort.Slice(patches, func(i, j int) bool {
+		return patchPath(patches[i]) < patchPath(patches[j])
+	})
+
+	return encodePatches(w, patches)
+}
+
+func openRepo() (*git.Repository, error) {
+	if conf.Path == "" {
+		return nil, ErrPathNotConfigured
+	}
+	if bareWorktree() {
+		return openBare(conf.Path)
+	}
+	repo, err := git.PlainOpen(conf.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Opening repo at %s: %v", conf.Path, err)
+	}
+	return repo, nil
+}
+
+func resolveTree(repo *git.Repository, rev string) (*object.Tree, error) {
+	h, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Resolving %s: %v", rev, err)
+	}
+	commit, err := repo.CommitObject(*h)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading commit %s: %v", rev, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading tree of %s: %v", rev, err)
+	}
+	return tree, nil
+}
+
+// isSiteFile reports whether fn (relative to the repo root) is a site file,
+// and if names is non-empty whether it is one of the named sites
+func isSiteFile(fn string, names []string) bool {
+	if path.Dir(fn) != "sites" || path.Ext(fn) != ".yaml" {
+		return false
+	}
+	if len(names) == 0 {
+		return true
+	}
+	name := strings.TrimSuffix(path.Base(fn), ".yaml")
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodePatches(w io.Writer, patches []fdiff.FilePatch) error {
+	if len(patches) == 0 {
+		return nil
+	}
+	if err := fdiff.NewUnifiedEncoder(w, diffContextLines).Encode(sitesPatch(patches)); err != nil {
+		return fmt.Errorf("cdb: Writing diff: %v", err)
+	}
+	return nil
+}
+
+// newFilePatch returns a patch transforming from into to, where nil means
+// the file doesn't exist. Returns nil if there is no difference.
+func newFilePatch(fn string, from, to *string) fdiff.FilePatch {
+	var fromContent, toContent string
+	p := &sitePatch{}
+	if from != nil {
+		fromContent = *from
+		p.from = newSiteFile(fn, fromContent)
+	}
+	if to != nil {
+		toContent = *to
+		p.to = newSiteFile(fn, toContent)
+	}
+	if (from == nil) == (to == nil) && fromContent == toContent {
+		return nil
+	}
+
+	for _, d := range diff.Do(fromContent, toContent) {
+		var op fdiff.Operation
+		switch d.Type {
+		case dmp.DiffEqual:
+			op = fdiff.Equal
+		case dmp.DiffDelete:
+			op = fdiff.Delete
+		case dmp.DiffInsert:
+			op = fdiff.Add
+		}
+		p.chunks = append(p.chunks, &siteChunk{d.Text, op})
+	}
+
+	return p
+}
+
+func patchPath(p fdiff.FilePatch) string {
+	from, to := p.Files()
+	if to != nil {
+		return to.Path()
+	}
+	return from.Path()
+}
+
+// The following implement the go-git diff interfaces so site diffs can be
+// written with its unified encoder
+
+type sitesPatch []fdiff.FilePatch
+
+func (p sitesPatch) FilePatches() []fdiff.FilePatch {
+	return p
+}
+
+func (p sitesPatch) Message() string {
+	return ""
+}
+
+type sitePatch struct {
+	from, to *siteFile
+	chunks   []fdiff.Chunk
+}
+
+func (p *sitePatch) IsBinary() bool {
+	return false
+}
+
+func (p *sitePatch) Files() (from, to fdiff.File) {
+	// Avoid returning typed nils
+	if p.from != nil {
+		from = p.from
+	}
+	if p.to != nil {
+		to = p.to
+	}
+	return from, to
+}
+
+func (p *sitePatch) Chunks() []fdiff.Chunk {
+	return p.chunks
+}
+
+type siteFile struct {
+	path string
+	hash plumbing.Hash
+}
+
+func newSiteFile(fn, contents string) *siteFile {
+	return &siteFile{
+		path: fn,
+		hash: plumbing.ComputeHash(plumbing.BlobObject, []byte(contents)),
+	}
+}
+
+func (f *siteFile) Hash() plumbing.Hash {
+	return f.hash
+}
+
+func (f *siteFile) Mode() filemode.FileMode {
+	return filemode.Regular
+}
+
+func (f *siteFile) Path() string {
+	return f.path
+}
+
+type siteChunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (c *siteChunk) Content() string {
+	return c.content
+}
+
+func (c *siteChunk) Type() fdiff.Operation {
+	return c.op
+}
@@ -0,0 +1,217 @@
+package cdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldChange is a change to a single field of a site. Fields are named as
+// in the site YAML files, and values are encoded as JSON so changes can be
+// saved and compared exactly.
+type FieldChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// EnvNamePattern matches the names of environment variables which may be
+// set in a site's env
+const EnvNamePattern = `^[A-Za-z_][A-Za-z0-9_]*$`
+
+var envNameRegexp = regexp.MustCompile(EnvNamePattern)
+
+// The field recording which pugo run last saved a site
+const provenanceField = "last-modified"
+
+// FieldNames returns the names of the fields of a site, as used in the site
+// YAML files
+func FieldNames() []string {
+	var names []string
+	t := reflect.TypeOf(Site{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := fieldName(t.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Field returns the value of the named field encoded as JSON
+func (s *Site) Field(name string) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.field(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Marshalling %s of %s: %v", name, s.name, err)
+	}
+	return data, nil
+}
+
+// SetField sets the named field from a JSON encoded value, marking the site
+// as changed if the value differs
+func (s *Site) SetField(name string, value json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.field(name)
+	if err != nil {
+		return err
+	}
+	newValue := reflect.New(v.Type())
+	if err := json.Unmarshal(value, newValue.Interface()); err != nil {
+		return fmt.Errorf("cdb: Invalid value for %s: %v", name, err)
+	}
+	if !reflect.DeepEqual(v.Interface(), newValue.Elem().Interface()) {
+		v.Set(newValue.Elem())
+		s.changed = true
+	}
+	return nil
+}
+
+// ParseField converts a value given as a string (e.g. on the command line)
+// to the JSON encoding of the named field's type. Lists are given as comma
+// separated values, maps (e.g. env) as comma separated key=value pairs, and
+// free-form fields (e.g. php) may be booleans, integers or strings.
+func ParseField(name string, value string) (json.RawMessage, error) {
+	f, err := (&Site{}).field(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	switch f.Kind() {
+	case reflect.String:
+		v = value
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("cdb: %s must be true or false", name)
+		}
+		v = b
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("cdb: %s must be an integer", name)
+		}
+		v = i
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v = list
+	case reflect.Map:
+		m := map[string]string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 || !envNameRegexp.MatchString(parts[0]) {
+				return nil, fmt.Errorf("cdb: %s must be given as NAME=value pairs, with names of letters, digits and underscores", name)
+			}
+			m[parts[0]] = parts[1]
+		}
+		v = m
+	case reflect.Interface:
+		// Keep anything other than a boolean or integer as a string, so e.g.
+		// a php version of 8.0 isn't turned into the number 8
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+			return nil, fmt.Errorf("cdb: Invalid value for %s: %v", name, err)
+		}
+		switch parsed.(type) {
+		case bool, int:
+			v = parsed
+		default:
+			v = value
+		}
+	default:
+		return nil, fmt.Errorf("cdb: Field %s cannot be set from a string", name)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Invalid value for %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// PendingChanges compares the site with its file in the working tree,
+// returning the fields which differ. A site without a file is compared with
+// an empty site.
+func (s *Site) PendingChanges() ([]FieldChange, error) {
+	saved := &Site{}
+	yamlData, err := ioutil.ReadFile(s.FileName())
+	if err == nil {
+		if saved, err = parseSite(s.FileName(), yamlData, s.defaults, conf.Strict); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cdb: Reading %s: %v", s.FileName(), err)
+	}
+
+	var changes []FieldChange
+	for _, name := range FieldNames() {
+		// Provenance changes with every save, so isn't a change itself
+		if name == provenanceField {
+			continue
+		}
+		before, err := saved.Field(name)
+		if err != nil {
+			return nil, err
+		}
+		after, err := s.Field(name)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(before, after) {
+			changes = append(changes, FieldChange{Field: name, Before: before, After: after})
+		}
+	}
+	return changes, nil
+}
+
+// field returns the settable value of the named field. Must be called with
+// the site locked.
+func (s *Site) field(name string) (reflect.Value, error) {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if fieldName(v.Type().Field(i)) == name {
+			return v.Field(i), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("cdb: Unknown site field '%s'", name)
+}
+
+// fieldName returns the YAML name of a site struct field, or an empty string
+// if the field isn't saved
+func fieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
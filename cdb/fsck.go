@@ -0,0 +1,228 @@
+package cdb
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Names of the checks made by Fsck
+const (
+	CheckLoad          = "load"
+	CheckDuplicateId   = "duplicate-id"
+	CheckArchivedId    = "archived-id"
+	CheckDuplicateName = "duplicate-name"
+	CheckNameMismatch  = "name-mismatch"
+	CheckImmortalAdmin = "immortal-admin"
+	CheckRequiredField = "required-field"
+	CheckManifest      = "manifest"
+)
+
+// Problem is an integrity problem found by Fsck
+type Problem struct {
+	// The site file with the problem
+	Site    string
+	Check   string
+	Message string
+	// Repairs the problem by changing the site, or nil if it must be
+	// repaired by hand
+	fix func()
+}
+
+// Fixable reports whether Fix can repair the problem
+func (p *Problem) Fixable() bool {
+	return p.fix != nil
+}
+
+// Fix repairs the problem if it is fixable, marking the site as changed so
+// the repair is committed by CommitSites
+func (p *Problem) Fix() {
+	if p.fix != nil {
+		p.fix()
+	}
+}
+
+// Fsck checks the integrity of the cdb, returning the problems found sorted
+// by site. It loads every site; in tolerant mode files which can't be
+// loaded are reported as problems too.
+func Fsck() ([]*Problem, error) {
+	sites, err := GetAllSites()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []*Problem
+	for _, loadError := range LoadErrors() {
+		check := CheckLoad
+		if errors.Is(loadError.Err, ErrManifestMismatch) {
+			check = CheckManifest
+		}
+		problems = append(problems, &Problem{
+			Site:    strings.TrimSuffix(loadError.FileName, ".yaml"),
+			Check:   check,
+			Message: loadError.Error(),
+		})
+	}
+	missing, err := ManifestProblems()
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range missing {
+		problems = append(problems, &Problem{
+			Site:    strings.TrimSuffix(path.Base(fn), ".yaml"),
+			Check:   CheckManifest,
+			Message: fmt.Sprintf("%s is in the integrity manifest but missing, it may have been deleted outside pugo", fn),
+		})
+	}
+
+	byId := make(map[int][]*Site)
+	byLowerName := make(map[string][]*Site)
+	for _, site := range sites {
+		byId[site.Id] = append(byId[site.Id], site)
+		byLowerName[strings.ToLower(site.name)] = append(byLowerName[strings.ToLower(site.name)], site)
+		problems = append(problems, checkSite(site)...)
+	}
+
+	for id, same := range byId {
+		if len(same) > 1 && id != 0 {
+			for _, site := range same {
+				problems = append(problems, &Problem{
+					Site:    site.name,
+					Check:   CheckDuplicateId,
+					Message: fmt.Sprintf("id %d is also used by %s", id, otherNames(same, site)),
+				})
+			}
+		}
+	}
+	// Archived sites keep their ids so they can be restored
+	archived, err := archivedSiteIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, site := range sites {
+		if name, ok := archived[site.Id]; ok && site.Id != 0 {
+			problems = append(problems, &Problem{
+				Site:    site.name,
+				Check:   CheckArchivedId,
+				Message: fmt.Sprintf("id %d is also used by archived site %s", site.Id, name),
+			})
+		}
+	}
+	// Aliases are looked up as names, so must be unique among both
+	for _, site := range sites {
+		for _, alias := range site.Aliases {
+			for _, other := range byLowerName[strings.ToLower(alias)] {
+				problems = append(problems, &Problem{
+					Site:    site.name,
+					Check:   CheckDuplicateName,
+					Message: fmt.Sprintf("alias %s is the name of %s", alias, other.name),
+				})
+			}
+			for _, other := range sites {
+				if other != site && other.HasAlias(alias) {
+					problems = append(problems, &Problem{
+						Site:    site.name,
+						Check:   CheckDuplicateName,
+						Message: fmt.Sprintf("alias %s is also an alias of %s", alias, other.name),
+					})
+				}
+			}
+		}
+	}
+	for _, same := range byLowerName {
+		if len(same) > 1 {
+			for _, site := range same {
+				problems = append(problems, &Problem{
+					Site:    site.name,
+					Check:   CheckDuplicateName,
+					Message: fmt.Sprintf("name differs only in case from %s", otherNames(same, site)),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Site != problems[j].Site {
+			return problems[i].Site < problems[j].Site
+		}
+		return problems[i].Check < problems[j].Check
+	})
+	return problems, nil
+}
+
+// checkSite checks the integrity of a single site
+func checkSite(site *Site) []*Problem {
+	var problems []*Problem
+	problem := func(check string, format string, a ...interface{}) *Problem {
+		p := &Problem{
+			Site:    site.name,
+			Check:   check,
+			Message: fmt.Sprintf(format, a...),
+		}
+		problems = append(problems, p)
+		return p
+	}
+
+	if site.Id <= 0 {
+		problem(CheckRequiredField, "id is missing")
+	}
+	if site.FullName == "" {
+		problem(CheckRequiredField, "full-name is empty")
+	}
+	if site.Email == "" {
+		problem(CheckRequiredField, "email is empty")
+	}
+	if len(site.Paths) == 0 {
+		problem(CheckRequiredField, "paths is empty")
+	}
+
+	// Sites are served from the path matching their file name, so a site
+	// without one has most likely been renamed without updating the other
+	if len(site.Paths) > 0 {
+		found := false
+		for _, p := range site.Paths {
+			if p == "/"+site.name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problem(CheckNameMismatch, "paths don't include /%s", site.name)
+		}
+	}
+
+	// Immortal admins always keep access, so also listing them as admins
+	// is redundant and inflates admin counts
+	immortal := make(map[string]bool)
+	for _, login := range site.ImmortalAdmins {
+		immortal[login] = true
+	}
+	for _, login := range site.Admins {
+		if immortal[login] {
+			login := login
+			p := problem(CheckImmortalAdmin, "immortal admin %s is also listed in admins", login)
+			// Protected sites are repaired by hand
+			if !site.Protected {
+				p.fix = func() {
+					site.RemoveAdmin(login)
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// otherNames returns the names of sites other than site, comma separated
+func otherNames(sites []*Site, site *Site) string {
+	var names []string
+	for _, other := range sites {
+		if other != site {
+			names = append(names, other.name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,208 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// SiteChange describes a change made to a site by a commit. Before is nil if
+// the commit created the site and After is nil if the commit deleted it.
+type SiteChange struct {
+	Name   string
+	Before *Site
+	After  *Site
+}
+
+// CommitInfo describes a commit to the cdb
+type CommitInfo struct {
+	Hash    string
+	Message string
+	// Whether the commit was made by pugo
+	Pugo bool
+	// The id of the pugo run which made the commit, if recorded
+	Run string
+}
+
+// GetCommitChanges returns the site changes made by a commit, identified by
+// a (possibly abbreviated) hash, compared to its parent
+func GetCommitChanges(ctx context.Context, hash string) (*CommitInfo, []SiteChange, error) {
+	repo, err := openRepo()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, err := repo.ResolveRevision(plumbing.Revision(hash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Resolving commit %s: %v", hash, err)
+	}
+	commit, err := repo.CommitObject(*h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading commit %s: %v", hash, err)
+	}
+	if commit.NumParents() != 1 {
+		return nil, nil, fmt.Errorf("cdb: Commit %s has %d parents, expected 1", hash, commit.NumParents())
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading parent of %s: %v", hash, err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading tree of %s: %v", hash, err)
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading tree of %s: %v", parent.Hash, err)
+	}
+
+	changes, err := object.DiffTreeContext(ctx, parentTree, tree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Diffing %s: %v", hash, err)
+	}
+
+	var siteChanges []SiteChange
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		if !isSiteFile(name, nil) || !isSiteFileName(path.Base(name)) {
+			continue
+		}
+
+		from, to, err := change.Files()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cdb: Reading %s: %v", name, err)
+		}
+		siteChange := SiteChange{Name: strings.TrimSuffix(path.Base(name), ".yaml")}
+		if siteChange.Before, err = parseSiteFile(from); err != nil {
+			return nil, nil, err
+		}
+		if siteChange.After, err = parseSiteFile(to); err != nil {
+			return nil, nil, err
+		}
+		siteChanges = append(siteChanges, siteChange)
+	}
+	sort.Slice(siteChanges, func(i, j int) bool {
+		return siteChanges[i].Name < siteChanges[j].Name
+	})
+
+	return newCommitInfo(commit), siteChanges, nil
+}
+
+func newCommitInfo(commit *object.Commit) *CommitInfo {
+	return &CommitInfo{
+		Hash:    commit.Hash.String(),
+		Message: strings.TrimSpace(commit.Message),
+		Pugo:    strings.HasPrefix(commit.Message, "sites: ") && strings.Contains(commit.Message, "(cmd=pugo"),
+		Run:     commitRun(commit.Message),
+	}
+}
+
+// commitRun returns the run id recorded in the Pugo-Run trailer of a commit
+// message, if any
+func commitRun(message string) string {
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, runTrailer+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, runTrailer+":"))
+		}
+	}
+	return ""
+}
+
+func parseSiteFile(f *object.File) (*Site, error) {
+	if f == nil {
+		return nil, nil
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading %s: %v", f.Name, err)
+	}
+	// Past versions are shown as they were, even if no longer valid
+	return parseSite(f.Name, []byte(contents), nil, false)
+}
+
+// AdminsAdded returns the admins present after the change but not before
+func (c *SiteChange) AdminsAdded() []string {
+	return adminsDifference(c.After, c.Before)
+}
+
+// AdminsRemoved returns the admins present before the change but not after
+func (c *SiteChange) AdminsRemoved() []string {
+	return adminsDifference(c.Before, c.After)
+}
+
+func adminsDifference(a, b *Site) []string {
+	if a == nil {
+		return nil
+	}
+	inB := make(map[string]bool)
+	if b != nil {
+		for _, admin := range b.Admins {
+			inB[admin] = true
+		}
+	}
+	var diff []string
+	for _, admin := range a.Admins {
+		if !inB[admin] {
+			diff = append(diff, admin)
+		}
+	}
+	return diff
+}
+
+// Revert undoes a change to the site. Admins added by the change are
+// removed and admins removed are added back, leaving other admins alone.
+// Other fields changed are restored to their previous value unless they've
+// since been changed again, in which case they're left alone and reported
+// as conflicts. Returns the names of the fields reverted and of those in
+// conflict.
+func (s *Site) Revert(change *SiteChange) (reverted []string, conflicts []string) {
+	if change.Before == nil || change.After == nil {
+		return nil, []string{"site created or deleted"}
+	}
+
+	for _, admin := range change.AdminsAdded() {
+		s.RemoveAdmin(admin)
+	}
+	for _, admin := range change.AdminsRemoved() {
+		s.AddAdmin(admin)
+	}
+	if len(change.AdminsAdded()) > 0 || len(change.AdminsRemoved()) > 0 {
+		reverted = append(reverted, "Admins")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := reflect.ValueOf(s).Elem()
+	before := reflect.ValueOf(change.Before).Elem()
+	after := reflect.ValueOf(change.After).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if field.PkgPath != "" || field.Name == "Admins" {
+			// Unexported, or handled above
+			continue
+		}
+		if reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), after.Field(i).Interface()) {
+			conflicts = append(conflicts, field.Name)
+			continue
+		}
+		current.Field(i).Set(before.Field(i))
+		s.changed = true
+		reverted = append(reverted, field.Name)
+	}
+
+	return reverted, conflicts
+}
@@ -0,0 +1,101 @@
+package cdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// NextFreeId returns the id to give a new site: one more than the highest
+// id used by a site, an archived site (so it can still be restored), or
+// reserved, e.g. the ids of newerpol websites
+func NextFreeId(reserved []int) (int, error) {
+	used, err := usedIds()
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	for id := range used {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	for _, id := range reserved {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next, nil
+}
+
+// IdGaps returns the ranges of ids below the highest which no site or
+// archived site uses, as pairs of the first and last id of each range
+func IdGaps() ([][2]int, error) {
+	used, err := usedIds()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(used))
+	for id := range used {
+		if id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var gaps [][2]int
+	last := 0
+	for _, id := range ids {
+		if id > last+1 {
+			gaps = append(gaps, [2]int{last + 1, id - 1})
+		}
+		last = id
+	}
+	return gaps, nil
+}
+
+// usedIds returns the ids used by sites and archived sites
+func usedIds() (map[int]bool, error) {
+	sites, err := GetAllSites()
+	if err != nil {
+		return nil, err
+	}
+	archived, err := archivedSiteIds()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]bool)
+	for _, site := range sites {
+		used[site.Id] = true
+	}
+	for id := range archived {
+		used[id] = true
+	}
+	return used, nil
+}
+
+// archivedSiteIds returns the names of archived sites keyed by their ids
+func archivedSiteIds() (map[int]string, error) {
+	names, err := ArchivedSiteNames()
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := loadDefaults()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]string)
+	for _, name := range names {
+		yamlData, err := ioutil.ReadFile(filepath.Join(conf.Path, archiveDir, name+".yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("cdb: Reading archived %s: %v", name, err)
+		}
+		site, err := parseSite(name+".yaml", yamlData, defaults, false)
+		if err != nil {
+			return nil, err
+		}
+		ids[site.Id] = name
+	}
+	return ids, nil
+}
@@ -0,0 +1,86 @@
+package cdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The site index maps site ids and aliases to names so that lazy mode can
+// find a site without loading every site. It is kept in the repo's git
+// directory so it doesn't show up as a change in the working tree, and is
+// only a hint: a missing, unreadable, or out of date index means sites are
+// loaded in full, which rewrites it.
+const siteIndexFileName = "pugo-sites.json"
+
+type siteIndex struct {
+	// The commit checked out when the index was written
+	Commit  string            `json:"commit"`
+	Names   map[int]string    `json:"names"`
+	Aliases map[string]string `json:"aliases"`
+}
+
+func siteIndexPath() string {
+	return filepath.Join(gitDir(), siteIndexFileName)
+}
+
+// readSiteIndex returns the site index, or an empty index if it can't be
+// read
+func readSiteIndex() *siteIndex {
+	index := &siteIndex{}
+	b, err := ioutil.ReadFile(siteIndexPath())
+	if err == nil {
+		err = json.Unmarshal(b, index)
+	}
+	if err != nil {
+		log.Debugf("cdb: Site index not read: %v", err)
+		return &siteIndex{}
+	}
+	return index
+}
+
+// current reports whether the index was written at the commit checked out,
+// so that anything missing from it doesn't exist
+func (index *siteIndex) current() bool {
+	return index.Commit != "" && index.Commit == headCommit()
+}
+
+// writeSiteIndex replaces the site index with sites. Failures are logged but
+// otherwise ignored, as the index is only a hint.
+func writeSiteIndex(sites []*Site) {
+	index := &siteIndex{
+		Commit:  headCommit(),
+		Names:   make(map[int]string, len(sites)),
+		Aliases: make(map[string]string),
+	}
+	for _, site := range sites {
+		index.Names[site.Id] = site.name
+		for _, alias := range site.Aliases {
+			index.Aliases[alias] = site.name
+		}
+	}
+
+	b, err := json.Marshal(index)
+	if err == nil {
+		err = ioutil.WriteFile(siteIndexPath(), b, 0644)
+	}
+	if err != nil {
+		log.Debugf("cdb: Site index not written: %v", err)
+	}
+}
+
+// headCommit returns the hash of the commit checked out, or an empty string
+// if it can't be determined
+func headCommit() string {
+	repo, err := openRepo()
+	if err != nil {
+		return ""
+	}
+	h, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	return h.Hash().String()
+}
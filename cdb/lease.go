@@ -0,0 +1,235 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// The lease is the commit origin's branch was at when it was last pulled or
+// pushed. Before committing, changes are moved onto anything pushed to
+// origin since by a concurrent run or by hand, and pushing is refused if
+// origin has moved again in the meantime, so concurrent changes are never
+// clobbered.
+var lease struct {
+	branch string
+	hash   plumbing.Hash
+}
+
+// ErrRemoteMoved is wrapped by the errors returned when origin's branch has
+// moved on from the lease in a way changes can't be moved onto, or moves
+// again before they are pushed
+var ErrRemoteMoved = errors.New("origin changed during the run")
+
+// setLease records the commit origin's branch is known to be at
+func setLease(hash plumbing.Hash) {
+	lease.branch = conf.Branch
+	lease.hash = hash
+}
+
+func hasLease() bool {
+	return lease.branch == conf.Branch && !lease.hash.IsZero()
+}
+
+// remoteHead returns the commit origin's branch was at when last fetched
+func remoteHead(repo *git.Repository) (plumbing.Hash, error) {
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName(), conf.Branch), true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("cdb: %s/%s: %v", remoteName(), conf.Branch, err)
+	}
+	return ref.Hash(), nil
+}
+
+// checkLease fetches origin and fails with ErrRemoteMoved if its branch has
+// moved on from the lease
+func checkLease(ctx context.Context, repo *git.Repository) error {
+	if !hasLease() {
+		return nil
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return err
+	}
+	remote, err := remoteHead(repo)
+	if err != nil {
+		return err
+	}
+	if remote != lease.hash {
+		return fmt.Errorf("cdb: Not pushing, %s/%s is at %s rather than %s as pulled: %w", remoteName(), conf.Branch, remote, lease.hash, ErrRemoteMoved)
+	}
+	return nil
+}
+
+// catchUpLease moves the changes staged in wt onto origin's branch if it has
+// moved on from the lease, so they are committed on top of any concurrent
+// changes rather than clobbering them. Returns the worktree to commit them
+// with: objects fetched aren't visible through wt's repository.
+func catchUpLease(ctx context.Context, wt *git.Worktree, opts *CommitSitesOptions) (*git.Worktree, error) {
+	if !hasLease() {
+		return wt, nil
+	}
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return nil, err
+	}
+	remote, err := remoteHead(repo)
+	if err != nil {
+		return nil, err
+	}
+	if remote == lease.hash {
+		return wt, nil
+	}
+	// A merge is made with particular parents, so can't be moved
+	if len(opts.parents) > 0 {
+		return nil, fmt.Errorf("cdb: %s/%s changed during the run, unable to commit", remoteName(), conf.Branch)
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+	var files []string
+	for fn, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			files = append(files, fn)
+		}
+	}
+	if wt, err = repo.Worktree(); err != nil {
+		return nil, fmt.Errorf("cdb: Opening worktree: %v", err)
+	}
+	if _, err := catchUp(ctx, repo, wt, files, "changes"); err != nil {
+		// The changes can be made again on top of origin by running the
+		// command again, which needs a clean working tree
+		if errors.Is(err, ErrRemoteMoved) {
+			if resetErr := wt.Reset(&git.ResetOptions{Mode: git.HardReset}); resetErr != nil {
+				log.Warnf("cdb: Discarding changes: %v", resetErr)
+			} else {
+				log.Warn("cdb: Changes discarded, run the command again to make them on top of the remote")
+			}
+		}
+		return nil, err
+	}
+	return wt, nil
+}
+
+// catchUp fetches origin and, if it has moved on from HEAD, resets to it
+// and stages the given files, which are changed in the working tree, again.
+// Fails if origin changed any of them too. Returns the commit origin is at,
+// which becomes the lease.
+func catchUp(ctx context.Context, repo *git.Repository, wt *git.Worktree, files []string, what string) (plumbing.Hash, error) {
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	remote, err := remoteHead(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("cdb: %v", err)
+	}
+	if remote == head.Hash() {
+		setLease(remote)
+		return remote, nil
+	}
+
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("cdb: %v", err)
+	}
+	remoteCommit, err := repo.CommitObject(remote)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("cdb: %v", err)
+	}
+	// Commits not yet pushed are pushed with the changes
+	if ok, err := remoteCommit.IsAncestor(headCommit); err == nil && ok {
+		setLease(remote)
+		return remote, nil
+	}
+	if err := moveOnto(wt, headCommit, remoteCommit, files, what, remoteName()+"/"+conf.Branch); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	setLease(remote)
+	return remote, nil
+}
+
+// moveOnto resets the working tree from head to onto, a descendant of it
+// named where, and stages the given files, which are changed in the working
+// tree, again. Fails with ErrRemoteMoved, before changing anything, if onto
+// isn't a descendant of head or changed any of the files too.
+func moveOnto(wt *git.Worktree, headCommit *object.Commit, onto *object.Commit, files []string, what string, where string) error {
+	if ok, err := headCommit.IsAncestor(onto); err != nil || !ok {
+		return fmt.Errorf("cdb: Unable to commit %s, %s has diverged from %s: %w", what, conf.Branch, where, ErrRemoteMoved)
+	}
+	for _, fn := range files {
+		// The manifest is updated again when the changes are committed, and
+		// entries appended to the ledger are appended again
+		if fn == manifestFile || fn == ledgerFile {
+			continue
+		}
+		before, _ := fileHash(headCommit, fn)
+		after, _ := fileHash(onto, fn)
+		if before != after {
+			return fmt.Errorf("cdb: Unable to commit %s, %s was also changed on %s: %w", what, fn, where, ErrRemoteMoved)
+		}
+	}
+
+	log.Infof("cdb: Moving %s onto %s (%s)", what, where, onto.Hash)
+	contents := make(map[string][]byte)
+	for _, fn := range files {
+		if fn == manifestFile {
+			continue
+		}
+		if fn == ledgerFile {
+			additions, err := ledgerAdditions(headCommit)
+			if err != nil {
+				return fmt.Errorf("%v, unable to commit %s: %w", err, what, ErrRemoteMoved)
+			}
+			contents[fn] = additions
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(conf.Path, filepath.FromSlash(fn)))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cdb: Reading %s: %v", fn, err)
+		}
+		if err == nil {
+			contents[fn] = data
+		}
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: onto.Hash, Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("cdb: Resetting to %s: %v", where, err)
+	}
+	for _, fn := range files {
+		if fn == manifestFile {
+			continue
+		}
+		if fn == ledgerFile {
+			if err := writeLedger(wt, contents[fn]); err != nil {
+				return err
+			}
+			continue
+		}
+		full := filepath.Join(conf.Path, filepath.FromSlash(fn))
+		if data, ok := contents[fn]; ok {
+			if err := ioutil.WriteFile(full, data, 0644); err != nil {
+				return fmt.Errorf("cdb: Restoring %s: %v", fn, err)
+			}
+			if _, err := wt.Add(fn); err != nil {
+				return fmt.Errorf("cdb: Staging %s: %v", fn, err)
+			}
+		} else if _, err := wt.Remove(fn); err != nil {
+			return fmt.Errorf("cdb: Staging removal of %s: %v", fn, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package cdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/yaml.v3"
+)
+
+// The access ledger, kept at the root of the cdb repo
+const ledgerFile = "ledger.yaml"
+
+// Ledger actions
+const (
+	LedgerGrant  = "grant"
+	LedgerRevoke = "revoke"
+)
+
+// LedgerEntry is an access change recorded in the ledger, a YAML sequence
+// which is only ever appended to, so the repo carries the history of who
+// was given access to which site and why
+type LedgerEntry struct {
+	Time   time.Time `yaml:"time"`
+	Action string    `yaml:"action"`
+	Login  string    `yaml:"login"`
+	Site   string    `yaml:"site"`
+	// The newerpol WebserverAccess id of the grant
+	GrantId int    `yaml:"grant-id,omitempty"`
+	Run     string `yaml:"run,omitempty"`
+}
+
+// appendLedger appends entries to the ledger in the working tree and stages
+// it, filling in the time and run
+func appendLedger(wt *git.Worktree, entries []LedgerEntry) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = now
+		}
+		if entries[i].Run == "" {
+			entries[i].Run = runId
+		}
+	}
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("cdb: Marshalling ledger entries: %v", err)
+	}
+	return writeLedger(wt, data)
+}
+
+// ledgerAdditions returns the entries appended to the ledger in the working
+// tree since commit, as they were written, so they can be appended again
+// with writeLedger after moving onto another commit. Fails if the ledger was
+// changed other than by appending.
+func ledgerAdditions(commit *object.Commit) ([]byte, error) {
+	var before string
+	f, err := commit.File(ledgerFile)
+	if err != nil && err != object.ErrFileNotFound {
+		return nil, fmt.Errorf("cdb: Reading ledger at %s: %v", commit.Hash, err)
+	}
+	if err == nil {
+		if before, err = f.Contents(); err != nil {
+			return nil, fmt.Errorf("cdb: Reading ledger at %s: %v", commit.Hash, err)
+		}
+	}
+	after, err := ioutil.ReadFile(filepath.Join(conf.Path, ledgerFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cdb: Reading ledger: %v", err)
+	}
+	if !bytes.HasPrefix(after, []byte(before)) {
+		return nil, fmt.Errorf("cdb: Ledger has been changed other than by appending to it")
+	}
+	return after[len(before):], nil
+}
+
+// writeLedger appends data, marshalled entries, to the ledger in the working
+// tree and stages it
+func writeLedger(wt *git.Worktree, data []byte) error {
+	fn := filepath.Join(conf.Path, ledgerFile)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cdb: Opening ledger: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("cdb: Appending to ledger: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cdb: Appending to ledger: %v", err)
+	}
+	if _, err := wt.Add(ledgerFile); err != nil {
+		return fmt.Errorf("cdb: Staging ledger: %v", err)
+	}
+	return nil
+}
+
+// ProductionGrantIds fetches origin and returns the grant ids recorded in the
+// ledger on its production branch: cdb.branch, even while the staging branch
+// is in use. Grants committed to the staging branch or for review have only
+// taken effect once they are listed.
+func ProductionGrantIds(ctx context.Context) (map[int]bool, error) {
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return nil, err
+	}
+	branch := conf.Branch
+	if productionBranch != "" {
+		branch = productionBranch
+	}
+	tree, err := resolveTree(repo, plumbing.NewRemoteReferenceName(remoteName(), branch).String())
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int]bool)
+	f, err := tree.File(ledgerFile)
+	if err == object.ErrFileNotFound {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading ledger on %s/%s: %v", remoteName(), branch, err)
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading ledger on %s/%s: %v", remoteName(), branch, err)
+	}
+	var entries []LedgerEntry
+	if err := yaml.Unmarshal([]byte(contents), &entries); err != nil {
+		return nil, fmt.Errorf("cdb: Parsing ledger on %s/%s: %v", remoteName(), branch, err)
+	}
+	for _, entry := range entries {
+		if entry.GrantId != 0 {
+			ids[entry.GrantId] = true
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,85 @@
+package cdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// NormalizeLogin applies the configured normalization (cdb.logins) to a
+// login, so the same login written differently, e.g. in a different case or
+// with a domain, compares equal
+func NormalizeLogin(login string) string {
+	n := conf.Logins
+	if n.Trim {
+		login = strings.TrimSpace(login)
+	}
+	if n.Lowercase {
+		login = strings.ToLower(login)
+	}
+	for _, suffix := range n.StripSuffixes {
+		if suffix != "" && len(login) > len(suffix) && strings.EqualFold(login[len(login)-len(suffix):], suffix) {
+			login = login[:len(login)-len(suffix)]
+			break
+		}
+	}
+	return login
+}
+
+// NormalizeAdmins normalizes the site's admins and immortal admins, removing
+// any which become empty or duplicated. Returns whether the site changed.
+func (s *Site) NormalizeAdmins() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	admins, adminsChanged := normalizeLogins(s.Admins)
+	sort.Strings(admins)
+	immortal, immortalChanged := normalizeLogins(s.ImmortalAdmins)
+	if !adminsChanged && !immortalChanged {
+		return false
+	}
+	s.Admins = admins
+	s.ImmortalAdmins = immortal
+	s.changed = true
+	return true
+}
+
+// normalizeLogins normalizes each login, keeping the first of any duplicates
+func normalizeLogins(logins []string) ([]string, bool) {
+	if logins == nil {
+		return nil, false
+	}
+	changed := false
+	seen := make(map[string]bool)
+	normalized := make([]string, 0, len(logins))
+	for _, login := range logins {
+		n := NormalizeLogin(login)
+		if n == "" || seen[n] {
+			changed = true
+			continue
+		}
+		if n != login {
+			changed = true
+		}
+		seen[n] = true
+		normalized = append(normalized, n)
+	}
+	return normalized, changed
+}
+
+// Unformatted reports whether the site's file differs from the way pugo
+// writes it, i.e. it would change if the site was saved
+func (s *Site) Unformatted() (bool, error) {
+	current, err := ioutil.ReadFile(s.FileName())
+	if err != nil {
+		return false, fmt.Errorf("cdb: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	formatted, err := s.marshal()
+	if err != nil {
+		return false, fmt.Errorf("cdb: Unable to marshall %s: %v", s.name, err)
+	}
+	return string(current) != string(formatted), nil
+}
@@ -0,0 +1,61 @@
+package cdb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Managed reports whether pugo may change the site: it must be listed in
+// cdb.managed_sites.allow, if that is set, and not in cdb.managed_sites.deny.
+// Sites are listed by name, alias or id.
+func (s *Site) Managed() bool {
+	if len(conf.ManagedSites.Allow) > 0 && !s.listedIn(conf.ManagedSites.Allow) {
+		return false
+	}
+	return !s.listedIn(conf.ManagedSites.Deny)
+}
+
+func (s *Site) listedIn(list []string) bool {
+	id := strconv.Itoa(s.Id)
+	for _, entry := range list {
+		if entry == s.name || entry == id || s.HasAlias(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtected returns an error naming the sites which were protected when
+// loaded, if any. Protected sites are only changed by commands naming them
+// explicitly, run with --force.
+func checkProtected(sites []*Site) error {
+	var names []string
+	for _, site := range sites {
+		if site.protected {
+			names = append(names, site.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("cdb: Refusing to change protected sites: %s", strings.Join(names, ", "))
+}
+
+// checkManaged returns an error naming the sites which pugo mustn't change,
+// if any
+func checkManaged(sites []*Site) error {
+	var names []string
+	for _, site := range sites {
+		if !site.Managed() {
+			names = append(names, site.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("cdb: Refusing to change sites excluded by cdb.managed_sites: %s", strings.Join(names, ", "))
+}
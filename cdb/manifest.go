@@ -0,0 +1,258 @@
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// The integrity manifest, kept at the root of the cdb repo, records the
+// SHA-256 checksum of every YAML file in the sites directory in the format
+// of sha256sum, so it can also be checked with sha256sum -c. pugo updates it
+// whenever it commits site files and checks each file against it when
+// loading, so a file corrupted or partially written outside pugo is found
+// before changes are made on top of it. A cdb without a manifest isn't
+// checked until pugo next commits to it.
+const manifestFile = "sites.sha256"
+
+// ErrManifestMismatch is wrapped by the error returned when loading a site
+// file which doesn't match the integrity manifest
+var ErrManifestMismatch = errors.New("integrity manifest mismatch")
+
+// manifest maps the path of each file, relative to the root of the cdb, to
+// its hex encoded checksum
+type manifest map[string]string
+
+// loadManifest returns the integrity manifest, reading it the first time it
+// is called. Returns nil if there is no manifest.
+func loadManifest() (manifest, error) {
+	sitesCache.manifestOnce.Do(func() {
+		sitesCache.manifest, sitesCache.manifestError = readManifest()
+	})
+	return sitesCache.manifest, sitesCache.manifestError
+}
+
+func readManifest() (manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(conf.Path, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading %s: %v", manifestFile, err)
+	}
+
+	m := make(manifest)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("cdb: %s line %d: Expected '<sha256>  <file>'", manifestFile, n)
+		}
+		m[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return m, nil
+}
+
+func (m manifest) marshal() []byte {
+	files := make([]string, 0, len(m))
+	for fn := range m {
+		files = append(files, fn)
+	}
+	sort.Strings(files)
+
+	var b bytes.Buffer
+	for _, fn := range files {
+		fmt.Fprintf(&b, "%s  %s\n", m[fn], fn)
+	}
+	return b.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isManifestFile reports whether a file, relative to the root of the cdb, is
+// recorded in the integrity manifest
+func isManifestFile(fn string) bool {
+	return path.Dir(fn) == "sites" && path.Ext(fn) == ".yaml"
+}
+
+// verifyManifest checks the contents of a file in the sites directory
+// against the integrity manifest, if there is one
+func verifyManifest(siteFileName string, data []byte) error {
+	m, err := loadManifest()
+	if err != nil || m == nil {
+		return err
+	}
+	fn := path.Join("sites", siteFileName)
+	expected, ok := m[fn]
+	if !ok {
+		return fmt.Errorf("cdb: %s: %w, it isn't in %s so may have been added outside pugo (see pugo fsck)", fn, ErrManifestMismatch, manifestFile)
+	}
+	if checksum(data) != expected {
+		return fmt.Errorf("cdb: %s: %w, it may be corrupt or have been edited outside pugo (see pugo fsck)", fn, ErrManifestMismatch)
+	}
+	return nil
+}
+
+// scanManifest returns the checksums of every file in the sites directory
+// of the working tree
+func scanManifest() (manifest, error) {
+	dirEnts, err := ioutil.ReadDir(filepath.Join(conf.Path, "sites"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+	m := make(manifest)
+	for _, entry := range dirEnts {
+		fn := path.Join("sites", entry.Name())
+		if entry.IsDir() || !isManifestFile(fn) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(conf.Path, "sites", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("cdb: Reading %s: %v", fn, err)
+		}
+		m[fn] = checksum(data)
+	}
+	return m, nil
+}
+
+// writeManifest writes the integrity manifest to the working tree and stages
+// it, if it has changed. Returns whether it changed.
+func writeManifest(wt *git.Worktree, m manifest) (bool, error) {
+	data := m.marshal()
+	full := filepath.Join(conf.Path, manifestFile)
+	if existing, err := ioutil.ReadFile(full); err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(full, data, 0644); err != nil {
+		return false, fmt.Errorf("cdb: Writing %s: %v", manifestFile, err)
+	}
+	if _, err := wt.Add(manifestFile); err != nil {
+		return false, fmt.Errorf("cdb: Staging %s: %v", manifestFile, err)
+	}
+	sitesCache.manifest = m
+	return true, nil
+}
+
+// updateManifest records the checksums of the site files staged in wt in
+// the integrity manifest, and stages it. Only the files staged are updated,
+// so files changed outside pugo remain mismatched. If there is no manifest
+// yet it is created from every file in the sites directory.
+func updateManifest(wt *git.Worktree) error {
+	m, err := readManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		log.Infof("cdb: Creating integrity manifest %s", manifestFile)
+		m, err = scanManifest()
+		if err != nil {
+			return err
+		}
+	} else {
+		status, err := wt.Status()
+		if err != nil {
+			return fmt.Errorf("cdb: %v", err)
+		}
+		for fn, s := range status {
+			if !isManifestFile(fn) || s.Staging == git.Unmodified || s.Staging == git.Untracked {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(conf.Path, filepath.FromSlash(fn)))
+			if os.IsNotExist(err) {
+				delete(m, fn)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("cdb: Reading %s: %v", fn, err)
+			}
+			m[fn] = checksum(data)
+		}
+	}
+	_, err = writeManifest(wt, m)
+	return err
+}
+
+// ManifestProblems returns the files recorded in the integrity manifest
+// which are missing from the sites directory, e.g. having been deleted
+// outside pugo. Files which don't match it are found when loading sites.
+func ManifestProblems() ([]string, error) {
+	m, err := loadManifest()
+	if err != nil || m == nil {
+		return nil, err
+	}
+	var missing []string
+	for fn := range m {
+		if _, err := os.Stat(filepath.Join(conf.Path, filepath.FromSlash(fn))); os.IsNotExist(err) {
+			missing = append(missing, fn)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// AcceptManifest records the current contents of every file in the sites
+// directory in the integrity manifest, accepting changes made outside pugo
+// once they have been checked, then commits and pushes as CommitSites does.
+// Returns the files whose checksums changed.
+func AcceptManifest(ctx context.Context, opts *CommitSitesOptions) ([]string, *CommitSitesResult, error) {
+	result := &CommitSitesResult{}
+
+	wt, err := GetWorktree(ctx)
+	if err != nil {
+		return nil, result, err
+	}
+	old, err := readManifest()
+	if err != nil {
+		return nil, result, err
+	}
+	m, err := scanManifest()
+	if err != nil {
+		return nil, result, err
+	}
+
+	var changed []string
+	for fn, sum := range m {
+		if old[fn] != sum {
+			changed = append(changed, fn)
+		}
+	}
+	for fn := range old {
+		if _, ok := m[fn]; !ok {
+			changed = append(changed, fn)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) == 0 && old != nil {
+		log.Infof("cdb: Integrity manifest %s is up to date", manifestFile)
+		return nil, result, nil
+	}
+	if opts.DryRun {
+		log.Infof("cdb: Dry run, not recording %d files in integrity manifest %s", len(changed), manifestFile)
+		return changed, result, nil
+	}
+
+	if _, err := writeManifest(wt, m); err != nil {
+		return changed, result, err
+	}
+	err = commitAndPush(ctx, wt, opts, 0, result, func(hash string, message string) {})
+	return changed, result, err
+}
@@ -0,0 +1,345 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// With cdb.staging_branch set, sync commits to the staging branch rather than
+// cdb.branch, and the changes reach production once reviewed with Promote.
+// productionBranch is cdb.branch while UseStagingBranch is in effect, until
+// the cdb is next configured.
+var productionBranch string
+
+// ErrNoStagingBranch is returned by Promote if cdb.staging_branch isn't set
+var ErrNoStagingBranch = errors.New("cdb: cdb.staging_branch isn't set")
+
+// UseStagingBranch switches to committing to cdb.staging_branch for the rest
+// of the run, if it is set. The branch is created from cdb.branch if it
+// doesn't exist yet. Any sites already loaded are discarded, so it must be
+// called before they are changed. Returns whether it is in use.
+func UseStagingBranch() bool {
+	if conf.StagingBranch == "" {
+		return false
+	}
+	if conf.Branch != conf.StagingBranch {
+		production := conf.Branch
+		c := *conf
+		c.Branch = c.StagingBranch
+		Configure(&c)
+		productionBranch = production
+		log.Infof("cdb: Committing to staging branch '%s', to be promoted to '%s' with pugo promote", conf.Branch, productionBranch)
+	}
+	return true
+}
+
+// ensureBranch creates the configured branch if it doesn't exist locally,
+// from origin's branch of the same name or, for the staging branch, from
+// the production branch on origin
+func ensureBranch(ctx context.Context, repo *git.Repository) error {
+	name := plumbing.NewBranchReferenceName(conf.Branch)
+	if _, err := repo.Reference(name, false); err == nil {
+		return nil
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return err
+	}
+
+	from := plumbing.NewRemoteReferenceName(remoteName(), conf.Branch)
+	ref, err := repo.Reference(from, true)
+	if err != nil && productionBranch != "" {
+		log.Infof("cdb: Creating staging branch '%s' from %s/%s", conf.Branch, remoteName(), productionBranch)
+		from = plumbing.NewRemoteReferenceName(remoteName(), productionBranch)
+		ref, err = repo.Reference(from, true)
+	}
+	if err != nil {
+		// Checking the branch out reports that it doesn't exist
+		return nil
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, ref.Hash())); err != nil {
+		return fmt.Errorf("cdb: Creating branch '%s': %v", conf.Branch, err)
+	}
+	return nil
+}
+
+// onOrigin fetches origin and reports whether the configured branch is on it
+func onOrigin(ctx context.Context, repo *git.Repository) (bool, error) {
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return false, err
+	}
+	_, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName(), conf.Branch), true)
+	return err == nil, nil
+}
+
+// fetchOrigin fetches every branch from origin
+func fetchOrigin(ctx context.Context, repo *git.Repository) error {
+	err := gitRetryPolicy().Do(ctx, "cdb fetch", func(ctx context.Context) error {
+		err := repo.FetchContext(ctx, &git.FetchOptions{RemoteName: remoteName(), Auth: auth()})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cdb: Fetching %s: %v", remoteName(), err)
+	}
+	return nil
+}
+
+// PromoteOptions are the options for promoting the staging branch
+type PromoteOptions struct {
+	DryRun bool
+	NoPush bool
+}
+
+// PromoteResult describes the outcome of Promote
+type PromoteResult struct {
+	// The commits on the staging branch not yet on the production branch,
+	// newest first
+	Commits []*CommitInfo
+	// The production branch's new head
+	Commit string
+	// Whether a merge commit was made, as production had moved on
+	Merged bool
+	Pushed bool
+	// The outcome of pushing the production branch to each of
+	// cdb.push_remotes
+	RemotePushes []RemotePush
+}
+
+// Promote brings the changes on cdb.staging_branch into cdb.branch on
+// origin. If the production branch hasn't moved on since the staging branch
+// left it, it is fast-forwarded. Otherwise the two are merged, provided they
+// didn't both change the same file, and the staging branch is then
+// fast-forwarded to the merge so the next sync starts from it.
+func Promote(ctx context.Context, opts *PromoteOptions) (result *PromoteResult, err error) {
+	result = &PromoteResult{}
+	if conf.StagingBranch == "" {
+		return result, ErrNoStagingBranch
+	}
+
+	// Bring production up to date and check it out to merge into
+	wt, err := GetWorktree(ctx)
+	if err != nil {
+		return result, err
+	}
+	repo, err := openRepo()
+	if err != nil {
+		return result, err
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return result, err
+	}
+
+	stagingRef, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName(), conf.StagingBranch), true)
+	if err != nil {
+		return result, fmt.Errorf("cdb: No staging branch %s/%s: %v", remoteName(), conf.StagingBranch, err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return result, fmt.Errorf("cdb: %v", err)
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return result, fmt.Errorf("cdb: %v", err)
+	}
+	stagingCommit, err := repo.CommitObject(stagingRef.Hash())
+	if err != nil {
+		return result, fmt.Errorf("cdb: %v", err)
+	}
+	result.Commit = head.Hash().String()
+
+	// Commits reachable from production are already promoted
+	promoted := make(map[plumbing.Hash]bool)
+	err = object.NewCommitPreorderIter(headCommit, nil, nil).ForEach(func(c *object.Commit) error {
+		promoted[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("cdb: Reading history of %s: %v", conf.Branch, err)
+	}
+	var base *object.Commit
+	err = object.NewCommitPreorderIter(stagingCommit, nil, nil).ForEach(func(c *object.Commit) error {
+		if !promoted[c.Hash] {
+			result.Commits = append(result.Commits, newCommitInfo(c))
+		} else if base == nil {
+			base = c
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("cdb: Reading history of %s: %v", conf.StagingBranch, err)
+	}
+	if len(result.Commits) == 0 {
+		log.Infof("cdb: Nothing on %s to promote to %s", conf.StagingBranch, conf.Branch)
+		return result, nil
+	}
+	if base == nil {
+		return result, fmt.Errorf("cdb: %s and %s have no history in common", conf.StagingBranch, conf.Branch)
+	}
+
+	fastForward := base.Hash == headCommit.Hash
+	if opts.DryRun {
+		how := "merge"
+		if fastForward {
+			how = "fast-forward"
+		}
+		log.Infof("cdb: Dry run, not promoting %d commits from %s to %s (%s)", len(result.Commits), conf.StagingBranch, conf.Branch, how)
+		return result, nil
+	}
+
+	commitOpts := &CommitSitesOptions{
+		Message: fmt.Sprintf("Promote %d commits from %s", len(result.Commits), conf.StagingBranch),
+		Cmd:     "promote",
+		NoPush:  opts.NoPush,
+	}
+	sitesResult := &CommitSitesResult{}
+	if fastForward {
+		log.Infof("cdb: Fast-forwarding %s to %s (%s)", conf.Branch, conf.StagingBranch, stagingCommit.Hash)
+		if err := wt.Reset(&git.ResetOptions{Commit: stagingCommit.Hash, Mode: git.HardReset}); err != nil {
+			return result, fmt.Errorf("cdb: Fast-forwarding %s: %v", conf.Branch, err)
+		}
+		sitesResult.Commit = stagingCommit.Hash.String()
+		if !opts.NoPush {
+			err = push(ctx, commitOpts, sitesResult)
+		}
+	} else {
+		log.Infof("cdb: Merging %s into %s", conf.StagingBranch, conf.Branch)
+		changed, err := mergeFiles(wt, base, headCommit, stagingCommit)
+		if err != nil {
+			return result, err
+		}
+		commitOpts.parents = []plumbing.Hash{headCommit.Hash, stagingCommit.Hash}
+		err = commitAndPush(ctx, wt, commitOpts, changed, sitesResult, func(hash string, message string) {})
+		result.Merged = true
+	}
+	result.Commit = sitesResult.Commit
+	result.Pushed = sitesResult.Pushed
+	result.RemotePushes = sitesResult.RemotePushes
+	if err != nil || opts.NoPush {
+		return result, err
+	}
+
+	// The staging branch carries on from production
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", conf.Branch, conf.StagingBranch))
+	err = gitRetryPolicy().Do(ctx, "cdb push", func(ctx context.Context) error {
+		err := repo.PushContext(ctx, &git.PushOptions{RemoteName: remoteName(), RefSpecs: []gitconfig.RefSpec{refSpec}, Auth: auth()})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("cdb: Pushing to %s/%s: %v", remoteName(), conf.StagingBranch, err)
+	}
+	local := plumbing.NewBranchReferenceName(conf.StagingBranch)
+	if _, err := repo.Reference(local, false); err == nil {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(local, plumbing.NewHash(result.Commit))); err != nil {
+			log.Warnf("cdb: Updating branch '%s': %v", conf.StagingBranch, err)
+		}
+	}
+	return result, nil
+}
+
+// mergeFiles applies the changes made on the staging branch since base to
+// the working tree, which has head checked out, and stages them. Fails,
+// leaving the working tree unchanged, if head changed any of the same files
+// differently. Returns the number of site files changed.
+func mergeFiles(wt *git.Worktree, base, head, staging *object.Commit) (int, error) {
+	toApply, conflicts, err := mergeChanges(base, head, staging)
+	if err != nil {
+		return 0, err
+	}
+	if len(conflicts) > 0 {
+		return 0, fmt.Errorf("cdb: %s and %s both changed %s, merge them by hand", conf.Branch, conf.StagingBranch, strings.Join(conflicts, ", "))
+	}
+	return applyFiles(wt, staging, toApply)
+}
+
+// mergeChanges returns the files changed between base and other which can
+// be applied on top of head, as head left them unchanged, and those which
+// conflict, as head changed them differently. The integrity manifest is
+// left to be updated from the files applied.
+func mergeChanges(base, head, other *object.Commit) (toApply, conflicts []string, err error) {
+	baseTree, err := base.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading tree of %s: %v", base.Hash, err)
+	}
+	otherTree, err := other.Tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Reading tree of %s: %v", other.Hash, err)
+	}
+	changes, err := object.DiffTree(baseTree, otherTree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdb: Diffing %s: %v", other.Hash, err)
+	}
+
+	for _, change := range changes {
+		fn := change.To.Name
+		if fn == "" {
+			fn = change.From.Name
+		}
+		if fn == manifestFile {
+			continue
+		}
+		before, _ := fileHash(base, fn)
+		ours, _ := fileHash(head, fn)
+		theirs, _ := fileHash(other, fn)
+		switch {
+		case ours == before:
+			toApply = append(toApply, fn)
+		case ours != theirs:
+			conflicts = append(conflicts, fn)
+		}
+	}
+	sort.Strings(conflicts)
+	return toApply, conflicts, nil
+}
+
+// applyFiles writes the versions of files in a commit to the working tree,
+// or removes them if the commit doesn't have them, and stages them. Returns
+// the number of site files changed.
+func applyFiles(wt *git.Worktree, from *object.Commit, files []string) (int, error) {
+	changed := 0
+	for _, fn := range files {
+		full := filepath.Join(conf.Path, filepath.FromSlash(fn))
+		f, err := from.File(fn)
+		if err == object.ErrFileNotFound {
+			if _, err := wt.Remove(fn); err != nil {
+				return 0, fmt.Errorf("cdb: Removing %s: %v", fn, err)
+			}
+		} else if err != nil {
+			return 0, fmt.Errorf("cdb: Reading %s: %v", fn, err)
+		} else {
+			contents, err := f.Contents()
+			if err != nil {
+				return 0, fmt.Errorf("cdb: Reading %s: %v", fn, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				return 0, fmt.Errorf("cdb: %v", err)
+			}
+			if err := ioutil.WriteFile(full, []byte(contents), 0644); err != nil {
+				return 0, fmt.Errorf("cdb: Writing %s: %v", fn, err)
+			}
+			if _, err := wt.Add(fn); err != nil {
+				return 0, fmt.Errorf("cdb: Staging %s: %v", fn, err)
+			}
+		}
+		if isSiteFileName(filepath.Base(fn)) && strings.HasPrefix(fn, "sites/") {
+			changed++
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,75 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/audit"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+)
+
+// The remote pulled from and pushed to if cdb.remote isn't set
+const defaultRemote = "origin"
+
+// remoteName returns the name of the remote the cdb is pulled from and pushed
+// to, cdb.remote
+func remoteName() string {
+	if conf.Remote == "" {
+		return defaultRemote
+	}
+	return conf.Remote
+}
+
+// RemotePush is the outcome of pushing to one of cdb.push_remotes
+type RemotePush struct {
+	Remote string `json:"remote"`
+	// Why the push failed, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// pushMirrors pushes refSpecs to each of cdb.push_remotes, once they have
+// been pushed to the primary remote. Each is the name of a remote of the
+// cdb checkout, or a URL. A failure is logged but doesn't fail the command,
+// as the change has already been made on the primary remote, and is returned
+// with the other outcomes so it can be reported.
+func pushMirrors(ctx context.Context, repo *git.Repository, refSpecs []gitconfig.RefSpec, what string) []RemotePush {
+	var results []RemotePush
+	for _, name := range conf.PushRemotes {
+		log.Infof("cdb: Pushing %s to %s", what, name)
+		err := pushMirror(ctx, repo, name, refSpecs)
+		if err != nil {
+			log.Warnf("cdb: Pushing %s to %s: %v", what, name, err)
+			results = append(results, RemotePush{Remote: name, Error: err.Error()})
+			continue
+		}
+		audit.Record(audit.Event{
+			Action: audit.ActionPush,
+			Detail: fmt.Sprintf("%s to %s", what, name),
+		})
+		results = append(results, RemotePush{Remote: name})
+	}
+	return results
+}
+
+func pushMirror(ctx context.Context, repo *git.Repository, name string, refSpecs []gitconfig.RefSpec) error {
+	var r *git.Remote
+	if strings.ContainsAny(name, ":/") {
+		r = git.NewRemote(repo.Storer, &gitconfig.RemoteConfig{Name: name, URLs: []string{name}})
+	} else {
+		var err error
+		if r, err = repo.Remote(name); err != nil {
+			return fmt.Errorf("remote %s: %v", name, err)
+		}
+	}
+	return gitRetryPolicy().Do(ctx, "cdb push "+name, func(ctx context.Context) error {
+		err := r.PushContext(ctx, &git.PushOptions{RemoteName: name, RefSpecs: refSpecs, Auth: auth()})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+}
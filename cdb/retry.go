@@ -0,0 +1,34 @@
+package cdb
+
+import (
+	"errors"
+
+	"github.com/icunion/pugo/retry"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// Errors from the remote which retrying won't fix
+var permanentGitErrors = []error{
+	git.ErrForceNeeded,
+	git.ErrNonFastForwardUpdate,
+	git.ErrDeleteRefNotSupported,
+	transport.ErrRepositoryNotFound,
+	transport.ErrEmptyRemoteRepository,
+	transport.ErrAuthenticationRequired,
+	transport.ErrAuthorizationFailed,
+	transport.ErrInvalidAuthMethod,
+}
+
+// gitRetryPolicy returns the policy for pulling from and pushing to origin
+func gitRetryPolicy() *retry.Policy {
+	return retry.PolicyFor(retry.Git, func(err error) bool {
+		for _, permanent := range permanentGitErrors {
+			if errors.Is(err, permanent) {
+				return false
+			}
+		}
+		return true
+	})
+}
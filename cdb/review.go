@@ -0,0 +1,208 @@
+package cdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/hooks"
+	"github.com/icunion/pugo/review"
+	"github.com/icunion/pugo/tracing"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// stackOnOpenReview moves the changes staged in wt onto the newest branch
+// pugo proposed for review whose request is still open, if any, so they are
+// committed on top of it. Every change appends to the ledger and updates the
+// integrity manifest, so requests cut from the cdb branch while another is
+// open would always conflict with it. If there's no open request, or the
+// changes can't be moved onto it, they are committed on the cdb branch as
+// usual. Returns the worktree to commit them with.
+func stackOnOpenReview(ctx context.Context, wt *git.Worktree, opts *CommitSitesOptions) (*git.Worktree, error) {
+	branches, err := review.OpenBranches(ctx, &conf.Review, conf.Branch, conf.Review.BranchPrefix)
+	if err != nil {
+		log.Warnf("cdb: Unable to find open requests to stack on, the request may conflict with them: %v", err)
+		return wt, nil
+	}
+	if len(branches) == 0 {
+		return wt, nil
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchOrigin(ctx, repo); err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+
+	// Requests stacked on each other each contain those before, so the
+	// newest contains them all
+	var onto *object.Commit
+	var ontoBranch string
+	for _, branch := range branches {
+		ref, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName(), branch), true)
+		if err != nil {
+			log.Debugf("cdb: Not stacking on %s: %v", branch, err)
+			continue
+		}
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil || commit.Hash == headCommit.Hash {
+			continue
+		}
+		if ok, err := headCommit.IsAncestor(commit); err != nil || !ok {
+			log.Debugf("cdb: Not stacking on %s, it isn't based on %s", branch, conf.Branch)
+			continue
+		}
+		if onto == nil || commit.Committer.When.After(onto.Committer.When) {
+			onto, ontoBranch = commit, branch
+		}
+	}
+	if onto == nil {
+		return wt, nil
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("cdb: %v", err)
+	}
+	var files []string
+	for fn, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			files = append(files, fn)
+		}
+	}
+	if wt, err = repo.Worktree(); err != nil {
+		return nil, fmt.Errorf("cdb: Opening worktree: %v", err)
+	}
+	where := remoteName() + "/" + ontoBranch
+	if err := moveOnto(wt, headCommit, onto, files, "changes", where); err != nil {
+		if errors.Is(err, ErrRemoteMoved) {
+			log.Warnf("cdb: Not stacking on %s, the request may conflict with it: %v", where, err)
+			return wt, nil
+		}
+		return nil, err
+	}
+	opts.reviewBase = headCommit.Hash
+	opts.reviewStackedOn = ontoBranch
+	return wt, nil
+}
+
+// pushForReview moves the commit just made on the cdb branch to a new
+// branch, pushes it to origin, and opens a pull or merge request for it into
+// the cdb branch. The cdb branch is reset to where it was, so the change only
+// reaches it once the request is merged. Sites already loaded keep the
+// changes, as they are what the rest of the run reports on.
+func pushForReview(ctx context.Context, opts *CommitSitesOptions, result *CommitSitesResult, message string) (err error) {
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(result.Commit))
+	if err != nil {
+		return fmt.Errorf("cdb: Reading commit %s: %v", result.Commit, err)
+	}
+	if commit.NumParents() == 0 {
+		return fmt.Errorf("cdb: Can't propose %s for review as it has no parent", result.Commit)
+	}
+
+	branch := reviewBranchName(opts)
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), commit.Hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return fmt.Errorf("cdb: Creating branch %s: %v", branch, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("cdb: Opening worktree: %v", err)
+	}
+	base := commit.ParentHashes[0]
+	if !opts.reviewBase.IsZero() {
+		base = opts.reviewBase
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: base, Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("cdb: Resetting %s: %v", conf.Branch, err)
+	}
+	result.ReviewBranch = branch
+	if opts.reviewStackedOn != "" {
+		log.Infof("cdb: Committed to %s for review, on top of %s", branch, opts.reviewStackedOn)
+	} else {
+		log.Infof("cdb: Committed to %s for review", branch)
+	}
+
+	if opts.NoPush {
+		log.Debugf("cdb: NoPush enabled, not pushing %s", branch)
+		return nil
+	}
+
+	log.Infof("cdb: Pushing to %s/%s", remoteName(), branch)
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch))
+	_, pushSpan := tracing.Start(ctx, "cdb.push")
+	err = gitRetryPolicy().Do(ctx, "cdb push", func(ctx context.Context) error {
+		err := repo.PushContext(ctx, &git.PushOptions{RemoteName: remoteName(), RefSpecs: []gitconfig.RefSpec{refSpec}, Auth: auth()})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+	tracing.End(pushSpan, &err)
+	if err != nil {
+		return fmt.Errorf("cdb: Pushing to %s/%s: %v", remoteName(), branch, err)
+	}
+	result.Pushed = true
+	audit.Record(audit.Event{
+		Action: audit.ActionPush,
+		Detail: fmt.Sprintf("%s to %s/%s", result.Commit, remoteName(), branch),
+	})
+
+	err = hooks.Run(ctx, hooks.PostPush, map[string]interface{}{
+		"message": opts.Message,
+		"commit":  result.Commit,
+		"branch":  branch,
+	})
+	if err != nil {
+		log.Warnf("cdb: %v", err)
+	}
+
+	description := message
+	if opts.reviewStackedOn != "" {
+		description += fmt.Sprintf("\n\nThis is stacked on %s, which was awaiting review, so includes its changes. Merge that first.", opts.reviewStackedOn)
+	}
+	url, err := review.Open(ctx, &conf.Review, &review.Request{
+		Title:       strings.SplitN(message, "\n", 2)[0],
+		Description: description,
+		Branch:      branch,
+		Base:        conf.Branch,
+	})
+	if err != nil {
+		return fmt.Errorf("cdb: %v. %s has been pushed, so a request can be opened for it by hand", err, branch)
+	}
+	result.ReviewURL = url
+	log.Infof("cdb: Opened %s to merge %s into %s", url, branch, conf.Branch)
+	return nil
+}
+
+// reviewBranchName returns the name of a new branch to commit to for review,
+// e.g. pugo/sync-20240601-093000
+func reviewBranchName(opts *CommitSitesOptions) string {
+	cmd := strings.ReplaceAll(opts.Cmd, " ", "-")
+	if cmd == "" {
+		cmd = "changes"
+	}
+	return conf.Review.BranchPrefix + cmd + "-" + time.Now().Format("20060102-150405")
+}
@@ -0,0 +1,122 @@
+package cdb
+
+import (
+	"reflect"
+	"strings"
+)
+
+// JSONSchema is the subset of JSON Schema (draft 2020-12) used to describe
+// site files. AdditionalProperties is either false, or the schema of
+// properties not listed in Properties.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	PropertyNames        *JSONSchema            `json:"propertyNames,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	UniqueItems          bool                   `json:"uniqueItems,omitempty"`
+	AnyOf                []*JSONSchema          `json:"anyOf,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinLength            int                    `json:"minLength,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+}
+
+// Descriptions of site fields, shown by editors. Fields without a
+// description are described by their name alone.
+var fieldDescriptions = map[string]string{
+	"id":              "The site's website id in eActivities. Must be unique.",
+	"full-name":       "The name of the Club, Society, or Project the site belongs to.",
+	"email":           "Contact email address for the site.",
+	"display-email":   "Email address shown publicly instead of email.",
+	"admins":          "Logins of the site's admins. Managed by pugo from eActivities.",
+	"aliases":         "Former names of the site, which pugo commands also accept.",
+	"expiry":          "Date the site expires (YYYY-MM-DD), or empty for no expiry.",
+	"disabled":        "Whether the site is disabled.",
+	"disabled_reason": "Why the site is disabled.",
+	"php":             "Whether PHP is enabled, or the PHP version to use.",
+	"env":             "Environment variables set for the site's PHP-FPM pool or Passenger app.",
+	"quota":           "Disk quota for the site's docroot in MiB, or 0 for no quota.",
+	"protected":       "Whether the site is protected from automated and bulk changes.",
+	"csp-code":        "Short code of the CSP owning the site in eActivities, recorded by pugo sync metadata.",
+	"committee":       "Name of the CSP owning the site in eActivities, recorded by pugo sync metadata.",
+	"ocid":            "OC id of the CSP owning the site in eActivities, recorded by pugo sync metadata.",
+	"last-modified":   "The pugo command and run which last saved the site. Written by pugo.",
+}
+
+// Schema returns a JSON Schema describing site files. Field types and which
+// fields are required are derived from Site, with additional rules matching
+// the validation pugo applies. phpVersions are the versions sites may use.
+func Schema(phpVersions []string) *JSONSchema {
+	schema := &JSONSchema{
+		Schema:               "https://json-schema.org/draft/2020-12/schema",
+		Title:                "icu-cdb site",
+		Description:          "A site file in the sites directory of icu-cdb, as read and written by pugo.",
+		Type:                 "object",
+		Properties:           make(map[string]*JSONSchema),
+		AdditionalProperties: false,
+	}
+
+	t := reflect.TypeOf(Site{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := fieldName(f)
+		if name == "" {
+			continue
+		}
+		property := kindSchema(f.Type)
+		property.Description = fieldDescriptions[name]
+		schema.Properties[name] = property
+
+		// Fields without omitempty are always written
+		if !strings.Contains(f.Tag.Get("yaml"), "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	zero, one := 0, 1
+	schema.Properties["id"].Minimum = &one
+	schema.Properties["quota"].Minimum = &zero
+	schema.Properties["full-name"].MinLength = 1
+	schema.Properties["email"].Format = "email"
+	schema.Properties["display-email"].Format = "email"
+	schema.Properties["admins"].UniqueItems = true
+	schema.Properties["immortal-admins"].UniqueItems = true
+	schema.Properties["aliases"].UniqueItems = true
+	schema.Properties["expiry"].Pattern = `^([0-9]{4}-[0-9]{2}-[0-9]{2})?$`
+	schema.Properties["env"].PropertyNames = &JSONSchema{Pattern: EnvNamePattern}
+	schema.Properties["php"].AnyOf = []*JSONSchema{
+		{Type: "boolean"},
+		{Type: "string", Enum: phpVersions},
+	}
+
+	return schema
+}
+
+// kindSchema returns the schema for values of type t
+func kindSchema(t reflect.Type) *JSONSchema {
+	switch t.Kind() {
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Slice:
+		s := &JSONSchema{Type: "array"}
+		if t.Elem().Kind() != reflect.Interface {
+			s.Items = kindSchema(t.Elem())
+		}
+		return s
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: kindSchema(t.Elem())}
+	default:
+		// Free-form, e.g. php
+		return &JSONSchema{}
+	}
+}
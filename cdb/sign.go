@@ -0,0 +1,69 @@
+package cdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// The signing key, once read and decrypted
+var cachedSigningKey *openpgp.Entity
+
+// signingKey returns the GPG key commits are signed with, read from
+// cdb.signing_key and decrypted with cdb.signing_passphrase if it is
+// protected by one. Returns nil if commits aren't signed. Commands check it
+// before changing the working tree, so a missing key or wrong passphrase
+// leaves it clean.
+func signingKey() (*openpgp.Entity, error) {
+	if conf.SigningKey == "" || cachedSigningKey != nil {
+		return cachedSigningKey, nil
+	}
+	data, err := ioutil.ReadFile(conf.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading signing key: %v", err)
+	}
+
+	// The key may be exported with or without --armor
+	var r io.Reader = bytes.NewReader(data)
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		r = block.Body
+	}
+	keyring, err := openpgp.ReadKeyRing(r)
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading signing key %s: %v", conf.SigningKey, err)
+	}
+
+	var key *openpgp.Entity
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil {
+			key = entity
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("cdb: Signing key %s contains no private key, export it with gpg --export-secret-keys", conf.SigningKey)
+	}
+
+	if key.PrivateKey.Encrypted {
+		if conf.SigningPassphrase == "" {
+			return nil, fmt.Errorf("cdb: Signing key %s is protected by a passphrase, but cdb.signing_passphrase isn't set", conf.SigningKey)
+		}
+		passphrase := []byte(conf.SigningPassphrase)
+		if err := key.PrivateKey.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("cdb: Decrypting signing key %s: %v", conf.SigningKey, err)
+		}
+		for _, subkey := range key.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+					return nil, fmt.Errorf("cdb: Decrypting signing subkey of %s: %v", conf.SigningKey, err)
+				}
+			}
+		}
+	}
+	cachedSigningKey = key
+	return key, nil
+}
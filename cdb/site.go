@@ -1,18 +1,34 @@
 package cdb
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
 
+// ExpiryFormat is the layout of site expiry dates, YYYY-MM-DD
+const ExpiryFormat = "2006-01-02"
+
+// Provenance records the pugo run which last saved a site, for people
+// browsing the cdb. It is only written if cdb.provenance is set.
+type Provenance struct {
+	// The command run, e.g. pugo sync
+	By  string    `yaml:"by" json:"by"`
+	Run string    `yaml:"run,omitempty" json:"run,omitempty"`
+	At  time.Time `yaml:"at" json:"at"`
+}
+
 type Site struct {
 	Id             int
 	FullName       string `yaml:"full-name"`
@@ -22,47 +38,126 @@ type Site struct {
 	ImmortalAdmins []string `yaml:"immortal-admins,omitempty"`
 	Expiry         string
 	Paths          []string
+	Aliases        []string      `yaml:"aliases,omitempty"`
 	Domains        []interface{} `yaml:"domains,omitempty"`
 	Disabled       bool `yaml:"disabled,omitempty"`
 	DisabledReason string `yaml:"disabled_reason,omitempty"`
 	Php            interface{} `yaml:"php,omitempty"`
 	Passenger      bool `yaml:"passenger,omitempty"`
 	Subpaths       bool `yaml:"subpaths,omitempty"`
+	Env            map[string]string `yaml:"env,omitempty"`
+	Quota          int `yaml:"quota,omitempty"`
+	Protected      bool `yaml:"protected,omitempty"`
+	CSPCode        string `yaml:"csp-code,omitempty"`
+	Committee      string `yaml:"committee,omitempty"`
+	OCId           int `yaml:"ocid,omitempty"`
+	Provenance     *Provenance `yaml:"last-modified,omitempty"`
 	name           string
 	mu             sync.Mutex
 	changed        bool
+	// The defaults applied when the site was loaded, and the fields its
+	// file set itself
+	defaults *siteDefaults
+	explicit map[string]bool
+	// Whether the site was protected when loaded, so removing protection
+	// is itself a change to a protected site
+	protected bool
 }
 
+// NewSite creates a site with the configured defaults (cdb.defaults) for
+// fields which site files may leave unset
 func NewSite() *Site {
 	site := Site{}
-	site.Disabled = false
-	site.Php = true
-	site.Passenger = false
+	site.Disabled = conf.Defaults.Disabled
+	site.Php = conf.Defaults.PhpValue()
+	site.Passenger = conf.Defaults.Passenger
+	site.Subpaths = conf.Defaults.Subpaths
 	site.changed = false
 	return &site
 }
 
+// NewNamedSite creates a new site with the given name, which determines the
+// name of its file
+func NewNamedSite(name string) *Site {
+	site := NewSite()
+	site.name = name
+	return site
+}
+
 func LoadSite(siteFileName string) (*Site, error) {
 	// Ensure file under consideration is a YAML file, skip if not
-	_, fn := path.Split(siteFileName)
-	if path.Ext(fn) != ".yaml" {
+	fn := filepath.Base(siteFileName)
+	if filepath.Ext(fn) != ".yaml" {
 		return nil, fmt.Errorf("cdb: %s not a YAML file", siteFileName)
 	}
+	if !isSiteFileName(fn) {
+		return nil, fmt.Errorf("cdb: %s not a site file", siteFileName)
+	}
 
-	site := NewSite()
-	site.name = strings.TrimSuffix(fn, path.Ext(fn))
-	yamlData, err := ioutil.ReadFile(path.Join(viper.GetString("cdb.path"), "sites", fn))
+	yamlData, err := ioutil.ReadFile(filepath.Join(conf.Path, "sites", fn))
 	if err != nil {
 		return nil, fmt.Errorf("cdb: Reading %s: %v", siteFileName, err)
 	}
+	if err := verifyManifest(fn, yamlData); err != nil {
+		return nil, err
+	}
+	defaults, err := loadDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSite(fn, yamlData, defaults, conf.Strict)
+}
+
+// parseSite creates a site from the YAML content of its file, applying
+// defaults, if not nil, for fields the file doesn't set. If strict is set
+// fields which don't exist are an error.
+func parseSite(siteFileName string, yamlData []byte, defaults *siteDefaults, strict bool) (*Site, error) {
+	fn := filepath.Base(siteFileName)
+	site := NewSite()
+	site.name = strings.TrimSuffix(fn, filepath.Ext(fn))
 
-	if err = yaml.Unmarshal(yamlData, site); err != nil {
+	explicit, err := topLevelKeys(yamlData)
+	if err != nil {
 		return nil, fmt.Errorf("cdb: Unmarshalling %s: %v", siteFileName, err)
 	}
+	site.explicit = explicit
+
+	if defaults != nil {
+		// Checked when the defaults were loaded
+		yaml.Unmarshal(defaults.yamlData, site)
+		site.defaults = defaults
+
+		// Maps would otherwise be merged with the default rather than
+		// replacing it
+		for key := range explicit {
+			if _, ok := defaults.fields[key]; ok {
+				if v, err := site.field(key); err == nil {
+					v.Set(reflect.Zero(v.Type()))
+				}
+			}
+		}
+	}
+	if err := unmarshalSite(yamlData, site, strict); err != nil {
+		return nil, fmt.Errorf("cdb: Unmarshalling %s: %v", siteFileName, err)
+	}
+	site.protected = site.Protected
 
 	return site, nil
 }
 
+// unmarshalSite decodes YAML into a site. If strict is set fields which
+// don't exist, e.g. misspelt ones, are an error rather than being ignored
+// and lost when the site is next saved.
+func unmarshalSite(yamlData []byte, site *Site, strict bool) error {
+	dec := yaml.NewDecoder(bytes.NewReader(yamlData))
+	dec.KnownFields(strict)
+	if err := dec.Decode(site); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
 func (s *Site) Changed() bool {
 	return s.changed
 }
@@ -75,10 +170,63 @@ func (s *Site) Name() string {
 	return s.name
 }
 
+// HasAlias reports whether the site was formerly known by name
+func (s *Site) HasAlias(name string) bool {
+	for _, alias := range s.Aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpiryTime returns the date the site expires, or the zero time if it has
+// no expiry. Returns an error if the expiry isn't a date in ExpiryFormat.
+func (s *Site) ExpiryTime() (time.Time, error) {
+	if s.Expiry == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(ExpiryFormat, s.Expiry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cdb: %s has invalid expiry date '%s'", s.name, s.Expiry)
+	}
+	return t, nil
+}
+
+// Expired reports whether the site's expiry date has passed. A site remains
+// valid on its expiry date, and sites without a valid expiry never expire.
+func (s *Site) Expired() bool {
+	t, err := s.ExpiryTime()
+	if err != nil || t.IsZero() {
+		return false
+	}
+	today, _ := time.Parse(ExpiryFormat, time.Now().Format(ExpiryFormat))
+	return t.Before(today)
+}
+
+// DomainNames returns the site's external domains. Domains are either
+// listed as names, or as mappings with the name under domain.
+func (s *Site) DomainNames() []string {
+	var names []string
+	for _, d := range s.Domains {
+		switch d := d.(type) {
+		case string:
+			names = append(names, d)
+		case map[string]interface{}:
+			if name, ok := d["domain"].(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
 func (s *Site) FileName() string {
-	return path.Join(viper.GetString("cdb.path"), "sites", s.name+".yaml")
+	return filepath.Join(conf.Path, "sites", s.name+".yaml")
 }
 
+// FileNameRepo returns the site's file name relative to the root of the
+// repo. Unlike FileName it always uses forward slashes, as git does.
 func (s *Site) FileNameRepo() string {
 	return path.Join("sites", s.name+".yaml")
 }
@@ -89,6 +237,7 @@ func (s *Site) AddAdmin(username string) {
 		"username": username,
 	}).Debug("cdb: AddAdmin start")
 
+	username = NormalizeLogin(username)
 	// Don't attempt to add an empty username
 	if username == "" {
 		return
@@ -97,12 +246,14 @@ func (s *Site) AddAdmin(username string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	for _, admin := range s.Admins {
+		if NormalizeLogin(admin) == username {
+			// Username already exists in admins, nothing to do
+			return
+		}
+	}
 	sort.Strings(s.Admins)
 	pos := sort.SearchStrings(s.Admins, username)
-	if pos < len(s.Admins) && s.Admins[pos] == username {
-		// Username already exists in admins, nothing to do
-		return
-	}
 	if pos == len(s.Admins) {
 		s.Admins = append(s.Admins, username)
 	} else {
@@ -124,6 +275,7 @@ func (s *Site) RemoveAdmin(username string) {
 		"username": username,
 	}).Debug("cdb: RemoveAdmin")
 
+	username = NormalizeLogin(username)
 	// Don't attempt to remove an empty username
 	if username == "" {
 		return
@@ -132,14 +284,19 @@ func (s *Site) RemoveAdmin(username string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sort.Strings(s.Admins)
-	pos := sort.SearchStrings(s.Admins, username)
-	if pos < len(s.Admins) && s.Admins[pos] == username {
-		if pos < len(s.Admins)-1 {
-			copy(s.Admins[pos:], s.Admins[pos+1:])
+	// Remove every entry for the username, including ones written before
+	// the current normalization applied
+	kept := s.Admins[:0]
+	for _, admin := range s.Admins {
+		if NormalizeLogin(admin) != username {
+			kept = append(kept, admin)
+		}
+	}
+	if len(kept) < len(s.Admins) {
+		for i := len(kept); i < len(s.Admins); i++ {
+			s.Admins[i] = ""
 		}
-		s.Admins[len(s.Admins)-1] = ""
-		s.Admins = s.Admins[:len(s.Admins)-1]
+		s.Admins = kept
 		log.WithFields(log.Fields{
 			"s.Admins": s.Admins,
 		}).Debug("cdb: RemoveAdmin after change")
@@ -149,11 +306,78 @@ func (s *Site) RemoveAdmin(username string) {
 	return
 }
 
+// RemoveAdminResult is the outcome of RemoveAdminChecked
+type RemoveAdminResult int
+
+const (
+	AdminRemoved RemoveAdminResult = iota
+	// The login wasn't one of the site's admins
+	AdminNotFound
+	// The login is one of the site's immortal admins, so wasn't removed
+	AdminImmortal
+)
+
+func (r RemoveAdminResult) String() string {
+	switch r {
+	case AdminRemoved:
+		return "removed"
+	case AdminNotFound:
+		return "not an admin"
+	case AdminImmortal:
+		return "immortal admin"
+	}
+	return fmt.Sprintf("RemoveAdminResult(%d)", int(r))
+}
+
+// HasAdmin reports whether username is listed in the site's admins. Immortal
+// admins are only included if they are also listed in admins.
+func (s *Site) HasAdmin(username string) bool {
+	username = NormalizeLogin(username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, admin := range s.Admins {
+		if NormalizeLogin(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// IsImmortal reports whether username is one of the site's immortal admins,
+// who keep access regardless of eActivities
+func (s *Site) IsImmortal(username string) bool {
+	username = NormalizeLogin(username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, admin := range s.ImmortalAdmins {
+		if NormalizeLogin(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveAdminChecked removes username from the site's admins as RemoveAdmin
+// does, but refuses to remove an immortal admin, leaving the site unchanged
+// and returning AdminImmortal for the caller to report
+func (s *Site) RemoveAdminChecked(username string) RemoveAdminResult {
+	if s.IsImmortal(username) {
+		return AdminImmortal
+	}
+	if !s.HasAdmin(username) {
+		return AdminNotFound
+	}
+	s.RemoveAdmin(username)
+	return AdminRemoved
+}
+
 func (s *Site) Save() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	yamlData, err := yaml.Marshal(s)
+	yamlData, err := s.marshal()
 	if err != nil {
 		return fmt.Errorf("cdb: Unable to marshall %s: %v", s.name, err)
 	}
@@ -0,0 +1,240 @@
+package cdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/webhooks"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Changes staged with NoCommit are recorded in the repo's git directory, so
+// later commands can stage more on top of them and CommitStaged can commit
+// them all together
+const stagedFileName = "pugo-staged.json"
+
+// ErrChangesStaged is returned when changes staged with NoCommit are pending
+// and a command would otherwise commit them under its own message
+var ErrChangesStaged = errors.New("cdb: Changes staged with --no-commit are pending, commit them with pugo commit first")
+
+// ErrNothingStaged is returned by CommitStaged when there are no staged
+// changes
+var ErrNothingStaged = errors.New("cdb: No changes staged with --no-commit")
+
+// StagedChanges describes the changes staged by commands run with NoCommit
+type StagedChanges struct {
+	// The commit the changes were staged on
+	Base string `json:"base"`
+	// The message of each command which staged changes
+	Messages []string `json:"messages"`
+	// The files staged, relative to the root of the cdb
+	Files []string `json:"files"`
+	// The changes to each site, recorded in the audit log once committed
+	Changes map[string][]FieldChange `json:"changes"`
+}
+
+// Sites returns the names of the sites changed, sorted
+func (s *StagedChanges) Sites() []string {
+	names := make([]string, 0, len(s.Changes))
+	for name := range s.Changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stagedPath() string {
+	return filepath.Join(gitDir(), stagedFileName)
+}
+
+// GetStagedChanges returns the changes staged with NoCommit, or nil if there
+// are none
+func GetStagedChanges() (*StagedChanges, error) {
+	if conf.Path == "" {
+		return nil, ErrPathNotConfigured
+	}
+	data, err := ioutil.ReadFile(stagedPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Reading staged changes: %v", err)
+	}
+	staged := &StagedChanges{}
+	if err := json.Unmarshal(data, staged); err != nil {
+		return nil, fmt.Errorf("cdb: Reading staged changes: %v", err)
+	}
+	return staged, nil
+}
+
+func writeStagedChanges(staged *StagedChanges) error {
+	data, err := json.MarshalIndent(staged, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cdb: Marshalling staged changes: %v", err)
+	}
+	if err := ioutil.WriteFile(stagedPath(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cdb: Recording staged changes: %v", err)
+	}
+	return nil
+}
+
+func removeStagedChanges() error {
+	if err := os.Remove(stagedPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cdb: Removing staged changes: %v", err)
+	}
+	return nil
+}
+
+// recordStaged adds the changes just staged by a command run with NoCommit
+// to those already recorded
+func recordStaged(repo *git.Repository, wt *git.Worktree, message string, pending map[string][]FieldChange) error {
+	staged, err := GetStagedChanges()
+	if err != nil {
+		return err
+	}
+	if staged == nil {
+		h, err := repo.Head()
+		if err != nil {
+			return fmt.Errorf("cdb: %v", err)
+		}
+		staged = &StagedChanges{Base: h.Hash().String(), Changes: make(map[string][]FieldChange)}
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("cdb: %v", err)
+	}
+	staged.Files = staged.Files[:0]
+	for fn, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			staged.Files = append(staged.Files, fn)
+		}
+	}
+	sort.Strings(staged.Files)
+	staged.Messages = append(staged.Messages, message)
+	for name, changes := range pending {
+		staged.Changes[name] = append(staged.Changes[name], changes...)
+	}
+	return writeStagedChanges(staged)
+}
+
+// checkOnlyStaged checks that the only changes in the working tree are those
+// staged with NoCommit
+func checkOnlyStaged(wt *git.Worktree, staged *StagedChanges) error {
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("cdb: %v", err)
+	}
+	isStaged := make(map[string]bool)
+	for _, fn := range staged.Files {
+		isStaged[fn] = true
+	}
+	for fn, s := range status {
+		if s.Worktree != git.Unmodified || (s.Staging != git.Unmodified && !isStaged[fn]) {
+			return fmt.Errorf("cdb: Working tree has changes to %s besides those staged with --no-commit", fn)
+		}
+	}
+	return nil
+}
+
+// CommitStagedOptions are the options for committing staged changes
+type CommitStagedOptions struct {
+	// The commit message snippet. If empty, the messages of the commands
+	// which staged the changes are used
+	Message string
+	DryRun  bool
+	NoPush  bool
+}
+
+// CommitStaged commits the changes staged by commands run with NoCommit as
+// a single commit, and pushes it to origin. If origin has moved on since the
+// changes were staged, they are moved onto it first, unless it changed the
+// same files.
+func CommitStaged(ctx context.Context, opts *CommitStagedOptions) (result *CommitSitesResult, err error) {
+	result = &CommitSitesResult{}
+
+	staged, err := GetStagedChanges()
+	if err != nil {
+		return result, err
+	}
+	if staged == nil {
+		return result, ErrNothingStaged
+	}
+	repo, err := openRepo()
+	if err != nil {
+		return result, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return result, fmt.Errorf("cdb: Opening worktree: %v", err)
+	}
+	if err := checkOnlyStaged(wt, staged); err != nil {
+		return result, err
+	}
+
+	message := opts.Message
+	if message == "" {
+		message = strings.Join(staged.Messages, "; ")
+	}
+	result.SitesChanged = len(staged.Changes)
+	if opts.DryRun {
+		log.Infof("cdb: Dry run, not committing %d staged changes to %d sites: %s", len(staged.Messages), result.SitesChanged, message)
+		return result, nil
+	}
+
+	if err := catchUpStaged(ctx, repo, wt, staged); err != nil {
+		return result, err
+	}
+
+	commitOpts := &CommitSitesOptions{
+		Message: message,
+		Cmd:     "commit",
+		NoPush:  opts.NoPush,
+	}
+	var events []webhooks.Event
+	err = commitAndPush(ctx, wt, commitOpts, result.SitesChanged, result, func(hash string, message string) {
+		auditCommit(staged.Changes, hash, message)
+		events = commitEvents(staged.Changes, hash, message)
+		if err := removeStagedChanges(); err != nil {
+			log.Warn(err)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+	sendEvents(ctx, events, result)
+	return result, nil
+}
+
+// catchUpStaged fetches origin and, if it has moved on from the commit the
+// changes were staged on, resets to it and stages the changes again. Fails
+// if origin changed any of the staged files.
+func catchUpStaged(ctx context.Context, repo *git.Repository, wt *git.Worktree, staged *StagedChanges) error {
+	remote, err := catchUp(ctx, repo, wt, staged.Files, "staged changes")
+	if err != nil || remote.String() == staged.Base {
+		return err
+	}
+	staged.Base = remote.String()
+	return writeStagedChanges(staged)
+}
+
+// fileHash returns the hash of a file in a commit, or the zero hash if it
+// doesn't exist
+func fileHash(commit *object.Commit, fn string) (plumbing.Hash, error) {
+	f, err := commit.File(fn)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return f.Hash, nil
+}
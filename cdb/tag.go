@@ -0,0 +1,82 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/icunion/pugo/audit"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+type TagOptions struct {
+	// The name of the tag
+	Name string
+	// The tag message
+	Message string
+	// If set perform dry run only
+	DryRun bool
+	// If set create the tag but don't push it to origin
+	NoPush bool
+}
+
+// TagHead creates an annotated tag at HEAD of the cdb and pushes it to
+// origin
+func TagHead(ctx context.Context, opts *TagOptions) error {
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("cdb: Reading HEAD: %v", err)
+	}
+
+	if opts.DryRun {
+		log.Infof("cdb: Dry run, not creating tag %s at %s", opts.Name, head.Hash())
+		return nil
+	}
+
+	log.Infof("cdb: Creating tag %s at %s", opts.Name, head.Hash())
+	_, err = repo.CreateTag(opts.Name, head.Hash(), &git.CreateTagOptions{
+		Tagger: &object.Signature{
+			Name:  conf.Author.Name,
+			Email: conf.Author.Email,
+			When:  time.Now(),
+		},
+		Message: opts.Message,
+	})
+	if err != nil {
+		return fmt.Errorf("cdb: Creating tag %s: %v", opts.Name, err)
+	}
+
+	audit.Record(audit.Event{Action: audit.ActionTag, Detail: fmt.Sprintf("%s at %s", opts.Name, head.Hash())})
+
+	if opts.NoPush {
+		log.Debug("cdb: NoPush enabled, not pushing tag")
+		return nil
+	}
+	log.Infof("cdb: Pushing tag %s to %s", opts.Name, remoteName())
+	refSpec := config.RefSpec(fmt.Sprintf("refs/tags/%s:refs/tags/%s", opts.Name, opts.Name))
+	err = gitRetryPolicy().Do(ctx, "cdb tag push", func(ctx context.Context) error {
+		err := repo.PushContext(ctx, &git.PushOptions{
+			RemoteName: remoteName(),
+			RefSpecs:   []config.RefSpec{refSpec},
+			Auth:       auth(),
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cdb: Pushing tag %s: %v", opts.Name, err)
+	}
+	pushMirrors(ctx, repo, []config.RefSpec{refSpec}, "tag "+opts.Name)
+
+	return nil
+}
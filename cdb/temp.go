@@ -0,0 +1,178 @@
+package cdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// With cdb.bare set, pugo works against a bare clone of the cdb rather than
+// a persistent checkout. Each run checks the branch out into a temporary
+// directory, which is used in place of cdb.path until the run finishes and
+// it is removed. Commits are made in, and pushed from, the bare clone.
+// With cdb.ephemeral set, each run instead clones cdb.url into a temporary
+// directory, so nothing need be kept on the host between runs.
+var tempWorktree string
+
+// Whether tempWorktree is an ephemeral clone rather than a worktree of the
+// bare clone
+var tempClone bool
+
+// Fetching into a bare clone updates its branches directly, as a bare clone
+// made with git clone --bare has no remote-tracking branches
+var bareFetchRefSpec = config.RefSpec("+refs/heads/*:refs/heads/*")
+
+// OpenTemporaryWorktree checks out the configured branch into a temporary
+// directory, which is then used as the cdb path: with cdb.ephemeral, by
+// cloning cdb.url, or with cdb.bare, from the bare clone after fetching it
+// from origin. It does nothing unless one is set, or if the worktree is
+// already open. The worktree is removed by RemoveTemporaryWorktree.
+func OpenTemporaryWorktree(ctx context.Context) error {
+	if tempWorktree != "" {
+		return nil
+	}
+	if conf.Ephemeral {
+		return cloneEphemeral(ctx)
+	}
+	if conf.Bare == "" {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "pugo-cdb-")
+	if err != nil {
+		return fmt.Errorf("cdb: Creating temporary worktree: %v", err)
+	}
+	repo, err := openBare(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// Without origin, run against the branch as last fetched. Commands
+	// which change the cdb still fail when they pull
+	err = gitRetryPolicy().Do(ctx, "cdb fetch", func(ctx context.Context) error {
+		err := repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: remoteName(),
+			RefSpecs:   []config.RefSpec{bareFetchRefSpec},
+			Auth:       auth(),
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Warnf("cdb: Fetching into %s: %v. Using the branch as last fetched", conf.Bare, err)
+	}
+
+	branch := plumbing.NewBranchReferenceName(conf.Branch)
+	ref, err := repo.Reference(branch, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cdb: Branch '%s' in %s: %v", conf.Branch, conf.Bare, err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cdb: Checking out branch '%s': %v", conf.Branch, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cdb: Opening worktree: %v", err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset}); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cdb: Checking out branch '%s': %v", conf.Branch, err)
+	}
+
+	log.Debugf("cdb: Checked out %s from %s into %s", ref.Hash(), conf.Bare, dir)
+	tempWorktree = dir
+	conf.Path = dir
+	sitesCache = sitesCacheStruct{}
+	return nil
+}
+
+// cloneEphemeral clones the configured branch of cdb.url into a temporary
+// directory and uses it as the cdb path
+func cloneEphemeral(ctx context.Context) error {
+	dir, err := ioutil.TempDir("", "pugo-cdb-")
+	if err != nil {
+		return fmt.Errorf("cdb: Creating temporary clone: %v", err)
+	}
+
+	log.Infof("cdb: Cloning %s into %s", conf.URL, dir)
+	err = gitRetryPolicy().Do(ctx, "cdb clone", func(ctx context.Context) error {
+		// Start afresh after a failed attempt
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		_, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+			URL:           conf.URL,
+			RemoteName:    remoteName(),
+			Auth:          auth(),
+			ReferenceName: plumbing.NewBranchReferenceName(conf.Branch),
+			SingleBranch:  true,
+		})
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cdb: Cloning %s: %v", conf.URL, err)
+	}
+
+	tempWorktree = dir
+	tempClone = true
+	conf.Path = dir
+	sitesCache = sitesCacheStruct{}
+	return nil
+}
+
+// RemoveTemporaryWorktree removes the worktree or clone opened by
+// OpenTemporaryWorktree, if any
+func RemoveTemporaryWorktree() {
+	if tempWorktree == "" {
+		return
+	}
+	if err := os.RemoveAll(tempWorktree); err != nil {
+		log.Warnf("cdb: Removing temporary worktree: %v", err)
+	}
+	tempWorktree = ""
+	tempClone = false
+}
+
+// bareWorktree reports whether the cdb path is a temporary worktree of the
+// bare clone
+func bareWorktree() bool {
+	return tempWorktree != "" && !tempClone
+}
+
+// openBare opens the bare clone at cdb.bare with its worktree at dir
+func openBare(dir string) (*git.Repository, error) {
+	if _, err := os.Stat(conf.Bare); err != nil {
+		return nil, fmt.Errorf("cdb: Opening bare repo: %v", err)
+	}
+	storage := filesystem.NewStorage(osfs.New(conf.Bare), cache.NewObjectLRUDefault())
+	repo, err := git.Open(storage, osfs.New(dir))
+	if err != nil {
+		return nil, fmt.Errorf("cdb: Opening bare repo at %s: %v", conf.Bare, err)
+	}
+	return repo, nil
+}
+
+// gitDir returns the directory holding the cdb's git metadata
+func gitDir() string {
+	if bareWorktree() {
+		return conf.Bare
+	}
+	return filepath.Join(conf.Path, ".git")
+}
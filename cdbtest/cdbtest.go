@@ -0,0 +1,176 @@
+// Package cdbtest provides a throwaway cdb, backed by git repos in a
+// temporary directory, and fixture builders for sites and newerpol grants.
+// It lets tooling built on pugo's packages, and pugo's own integration tests,
+// exercise loading, changing, and committing sites without touching a
+// production cdb or newerpol, e.g.
+//
+//	repo := cdbtest.New(t,
+//		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123")),
+//	)
+//	site, _ := cdb.GetSiteByName("mysite")
+//	site.AddAdmin("cd456")
+//	cdb.CommitSites(ctx, &cdb.CommitSitesOptions{Message: "Add admin"})
+//	repo.Site(t, "mysite") // has both admins
+package cdbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/config"
+
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Repo is a cdb working tree with a bare repo as its origin, both in a
+// temporary directory removed when the test finishes
+type Repo struct {
+	// Path of the working tree
+	Path string
+	// Path of the bare repo used as origin
+	Origin string
+	// The configuration cdb is using for the repo
+	Config *config.Cdb
+
+	repo *git.Repository
+}
+
+// New creates a cdb containing sites, committed and pushed to origin, and
+// configures the cdb package to use it. The cdb package has a single
+// configuration, so tests using New must not run in parallel.
+func New(tb testing.TB, sites ...*cdb.Site) *Repo {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	r := &Repo{
+		Path:   filepath.Join(dir, "cdb"),
+		Origin: filepath.Join(dir, "origin.git"),
+		Config: &config.Cdb{
+			Branch:      "master",
+			Author:      config.Person{Name: "pugo", Email: "pugo@example.com"},
+			PhpVersions: []string{"7.4", "8.0", "8.1", "8.2", "8.3"},
+			Concurrency: 2,
+			Source:      "cdbtest",
+		},
+	}
+	r.Config.Path = r.Path
+
+	if _, err := git.PlainInit(r.Origin, true); err != nil {
+		tb.Fatalf("cdbtest: Creating origin: %v", err)
+	}
+	repo, err := git.PlainInit(r.Path, false)
+	if err != nil {
+		tb.Fatalf("cdbtest: Creating repo: %v", err)
+	}
+	r.repo = repo
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{r.Origin},
+	})
+	if err != nil {
+		tb.Fatalf("cdbtest: Adding origin: %v", err)
+	}
+
+	// Git doesn't track empty directories, so keep the sites directory
+	// with a placeholder in case there are no sites
+	if err := os.MkdirAll(filepath.Join(r.Path, "sites"), 0755); err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.Path, "sites", ".gitkeep"), nil, 0644); err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+
+	r.Write(tb, "Initial sites", sites...)
+	return r
+}
+
+// Write saves sites to the working tree, commits and pushes them as though
+// they had been changed by hand, and reconfigures the cdb package so that
+// sites are loaded afresh
+func (r *Repo) Write(tb testing.TB, message string, sites ...*cdb.Site) {
+	tb.Helper()
+
+	cdb.Configure(r.Config)
+	for _, site := range sites {
+		if err := site.Save(); err != nil {
+			tb.Fatalf("cdbtest: %v", err)
+		}
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		tb.Fatalf("cdbtest: Opening worktree: %v", err)
+	}
+	if _, err := wt.Add("sites"); err != nil {
+		tb.Fatalf("cdbtest: Staging sites: %v", err)
+	}
+	_, err = wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "cdbtest",
+			Email: "cdbtest@example.com",
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		tb.Fatalf("cdbtest: Committing: %v", err)
+	}
+	err = r.repo.Push(&git.PushOptions{RemoteName: "origin"})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		tb.Fatalf("cdbtest: Pushing: %v", err)
+	}
+
+	cdb.Configure(r.Config)
+}
+
+// Site reads a site from the working tree, ignoring any copy the cdb package
+// has loaded. It returns nil if the site doesn't exist.
+func (r *Repo) Site(tb testing.TB, name string) *cdb.Site {
+	tb.Helper()
+
+	if _, err := os.Stat(filepath.Join(r.Path, "sites", name+".yaml")); os.IsNotExist(err) {
+		return nil
+	}
+	site, err := cdb.LoadSite(name + ".yaml")
+	if err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+	return site
+}
+
+// Head returns the commit at the head of the working tree
+func (r *Repo) Head(tb testing.TB) *object.Commit {
+	tb.Helper()
+
+	ref, err := r.repo.Head()
+	if err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+	commit, err := r.repo.CommitObject(ref.Hash())
+	if err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+	return commit
+}
+
+// OriginHead returns the hash of the branch in origin, to check whether
+// commits have been pushed
+func (r *Repo) OriginHead(tb testing.TB) plumbing.Hash {
+	tb.Helper()
+
+	origin, err := git.PlainOpen(r.Origin)
+	if err != nil {
+		tb.Fatalf("cdbtest: Opening origin: %v", err)
+	}
+	ref, err := origin.Reference(plumbing.NewBranchReferenceName(r.Config.Branch), true)
+	if err != nil {
+		tb.Fatalf("cdbtest: %v", err)
+	}
+	return ref.Hash()
+}
@@ -0,0 +1,59 @@
+package cdbtest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/cdbtest"
+)
+
+// TestCommitSites runs the example in the package documentation: a site is
+// loaded from a throwaway cdb, changed, and committed and pushed to origin
+func TestCommitSites(t *testing.T) {
+	repo := cdbtest.New(t,
+		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123")),
+	)
+	initial := repo.Head(t)
+
+	site, err := cdb.GetSiteByName("mysite")
+	if err != nil {
+		t.Fatalf("GetSiteByName: %v", err)
+	}
+	if site == nil {
+		t.Fatal("GetSiteByName: mysite not found")
+	}
+	site.AddAdmin("cd456")
+	result, err := cdb.CommitSites(context.Background(), &cdb.CommitSitesOptions{Message: "Add admin", Cmd: "test"})
+	if err != nil {
+		t.Fatalf("CommitSites: %v", err)
+	}
+	if result.SitesChanged != 1 {
+		t.Errorf("CommitSites changed %d sites, want 1", result.SitesChanged)
+	}
+
+	head := repo.Head(t)
+	if head.Hash == initial.Hash {
+		t.Fatal("CommitSites didn't commit")
+	}
+	if len(head.ParentHashes) != 1 || head.ParentHashes[0] != initial.Hash {
+		t.Errorf("Commit %s isn't on top of %s", head.Hash, initial.Hash)
+	}
+	if !strings.Contains(head.Message, "Add admin") {
+		t.Errorf("Commit message %q doesn't contain %q", head.Message, "Add admin")
+	}
+	if origin := repo.OriginHead(t); origin != head.Hash {
+		t.Errorf("Origin is at %s, want %s", origin, head.Hash)
+	}
+
+	got := repo.Site(t, "mysite")
+	if got == nil {
+		t.Fatal("mysite missing from the working tree")
+	}
+	for _, login := range []string{"ab123", "cd456"} {
+		if !got.HasAdmin(login) {
+			t.Errorf("mysite admins %v don't include %s", got.Admins, login)
+		}
+	}
+}
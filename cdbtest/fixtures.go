@@ -0,0 +1,113 @@
+package cdbtest
+
+import (
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+)
+
+type SiteOption func(*cdb.Site)
+
+// Site builds a site with the given id and name, a full name, email address,
+// and path derived from the name, and no admins, changed by any options
+func Site(id int, name string, opts ...SiteOption) *cdb.Site {
+	site := cdb.NewNamedSite(name)
+	site.Id = id
+	site.FullName = "Site " + name
+	site.Email = name + "@example.com"
+	site.Paths = []string{"/" + name}
+	for _, opt := range opts {
+		opt(site)
+	}
+	return site
+}
+
+func WithAdmins(logins ...string) SiteOption {
+	return func(site *cdb.Site) {
+		for _, login := range logins {
+			site.AddAdmin(login)
+		}
+	}
+}
+
+func WithImmortalAdmins(logins ...string) SiteOption {
+	return func(site *cdb.Site) {
+		site.ImmortalAdmins = append(site.ImmortalAdmins, logins...)
+	}
+}
+
+// WithExpiry sets the expiry date, formatted YYYY-MM-DD
+func WithExpiry(date string) SiteOption {
+	return func(site *cdb.Site) {
+		site.Expiry = date
+	}
+}
+
+// WithPhp sets php to true, false, or a version string
+func WithPhp(php interface{}) SiteOption {
+	return func(site *cdb.Site) {
+		site.Php = php
+	}
+}
+
+func WithDisabled(reason string) SiteOption {
+	return func(site *cdb.Site) {
+		site.Disabled = true
+		site.DisabledReason = reason
+	}
+}
+
+type GrantOption func(*newerpol.AccessRecord)
+
+// Grant builds a pending request to grant login access to a website, as
+// returned by newerpol.GetGrants, changed by any options
+func Grant(accessId int, websiteId int, login string, opts ...GrantOption) newerpol.AccessRecord {
+	grant := newerpol.AccessRecord{
+		AccessId:      accessId,
+		WebsiteId:     websiteId,
+		RequestStatus: newerpol.AccessGrantPending,
+		FirstName:     login,
+		LookupName:    login,
+		Login:         login,
+		Email:         login + "@example.com",
+		CSP:           "CSP",
+	}
+	for _, opt := range opts {
+		opt(&grant)
+	}
+	return grant
+}
+
+// Revoke builds a pending request to revoke login's access to a website, as
+// returned by newerpol.GetGrants, changed by any options
+func Revoke(accessId int, websiteId int, login string, opts ...GrantOption) newerpol.AccessRecord {
+	return Grant(accessId, websiteId, login, append([]GrantOption{WithStatus(newerpol.AccessRevokePending)}, opts...)...)
+}
+
+// WithStatus sets the request status, e.g. newerpol.AccessGranted for a
+// grant which has already been processed
+func WithStatus(status int) GrantOption {
+	return func(grant *newerpol.AccessRecord) {
+		grant.RequestStatus = status
+	}
+}
+
+func WithEmail(email string) GrantOption {
+	return func(grant *newerpol.AccessRecord) {
+		grant.Email = email
+	}
+}
+
+func WithCSP(csp string) GrantOption {
+	return func(grant *newerpol.AccessRecord) {
+		grant.CSP = csp
+	}
+}
+
+// ByWebsite groups grants by website id, as newerpol.GetGrants does
+func ByWebsite(grants ...newerpol.AccessRecord) map[int][]newerpol.AccessRecord {
+	byWebsite := make(map[int][]newerpol.AccessRecord)
+	for _, grant := range grants {
+		byWebsite[grant.WebsiteId] = append(byWebsite[grant.WebsiteId], grant)
+	}
+	return byWebsite
+}
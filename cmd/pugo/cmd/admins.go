@@ -14,9 +14,17 @@ var adminsCmd = &cobra.Command{
 	Use:   "admins",
 	Short: "Clear site admins.",
 	Long: `Reset site admins back to none. By default only acts on sites
-where access is managed through eActivities.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		resetAdmins(cmd)
+where access is managed through eActivities.
+
+The reset can be restricted to particular sites with --site (by name or id)
+and to sites matching --filter expressions, as for pugo list. Without --all,
+sites named with --site which aren't managed through eActivities are skipped.
+
+Managed sites which can't be loaded are skipped and reported, and the rest
+are reset, exiting with the partial failure exit code.`,
+	Annotations: map[string]string{annotationRunLock: "true", annotationContinueOnError: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resetAdmins(cmd)
 	},
 }
 
@@ -24,54 +32,93 @@ var allSites bool
 
 func init() {
 	resetCmd.AddCommand(adminsCmd)
+	addForceFlag(adminsCmd)
 
 	adminsCmd.Flags().BoolVar(&allSites, "all", false, "Reset admins for all sites in cdb, not just the sites where access is managed through eActivities")
+	addResetScopeFlags(adminsCmd)
+	addPlanOutFlag(adminsCmd)
 }
 
 func resetAdmins(cmd *cobra.Command) error {
 	log.Info("reset-admins: Starting reset ...")
 
-	siteIdsToCommit := make(map[int]bool)
+	// Site files which can't be loaded are reported, and the rest reset
+	if err := recordLoadFailures("reset-admins"); err != nil {
+		return err
+	}
 
-	// Update sites
+	// Determine sites to reset
+	var sites []*cdb.Site
 	if allSites {
-		sites, err := cdb.GetAllSites()
+		var err error
+		sites, err = cdb.GetAllSites()
 		if err != nil {
-			log.Fatalf("reset-admins: Getting all sites: %v", err)
-		}
-
-		for _, site := range sites {
-			site.Admins = []string{}
-			site.MarkAsChanged()
-			siteIdsToCommit[site.Id] = true
+			return gitErrorf("reset-admins: Getting all sites: %w", err)
 		}
 	} else {
-		newerpolDb, err := newerpol.Connect()
+		newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
 		if err != nil {
-			log.Fatal(fmt.Errorf("reset-admins: ", err))
+			return dbErrorf("reset-admins: Connecting to newerpol: %w", err)
 		}
 		defer newerpolDb.Close()
 
-		managedSiteIds, err := newerpol.GetManagedSiteIds(newerpolDb)
+		managedSiteIds, err := newerpol.GetManagedSiteIds(runCtx, newerpolDb)
 		if err != nil {
-			log.Fatalf("reset-admins: Getting managed site ids: %v", err)
+			return dbErrorf("reset-admins: Getting managed site ids: %w", err)
 		}
 
 		for _, id := range managedSiteIds {
 			site, err := cdb.GetSiteById(id)
 			if err != nil {
-				log.Fatalf("reset-admins: %v", err)
+				return gitErrorf("reset-admins: %w", err)
 			}
 			if site == nil {
-				log.Warnf("reset-admins: Unable to reset admins for site %d - site not found in cdb. Skipping", id)
+				log.Warnf("reset-admins: Unable to reset admins for site %d - site not found in cdb%s. Skipping", id, orUnloadable())
+				continue
 			}
-
-			site.Admins = []string{}
-			site.MarkAsChanged()
-			siteIdsToCommit[site.Id] = true
+			sites = append(sites, site)
 		}
 	}
 
+	sites, err := scopeResetSites("reset-admins", sites)
+	if err != nil {
+		return fmt.Errorf("reset-admins: %w", err)
+	}
+	sites = withoutProtected("reset-admins", sites)
+	if resetScoped() && len(sites) == 0 {
+		log.Info("reset-admins: No sites to reset")
+		return reportFailures("reset-admins")
+	}
+
+	// Confirm before clearing admins
+	totalAdmins := 0
+	for _, site := range sites {
+		totalAdmins += len(site.Admins)
+	}
+	scope := "eActivities managed sites"
+	if allSites {
+		scope = "ALL sites"
+	}
+	if resetScoped() {
+		scope += " matching --site and --filter"
+	}
+	proceed, err := confirm(fmt.Sprintf("This will remove %d admins from %d sites (%s).", totalAdmins, len(sites), scope))
+	if err != nil {
+		return fmt.Errorf("reset-admins: %w", err)
+	}
+	if !proceed {
+		log.Info("reset-admins: Aborted")
+		return nil
+	}
+
+	// Update sites
+	siteIdsToCommit := make(map[int]bool)
+	for _, site := range sites {
+		site.Admins = []string{}
+		site.MarkAsChanged()
+		siteIdsToCommit[site.Id] = true
+	}
+
 	// Commit changes to repo
 	commitOpts := &cdb.CommitSitesOptions{
 		Ids:             siteIdsToCommit,
@@ -80,11 +127,18 @@ func resetAdmins(cmd *cobra.Command) error {
 		DryRun:          globalOpts.dryRun,
 		ForceUpdateTree: globalOpts.forceUpdateTree,
 		NoPush:          globalOpts.noPush,
+		AllowLoadErrors: true,
 	}
 	if allSites {
 		commitOpts.Message = "Reset admins (all sites)"
 	}
+	if resetScoped() {
+		commitOpts.Message = "Reset admins on " + resetScopeDescription(sites)
+	}
 
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("reset-admins: %w", err)
+	}
 	log.WithFields(log.Fields{
 		"Ids":             siteIdsToCommit,
 		"Message":         commitOpts.Message,
@@ -93,9 +147,17 @@ func resetAdmins(cmd *cobra.Command) error {
 		"ForceUpdateTree": globalOpts.forceUpdateTree,
 		"NoPush":          globalOpts.noPush,
 	}).Debugf("reset-admins: Committing sites")
-	if err := cdb.CommitSites(commitOpts); err != nil {
-		log.Fatalf("reset-admins: %v", err)
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("reset-admins: %w", err)
+	}
+
+	if planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("reset-admins: %w", err)
+		}
 	}
 
-	return nil
+	return reportFailures("reset-admins")
 }
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/secrets"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Scopes which may be given to API clients, in serve.scopes
+const (
+	scopeRead  = "read"  // List sites, and show sites and their admins
+	scopeSync  = "sync"  // Trigger syncs
+	scopeAdmin = "admin" // Add and remove site admins
+)
+
+// The environment variable pugo serve sets to the name of the client a run
+// is for, so that the changes it makes are attributed to the client
+const apiClientEnv = "PUGO_API_CLIENT"
+
+// apiClient is a client of the API, identified by its bearer token
+type apiClient struct {
+	name   string
+	token  string
+	scopes map[string]bool
+}
+
+// apiServer serves the API pugo serve provides under /api/. Requests are
+// carried out by running pugo, so changes take the run lock and are
+// committed, audited and summarised as for any other run.
+type apiServer struct {
+	clients []*apiClient
+}
+
+// configure reads the clients from serve.tokens, and their scopes from
+// serve.scopes and serve.roles, resolving the tokens. The clients are only
+// replaced if they are all read.
+func (s *apiServer) configure() error {
+	var clients []*apiClient
+	byName := make(map[string]*apiClient)
+	for _, token := range conf.Serve.Tokens {
+		name, ref, _ := strings.Cut(token, "=")
+		value, err := secrets.Resolve(context.Background(), ref)
+		if err != nil {
+			return fmt.Errorf("Token for %s: %v", name, err)
+		}
+		for _, c := range clients {
+			if c.token == value {
+				return fmt.Errorf("%s and %s have the same token", c.name, name)
+			}
+		}
+		c := &apiClient{name: name, token: value, scopes: make(map[string]bool)}
+		clients = append(clients, c)
+		byName[name] = c
+	}
+	for _, grant := range []struct {
+		names  []string
+		scopes []string
+	}{
+		{conf.Serve.Scopes.Read, []string{scopeRead}},
+		{conf.Serve.Scopes.Sync, []string{scopeSync}},
+		{conf.Serve.Scopes.Admin, []string{scopeAdmin}},
+		{conf.Serve.Roles.Viewer, []string{scopeRead}},
+		{conf.Serve.Roles.Operator, []string{scopeRead, scopeSync}},
+		{conf.Serve.Roles.Admin, []string{scopeRead, scopeSync, scopeAdmin}},
+	} {
+		for _, name := range grant.names {
+			if c, ok := byName[name]; ok {
+				for _, scope := range grant.scopes {
+					c.scopes[scope] = true
+				}
+			}
+		}
+	}
+
+	s.clients = clients
+	return nil
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/sites", s.route(scopeRead, func(r *http.Request) []string {
+		return []string{"list"}
+	}))
+	mux.Handle("GET /api/sites/{site}", s.route(scopeRead, func(r *http.Request) []string {
+		return []string{"show", "--", r.PathValue("site")}
+	}))
+	mux.Handle("GET /api/sites/{site}/admins", s.route(scopeRead, func(r *http.Request) []string {
+		return []string{"admins", "list", "--", r.PathValue("site")}
+	}))
+	mux.Handle("PUT /api/sites/{site}/admins/{login}", s.route(scopeAdmin, func(r *http.Request) []string {
+		return []string{"admins", "add", "--reason=" + r.URL.Query().Get("reason"), "--", r.PathValue("site"), r.PathValue("login")}
+	}))
+	mux.Handle("DELETE /api/sites/{site}/admins/{login}", s.route(scopeAdmin, func(r *http.Request) []string {
+		return []string{"admins", "remove", "--reason=" + r.URL.Query().Get("reason"), "--", r.PathValue("site"), r.PathValue("login")}
+	}))
+	mux.Handle("POST /api/sync", s.route(scopeSync, func(r *http.Request) []string {
+		args := []string{"sync"}
+		for _, site := range r.URL.Query()["site"] {
+			args = append(args, "--site="+site)
+		}
+		return args
+	}))
+	return mux
+}
+
+// route returns the handler of an endpoint, which authenticates the client
+// and checks it has scope before running pugo with the arguments from args.
+// Each request by a client is recorded in the audit log, with its outcome.
+func (s *apiServer) route(scope string, args func(r *http.Request) []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := s.authenticate(r)
+		if client == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pugo"`)
+			writeAPIError(w, http.StatusUnauthorized, "A valid bearer token is required")
+			return
+		}
+		status := s.serve(w, r, client, scope, args)
+		audit.Record(audit.Event{
+			Action: audit.ActionAPIRequest,
+			Client: client.name,
+			Detail: fmt.Sprintf("%s %s: %d", r.Method, r.URL.Path, status),
+		})
+	})
+}
+
+// serve responds to an authenticated request, returning the status
+func (s *apiServer) serve(w http.ResponseWriter, r *http.Request, client *apiClient, scope string, args func(r *http.Request) []string) int {
+	if !client.scopes[scope] {
+		log.Warnf("serve: %s denied %s %s, which needs the %s scope", client.name, r.Method, r.URL.Path, scope)
+		return writeAPIError(w, http.StatusForbidden, fmt.Sprintf("The %s scope is required", scope))
+	}
+
+	log.Infof("serve: %s %s %s", client.name, r.Method, r.URL.Path)
+	out, err := runPugo(client.name, args(r)...)
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		status := http.StatusInternalServerError
+		switch exitErr.ExitCode() {
+		case exitGeneralError:
+			status = http.StatusBadRequest
+		case exitLocked:
+			status = http.StatusConflict
+		}
+		return writeAPIError(w, status, lastLoggedError(exitErr.Stderr))
+	case err != nil:
+		log.Warnf("serve: %v", err)
+		return writeAPIError(w, http.StatusInternalServerError, "Unable to run pugo")
+	case len(out) == 0:
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+	return http.StatusOK
+}
+
+// authenticate returns the client whose token the request bears, or nil if
+// there isn't one
+func (s *apiServer) authenticate(r *http.Request) *apiClient {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	for _, c := range s.clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// runPugo runs pugo with args and the config file in use for client,
+// returning its output as JSON. It isn't stopped if the client goes away, so
+// that a change isn't abandoned part way through. If it fails an
+// *exec.ExitError is returned, whose Stderr has the JSON log.
+func runPugo(client string, args ...string) ([]byte, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Finding pugo executable: %v", err)
+	}
+	global := []string{"--output=json", "--log-format=json", "--yes"}
+	if fn := viper.ConfigFileUsed(); fn != "" {
+		global = append(global, "--config="+fn)
+	}
+	c := exec.Command(exe, append(global, args...)...)
+	c.Env = append(os.Environ(), apiClientEnv+"="+client)
+	return c.Output()
+}
+
+// lastLoggedError returns the message of the last error in a JSON log, i.e.
+// the error pugo exited with
+func lastLoggedError(logged []byte) string {
+	message := "pugo failed"
+	scanner := bufio.NewScanner(bytes.NewReader(logged))
+	for scanner.Scan() {
+		var entry struct {
+			Level   string `json:"level"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Level == "error" {
+			message = entry.Message
+		}
+	}
+	return message
+}
+
+// writeAPIError responds with status and an error message, returning the
+// status
+func writeAPIError(w http.ResponseWriter, status int, message string) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	return status
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/plan"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply <plan.json>",
+	Short: "Apply a plan saved with --plan-out",
+	Long: `Execute a plan previously saved by a dry run with --plan-out,
+making exactly the changes it describes: the site fields are set and
+committed, the grants finished in newerpol, and the emails sent.
+
+The plan is refused if anything has drifted since it was made, i.e. if any
+site field no longer has the value the plan expects to change, or any grant
+is no longer in the state it was in. Make a new plan in that case.`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doApply(cmd, args[0])
+	},
+}
+
+var applyNoEmail bool
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+	addForceFlag(applyCmd)
+
+	applyCmd.Flags().BoolVar(&applyNoEmail, "no-email", false, "Don't send the emails in the plan. Implied by dry-run.")
+}
+
+func doApply(cmd *cobra.Command, fn string) error {
+	p, err := plan.Load(fn)
+	if err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if p.ApprovalReason != "" {
+		return fmt.Errorf("apply: %s needs approval (%s), so must be applied with pugo approve", fn, p.ApprovalReason)
+	}
+	log.Infof("apply: Applying plan from %s made by %s (run %s) at %s", fn, p.Command, p.RunId, p.Created.Format("2006-01-02 15:04:05"))
+
+	_, err = applyPlan(p, "apply")
+	return err
+}
+
+// applyPlan makes the changes described by a plan, refusing if anything has
+// drifted since it was made. logPrefix names the command applying it, which
+// is also recorded in the commit. Returns whether the plan was applied,
+// i.e. not aborted.
+func applyPlan(p *plan.Plan, logPrefix string) (bool, error) {
+
+	// Bring the worktree up to date before loading sites so drift is
+	// checked against the latest cdb
+	if _, err := cdb.GetWorktree(runCtx); err != nil {
+		return false, gitErrorf("%s: %w", logPrefix, err)
+	}
+
+	var drift []string
+	siteIdsToCommit := make(map[int]bool)
+	sites := make(map[string]*cdb.Site)
+	for _, sc := range p.Sites {
+		site, err := cdb.GetSiteByName(sc.Name)
+		if err != nil {
+			return false, gitErrorf("%s: %w", logPrefix, err)
+		}
+		if site == nil || site.Id != sc.Id {
+			drift = append(drift, fmt.Sprintf("%s: site not found with id %d", sc.Name, sc.Id))
+			continue
+		}
+		for _, change := range sc.Changes {
+			current, err := site.Field(change.Field)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", logPrefix, err)
+			}
+			if !jsonEqual(current, change.Before) {
+				drift = append(drift, fmt.Sprintf("%s: %s is %s, plan expected %s", sc.Name, change.Field, current, compactJSON(change.Before)))
+			}
+		}
+		sites[sc.Name] = site
+	}
+
+	var newerpolDb *sqlx.DB
+	if len(p.Grants) > 0 {
+		var err error
+		newerpolDb, err = newerpol.Connect(runCtx, &conf.Newerpol)
+		if err != nil {
+			return false, dbErrorf("%s: Connecting to newerpol: %w", logPrefix, err)
+		}
+		defer newerpolDb.Close()
+
+		var ids []int
+		for _, g := range p.Grants {
+			ids = append(ids, g.AccessId)
+		}
+		statuses, err := newerpol.GetAccessStatuses(runCtx, newerpolDb, ids)
+		if err != nil {
+			return false, dbErrorf("%s: %w", logPrefix, err)
+		}
+		for _, g := range p.Grants {
+			if status, ok := statuses[g.AccessId]; !ok || status != g.RequestStatus {
+				drift = append(drift, fmt.Sprintf("grant %d: status is %d, plan expected %d", g.AccessId, status, g.RequestStatus))
+			}
+		}
+	}
+
+	if len(drift) > 0 {
+		for _, d := range drift {
+			log.Warnf("%s: Drift: %s", logPrefix, d)
+		}
+		return false, fmt.Errorf("%s: Refusing to apply plan, %d changes since it was made", logPrefix, len(drift))
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will change %d sites, finish %d grants and send %d emails.", len(p.Sites), len(p.Grants), len(p.Emails)))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if !proceed {
+		log.Infof("%s: Aborted", logPrefix)
+		return false, nil
+	}
+
+	// Apply and commit site changes
+	for _, sc := range p.Sites {
+		site := sites[sc.Name]
+		for _, change := range sc.Changes {
+			if err := site.SetField(change.Field, change.After); err != nil {
+				return false, fmt.Errorf("%s: %w", logPrefix, err)
+			}
+		}
+		siteIdsToCommit[site.Id] = true
+	}
+	var ledger []cdb.LedgerEntry
+	for _, g := range p.Grants {
+		site, err := cdb.GetSiteById(g.WebsiteId)
+		if err != nil {
+			return false, gitErrorf("%s: %w", logPrefix, err)
+		}
+		if site != nil {
+			ledger = append(ledger, ledgerEntry(g, site))
+		}
+	}
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         p.Message,
+		Cmd:             logPrefix,
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+		Ledger:          ledger,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return false, gitErrorf("%s: %w", logPrefix, err)
+	}
+	if globalOpts.dryRun {
+		log.Infof("%s: Performing dry run - grants will not be finished and emails will not be sent.", logPrefix)
+		return true, nil
+	}
+
+	// Finish grants
+	for _, g := range p.Grants {
+		updated, err := g.FinishGrant(runCtx, newerpolDb)
+		if err != nil {
+			// cdb changes have already been committed at this point
+			return true, partialFailureErrorf("%s: %w", logPrefix, err)
+		}
+		if updated {
+			runSummary.addGrantsProcessed(1)
+		}
+	}
+
+	if applyNoEmail || len(p.Emails) == 0 {
+		return true, nil
+	}
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return true, partialFailureErrorf("%s: Unable to start email worker, emails will not be sent: %w", logPrefix, err)
+	}
+	defer email.ShutdownWorker()
+	for _, emailOpts := range p.Emails {
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.WithFields(log.Fields{
+				"emailOpts": emailOpts,
+			}).Warnf("%s: Error attempting to send email: %v", logPrefix, err)
+		}
+	}
+
+	return true, nil
+}
+
+// jsonEqual reports whether two JSON encoded values are identical, ignoring
+// formatting
+func jsonEqual(a, b json.RawMessage) bool {
+	return bytes.Equal(compactJSON(a), compactJSON(b))
+}
+
+func compactJSON(data json.RawMessage) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
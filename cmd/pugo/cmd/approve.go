@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/plan"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var approveCmd = &cobra.Command{
+	Use:   "approve <plan.json>",
+	Short: "Approve and apply a plan of sensitive changes",
+	Long: `Apply a plan of changes which needs approval by a second
+sysadmin, as pugo apply would: the site fields are set and committed, the
+grants finished in newerpol, and the emails sent. The plan is refused if
+anything has drifted since it was made.
+
+Changes need approval if they touch a site listed in approval.sites, or more
+sites than approval.max_sites. Instead of committing them, sync, expire,
+php migrate, reset admins, reset expiry and fsck --fix write a plan to
+approval.dir and stop. The plan may be given by path or by its name in
+approval.dir, and can't be approved by the user who made it. Once applied
+it is moved to the approved directory within approval.dir.
+
+Grants in a plan written by sync are left pending, and later syncs don't
+plan them again while it awaits approval. If a plan is rejected, delete it
+and run pugo sync --all to plan its grants afresh.`,
+	Args:              cobra.ExactArgs(1),
+	Annotations:       map[string]string{annotationRunLock: "true"},
+	ValidArgsFunction: completePendingApprovals,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doApprove(cmd, args[0])
+	},
+}
+
+// approvalReason is why the changes made by the running command need
+// approval, set once they have been diverted to a plan
+var approvalReason string
+
+func init() {
+	rootCmd.AddCommand(approveCmd)
+	addForceFlag(approveCmd)
+
+	approveCmd.Flags().BoolVar(&applyNoEmail, "no-email", false, "Don't send the emails in the plan. Implied by dry-run.")
+}
+
+// requireApproval checks whether the sites which would be committed with
+// commitOpts need approval by a second sysadmin. If so the command is
+// switched to a dry run writing a plan to approval.dir, which the command
+// writes as it would with --plan-out.
+func requireApproval(commitOpts *cdb.CommitSitesOptions) error {
+	if globalOpts.dryRun {
+		return nil
+	}
+	reason := approvalNeeded(cdb.ChangedSites(commitOpts.Ids))
+	if reason == "" {
+		return nil
+	}
+
+	dir, err := homedir.Expand(viper.GetString("approval.dir"))
+	if err != nil || dir == "" {
+		return configErrorf("Changes need approval (%s), but approval.dir isn't set", reason)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Creating approval.dir: %w", err)
+	}
+
+	approvalReason = reason
+	planOut = filepath.Join(dir, fmt.Sprintf("%s-%s.json", time.Now().Format("20060102T150405"), runId))
+	globalOpts.dryRun = true
+	commitOpts.DryRun = true
+	log.Warnf("Changes need approval (%s) - nothing will be committed. A plan will be written to %s for another sysadmin to apply with pugo approve", reason, planOut)
+	return nil
+}
+
+// approvalNeeded returns why changes to sites need approval, or an empty
+// string if they don't
+func approvalNeeded(sites []*cdb.Site) string {
+	if max := viper.GetInt("approval.max_sites"); max > 0 && len(sites) > max {
+		return fmt.Sprintf("%d sites changed, more than approval.max_sites", len(sites))
+	}
+	flagged := viper.GetStringSlice("approval.sites")
+	var names []string
+	for _, site := range sites {
+		for _, entry := range flagged {
+			if entry == site.Name() || entry == fmt.Sprint(site.Id) || site.HasAlias(entry) {
+				names = append(names, site.Name())
+				break
+			}
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Sprintf("changes to %s", strings.Join(names, ", "))
+	}
+	return ""
+}
+
+func doApprove(cmd *cobra.Command, fn string) error {
+	dir, err := homedir.Expand(viper.GetString("approval.dir"))
+	if err != nil {
+		return configErrorf("approve: approval.dir: %w", err)
+	}
+	if _, err := os.Stat(fn); os.IsNotExist(err) && dir != "" {
+		fn = filepath.Join(dir, filepath.Base(fn))
+	}
+
+	p, err := plan.Load(fn)
+	if err != nil {
+		return fmt.Errorf("approve: %w", err)
+	}
+	if p.ApprovalReason == "" {
+		return fmt.Errorf("approve: %s doesn't need approval, apply it with pugo apply", fn)
+	}
+	approver := currentUsername()
+	if p.RequestedBy == approver {
+		return fmt.Errorf("approve: %s was made by %s, so must be approved by another sysadmin", fn, approver)
+	}
+	log.Infof("approve: Approving plan from %s made by %s with %s (run %s) at %s, needing approval for %s", fn, p.RequestedBy, p.Command, p.RunId, p.Created.Format("2006-01-02 15:04:05"), p.ApprovalReason)
+
+	p.Message = fmt.Sprintf("%s (requested by %s, approved by %s)", p.Message, p.RequestedBy, approver)
+	applied, err := applyPlan(p, "approve")
+	if err != nil {
+		return err
+	}
+	if !applied || globalOpts.dryRun {
+		return nil
+	}
+
+	approvedDir := filepath.Join(filepath.Dir(fn), "approved")
+	err = os.MkdirAll(approvedDir, 0755)
+	if err == nil {
+		err = os.Rename(fn, filepath.Join(approvedDir, filepath.Base(fn)))
+	}
+	if err != nil {
+		log.Warnf("approve: Unable to move %s to %s: %v", fn, approvedDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Query the audit log and check sites against access policy",
+	Long: `Query the audit log of changes made by pugo. Every admin added or
+removed, other site change, commit, push, tag, grant finished, reset or
+blocked, email sent, and pugo serve API request is recorded in audit.file
+(by default ~/.pugo-audit.jsonl). Changes made through the API record the
+client they were made for.
+
+pugo audit admins checks sites against the access policy, listing those with
+more admins than sync.max_admins allows.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("audit: Subcommand required")
+	},
+}
+
+var auditLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "List audit log events",
+	Long: `List events from the audit log, oldest first. --since takes a date
+(yyyy-mm-dd), or a duration such as 36h or 7d. --user matches the user who
+ran pugo, the API client a change was made for, and the login an event
+affects.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return auditLog(cmd)
+	},
+}
+
+var auditAdminsCmd = &cobra.Command{
+	Use:   "admins",
+	Short: "List sites with more admins than policy allows",
+	Long: `List the sites with more admins than sync.max_admins allows,
+which sync won't add further admins to until some are removed. Immortal
+admins aren't counted. The command exits with a non-zero status if any sites
+are over the limit.`,
+	Args:              cobra.NoArgs,
+	ValidArgsFunction: cobra.NoFileCompletions,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return auditAdmins(cmd)
+	},
+}
+
+type auditLogOptions struct {
+	since  string
+	site   string
+	user   string
+	action string
+}
+
+var auditLogOpts auditLogOptions
+
+// auditEvents is the audit log output
+type auditEvents []audit.Event
+
+func (e auditEvents) Header() []string {
+	return []string{"TIME", "USER", "CLIENT", "COMMAND", "ACTION", "SITE", "LOGIN", "DETAIL"}
+}
+
+func (e auditEvents) Rows() [][]string {
+	rows := make([][]string, 0, len(e))
+	for _, event := range e {
+		rows = append(rows, []string{event.Time.Local().Format("2006-01-02 15:04:05"), event.User, event.Client, event.Command, event.Action, event.Site, event.Login, event.Detail})
+	}
+	return rows
+}
+
+// siteAdminCount is a single row of audit admins output
+type siteAdminCount struct {
+	Site   string `json:"site" yaml:"site"`
+	Admins int    `json:"admins" yaml:"admins"`
+	Limit  int    `json:"limit" yaml:"limit"`
+}
+
+type siteAdminCounts []siteAdminCount
+
+func (c siteAdminCounts) Header() []string {
+	return []string{"SITE", "ADMINS", "LIMIT"}
+}
+
+func (c siteAdminCounts) Rows() [][]string {
+	rows := make([][]string, 0, len(c))
+	for _, count := range c {
+		rows = append(rows, []string{count.Site, strconv.Itoa(count.Admins), strconv.Itoa(count.Limit)})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditLogCmd)
+	auditCmd.AddCommand(auditAdminsCmd)
+
+	auditLogCmd.Flags().StringVar(&auditLogOpts.since, "since", "", "Only list events since the given date (yyyy-mm-dd) or duration ago (e.g. 36h, 7d).")
+	auditLogCmd.Flags().StringVar(&auditLogOpts.site, "site", "", "Only list events for the given site.")
+	auditLogCmd.Flags().StringVar(&auditLogOpts.user, "user", "", "Only list events made by, or affecting, the given user or login.")
+	auditLogCmd.Flags().StringVar(&auditLogOpts.action, "action", "", "Only list events with the given action (e.g. admin-add).")
+	auditLogCmd.RegisterFlagCompletionFunc("site", completeSiteNames)
+	auditLogCmd.RegisterFlagCompletionFunc("action", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{
+			audit.ActionAdminAdd, audit.ActionAdminRemove, audit.ActionSiteChange,
+			audit.ActionSiteRemove, audit.ActionSiteArchive, audit.ActionSiteRestore,
+			audit.ActionCommit, audit.ActionPush, audit.ActionTag,
+			audit.ActionGrantFinish, audit.ActionGrantReset, audit.ActionGrantBlock,
+			audit.ActionEmailSent,
+		}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+func auditLog(cmd *cobra.Command) error {
+	opts := &audit.QueryOptions{
+		Site:   auditLogOpts.site,
+		User:   auditLogOpts.user,
+		Action: auditLogOpts.action,
+	}
+	if auditLogOpts.since != "" {
+		since, err := parseSince(auditLogOpts.since)
+		if err != nil {
+			return fmt.Errorf("audit-log: %w", err)
+		}
+		opts.Since = since
+	}
+
+	events, err := audit.Query(opts)
+	if err != nil {
+		return fmt.Errorf("audit-log: %w", err)
+	}
+
+	if err := writeOutput(os.Stdout, auditEvents(events)); err != nil {
+		return fmt.Errorf("audit-log: %w", err)
+	}
+
+	return nil
+}
+
+func auditAdmins(cmd *cobra.Command) error {
+	limit := viper.GetInt("sync.max_admins")
+	if limit <= 0 {
+		log.Info("audit-admins: sync.max_admins isn't set, so no sites are over the limit")
+		return nil
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("audit-admins: Getting all sites: %w", err)
+	}
+	result := siteAdminCounts{}
+	for _, site := range sites {
+		if len(site.Admins) > limit {
+			result = append(result, siteAdminCount{Site: site.Name(), Admins: len(site.Admins), Limit: limit})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Admins != result[j].Admins {
+			return result[i].Admins > result[j].Admins
+		}
+		return result[i].Site < result[j].Site
+	})
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("audit-admins: %w", err)
+	}
+	if len(result) > 0 {
+		return newExitError(exitCheckFailed, "audit-admins: %d sites have more than %d admins", len(result), limit)
+	}
+	return nil
+}
+
+// parseSince parses a date (yyyy-mm-dd, local time) or a duration before now.
+// As well as Go durations, a number of days may be given as e.g. 7d.
+func parseSince(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 0 {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since '%s': must be a date (yyyy-mm-dd) or duration (e.g. 36h, 7d)", value)
+}
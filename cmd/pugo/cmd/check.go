@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the cdb against eActivities",
+	Long: `Compare each site in the cdb with the website of the same id in
+eActivities, listing the sites whose name differs from the website's folder,
+e.g. because a site was renamed on one side only. A folder matching one of
+the site's aliases isn't a mismatch. The command exits with a non-zero
+status if any mismatches are found.
+
+With --propose a rename of each cdb site to its eActivities folder is also
+listed. After renaming a site file, its paths should be updated to match
+(see pugo fsck), and the old name kept as an alias so links still work;
+alternatively rename the website in eActivities instead.`,
+	Args:              cobra.NoArgs,
+	ValidArgsFunction: cobra.NoFileCompletions,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return check(cmd)
+	},
+}
+
+var checkPropose bool
+
+// nameMismatch is a single row of check output
+type nameMismatch struct {
+	Id       int    `json:"id" yaml:"id"`
+	Site     string `json:"site" yaml:"site"`
+	Folder   string `json:"folder" yaml:"folder"`
+	Proposal string `json:"proposal,omitempty" yaml:"proposal,omitempty"`
+}
+
+type nameMismatches []nameMismatch
+
+func (m nameMismatches) Header() []string {
+	if checkPropose {
+		return []string{"ID", "SITE", "EACTIVITIES FOLDER", "PROPOSAL"}
+	}
+	return []string{"ID", "SITE", "EACTIVITIES FOLDER"}
+}
+
+func (m nameMismatches) Rows() [][]string {
+	rows := make([][]string, 0, len(m))
+	for _, mismatch := range m {
+		row := []string{strconv.Itoa(mismatch.Id), mismatch.Site, mismatch.Folder}
+		if checkPropose {
+			row = append(row, mismatch.Proposal)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().BoolVar(&checkPropose, "propose", false, "Propose renaming each mismatched site to its eActivities folder.")
+}
+
+func check(cmd *cobra.Command) error {
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("check: Getting all sites: %w", err)
+	}
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("check: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	folders, err := newerpol.GetWebsiteFolders(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("check: %w", err)
+	}
+
+	result := nameMismatches{}
+	for _, site := range sites {
+		folder, ok := folders[site.Id]
+		if !ok || folder == "" || folder == site.Name() || site.HasAlias(folder) {
+			continue
+		}
+		mismatch := nameMismatch{Id: site.Id, Site: site.Name(), Folder: folder}
+		if checkPropose {
+			if other, err := cdb.GetSiteByName(folder); err == nil && other != nil {
+				mismatch.Proposal = fmt.Sprintf("none, %s is the name of site %d", folder, other.Id)
+			} else {
+				mismatch.Proposal = fmt.Sprintf("git mv sites/%s.yaml sites/%s.yaml", site.Name(), folder)
+			}
+		}
+		result = append(result, mismatch)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	log.Infof("check: Compared %d sites with %d eActivities websites", len(sites), len(folders))
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	if len(result) > 0 {
+		return newExitError(exitCheckFailed, "check: %d sites are named differently in eActivities", len(result))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cdbCmd = &cobra.Command{
+	Use:   "cdb",
+	Short: "Manage the cdb checkout",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("cdb: Subcommand required")
+	},
+}
+
+var cdbCloneCmd = &cobra.Command{
+	Use:   "clone",
+	Short: "Clone the cdb into cdb.path",
+	Long: `Clone cdb.url into cdb.path and check out cdb.branch, e.g. when
+setting up a new host. cdb.path must be missing or an empty directory.
+
+Other commands clone the cdb in the same way the first time they are run if
+cdb.path is missing or empty and cdb.url is set, so running this first is
+optional. It isn't needed at all with cdb.bare or cdb.ephemeral.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doCdbClone(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cdbCmd)
+	cdbCmd.AddCommand(cdbCloneCmd)
+}
+
+func doCdbClone(cmd *cobra.Command) error {
+	if conf.Cdb.Bare != "" || conf.Cdb.Ephemeral {
+		return configErrorf("cdb-clone: cdb.path isn't used with cdb.bare or cdb.ephemeral")
+	}
+	err := cdb.Clone(runCtx)
+	if errors.Is(err, cdb.ErrAlreadyCloned) {
+		log.Infof("cdb-clone: %s is already cloned", conf.Cdb.Path)
+		return nil
+	}
+	if errors.Is(err, cdb.ErrPathNotConfigured) || errors.Is(err, cdb.ErrURLNotConfigured) {
+		return configErrorf("cdb-clone: %w", err)
+	}
+	if err != nil {
+		return gitErrorf("cdb-clone: %w", err)
+	}
+	log.Infof("cdb-clone: Cloned %s into %s", conf.Cdb.URL, conf.Cdb.Path)
+	return nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var commitCmd = &cobra.Command{
+	Use:   "commit",
+	Short: "Commit the changes staged with --no-commit",
+	Long: `Commit the changes made by pugo site set, pugo admins add and pugo
+admins remove run with --no-commit as a single commit, and push it to origin.
+This allows a batch of manual edits to be reviewed and pushed together rather
+than as one commit each.
+
+The commit message is given with -m; without it the messages of the staged
+commands are joined together. If origin has moved on since the changes were
+staged they are moved onto it first, unless it changed the same site files.
+While changes are staged, commands which would commit to the cdb (e.g. pugo
+sync) refuse to run until they have been committed.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doCommit(cmd)
+	},
+}
+
+var commitMessage string
+
+// noCommit is set by --no-commit on commands which support it, to stage
+// their changes to be committed later with pugo commit
+var noCommit bool
+
+func addNoCommitFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&noCommit, "no-commit", false, "Stage the changes in the cdb but don't commit them, so they can be committed together with others using pugo commit.")
+}
+
+func init() {
+	rootCmd.AddCommand(commitCmd)
+
+	commitCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "Commit message. Defaults to the messages of the staged commands.")
+}
+
+func doCommit(cmd *cobra.Command) error {
+	staged, err := cdb.GetStagedChanges()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if staged == nil {
+		log.Info("commit: No changes staged with --no-commit")
+		return nil
+	}
+	log.Infof("commit: Staged changes to %s:\n  %s", strings.Join(staged.Sites(), ", "), strings.Join(staged.Messages, "\n  "))
+
+	message := commitMessage
+	if message != "" {
+		message = attributedMessage(message, "")
+	}
+	commitResult, err := cdb.CommitStaged(runCtx, &cdb.CommitStagedOptions{
+		Message: message,
+		DryRun:  globalOpts.dryRun,
+		NoPush:  globalOpts.noPush,
+	})
+	runSummary.recordCommit(commitResult)
+	if errors.Is(err, cdb.ErrNothingStaged) {
+		log.Info("commit: No changes staged with --no-commit")
+		return nil
+	}
+	if err != nil {
+		return gitErrorf("commit: %w", err)
+	}
+	return nil
+}
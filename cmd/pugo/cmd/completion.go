@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var completionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|fish]",
+	Short: "Generate shell completion script",
+	Long: `Output a shell completion script for pugo. Site names are
+completed dynamically from the cdb, so completion reflects the sites present
+in the configured checkout.
+
+To load completions for the current bash session:
+
+  source <(pugo completion bash)
+
+For zsh, place the output in a file named _pugo somewhere in your fpath.
+For fish:
+
+  pugo completion fish > ~/.config/fish/completions/pugo.fish`,
+	Annotations: map[string]string{annotationNoConfig: "true"},
+	ValidArgs:   []string{"bash", "zsh", "fish"},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("Requires a single shell argument: bash, zsh, or fish")
+		}
+		return cobra.OnlyValidArgs(cmd, args)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case "bash":
+			return rootCmd.GenBashCompletion(os.Stdout)
+		case "zsh":
+			return rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return rootCmd.GenFishCompletion(os.Stdout, true)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+}
+
+// completeSiteNames completes a single site name argument from the cdb
+func completeSiteNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var names []string
+	for _, site := range sites {
+		if strings.HasPrefix(site.Name(), toComplete) {
+			names = append(names, site.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeArchivedSiteNames completes the names of archived sites
+func completeArchivedSiteNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	archived, err := cdb.ArchivedSiteNames()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var names []string
+	for _, name := range archived {
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSiteFilters completes --filter values. Field names are completed
+// first, then site names once the name field has been chosen
+func completeSiteFilters(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if strings.HasPrefix(toComplete, "name=") {
+		names, directive := completeSiteNames(cmd, nil, strings.TrimPrefix(toComplete, "name="))
+		for i := range names {
+			names[i] = "name=" + names[i]
+		}
+		return names, directive
+	}
+
+	fields := []string{"id=", "name=", "email=", "admin=", "expiry=", "disabled="}
+	return fields, cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveNoSpace
+}
+
+// completePendingApprovals completes the names of the plans in approval.dir
+func completePendingApprovals(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	dir, err := homedir.Expand(viper.GetString("approval.dir"))
+	if err != nil || dir == "" {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var names []string
+	for _, match := range matches {
+		names = append(names, filepath.Base(match))
+	}
+	return names, cobra.ShellCompDirectiveDefault
+}
@@ -0,0 +1,577 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/generate"
+	"github.com/icunion/pugo/secrets"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View or update pugo configuration",
+	Long: `View the effective pugo configuration or update keys in the
+configuration file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("config: Must be run with subcommand")
+	},
+}
+
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Print the effective configuration",
+	Long: `Print the effective configuration, merged from defaults, the
+configuration file, environment, and flags. Secrets such as passwords, and
+any value resolved from a reference to a secret or decrypted, are masked.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return viewConfig(cmd)
+	},
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt <value>",
+	Short: "Encrypt a value for use in the configuration file",
+	Long: `Encrypt a value with age so it can be stored in the
+configuration file, e.g. in a version controlled deployment. The value is
+encrypted to the host key in secrets.identity_file (as generated by
+age-keygen) and any additional --recipient keys, and decrypted transparently
+when pugo starts.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		encrypted, err := secrets.Encrypt(args[0], configOpts.recipients...)
+		if err != nil {
+			return configErrorf("config: %w", err)
+		}
+		fmt.Println(encrypted)
+		return nil
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Set a key in the configuration file",
+	Long: `Set a key in the configuration file, creating the file if it
+doesn't exist. The key and value are validated before the file is written.
+List values (e.g. report.recipients) are given comma separated. Comments and
+ordering in the existing file are preserved. With --encrypt the value is
+encrypted as with config encrypt before being written.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeConfigSet,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setConfig(cmd, args[0], args[1])
+	},
+}
+
+type configOptions struct {
+	encrypt    bool
+	recipients []string
+}
+
+var configOpts configOptions
+
+// configKey describes a known configuration key
+type configKey struct {
+	// Whether the value should be masked when displayed
+	secret bool
+	// Whether the value is a list
+	list bool
+	// Whether the value is an integer rather than a string
+	integer bool
+	// The values the key may take, if limited to a fixed set
+	values []string
+	// Validates a value, nil if any value is acceptable
+	validate func(value string) error
+}
+
+// configKeys lists all configuration keys understood by pugo
+var configKeys = map[string]configKey{
+	"newerpol.name":              {},
+	"newerpol.host":              {validate: validateNonEmpty},
+	"newerpol.instance":          {},
+	"newerpol.username":          {},
+	"newerpol.password":          {secret: true},
+	"newerpol.database":          {validate: validateNonEmpty},
+	"cdb.path":                   {validate: validateNonEmpty},
+	"cdb.bare":                   {},
+	"cdb.ephemeral":              {values: []string{"true", "false"}},
+	"cdb.url":                    {},
+	"cdb.remote_url":             {},
+	"cdb.branch":                 {validate: validateNonEmpty},
+	"cdb.staging_branch":         {},
+	"cdb.remote":                 {validate: validateNonEmpty},
+	"cdb.push_remotes":           {list: true},
+	"cdb.author.name":            {validate: validateNonEmpty},
+	"cdb.author.email":           {validate: validateEmail},
+	"cdb.php_versions":           {list: true},
+	"cdb.concurrency":            {integer: true, validate: validatePositive},
+	"cdb.auth.username":          {},
+	"cdb.auth.password":          {secret: true},
+	"cdb.signing_key":            {},
+	"cdb.signing_passphrase":     {secret: true},
+	"cdb.review.provider":        {values: []string{"github", "gitlab"}},
+	"cdb.review.api_url":         {validate: validateURL},
+	"cdb.review.repo":            {},
+	"cdb.review.token":           {secret: true},
+	"cdb.review.branch_prefix":   {},
+	"cdb.strict":                 {values: []string{"true", "false"}},
+	"cdb.provenance":             {values: []string{"true", "false"}},
+	"cdb.logins.trim":            {values: []string{"true", "false"}},
+	"cdb.logins.lowercase":       {values: []string{"true", "false"}},
+	"cdb.logins.strip_suffixes":  {list: true},
+	"cdb.managed_sites.allow":    {list: true},
+	"cdb.managed_sites.deny":     {list: true},
+	"cdb.defaults.php":           {validate: validatePhpDefault},
+	"cdb.defaults.passenger":     {values: []string{"true", "false"}},
+	"cdb.defaults.subpaths":      {values: []string{"true", "false"}},
+	"cdb.defaults.disabled":      {values: []string{"true", "false"}},
+	"email.host":                 {validate: validateNonEmpty},
+	"email.port":                 {integer: true, validate: validatePort},
+	"email.username":             {},
+	"email.password":             {secret: true},
+	"email.resources_path":       {validate: validateNonEmpty},
+	"email.sender.name":          {},
+	"email.sender.email":         {validate: validateEmail},
+	"email.notify_site_admins":   {values: []string{"true", "false"}},
+	"email.dead_letter_dir":      {},
+	"sync.disable_inactive_csps": {values: []string{"true", "false"}},
+	"sync.blocklist":             {list: true, validate: validatePattern},
+	"sync.max_admins":            {integer: true},
+	"sync.confirm_access":        {values: []string{"true", "false"}},
+	"sync.change_tracking":       {values: []string{"true", "false"}},
+	"sync.full_scan_interval":    {validate: validateDuration},
+	"sync.review":                {values: []string{"true", "false"}},
+	"confirm.dir":                {},
+	"confirm.expiry":             {validate: validateDuration},
+	"serve.listen":               {},
+	"serve.base_url":             {},
+	"serve.tokens":               {list: true, secret: true, validate: validateServeToken},
+	"serve.scopes.read":          {list: true},
+	"serve.scopes.sync":          {list: true},
+	"serve.scopes.admin":         {list: true},
+	"serve.roles.viewer":         {list: true},
+	"serve.roles.operator":       {list: true},
+	"serve.roles.admin":          {list: true},
+	"log.format":                 {values: []string{"text", "json"}},
+	"log.repeat_limit":           {integer: true},
+	"report.recipients":          {list: true, validate: validateEmail},
+	"summary.dir":                {},
+	"approval.dir":               {},
+	"approval.sites":             {list: true},
+	"approval.max_sites":         {integer: true},
+	"state.file":                 {},
+	"tracing.endpoint":           {},
+	"tracing.headers":            {list: true, secret: true},
+	"tracing.service_name":       {},
+	"metrics.pushgateway":        {},
+	"metrics.statsd":             {},
+	"metrics.prefix":             {validate: validateNonEmpty},
+	"metrics.job":                {validate: validateNonEmpty},
+	"retry.git.attempts":         {integer: true, validate: validatePositive},
+	"retry.git.backoff":          {validate: validateDuration},
+	"retry.git.max_backoff":      {validate: validateDuration},
+	"retry.git.jitter":           {validate: validateJitter},
+	"retry.newerpol.attempts":    {integer: true, validate: validatePositive},
+	"retry.newerpol.backoff":     {validate: validateDuration},
+	"retry.newerpol.max_backoff": {validate: validateDuration},
+	"retry.newerpol.jitter":      {validate: validateJitter},
+	"retry.smtp.attempts":        {integer: true, validate: validatePositive},
+	"retry.smtp.backoff":         {validate: validateDuration},
+	"retry.smtp.max_backoff":     {validate: validateDuration},
+	"retry.smtp.jitter":          {validate: validateJitter},
+	"retry.webhook.attempts":     {integer: true, validate: validatePositive},
+	"retry.webhook.backoff":      {validate: validateDuration},
+	"retry.webhook.max_backoff":  {validate: validateDuration},
+	"retry.webhook.jitter":       {validate: validateJitter},
+	"audit.file":                 {},
+	"lock.file":                  {},
+	"vault.address":              {},
+	"vault.token":                {secret: true},
+	"secrets.identity_file":      {},
+	"hooks.pre_commit":           {list: true},
+	"hooks.post_push":            {list: true},
+	"hooks.post_sync":            {list: true},
+	"webhooks.urls":              {list: true, validate: validateURL},
+	"webhooks.secret":            {secret: true},
+	"domains.cnames":             {list: true},
+	"domains.networks":           {list: true, validate: validateCIDR},
+	"domains.probe.path":         {},
+	"domains.probe.token":        {},
+	"domains.timeout":            {validate: validateDuration},
+	"probe.base_url":             {},
+	"probe.concurrency":          {integer: true, validate: validatePositive},
+	"probe.timeout":              {validate: validateDuration},
+	"generate.index.template":    {},
+	"generate.keys.dir":          {},
+	"generate.keys.options":      {},
+	"principals.format":          {validate: validatePrincipalFormat},
+	"du.docroot":                 {validate: validateDocroot},
+}
+
+const maskedValue = "********"
+
+// configSettings is the config view output: a nested map of settings
+type configSettings map[string]interface{}
+
+func (c configSettings) Header() []string {
+	return []string{"KEY", "VALUE"}
+}
+
+func (c configSettings) Rows() [][]string {
+	flat := make(map[string]string)
+	flattenSettings("", c, flat)
+
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, []string{key, flat[key]})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configViewCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configEncryptCmd)
+
+	configSetCmd.Flags().BoolVar(&configOpts.encrypt, "encrypt", false, "Encrypt the value before writing it to the configuration file.")
+	for _, c := range []*cobra.Command{configSetCmd, configEncryptCmd} {
+		c.Flags().StringArrayVar(&configOpts.recipients, "recipient", nil, "Additional age recipient (public key) to encrypt to. May be repeated.")
+	}
+}
+
+func viewConfig(cmd *cobra.Command) error {
+	settings := configSettings(maskSecrets("", viper.AllSettings()))
+	if err := writeOutput(os.Stdout, settings); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+func setConfig(cmd *cobra.Command, key string, value string) error {
+	ck, ok := configKeys[key]
+	if !ok {
+		return configErrorf("config: Unknown key '%s'", key)
+	}
+
+	// Validate and build the new value node
+	tag := "!!str"
+	if ck.integer {
+		tag = "!!int"
+	}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+	if ck.list {
+		valueNode = &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if err := ck.check(item); err != nil {
+				return configErrorf("config: Invalid value for %s: %v", key, err)
+			}
+			valueNode.Content = append(valueNode.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: item})
+		}
+	} else if err := ck.check(value); err != nil {
+		return configErrorf("config: Invalid value for %s: %v", key, err)
+	}
+	if configOpts.encrypt {
+		if ck.list || ck.integer {
+			return configErrorf("config: %s cannot be encrypted", key)
+		}
+		encrypted, err := secrets.Encrypt(value, configOpts.recipients...)
+		if err != nil {
+			return configErrorf("config: %w", err)
+		}
+		valueNode.Value = encrypted
+	}
+
+	fn, err := configFileName()
+	if err != nil {
+		return configErrorf("config: %w", err)
+	}
+
+	// Load existing file as a node tree so comments and order survive
+	var doc yaml.Node
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return configErrorf("config: Reading %s: %w", fn, err)
+	}
+	if len(data) > 0 {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return configErrorf("config: Parsing %s: %w", fn, err)
+		}
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if err := setNode(doc.Content[0], strings.Split(key, "."), valueNode); err != nil {
+		return configErrorf("config: Setting %s: %w", key, err)
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	enc.Close()
+	if err := ioutil.WriteFile(fn, out.Bytes(), 0600); err != nil {
+		return configErrorf("config: Writing %s: %w", fn, err)
+	}
+
+	shown := value
+	if ck.secret || configOpts.encrypt {
+		shown = maskedValue
+	}
+	log.Infof("config: Set %s = %s in %s", key, shown, fn)
+
+	return nil
+}
+
+// configFileName returns the config file in use, or the default location if
+// no config file was found
+func configFileName() (string, error) {
+	if fn := viper.ConfigFileUsed(); fn != "" {
+		return fn, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".pugo.yaml"), nil
+}
+
+// setNode sets the value at path within a YAML mapping node, creating
+// intermediate mappings as required
+func setNode(mapping *yaml.Node, path []string, value *yaml.Node) error {
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected mapping at '%s'", path[0])
+	}
+
+	for i := 0; i < len(mapping.Content)-1; i += 2 {
+		if mapping.Content[i].Value != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			mapping.Content[i+1] = value
+			return nil
+		}
+		return setNode(mapping.Content[i+1], path[1:], value)
+	}
+
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: path[0]}
+	if len(path) == 1 {
+		mapping.Content = append(mapping.Content, keyNode, value)
+		return nil
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	mapping.Content = append(mapping.Content, keyNode, child)
+	return setNode(child, path[1:], value)
+}
+
+// maskSecrets returns a copy of settings with secret values, and values
+// resolved from references in the config file (e.g. an encrypted age:
+// value), masked
+func maskSecrets(prefix string, settings map[string]interface{}) map[string]interface{} {
+	masked := make(map[string]interface{})
+	for key, value := range settings {
+		fullKey := key
+		if prefix != "" {
+			fullKey = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			masked[key] = maskSecrets(fullKey, nested)
+			continue
+		}
+		if (configKeys[fullKey].secret || currentConfigFile.resolved[fullKey]) && fmt.Sprint(value) != "" {
+			masked[key] = maskedValue
+			continue
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]string) {
+	for key, value := range settings {
+		fullKey := key
+		if prefix != "" {
+			fullKey = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenSettings(fullKey, v, flat)
+		case configSettings:
+			flattenSettings(fullKey, v, flat)
+		case []interface{}, []string:
+			flat[fullKey] = strings.Trim(fmt.Sprint(v), "[]")
+		default:
+			flat[fullKey] = fmt.Sprint(v)
+		}
+	}
+}
+
+// check validates a value, or a single item of a list, for the key
+func (ck configKey) check(value string) error {
+	if len(ck.values) > 0 {
+		if err := validateOneOf(ck.values...)(value); err != nil {
+			return err
+		}
+	}
+	if ck.validate != nil {
+		return ck.validate(value)
+	}
+	return nil
+}
+
+// completeConfigSet completes the key, then the value, of config set. Values
+// are completed if the key takes a fixed set of values, and as file names
+// if the key is a path.
+func completeConfigSet(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		keys := make([]string, 0, len(configKeys))
+		for key := range configKeys {
+			if strings.HasPrefix(key, toComplete) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys, cobra.ShellCompDirectiveNoFileComp
+	case 1:
+		ck := configKeys[args[0]]
+		if len(ck.values) > 0 {
+			return ck.values, cobra.ShellCompDirectiveNoFileComp
+		}
+		if strings.HasSuffix(args[0], "path") || strings.HasSuffix(args[0], "file") || strings.HasSuffix(args[0], "dir") {
+			return nil, cobra.ShellCompDirectiveDefault
+		}
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+func validateNonEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validateEmail(value string) error {
+	if _, err := mail.ParseAddress(value); err != nil {
+		return fmt.Errorf("'%s' is not a valid email address", value)
+	}
+	return nil
+}
+
+func validateServeToken(value string) error {
+	if name, token, ok := strings.Cut(value, "="); !ok || name == "" || token == "" {
+		return fmt.Errorf("must be of the form name=token")
+	}
+	return nil
+}
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("'%s' is not a valid port", value)
+	}
+	return nil
+}
+
+func validatePositive(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("'%s' must be a whole number of at least 1", value)
+	}
+	return nil
+}
+
+func validatePhpDefault(value string) error {
+	return validateOneOf(append([]string{"true", "false"}, viper.GetStringSlice("cdb.php_versions")...)...)(value)
+}
+
+func validateDocroot(value string) error {
+	if value != "" && !strings.Contains(value, "{site}") {
+		return fmt.Errorf("'%s' must contain {site}", value)
+	}
+	return nil
+}
+
+func validateDuration(value string) error {
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		return fmt.Errorf("'%s' is not a valid duration (e.g. 500ms, 2s)", value)
+	}
+	return nil
+}
+
+func validateCIDR(value string) error {
+	if _, _, err := net.ParseCIDR(value); err != nil {
+		return fmt.Errorf("'%s' is not a network in CIDR notation (e.g. 192.0.2.0/24)", value)
+	}
+	return nil
+}
+
+func validatePrincipalFormat(value string) error {
+	_, err := generate.NewPrincipals(value)
+	if err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "generate: "))
+	}
+	return nil
+}
+
+func validatePattern(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("'%s' is not a valid pattern (e.g. svc-*)", value)
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'%s' is not an http or https URL", value)
+	}
+	return nil
+}
+
+func validateJitter(value string) error {
+	jitter, err := strconv.ParseFloat(value, 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		return fmt.Errorf("'%s' must be a number between 0 and 1", value)
+	}
+	return nil
+}
+
+func validateOneOf(allowed ...string) func(string) error {
+	return func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' must be one of %s", value, strings.Join(allowed, ", "))
+	}
+}
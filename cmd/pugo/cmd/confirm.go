@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// confirm displays a summary of the impact of a destructive operation and
+// asks the user to confirm they wish to proceed. Confirmation is skipped if
+// --yes (or --force, see addForceFlag) is supplied or a dry run is being
+// performed. Returns whether the operation should proceed, or an error if
+// confirmation is required but stdin is not interactive.
+func confirm(summary string) (bool, error) {
+	if globalOpts.yes || globalOpts.dryRun {
+		return true, nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return false, fmt.Errorf("confirmation required but stdin is not a terminal: re-run with --yes to proceed")
+	}
+
+	fmt.Fprintln(os.Stderr, summary)
+	fmt.Fprint(os.Stderr, "Proceed? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("reading confirmation: %v", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// addForceFlag adds --force to a command which asks for confirmation, as
+// another name for --yes. Commands with a --force of their own, e.g. to
+// change protected sites, don't have it.
+func addForceFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&globalOpts.yes, "force", false, "Same as --yes.")
+}
+
+// isTerminal reports whether f is attached to an interactive terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
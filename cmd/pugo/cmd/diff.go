@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [<commit> [<commit>]]",
+	Short: "Show changes to site files",
+	Long: `Show per-site YAML diffs. With no arguments the working tree is
+compared with the branch head, showing uncommitted changes (e.g. after a dry
+run with --force-update-tree). With one commit the working tree is compared
+with that commit, and with two commits the changes between them are shown.
+
+Use --site to restrict the diff to particular sites.`,
+	Args:              cobra.MaximumNArgs(2),
+	ValidArgsFunction: cobra.NoFileCompletions,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doDiff(cmd, args)
+	},
+}
+
+var diffSites []string
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringArrayVar(&diffSites, "site", nil, "Only show changes to the given site. May be repeated.")
+	diffCmd.RegisterFlagCompletionFunc("site", completeSiteNames)
+}
+
+func doDiff(cmd *cobra.Command, args []string) error {
+	var err error
+	switch len(args) {
+	case 0:
+		err = cdb.DiffWorktree(runCtx, os.Stdout, "", diffSites)
+	case 1:
+		err = cdb.DiffWorktree(runCtx, os.Stdout, args[0], diffSites)
+	case 2:
+		err = cdb.DiffCommits(runCtx, os.Stdout, args[0], args[1], diffSites)
+	}
+	if err != nil {
+		return gitErrorf("diff: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/domains"
+
+	"github.com/spf13/cobra"
+)
+
+var domainsCmd = &cobra.Command{
+	Use:   "domains",
+	Short: "Check sites' external domains",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("domains: Subcommand required")
+	},
+}
+
+var domainsVerifyCmd = &cobra.Command{
+	Use:   "verify [site...]",
+	Short: "Verify external domains still point at union infrastructure",
+	Long: `Check each external domain in the cdb, or those of the given sites,
+still points at union infrastructure: its CNAME must match one of
+domains.cnames or it must resolve to an address in one of domains.networks.
+If domains.probe.path is set, fetching it from the domain over HTTP must also
+return domains.probe.token.
+
+Each domain is reported as ok, lapsed (it no longer resolves), foreign (it
+resolves elsewhere, so may have been hijacked), probe-failed, or error. The
+command exits with a non-zero status if any domain isn't ok, for use as a
+monitoring check.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return verifyDomains(cmd, args)
+	},
+}
+
+// How many domains are checked at once
+const domainsVerifyConcurrency = 8
+
+// domainStatus is a single row of domains verify output
+type domainStatus struct {
+	Site   string `json:"site" yaml:"site"`
+	Domain string `json:"domain" yaml:"domain"`
+	Status string `json:"status" yaml:"status"`
+	Detail string `json:"detail" yaml:"detail"`
+}
+
+type domainStatuses []domainStatus
+
+func (s domainStatuses) Header() []string {
+	return []string{"SITE", "DOMAIN", "STATUS", "DETAIL"}
+}
+
+func (s domainStatuses) Rows() [][]string {
+	rows := make([][]string, 0, len(s))
+	for _, d := range s {
+		rows = append(rows, []string{d.Site, d.Domain, d.Status, d.Detail})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(domainsCmd)
+	domainsCmd.AddCommand(domainsVerifyCmd)
+}
+
+func verifyDomains(cmd *cobra.Command, names []string) error {
+	verifier, err := domains.Configured()
+	if err != nil {
+		return configErrorf("domains-verify: %w", err)
+	}
+
+	var sites []*cdb.Site
+	if len(names) > 0 {
+		for _, name := range names {
+			site, err := lookupSite(name)
+			if err != nil {
+				return fmt.Errorf("domains-verify: %w", err)
+			}
+			sites = append(sites, site)
+		}
+	} else {
+		sites, err = cdb.GetAllSites()
+		if err != nil {
+			return gitErrorf("domains-verify: Getting all sites: %w", err)
+		}
+	}
+
+	var result domainStatuses
+	for _, site := range sites {
+		for _, domain := range site.DomainNames() {
+			result = append(result, domainStatus{Site: site.Name(), Domain: domain})
+		}
+	}
+
+	// Lookups and probes mostly wait on the network, so check several
+	// domains at once
+	sem := make(chan struct{}, domainsVerifyConcurrency)
+	var wg sync.WaitGroup
+	for i := range result {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d *domainStatus) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := verifier.Verify(runCtx, d.Domain)
+			d.Status, d.Detail = r.Status, r.Detail
+		}(&result[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Site != result[j].Site {
+			return result[i].Site < result[j].Site
+		}
+		return result[i].Domain < result[j].Domain
+	})
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("domains-verify: %w", err)
+	}
+
+	failed := 0
+	for _, d := range result {
+		if d.Status != domains.StatusOK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return newExitError(exitCheckFailed, "domains-verify: %d of %d domains failed verification", failed, len(result))
+	}
+	return nil
+}
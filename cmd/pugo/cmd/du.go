@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/usage"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var duCmd = &cobra.Command{
+	Use:   "du [site...]",
+	Short: "Report the disk space used by sites",
+	Long: `Measure the size of the docroot of each enabled site, or of the given
+sites, and report the largest, comparing each against the site's quota (in
+MiB, set with pugo site set <site> quota=<MiB>). Docroots are found at
+du.docroot, with {site} replaced by the site's name, and are read through the
+local filesystem, so pugo must run on the webserver or with its docroots
+mounted.
+
+With --notify the admins of sites over their quota are emailed, using the
+over-quota template.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return diskUsage(cmd, args)
+	},
+}
+
+type duOptions struct {
+	top    int
+	notify bool
+}
+
+var duOpts duOptions
+
+// How many docroots are measured at once
+const duConcurrency = 4
+
+// siteUsage is a single row of du output
+type siteUsage struct {
+	Site      string `json:"site" yaml:"site"`
+	Size      int64  `json:"size" yaml:"size"`
+	Quota     int    `json:"quota,omitempty" yaml:"quota,omitempty"`
+	OverQuota bool   `json:"over_quota" yaml:"over_quota"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+	site      *cdb.Site
+}
+
+type siteUsageReport []siteUsage
+
+func (r siteUsageReport) Header() []string {
+	return []string{"SITE", "SIZE (MIB)", "QUOTA (MIB)", "USED", "ERROR"}
+}
+
+func (r siteUsageReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, u := range r {
+		quota, used := "", ""
+		if u.Quota > 0 {
+			quota = strconv.Itoa(u.Quota)
+			used = fmt.Sprintf("%d%%", u.Size*100/(int64(u.Quota)*usage.MiB))
+		}
+		rows = append(rows, []string{
+			u.Site,
+			strconv.FormatInt(u.Size/usage.MiB, 10),
+			quota,
+			used,
+			u.Error,
+		})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(duCmd)
+
+	duCmd.Flags().IntVar(&duOpts.top, "top", 20, "Report only the largest sites. 0 reports every site.")
+	duCmd.Flags().BoolVar(&duOpts.notify, "notify", false, "Email the admins of sites over their quota. Implied off by dry-run.")
+}
+
+func diskUsage(cmd *cobra.Command, names []string) error {
+	var sites []*cdb.Site
+	if len(names) > 0 {
+		for _, name := range names {
+			site, err := lookupSite(name)
+			if err != nil {
+				return fmt.Errorf("du: %w", err)
+			}
+			sites = append(sites, site)
+		}
+	} else {
+		all, err := cdb.GetAllSites()
+		if err != nil {
+			return gitErrorf("du: Getting all sites: %w", err)
+		}
+		for _, site := range all {
+			if !site.Disabled {
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	result := make(siteUsageReport, 0, len(sites))
+	for _, site := range sites {
+		if _, err := usage.Docroot(site); err != nil {
+			return configErrorf("du: %w", err)
+		}
+		result = append(result, siteUsage{Site: site.Name(), Quota: site.Quota, site: site})
+	}
+
+	sem := make(chan struct{}, duConcurrency)
+	var wg sync.WaitGroup
+	for i := range result {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u *siteUsage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			docroot, _ := usage.Docroot(u.site)
+			size, err := usage.Measure(runCtx, docroot)
+			if err != nil {
+				log.Warnf("du: Measuring %s: %v", u.Site, err)
+				u.Error = err.Error()
+				return
+			}
+			u.Size = size
+			u.OverQuota = usage.OverQuota(u.site, size)
+		}(&result[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Size != result[j].Size {
+			return result[i].Size > result[j].Size
+		}
+		return result[i].Site < result[j].Site
+	})
+
+	var over []siteUsage
+	for _, u := range result {
+		if u.OverQuota {
+			over = append(over, u)
+		}
+	}
+
+	report := result
+	if duOpts.top > 0 && len(report) > duOpts.top {
+		report = report[:duOpts.top]
+	}
+	if err := writeOutput(os.Stdout, report); err != nil {
+		return fmt.Errorf("du: %w", err)
+	}
+
+	if len(over) > 0 {
+		log.Warnf("du: %d sites are over their quota", len(over))
+	}
+	if !duOpts.notify || len(over) == 0 {
+		return nil
+	}
+
+	emails, err := overQuotaEmails(over)
+	if err != nil {
+		return dbErrorf("du: %w", err)
+	}
+	if globalOpts.dryRun {
+		log.Infof("du: Performing dry run - %d emails will not be sent.", len(emails))
+		return nil
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return partialFailureErrorf("du: Unable to start email worker, emails will not be sent: %w", err)
+	}
+	defer email.ShutdownWorker()
+
+	for _, emailOpts := range emails {
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.WithFields(log.Fields{
+				"emailOpts": emailOpts,
+			}).Warnf("du: Error attempting to send email: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// overQuotaEmails looks up the admins of sites over their quota in newerpol,
+// returning the emails to send them
+func overQuotaEmails(over []siteUsage) ([]*email.EmailOptions, error) {
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	var logins []string
+	for _, u := range over {
+		logins = append(logins, u.site.Admins...)
+	}
+	people, err := newerpol.LookupPeople(runCtx, newerpolDb, logins)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*email.EmailOptions
+	for _, u := range over {
+		for _, login := range u.site.Admins {
+			person, ok := people[login]
+			if !ok || person.Email == "" {
+				log.Warnf("du: No email address for %s - skipping email", login)
+				continue
+			}
+			emails = append(emails, &email.EmailOptions{
+				FirstName: person.FirstName,
+				EmailName: person.LookupName,
+				Email:     person.Email,
+				CSP:       siteCSPName(u.site),
+				Folder:    u.site.Name(),
+				Subject:   "Website Over Disk Quota",
+				Type:      "over-quota",
+				Size:      int(u.Size / usage.MiB),
+				Quota:     u.Quota,
+			})
+		}
+	}
+
+	return emails, nil
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/email"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var emailCmd = &cobra.Command{
+	Use:   "email",
+	Short: "Email commands",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("email: Subcommand required")
+	},
+}
+
+var emailTestCmd = &cobra.Command{
+	Use:   "test <address>",
+	Short: "Send a test email",
+	Long: `Send an email of the given --type to address, filled with sample
+data, to check the email templates and SMTP settings. By default the test
+type is sent.`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendTestEmail(args[0])
+	},
+}
+
+var emailResendCmd = &cobra.Command{
+	Use:   "resend [id...]",
+	Short: "List and resend emails which couldn't be sent",
+	Long: `List the emails kept in email.dead_letter_dir because they couldn't be
+sent, even after retrying, or resend them.
+
+Without arguments the emails are listed. Emails given by id, or all of them
+with --all, are resent and removed once sent; those which fail again are kept.
+--to restricts both to emails to recipients matching a pattern (e.g.
+*@ic.ac.uk), and --since to emails which last failed since a date or
+duration ago.`,
+	Annotations: map[string]string{annotationRunLock: "true", annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resendEmails(args)
+	},
+}
+
+var emailTestType string
+
+var emailResendOpts struct {
+	all   bool
+	to    string
+	since string
+}
+
+func init() {
+	rootCmd.AddCommand(emailCmd)
+	emailCmd.AddCommand(emailTestCmd)
+	emailCmd.AddCommand(emailResendCmd)
+
+	emailTestCmd.Flags().StringVar(&emailTestType, "type", "test", "Type of email to send.")
+	emailTestCmd.RegisterFlagCompletionFunc("type", completeEmailTypes)
+
+	emailResendCmd.Flags().BoolVar(&emailResendOpts.all, "all", false, "Resend all emails (matching --to and --since).")
+	emailResendCmd.Flags().StringVar(&emailResendOpts.to, "to", "", "Only emails to a recipient matching the given pattern.")
+	emailResendCmd.Flags().StringVar(&emailResendOpts.since, "since", "", "Only emails which last failed since the given date (yyyy-mm-dd) or duration ago (e.g. 36h, 7d).")
+}
+
+// deadLetters is the list of emails which couldn't be sent
+type deadLetters []*email.DeadLetter
+
+func (d deadLetters) Header() []string {
+	return []string{"ID", "FAILED", "ATTEMPTS", "TO", "SUBJECT", "ERROR"}
+}
+
+func (d deadLetters) Rows() [][]string {
+	rows := make([][]string, 0, len(d))
+	for _, l := range d {
+		rows = append(rows, []string{
+			l.Id,
+			l.Failed.Format("2006-01-02 15:04:05"),
+			strconv.Itoa(l.Attempts),
+			strings.Join(l.To, ", "),
+			l.Subject,
+			l.Error,
+		})
+	}
+	return rows
+}
+
+// completeEmailTypes completes the types of email which can be sent
+func completeEmailTypes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return email.Types(), cobra.ShellCompDirectiveNoFileComp
+}
+
+func sendTestEmail(address string) error {
+	if err := validateOneOf(email.Types()...)(emailTestType); err != nil {
+		return fmt.Errorf("email-test: Invalid --type: %v", err)
+	}
+	if err := validateEmail(address); err != nil {
+		return fmt.Errorf("email-test: %v", err)
+	}
+
+	if globalOpts.dryRun {
+		log.Infof("email-test: Dry run, not sending %s email to %s", emailTestType, address)
+		return nil
+	}
+
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return fmt.Errorf("email-test: %w", err)
+	}
+	err := email.SendEmail(&email.EmailOptions{
+		CSP:       "Test Society",
+		Email:     address,
+		FirstName: "Test",
+		Folder:    "test",
+		Subject:   fmt.Sprintf("pugo test email (%s)", emailTestType),
+		Type:      emailTestType,
+		Added:     []string{"abc123"},
+		Removed:   []string{"xyz789"},
+		PhpFrom:   "7.4",
+		PhpTo:     "8.3",
+		Size:      1200,
+		Quota:     1000,
+
+		ConfirmURL: "https://pugo.example.com/confirm/0123456789abcdef0123456789abcdef",
+	})
+	email.ShutdownWorker()
+	if err != nil {
+		return fmt.Errorf("email-test: %w", err)
+	}
+
+	if _, failed := email.Stats(); failed > 0 {
+		return fmt.Errorf("email-test: Sending to %s failed", address)
+	}
+	log.Infof("email-test: Sent %s email to %s", emailTestType, address)
+	return nil
+}
+
+func resendEmails(ids []string) error {
+	if emailResendOpts.all && len(ids) > 0 {
+		return fmt.Errorf("email-resend: Give either ids or --all, not both")
+	}
+	if emailResendOpts.to != "" {
+		if _, err := path.Match(emailResendOpts.to, ""); err != nil {
+			return fmt.Errorf("email-resend: Invalid --to pattern '%s': %v", emailResendOpts.to, err)
+		}
+	}
+	var since time.Time
+	if emailResendOpts.since != "" {
+		var err error
+		if since, err = parseSince(emailResendOpts.since); err != nil {
+			return fmt.Errorf("email-resend: %v", err)
+		}
+	}
+
+	letters, err := email.ListDeadLetters(&conf.Email)
+	if err != nil {
+		return fmt.Errorf("email-resend: %w", err)
+	}
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var matching deadLetters
+	for _, l := range letters {
+		if len(ids) > 0 && !wanted[l.Id] {
+			continue
+		}
+		delete(wanted, l.Id)
+		if !since.IsZero() && l.Failed.Before(since) {
+			continue
+		}
+		if emailResendOpts.to != "" && !matchesRecipient(l, emailResendOpts.to) {
+			continue
+		}
+		matching = append(matching, l)
+	}
+	for id := range wanted {
+		return fmt.Errorf("email-resend: No email %s to resend", id)
+	}
+
+	if len(ids) == 0 && !emailResendOpts.all {
+		return writeOutput(os.Stdout, matching)
+	}
+	if len(matching) == 0 {
+		log.Info("email-resend: No emails to resend")
+		return nil
+	}
+	if globalOpts.dryRun {
+		log.Infof("email-resend: Dry run, not resending %d emails", len(matching))
+		return writeOutput(os.Stdout, matching)
+	}
+
+	sent, err := email.Resend(runCtx, &conf.Email, matching)
+	if err != nil {
+		return partialFailureErrorf("email-resend: %w", err)
+	}
+	log.Infof("email-resend: Resent %d of %d emails", sent, len(matching))
+	if sent < len(matching) {
+		return partialFailureErrorf("email-resend: %d emails failed again and were kept", len(matching)-sent)
+	}
+	return nil
+}
+
+// matchesRecipient reports whether any recipient of l matches pattern
+func matchesRecipient(l *email.DeadLetter, pattern string) bool {
+	for _, to := range l.To {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(to)); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// Exit codes returned by pugo. Wrapping scripts and monitoring can use
+// these to distinguish between failure modes.
+const (
+	exitOK             = 0
+	exitGeneralError   = 1 // Unclassified error, including usage errors
+	exitConfigError    = 2 // Missing or invalid configuration
+	exitDbError        = 3 // Error connecting to or querying Newerpol
+	exitGitError       = 4 // Error reading or updating the cdb repo
+	exitPartialFailure = 5 // Changes were only partially applied
+	exitCheckFailed    = 6 // A monitoring check (e.g. status --max-age) failed
+	exitLocked         = 7 // Another pugo run holds the run lock
+)
+
+// exitError associates an exit code with an error returned from a command
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func newExitError(code int, format string, args ...interface{}) error {
+	return &exitError{
+		code: code,
+		err:  fmt.Errorf(format, args...),
+	}
+}
+
+func configErrorf(format string, args ...interface{}) error {
+	return newExitError(exitConfigError, format, args...)
+}
+
+func dbErrorf(format string, args ...interface{}) error {
+	return newExitError(exitDbError, format, args...)
+}
+
+func gitErrorf(format string, args ...interface{}) error {
+	return newExitError(exitGitError, format, args...)
+}
+
+func partialFailureErrorf(format string, args ...interface{}) error {
+	return newExitError(exitPartialFailure, format, args...)
+}
+
+// exitCode determines the exit code for an error returned from a command
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, cdb.ErrPathNotConfigured) {
+		return exitConfigError
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return exitGeneralError
+}
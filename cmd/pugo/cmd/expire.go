@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var expireCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "Enforce site expiry dates",
+	Long: `Find sites whose expiry date has passed and remove all admins
+who are not also immortal admins. With --disable the sites are disabled
+instead, leaving their admins untouched. With --notify the removed admins are
+sent the standard access removed email.`,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return expireSites(cmd)
+	},
+}
+
+type expireOptions struct {
+	disable bool
+	notify  bool
+}
+
+var expireOpts expireOptions
+
+// removedAdmin records an admin removed from a site so they can be notified
+type removedAdmin struct {
+	login string
+	site  *cdb.Site
+}
+
+func init() {
+	rootCmd.AddCommand(expireCmd)
+	addForceFlag(expireCmd)
+
+	expireCmd.Flags().BoolVar(&expireOpts.disable, "disable", false, "Disable expired sites instead of removing their admins.")
+	expireCmd.Flags().BoolVar(&expireOpts.notify, "notify", false, "Email admins removed from expired sites. Implied off by dry-run.")
+	addPlanOutFlag(expireCmd)
+}
+
+func expireSites(cmd *cobra.Command) error {
+	log.Info("expire: Starting expiry ...")
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("expire: Getting all sites: %w", err)
+	}
+	sites = withoutProtected("expire", sites)
+
+	// Find expired sites
+	var expired []*cdb.Site
+	for _, site := range sites {
+		if _, err := site.ExpiryTime(); err != nil {
+			log.Warnf("expire: %v, skipping", err)
+			continue
+		}
+		if site.Expired() {
+			if expireOpts.disable && site.Disabled {
+				continue
+			}
+			expired = append(expired, site)
+		}
+	}
+
+	if len(expired) == 0 {
+		log.Info("expire: No expired sites found")
+		return nil
+	}
+
+	// Confirm before making changes
+	summary := fmt.Sprintf("This will remove non-immortal admins from %d expired sites.", len(expired))
+	if expireOpts.disable {
+		summary = fmt.Sprintf("This will disable %d expired sites.", len(expired))
+	}
+	proceed, err := confirm(summary)
+	if err != nil {
+		return fmt.Errorf("expire: %w", err)
+	}
+	if !proceed {
+		log.Info("expire: Aborted")
+		return nil
+	}
+
+	// Update sites
+	siteIdsToCommit := make(map[int]bool)
+	var removed []removedAdmin
+	for _, site := range expired {
+		if expireOpts.disable {
+			log.Infof("expire: Disabling %s (expired %s)", site.Name(), site.Expiry)
+			site.Disabled = true
+			site.DisabledReason = fmt.Sprintf("Expired %s", site.Expiry)
+			site.MarkAsChanged()
+		} else {
+			for _, login := range append([]string{}, site.Admins...) {
+				if site.RemoveAdminChecked(login) != cdb.AdminRemoved {
+					continue
+				}
+				log.Infof("expire: Removed %s from %s (expired %s)", login, site.Name(), site.Expiry)
+				removed = append(removed, removedAdmin{login: login, site: site})
+			}
+		}
+		if site.Changed() {
+			siteIdsToCommit[site.Id] = true
+		}
+	}
+
+	// Commit changes to repo
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         "Remove admins from expired sites",
+		Cmd:             "expire",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if expireOpts.disable {
+		commitOpts.Message = "Disable expired sites"
+	}
+
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("expire: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"Ids":             siteIdsToCommit,
+		"Message":         commitOpts.Message,
+		"Cmd":             "expire",
+		"DryRun":          globalOpts.dryRun,
+		"ForceUpdateTree": globalOpts.forceUpdateTree,
+		"NoPush":          globalOpts.noPush,
+	}).Debugf("expire: Committing sites")
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("expire: %w", err)
+	}
+
+	var emails []*email.EmailOptions
+	if expireOpts.notify && len(removed) > 0 && (!globalOpts.dryRun || planOut != "") {
+		if emails, err = removedAdminEmails("expire", removed); err != nil {
+			// cdb changes have already been committed unless this is a
+			// dry run
+			if globalOpts.dryRun {
+				return dbErrorf("expire: %w", err)
+			}
+			return partialFailureErrorf("expire: %w", err)
+		}
+	}
+
+	if globalOpts.dryRun {
+		if planOut != "" {
+			if err := writePlan(cmd.CommandPath(), commitOpts, nil, emails); err != nil {
+				return fmt.Errorf("expire: %w", err)
+			}
+		}
+		if len(emails) > 0 {
+			log.Info("expire: Performing dry run - emails will not be sent.")
+		}
+		return nil
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+
+	// Notify removed admins
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return partialFailureErrorf("expire: Unable to start email worker, emails will not be sent: %w", err)
+	}
+	defer email.ShutdownWorker()
+
+	for _, emailOpts := range emails {
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.WithFields(log.Fields{
+				"emailOpts": emailOpts,
+			}).Warnf("expire: Error attempting to send email: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// removedAdminEmails looks up admins removed from sites in newerpol,
+// returning the standard access removed emails to send them. logPrefix is
+// the command name used when logging.
+func removedAdminEmails(logPrefix string, removed []removedAdmin) ([]*email.EmailOptions, error) {
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	var logins []string
+	for _, r := range removed {
+		logins = append(logins, r.login)
+	}
+	people, err := newerpol.LookupPeople(runCtx, newerpolDb, logins)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*email.EmailOptions
+	for _, r := range removed {
+		person, ok := people[r.login]
+		if !ok || person.Email == "" {
+			log.Warnf("%s: No email address for %s - skipping email", logPrefix, r.login)
+			continue
+		}
+		emails = append(emails, &email.EmailOptions{
+			FirstName: person.FirstName,
+			EmailName: person.LookupName,
+			Email:     person.Email,
+			CSP:       siteCSPName(r.site),
+			Folder:    r.site.Name(),
+			Subject:   "Website Access Removed",
+			Type:      "revoked",
+		})
+	}
+
+	return emails, nil
+}
@@ -13,7 +13,10 @@ import (
 var expiryCmd = &cobra.Command{
 	Use:   "expiry [yyyy-mm-dd]",
 	Short: "Reset user expiry date",
-	Long:  `Reset user expiry date on all sites to the specified date`,
+	Long: `Reset user expiry date on all sites to the specified date.
+
+The reset can be restricted to particular sites with --site (by name or id)
+and to sites matching --filter expressions, as for pugo list.`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 1 {
 			return fmt.Errorf("Requires a single date argument in the form yyyy-mm-dd")
@@ -24,14 +27,19 @@ var expiryCmd = &cobra.Command{
 		}
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
 		date, _ := time.Parse("2006-01-02", args[0])
-		resetExpiry(cmd, date)
+		return resetExpiry(cmd, date)
 	},
 }
 
 func init() {
 	resetCmd.AddCommand(expiryCmd)
+	addForceFlag(expiryCmd)
+
+	addResetScopeFlags(expiryCmd)
+	addPlanOutFlag(expiryCmd)
 }
 
 func resetExpiry(cmd *cobra.Command, date time.Time) error {
@@ -44,14 +52,36 @@ func resetExpiry(cmd *cobra.Command, date time.Time) error {
 		log.Warn("reset-expiry: new expiry date does not co-incide with year end (31 July)")
 	}
 
-	siteIdsToCommit := make(map[int]bool)
-
-	// Update sites
 	sites, err := cdb.GetAllSites()
 	if err != nil {
-		log.Fatalf("reset-expiry: Getting all sites: %v", err)
+		return gitErrorf("reset-expiry: Getting all sites: %w", err)
+	}
+	sites, err = scopeResetSites("reset-expiry", sites)
+	if err != nil {
+		return fmt.Errorf("reset-expiry: %w", err)
+	}
+	sites = withoutProtected("reset-expiry", sites)
+	if resetScoped() && len(sites) == 0 {
+		log.Info("reset-expiry: No sites to reset")
+		return nil
 	}
 
+	// Confirm before rewriting expiry on every site
+	scope := "all"
+	if resetScoped() {
+		scope = "the"
+	}
+	proceed, err := confirm(fmt.Sprintf("This will set the expiry date of %s %d sites to %s.", scope, len(sites), date.Format("2006-01-02")))
+	if err != nil {
+		return fmt.Errorf("reset-expiry: %w", err)
+	}
+	if !proceed {
+		log.Info("reset-expiry: Aborted")
+		return nil
+	}
+
+	// Update sites
+	siteIdsToCommit := make(map[int]bool)
 	for _, site := range sites {
 		site.Expiry = date.Format("2006-01-02")
 		site.MarkAsChanged()
@@ -67,7 +97,13 @@ func resetExpiry(cmd *cobra.Command, date time.Time) error {
 		ForceUpdateTree: globalOpts.forceUpdateTree,
 		NoPush:          globalOpts.noPush,
 	}
+	if resetScoped() {
+		commitOpts.Message += " on " + resetScopeDescription(sites)
+	}
 
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("reset-expiry: %w", err)
+	}
 	log.WithFields(log.Fields{
 		"Ids":             siteIdsToCommit,
 		"Message":         commitOpts.Message,
@@ -76,8 +112,16 @@ func resetExpiry(cmd *cobra.Command, date time.Time) error {
 		"ForceUpdateTree": globalOpts.forceUpdateTree,
 		"NoPush":          globalOpts.noPush,
 	}).Debugf("reset-expiry: Committing sites")
-	if err := cdb.CommitSites(commitOpts); err != nil {
-		log.Fatalf("reset-expiry: %v", err)
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("reset-expiry: %w", err)
+	}
+
+	if planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("reset-expiry: %w", err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var siteExpiryCmd = &cobra.Command{
+	Use:   "expiry",
+	Short: "Manage the expiry date of individual sites",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("expiry: Subcommand required")
+	},
+}
+
+var siteExpirySetCmd = &cobra.Command{
+	Use:   "set <site> <yyyy-mm-dd>",
+	Short: "Set the expiry date of a single site",
+	Long: `Set the user expiry date of a single site and commit the change, e.g.
+to extend a project site part way through the year. Unlike pugo reset expiry
+only the named site is changed.
+
+The date must be given as YYYY-MM-DD. A date in the past, or earlier than the
+site's current expiry, is allowed but warned about. Protected sites are only
+changed with --force.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("Requires a site and a date in the form yyyy-mm-dd")
+		}
+		if _, err := time.Parse(cdb.ExpiryFormat, args[1]); err != nil {
+			return fmt.Errorf("Invalid date specified: %s", args[1])
+		}
+		return nil
+	},
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationRunLock: "true", annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		date, _ := time.Parse(cdb.ExpiryFormat, args[1])
+		return doSiteExpirySet(cmd, args[0], date)
+	},
+}
+
+type siteExpiryOptions struct {
+	reason string
+	force  bool
+}
+
+var siteExpiryOpts siteExpiryOptions
+
+func init() {
+	rootCmd.AddCommand(siteExpiryCmd)
+	siteExpiryCmd.AddCommand(siteExpirySetCmd)
+
+	siteExpirySetCmd.Flags().StringVar(&siteExpiryOpts.reason, "reason", "", "Reason for the change, recorded in the commit message.")
+	siteExpirySetCmd.Flags().BoolVar(&siteExpiryOpts.force, "force", false, "Change the site even if it is protected.")
+	addPlanOutFlag(siteExpirySetCmd)
+	addNoCommitFlag(siteExpirySetCmd)
+}
+
+func doSiteExpirySet(cmd *cobra.Command, nameOrId string, date time.Time) error {
+	site, err := lookupSite(nameOrId)
+	if err != nil {
+		return fmt.Errorf("expiry-set: %w", err)
+	}
+	if err := checkNotProtected(site, siteExpiryOpts.force); err != nil {
+		return fmt.Errorf("expiry-set: %w", err)
+	}
+
+	expiry := date.Format(cdb.ExpiryFormat)
+	if site.Expiry == expiry {
+		log.Infof("expiry-set: No change to %s, it already expires on %s", site.Name(), expiry)
+		return nil
+	}
+	if date.Before(time.Now()) {
+		log.Warnf("expiry-set: New expiry date %s is in the past, so %s's users will expire immediately", expiry, site.Name())
+	}
+	if current, err := time.Parse(cdb.ExpiryFormat, site.Expiry); err == nil && date.Before(current) {
+		log.Warnf("expiry-set: New expiry date %s is earlier than the current one (%s)", expiry, site.Expiry)
+	}
+
+	before := site.Expiry
+	if before == "" {
+		before = "none"
+	}
+	proceed, err := confirm(fmt.Sprintf("This will change the expiry date of %s from %s to %s.", site.Name(), before, expiry))
+	if err != nil {
+		return fmt.Errorf("expiry-set: %w", err)
+	}
+	if !proceed {
+		log.Info("expiry-set: Aborted")
+		return nil
+	}
+
+	site.Expiry = expiry
+	site.MarkAsChanged()
+	log.Infof("expiry-set: %s: expiry %s -> %s", site.Name(), before, expiry)
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             map[int]bool{site.Id: true},
+		Message:         attributedMessage(fmt.Sprintf("Set expiry date of %s to %s", site.Name(), expiry), siteExpiryOpts.reason),
+		Cmd:             "expiry set",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+		NoCommit:        noCommit,
+		AllowProtected:  siteExpiryOpts.force,
+	}
+	if globalOpts.dryRun && planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("expiry-set: %w", err)
+		}
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("expiry-set: %w", err)
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("expiry-set: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runFailure is a site or grant which a command failed to process. Commands
+// working through many sites record failures and carry on with the rest,
+// then report them together and exit with exitPartialFailure
+type runFailure struct {
+	Site     string `json:"site"`
+	AccessId int    `json:"access_id,omitempty"`
+	Stage    string `json:"stage"`
+	Error    string `json:"error"`
+}
+
+type failureReport []runFailure
+
+func (r failureReport) Header() []string {
+	return []string{"SITE", "GRANT", "STAGE", "ERROR"}
+}
+
+func (r failureReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, f := range r {
+		grant := ""
+		if f.AccessId > 0 {
+			grant = strconv.Itoa(f.AccessId)
+		}
+		rows = append(rows, []string{f.Site, grant, f.Stage, f.Error})
+	}
+	return rows
+}
+
+// recordFailure logs and records a site or grant which failed, leaving the
+// command to carry on with the rest
+func recordFailure(logPrefix string, f runFailure) {
+	if f.AccessId > 0 {
+		log.Errorf("%s: Failed to %s grant %d for %s, skipping: %s", logPrefix, f.Stage, f.AccessId, f.Site, f.Error)
+	} else {
+		log.Errorf("%s: Failed to %s site %s, skipping: %s", logPrefix, f.Stage, f.Site, f.Error)
+	}
+	runSummary.recordFailure(f)
+}
+
+// recordLoadFailures loads every site, and records each site file which
+// can't be loaded as a failure, once. The sites in them aren't found by the
+// command, so are skipped. Returns an error if the cdb can't be read at all.
+func recordLoadFailures(logPrefix string) error {
+	if _, err := cdb.GetAllSites(); err != nil {
+		return gitErrorf("%s: %w", logPrefix, err)
+	}
+	for _, loadError := range cdb.LoadErrors() {
+		recordFailure(logPrefix, runFailure{
+			Site:  strings.TrimSuffix(loadError.FileName, ".yaml"),
+			Stage: "load",
+			Error: loadError.Error(),
+		})
+	}
+	return nil
+}
+
+// orUnloadable qualifies a site not being found in the cdb when it may be in
+// one of the site files which couldn't be loaded
+func orUnloadable() string {
+	if len(cdb.LoadErrors()) > 0 {
+		return " (or in a site file which can't be loaded)"
+	}
+	return ""
+}
+
+// reportFailures writes a report of the failures recorded by the command,
+// if any, returning the partial failure error for the command to exit with
+func reportFailures(logPrefix string) error {
+	failures := runSummary.failures()
+	if len(failures) == 0 {
+		return nil
+	}
+	if err := writeOutput(os.Stdout, failures); err != nil {
+		log.Warnf("%s: Unable to write failure report: %v", logPrefix, err)
+	}
+	return partialFailureErrorf("%s: %d sites or grants failed and were skipped, see report", logPrefix, len(failures))
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// siteFilter reports whether a site matches a filter expression
+type siteFilter func(site *cdb.Site) bool
+
+// parseSiteFilters parses filter expressions of the form field=value.
+// Supported fields are:
+//
+//	id        site id
+//	name      site name or alias (shell glob pattern)
+//	email     site email address (shell glob pattern)
+//	admin     login present in the site's admins
+//	expiry    expiry date (yyyy-mm-dd)
+//	disabled  true or false
+func parseSiteFilters(exprs []string) ([]siteFilter, error) {
+	var filters []siteFilter
+
+	for _, expr := range exprs {
+		parts := strings.SplitN(expr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid filter '%s': must be of the form field=value", expr)
+		}
+		field, value := parts[0], parts[1]
+
+		switch field {
+		case "id":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': id must be an integer", expr)
+			}
+			filters = append(filters, func(site *cdb.Site) bool {
+				return site.Id == id
+			})
+		case "name":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': %v", expr, err)
+			}
+			filters = append(filters, func(site *cdb.Site) bool {
+				for _, name := range append([]string{site.Name()}, site.Aliases...) {
+					if matched, _ := path.Match(value, name); matched {
+						return true
+					}
+				}
+				return false
+			})
+		case "email":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': %v", expr, err)
+			}
+			filters = append(filters, func(site *cdb.Site) bool {
+				matched, _ := path.Match(value, site.Email)
+				return matched
+			})
+		case "admin":
+			filters = append(filters, func(site *cdb.Site) bool {
+				for _, admin := range site.Admins {
+					if admin == value {
+						return true
+					}
+				}
+				return false
+			})
+		case "expiry":
+			filters = append(filters, func(site *cdb.Site) bool {
+				return site.Expiry == value
+			})
+		case "disabled":
+			disabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': disabled must be true or false", expr)
+			}
+			filters = append(filters, func(site *cdb.Site) bool {
+				return site.Disabled == disabled
+			})
+		default:
+			return nil, fmt.Errorf("invalid filter '%s': unknown field '%s'", expr, field)
+		}
+	}
+
+	return filters, nil
+}
+
+// filterSites returns the sites matching all of the supplied filters
+func filterSites(sites []*cdb.Site, filters []siteFilter) []*cdb.Site {
+	var matched []*cdb.Site
+
+SITES:
+	for _, site := range sites {
+		for _, filter := range filters {
+			if !filter(site) {
+				continue SITES
+			}
+		}
+		matched = append(matched, site)
+	}
+
+	return matched
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt",
+	Short: "Rewrite site files in pugo's format",
+	Long: `Rewrite the site files which differ from the way pugo writes them,
+e.g. after hand edits, and commit them as a single change.
+
+With --normalize-admins the admins and immortal admins of every site are also
+normalized as configured by cdb.logins (trimming whitespace, lowercasing, and
+stripping domain suffixes), removing entries which then duplicate another.`,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return formatSites(cmd)
+	},
+}
+
+type fmtOptions struct {
+	normalizeAdmins bool
+	reason          string
+}
+
+var fmtOpts fmtOptions
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+	addForceFlag(fmtCmd)
+
+	fmtCmd.Flags().BoolVar(&fmtOpts.normalizeAdmins, "normalize-admins", false, "Normalize the logins of each site's admins as configured by cdb.logins.")
+	fmtCmd.Flags().StringVar(&fmtOpts.reason, "reason", "", "Reason for the change, recorded in the commit message.")
+}
+
+func formatSites(cmd *cobra.Command) error {
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("fmt: Getting all sites: %w", err)
+	}
+	sites = withoutProtected("fmt", sites)
+
+	siteIdsToCommit := make(map[int]bool)
+	for _, site := range sites {
+		if fmtOpts.normalizeAdmins && site.NormalizeAdmins() {
+			log.Infof("fmt: Normalized admins of %s", site.Name())
+			siteIdsToCommit[site.Id] = true
+			continue
+		}
+		unformatted, err := site.Unformatted()
+		if err != nil {
+			return gitErrorf("fmt: %w", err)
+		}
+		if unformatted {
+			log.Infof("fmt: Reformatting %s", site.Name())
+			site.MarkAsChanged()
+			siteIdsToCommit[site.Id] = true
+		}
+	}
+	if len(siteIdsToCommit) == 0 {
+		log.Info("fmt: Nothing to do")
+		return nil
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will rewrite %d site files.", len(siteIdsToCommit)))
+	if err != nil {
+		return fmt.Errorf("fmt: %w", err)
+	}
+	if !proceed {
+		log.Info("fmt: Aborted")
+		return nil
+	}
+
+	message := fmt.Sprintf("Format %d sites", len(siteIdsToCommit))
+	if fmtOpts.normalizeAdmins {
+		message = fmt.Sprintf("Format %d sites and normalize admins", len(siteIdsToCommit))
+	}
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         attributedMessage(message, fmtOpts.reason),
+		Cmd:             "fmt",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("fmt: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the integrity of the cdb",
+	Long: `Check the cdb for problems which pugo's own changes can't introduce
+but hand edits can:
+
+  load            site files which can't be loaded
+  duplicate-id    sites sharing an id
+  archived-id     sites sharing an id with an archived site
+  duplicate-name  site names differing only in case, and clashing aliases
+  name-mismatch   sites whose paths don't include /<name>
+  immortal-admin  immortal admins also listed in admins
+  required-field  an empty id, full-name, email, or paths
+  manifest        site files which don't match the integrity manifest
+                  (sites.sha256), e.g. corrupted or edited outside pugo
+
+With --fix the problems which can be repaired automatically (marked FIXABLE)
+are fixed and committed as a single change. The others must be fixed by hand.
+The command exits with a non-zero status if any problems remain. Ranges of
+unused ids are also logged, though as sites are removed they aren't problems.
+
+Once site files changed outside pugo have been checked, --accept-manifest
+records their current contents in the integrity manifest and commits it
+before checking, so they can be loaded again.`,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fsck(cmd)
+	},
+}
+
+type fsckOptions struct {
+	fix            bool
+	acceptManifest bool
+}
+
+var fsckOpts fsckOptions
+
+// fsckProblem is a single row of fsck output
+type fsckProblem struct {
+	Site    string `json:"site" yaml:"site"`
+	Check   string `json:"check" yaml:"check"`
+	Problem string `json:"problem" yaml:"problem"`
+	Fixable bool   `json:"fixable" yaml:"fixable"`
+}
+
+type fsckProblems []fsckProblem
+
+func (p fsckProblems) Header() []string {
+	return []string{"SITE", "CHECK", "PROBLEM", "FIXABLE"}
+}
+
+func (p fsckProblems) Rows() [][]string {
+	rows := make([][]string, 0, len(p))
+	for _, problem := range p {
+		rows = append(rows, []string{
+			problem.Site,
+			problem.Check,
+			problem.Problem,
+			strconv.FormatBool(problem.Fixable),
+		})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	addForceFlag(fsckCmd)
+
+	fsckCmd.Flags().BoolVar(&fsckOpts.fix, "fix", false, "Fix and commit the problems which can be repaired automatically.")
+	fsckCmd.Flags().BoolVar(&fsckOpts.acceptManifest, "accept-manifest", false, "Record the current contents of every site file in the integrity manifest and commit it before checking.")
+}
+
+func fsck(cmd *cobra.Command) error {
+	if fsckOpts.acceptManifest {
+		if err := fsckAcceptManifest(); err != nil {
+			return err
+		}
+	}
+
+	// Only fixing writes to the cdb, so otherwise report site files which
+	// can't be loaded rather than failing on them
+	if !fsckOpts.fix {
+		cdb.EnableTolerantLoading()
+	}
+
+	problems, err := cdb.Fsck()
+	if err != nil {
+		return gitErrorf("fsck: %w", err)
+	}
+
+	result := make(fsckProblems, 0, len(problems))
+	var fixable []*cdb.Problem
+	duplicateIds := false
+	for _, problem := range problems {
+		result = append(result, fsckProblem{
+			Site:    problem.Site,
+			Check:   problem.Check,
+			Problem: problem.Message,
+			Fixable: problem.Fixable(),
+		})
+		if problem.Fixable() {
+			fixable = append(fixable, problem)
+		}
+		if problem.Check == cdb.CheckDuplicateId {
+			duplicateIds = true
+		}
+	}
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("fsck: %w", err)
+	}
+
+	// Gaps in ids aren't problems, as sites are removed, but are worth
+	// knowing about when allocating ids by hand
+	if gaps, err := cdb.IdGaps(); err != nil {
+		log.Warnf("fsck: %v", err)
+	} else if len(gaps) > 0 {
+		var ranges []string
+		for _, gap := range gaps {
+			if gap[0] == gap[1] {
+				ranges = append(ranges, strconv.Itoa(gap[0]))
+			} else {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", gap[0], gap[1]))
+			}
+		}
+		log.Infof("fsck: Unused ids below the highest: %s", strings.Join(ranges, ", "))
+	}
+
+	remaining := len(problems)
+	if fsckOpts.fix && len(fixable) > 0 && duplicateIds {
+		// Sites are committed by id, so only one of each set of sites
+		// sharing an id would be saved
+		log.Warn("fsck: Not fixing problems until duplicate ids are fixed by hand")
+	} else if fsckOpts.fix && len(fixable) > 0 {
+		fixed, err := fsckFix(cmd, fixable)
+		if err != nil {
+			return err
+		}
+		if fixed && !globalOpts.dryRun {
+			remaining -= len(fixable)
+		}
+	}
+
+	if remaining > 0 {
+		return newExitError(exitCheckFailed, "fsck: %d problems found", remaining)
+	}
+	return nil
+}
+
+// fsckAcceptManifest records the current contents of the site files in the
+// integrity manifest
+func fsckAcceptManifest() error {
+	proceed, err := confirm("This will accept the current contents of every site file as correct.")
+	if err != nil {
+		return fmt.Errorf("fsck: %w", err)
+	}
+	if !proceed {
+		log.Info("fsck: Aborted")
+		return nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Message:         "Accept site files in integrity manifest",
+		Cmd:             "fsck",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("fsck: %w", err)
+	}
+	accepted, commitResult, err := cdb.AcceptManifest(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("fsck: %w", err)
+	}
+	action := "Accepted"
+	if globalOpts.dryRun {
+		action = "Would accept"
+	}
+	for _, fn := range accepted {
+		log.Infof("fsck: %s %s", action, fn)
+	}
+	return nil
+}
+
+// fsckFix fixes problems and commits the sites changed, returning whether
+// they were fixed
+func fsckFix(cmd *cobra.Command, problems []*cdb.Problem) (bool, error) {
+	proceed, err := confirm(fmt.Sprintf("This will fix %d problems.", len(problems)))
+	if err != nil {
+		return false, fmt.Errorf("fsck: %w", err)
+	}
+	if !proceed {
+		log.Info("fsck: Aborted")
+		return false, nil
+	}
+
+	for _, problem := range problems {
+		log.Infof("fsck: Fixing %s: %s", problem.Site, problem.Message)
+		problem.Fix()
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Message:         fmt.Sprintf("Fix %d integrity problems", len(problems)),
+		Cmd:             "fsck",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return false, fmt.Errorf("fsck: %w", err)
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return false, gitErrorf("fsck: %w", err)
+	}
+
+	if planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return false, fmt.Errorf("fsck: %w", err)
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var gendocsCmd = &cobra.Command{
+	Use:   "gendocs <dir>",
+	Short: "Generate man pages and Markdown reference",
+	Long: `Generate reference documentation for every pugo command and flag.
+Man pages are written to <dir>/man and Markdown to <dir>/markdown. Existing
+files with the same names are overwritten.
+
+The docs are the same each time they are generated from the same pugo, so
+aren't dated: man pages are given the date in SOURCE_DATE_EPOCH (seconds
+since the Unix epoch) if it is set, e.g. the time of the commit built, or
+else the zero date.`,
+	Annotations: map[string]string{annotationNoConfig: "true"},
+	Args:        cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return genDocs(cmd, args[0])
+	},
+}
+
+type gendocsOptions struct {
+	format string
+}
+
+var gendocsOpts gendocsOptions
+
+func init() {
+	rootCmd.AddCommand(gendocsCmd)
+
+	gendocsCmd.Flags().StringVar(&gendocsOpts.format, "format", "all", "Documentation format to generate: man, markdown, or all.")
+}
+
+func genDocs(cmd *cobra.Command, dir string) error {
+	genMan := gendocsOpts.format == "man" || gendocsOpts.format == "all"
+	genMarkdown := gendocsOpts.format == "markdown" || gendocsOpts.format == "all"
+	if !genMan && !genMarkdown {
+		return fmt.Errorf("gendocs: Unknown format '%s'", gendocsOpts.format)
+	}
+
+	// Omit the generation date so regenerating unchanged docs produces no
+	// diff. Each command's page checks its own setting.
+	disableAutoGenTag(rootCmd)
+
+	if genMan {
+		manDir := filepath.Join(dir, "man")
+		if err := os.MkdirAll(manDir, 0755); err != nil {
+			return fmt.Errorf("gendocs: %w", err)
+		}
+		date, err := manDate()
+		if err != nil {
+			return fmt.Errorf("gendocs: %w", err)
+		}
+		header := &doc.GenManHeader{
+			Title:   "PUGO",
+			Section: "1",
+			Source:  "Imperial College Union",
+			Date:    &date,
+		}
+		if err := doc.GenManTree(rootCmd, header, manDir); err != nil {
+			return fmt.Errorf("gendocs: Generating man pages: %w", err)
+		}
+		log.Infof("gendocs: Man pages written to %s", manDir)
+	}
+
+	if genMarkdown {
+		markdownDir := filepath.Join(dir, "markdown")
+		if err := os.MkdirAll(markdownDir, 0755); err != nil {
+			return fmt.Errorf("gendocs: %w", err)
+		}
+		if err := doc.GenMarkdownTree(rootCmd, markdownDir); err != nil {
+			return fmt.Errorf("gendocs: Generating Markdown: %w", err)
+		}
+		log.Infof("gendocs: Markdown reference written to %s", markdownDir)
+	}
+
+	return nil
+}
+
+// disableAutoGenTag omits the generation date from the docs of cmd and every
+// command under it
+func disableAutoGenTag(cmd *cobra.Command) {
+	cmd.DisableAutoGenTag = true
+	for _, c := range cmd.Commands() {
+		disableAutoGenTag(c)
+	}
+}
+
+// manDate returns the date man pages are given: that in SOURCE_DATE_EPOCH,
+// as for reproducible builds, or the zero time, rather than today's date,
+// which cobra uses otherwise
+func manDate() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH '%s'", epoch)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
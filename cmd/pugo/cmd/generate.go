@@ -0,0 +1,399 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/generate"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var generateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate artefacts from the cdb",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("generate: Subcommand required")
+	},
+}
+
+var generateIndexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "Generate an HTML directory of sites",
+	Long: `Generate a browsable HTML directory of the sites in the cdb, grouped
+by the CSP which owns them in eActivities (as recorded by pugo sync
+metadata), listing each site's URLs and contact address. Sites' paths are listed as URLs under probe.base_url.
+
+The directory is rendered with a built in template, or the Go html/template
+given by --template or generate.index.template, and written to --out or
+standard output.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return generateIndex(cmd)
+	},
+}
+
+var generateAccessCmd = &cobra.Command{
+	Use:   "access [site...]",
+	Short: "Generate webserver access-control files from admins",
+	Long: `Generate access-control files for sites protected at the webserver
+layer, allowing each site's admins and immortal admins by login. With
+--format htgroup a single Apache group file, htgroup, is written with a group
+per site; with --format require a file per site, <site>.conf, is written
+containing a Require directive. Logins are authenticated by the webserver
+against the college directory, so no password (htpasswd) files are needed.
+Each login is written as the principal given by principals.format, e.g.
+{login}@IC.AC.UK for Kerberos.
+
+Files are written to --out-dir for every site, or the given sites,
+optionally restricted with --filter as for pugo list. Disabled and expired
+sites are denied to everyone, and files generated for sites which have since
+been removed from the cdb are deleted, so access ends with the site.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return generateAccess(cmd, args)
+	},
+}
+
+var generateEnvCmd = &cobra.Command{
+	Use:   "env [site...]",
+	Short: "Generate per-site environment files",
+	Long: `Generate a file per site setting the environment variables in its
+env, for inclusion in the site's PHP-FPM pool or Apache configuration. With
+--format fpm, <site>.conf contains env[NAME] pool directives; with --format
+apache, <site>.conf contains SetEnv directives, e.g. for Passenger apps; and
+with --format dotenv, <site>.env contains NAME="value" lines.
+
+Files are written to --out-dir for every enabled site, or the given sites,
+optionally restricted with --filter as for pugo list. Sites with an empty env
+get a file without variables, so variables removed from the cdb are removed
+from the site.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return generateEnv(cmd, args)
+	},
+}
+
+var generateShellCmd = &cobra.Command{
+	Use:   "shell [site...]",
+	Short: "Generate SSH and SFTP access files from admins",
+	Long: `Generate files giving each site's admins and immortal admins shell
+or SFTP access to the site. With --format authorized-keys a file per site,
+<site>.authorized_keys, is written for installing as the authorized_keys of
+the site's account, containing the admins' keys from the key store. With
+--format sftp-map a single file, sftp-map, is written with a line per login
+listing the sites they may access, e.g. for an SFTP server to chroot them.
+
+The key store, generate.keys.dir, is a directory of <login>.pub files in
+authorized_keys format. Admins without keys are left out and listed in a
+warning. Each key is prefixed with generate.keys.options if set, e.g.
+restrict, or restrict,command="internal-sftp" to allow only SFTP.
+
+Files are written to --out-dir for every site, or the given sites,
+optionally restricted with --filter as for pugo list. Disabled and expired
+sites get authorized_keys without keys and are left out of the SFTP map, and
+files generated for sites which have since been removed from the cdb are
+deleted, so access ends with the site.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return generateShell(cmd, args)
+	},
+}
+
+type generateOptions struct {
+	out      string
+	template string
+	format   string
+	outDir   string
+	filters  []string
+}
+
+var generateOpts generateOptions
+
+func init() {
+	rootCmd.AddCommand(generateCmd)
+	generateCmd.AddCommand(generateIndexCmd)
+	generateCmd.AddCommand(generateAccessCmd)
+	generateCmd.AddCommand(generateEnvCmd)
+	generateCmd.AddCommand(generateShellCmd)
+
+	generateIndexCmd.Flags().StringVar(&generateOpts.out, "out", "", "Write the index to the given file rather than standard output.")
+	generateIndexCmd.Flags().StringVar(&generateOpts.template, "template", "", "Render the index with the given template. Overrides generate.index.template.")
+
+	generateAccessCmd.Flags().StringVar(&generateOpts.format, "format", generate.AccessRequire, "Format of the files to generate: "+strings.Join(generate.AccessFormats, " or ")+".")
+	generateAccessCmd.Flags().StringVar(&generateOpts.outDir, "out-dir", "", "Directory to write the files to.")
+	generateAccessCmd.Flags().StringArrayVar(&generateOpts.filters, "filter", nil, "Only generate files for sites matching field=value. May be repeated.")
+	generateAccessCmd.MarkFlagRequired("out-dir")
+	generateAccessCmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return generate.AccessFormats, cobra.ShellCompDirectiveNoFileComp
+	})
+	generateAccessCmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+
+	generateEnvCmd.Flags().StringVar(&generateOpts.format, "format", generate.EnvFPM, "Format of the files to generate: "+strings.Join(generate.EnvFormats, ", ")+".")
+	generateEnvCmd.Flags().StringVar(&generateOpts.outDir, "out-dir", "", "Directory to write the files to.")
+	generateEnvCmd.Flags().StringArrayVar(&generateOpts.filters, "filter", nil, "Only generate files for sites matching field=value. May be repeated.")
+	generateEnvCmd.MarkFlagRequired("out-dir")
+	generateEnvCmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return generate.EnvFormats, cobra.ShellCompDirectiveNoFileComp
+	})
+	generateEnvCmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+
+	generateShellCmd.Flags().StringVar(&generateOpts.format, "format", generate.ShellAuthorizedKeys, "Format of the files to generate: "+strings.Join(generate.ShellFormats, " or ")+".")
+	generateShellCmd.Flags().StringVar(&generateOpts.outDir, "out-dir", "", "Directory to write the files to.")
+	generateShellCmd.Flags().StringArrayVar(&generateOpts.filters, "filter", nil, "Only generate files for sites matching field=value. May be repeated.")
+	generateShellCmd.MarkFlagRequired("out-dir")
+	generateShellCmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return generate.ShellFormats, cobra.ShellCompDirectiveNoFileComp
+	})
+	generateShellCmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+}
+
+func generateIndex(cmd *cobra.Command) error {
+	var tmpl *template.Template
+	fn := generateOpts.template
+	if fn == "" {
+		fn = viper.GetString("generate.index.template")
+	}
+	if fn != "" {
+		var err error
+		if tmpl, err = generate.ParseTemplate(fn); err != nil {
+			return configErrorf("generate-index: %w", err)
+		}
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("generate-index: Getting all sites: %w", err)
+	}
+
+	index := generate.BuildIndex(sites, siteCSPs(sites), viper.GetString("probe.base_url"))
+	var buff bytes.Buffer
+	if err := index.Write(&buff, tmpl); err != nil {
+		return err
+	}
+
+	if generateOpts.out == "" {
+		_, err := os.Stdout.Write(buff.Bytes())
+		return err
+	}
+	if err := ioutil.WriteFile(generateOpts.out, buff.Bytes(), 0644); err != nil {
+		return fmt.Errorf("generate-index: %w", err)
+	}
+	log.Infof("generate-index: Index of %d sites written to %s", index.Sites, generateOpts.out)
+	return nil
+}
+
+// generateSites returns the named sites, or every site if none are named,
+// restricted by --filter. Disabled sites are left out unless withDisabled,
+// for generators which must write files denying access to them.
+func generateSites(names []string, withDisabled bool) ([]*cdb.Site, error) {
+	filters, err := parseSiteFilters(generateOpts.filters)
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []*cdb.Site
+	if len(names) > 0 {
+		for _, name := range names {
+			site, err := lookupSite(name)
+			if err != nil {
+				return nil, err
+			}
+			sites = append(sites, site)
+		}
+	} else {
+		all, err := cdb.GetAllSites()
+		if err != nil {
+			return nil, gitErrorf("Getting all sites: %w", err)
+		}
+		for _, site := range all {
+			if withDisabled || !site.Disabled {
+				sites = append(sites, site)
+			}
+		}
+	}
+	return filterSites(sites, filters), nil
+}
+
+// writeGeneratedFiles writes each file to --out-dir
+func writeGeneratedFiles(files map[string]*bytes.Buffer) error {
+	if err := os.MkdirAll(generateOpts.outDir, 0755); err != nil {
+		return err
+	}
+	for fn, buff := range files {
+		if err := ioutil.WriteFile(filepath.Join(generateOpts.outDir, fn), buff.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneGeneratedFiles deletes the files in --out-dir named <site><suffix>
+// which pugo generated for sites no longer in the cdb, so that they stop
+// granting access. Files pugo didn't generate are left alone. Returns the
+// number of files deleted.
+func pruneGeneratedFiles(suffix string) (int, error) {
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return 0, gitErrorf("Getting all sites: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, site := range sites {
+		names[site.Name()] = true
+	}
+
+	entries, err := ioutil.ReadDir(generateOpts.outDir)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, entry := range entries {
+		fn := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fn, suffix) || names[strings.TrimSuffix(fn, suffix)] {
+			continue
+		}
+		path := filepath.Join(generateOpts.outDir, fn)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return pruned, err
+		}
+		if !bytes.HasPrefix(data, []byte(generate.Header)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return pruned, err
+		}
+		log.Infof("Deleted %s, generated for a site no longer in the cdb", path)
+		pruned++
+	}
+	return pruned, nil
+}
+
+func generateAccess(cmd *cobra.Command, names []string) error {
+	sites, err := generateSites(names, true)
+	if err != nil {
+		return fmt.Errorf("generate-access: %w", err)
+	}
+
+	principals, err := generate.ConfiguredPrincipals()
+	if err != nil {
+		return configErrorf("generate-access: %w", err)
+	}
+
+	files := make(map[string]*bytes.Buffer)
+	switch generateOpts.format {
+	case generate.AccessHTGroup:
+		var buff bytes.Buffer
+		if err := generate.WriteHTGroup(&buff, sites, principals); err != nil {
+			return err
+		}
+		files["htgroup"] = &buff
+	case generate.AccessRequire:
+		for _, site := range sites {
+			var buff bytes.Buffer
+			if err := generate.WriteRequire(&buff, site, principals); err != nil {
+				return err
+			}
+			files[site.Name()+".conf"] = &buff
+		}
+	default:
+		return fmt.Errorf("generate-access: Unknown format '%s', must be %s", generateOpts.format, strings.Join(generate.AccessFormats, " or "))
+	}
+
+	if err := writeGeneratedFiles(files); err != nil {
+		return fmt.Errorf("generate-access: %w", err)
+	}
+	if generateOpts.format == generate.AccessRequire {
+		if _, err := pruneGeneratedFiles(".conf"); err != nil {
+			return fmt.Errorf("generate-access: %w", err)
+		}
+	}
+	log.Infof("generate-access: %d files for %d sites written to %s", len(files), len(sites), generateOpts.outDir)
+	return nil
+}
+
+func generateEnv(cmd *cobra.Command, names []string) error {
+	if err := validateOneOf(generate.EnvFormats...)(generateOpts.format); err != nil {
+		return fmt.Errorf("generate-env: --format: %w", err)
+	}
+
+	sites, err := generateSites(names, false)
+	if err != nil {
+		return fmt.Errorf("generate-env: %w", err)
+	}
+
+	files := make(map[string]*bytes.Buffer)
+	for _, site := range sites {
+		var buff bytes.Buffer
+		if err := generate.WriteEnv(&buff, site, generateOpts.format); err != nil {
+			return err
+		}
+		files[generate.EnvFileName(site, generateOpts.format)] = &buff
+	}
+
+	if err := writeGeneratedFiles(files); err != nil {
+		return fmt.Errorf("generate-env: %w", err)
+	}
+	log.Infof("generate-env: Environment files for %d sites written to %s", len(files), generateOpts.outDir)
+	return nil
+}
+
+func generateShell(cmd *cobra.Command, names []string) error {
+	if err := validateOneOf(generate.ShellFormats...)(generateOpts.format); err != nil {
+		return fmt.Errorf("generate-shell: --format: %w", err)
+	}
+
+	sites, err := generateSites(names, true)
+	if err != nil {
+		return fmt.Errorf("generate-shell: %w", err)
+	}
+
+	files := make(map[string]*bytes.Buffer)
+	switch generateOpts.format {
+	case generate.ShellAuthorizedKeys:
+		dir, err := homedir.Expand(viper.GetString("generate.keys.dir"))
+		if err != nil || dir == "" {
+			return configErrorf("generate-shell: generate.keys.dir isn't set")
+		}
+		keys, err := generate.LoadKeyStore(dir)
+		if err != nil {
+			return configErrorf("generate-shell: %w", err)
+		}
+		for _, site := range sites {
+			var buff bytes.Buffer
+			missing, err := generate.WriteAuthorizedKeys(&buff, site, keys, viper.GetString("generate.keys.options"))
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				log.Warnf("generate-shell: Admins of %s without keys: %s", site.Name(), strings.Join(missing, ", "))
+			}
+			files[site.Name()+".authorized_keys"] = &buff
+		}
+	case generate.ShellSFTPMap:
+		var buff bytes.Buffer
+		if err := generate.WriteSFTPMap(&buff, sites); err != nil {
+			return err
+		}
+		files["sftp-map"] = &buff
+	}
+
+	if err := writeGeneratedFiles(files); err != nil {
+		return fmt.Errorf("generate-shell: %w", err)
+	}
+	if generateOpts.format == generate.ShellAuthorizedKeys {
+		if _, err := pruneGeneratedFiles(".authorized_keys"); err != nil {
+			return fmt.Errorf("generate-shell: %w", err)
+		}
+	}
+	log.Infof("generate-shell: %d files for %d sites written to %s", len(files), len(sites), generateOpts.outDir)
+	return nil
+}
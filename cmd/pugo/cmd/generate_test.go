@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/cdbtest"
+	"github.com/icunion/pugo/generate"
+
+	"github.com/spf13/viper"
+)
+
+// TestGenerateAccessDisabledSite checks that a site's access file stops
+// allowing its admins once the site is disabled, and is deleted once the
+// site is removed from the cdb
+func TestGenerateAccessDisabledSite(t *testing.T) {
+	repo := cdbtest.New(t,
+		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123")),
+	)
+	generateOpts = generateOptions{format: generate.AccessRequire, outDir: t.TempDir()}
+	fn := filepath.Join(generateOpts.outDir, "mysite.conf")
+
+	if err := generateAccess(nil, nil); err != nil {
+		t.Fatalf("generateAccess: %v", err)
+	}
+	if got := readGenerated(t, fn); !strings.Contains(got, "Require user ab123") {
+		t.Errorf("Enabled site's access file doesn't allow its admin:\n%s", got)
+	}
+
+	repo.Write(t, "Disable mysite",
+		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123"), cdbtest.WithDisabled("Testing")),
+	)
+	if err := generateAccess(nil, nil); err != nil {
+		t.Fatalf("generateAccess: %v", err)
+	}
+	if got := readGenerated(t, fn); !strings.Contains(got, "Require all denied") || strings.Contains(got, "ab123") {
+		t.Errorf("Disabled site's access file doesn't deny everyone:\n%s", got)
+	}
+
+	if err := os.Remove(filepath.Join(repo.Path, "sites", "mysite.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	cdb.Configure(repo.Config)
+	if err := generateAccess(nil, nil); err != nil {
+		t.Fatalf("generateAccess: %v", err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("Access file of removed site wasn't deleted")
+	}
+}
+
+// TestGenerateShellDisabledSite checks that a site's authorized_keys stop
+// listing its admins' keys once the site is disabled
+func TestGenerateShellDisabledSite(t *testing.T) {
+	repo := cdbtest.New(t,
+		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123")),
+	)
+	keys := t.TempDir()
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample ab123"
+	if err := ioutil.WriteFile(filepath.Join(keys, "ab123.pub"), []byte(key+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("generate.keys.dir", keys)
+	defer viper.Set("generate.keys.dir", nil)
+	generateOpts = generateOptions{format: generate.ShellAuthorizedKeys, outDir: t.TempDir()}
+	fn := filepath.Join(generateOpts.outDir, "mysite.authorized_keys")
+
+	if err := generateShell(nil, nil); err != nil {
+		t.Fatalf("generateShell: %v", err)
+	}
+	if got := readGenerated(t, fn); !strings.Contains(got, key) {
+		t.Errorf("Enabled site's authorized_keys doesn't have its admin's key:\n%s", got)
+	}
+
+	repo.Write(t, "Disable mysite",
+		cdbtest.Site(1, "mysite", cdbtest.WithAdmins("ab123"), cdbtest.WithDisabled("Testing")),
+	)
+	if err := generateShell(nil, nil); err != nil {
+		t.Fatalf("generateShell: %v", err)
+	}
+	if got := readGenerated(t, fn); strings.Contains(got, key) {
+		t.Errorf("Disabled site's authorized_keys still has its admin's key:\n%s", got)
+	}
+}
+
+func readGenerated(t *testing.T, fn string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Reading generated file: %v", err)
+	}
+	return string(data)
+}
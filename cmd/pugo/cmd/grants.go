@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/icunion/pugo/newerpol"
+
+	"github.com/spf13/cobra"
+)
+
+var grantsCmd = &cobra.Command{
+	Use:   "grants",
+	Short: "Report on access grants in newerpol",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("grants: Subcommand required")
+	},
+}
+
+var grantsStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Summarise past grants and revocations",
+	Long: `Summarise the access history in newerpol: the number of access
+requests submitted, grants made and revocations made, and the average time
+from a request being submitted to it being granted. By default the history is
+grouped by month; with --by csp it is grouped by the CSP owning each website
+instead.
+
+--since takes a date (yyyy-mm-dd), or a duration such as 36h or 90d, and
+only counts requests, grants and revocations made since then. As for other
+query commands the output can be a table, JSON, YAML or CSV (--output).`,
+	Args:              cobra.NoArgs,
+	ValidArgsFunction: cobra.NoFileCompletions,
+	Annotations:       map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return grantsStats(cmd)
+	},
+}
+
+type grantsStatsOptions struct {
+	since string
+	by    string
+}
+
+var grantsStatsOpts grantsStatsOptions
+
+// grantCounts are the statistics for a single month or CSP
+type grantCounts struct {
+	Requests     int    `json:"requests" yaml:"requests"`
+	Grants       int    `json:"grants" yaml:"grants"`
+	Revocations  int    `json:"revocations" yaml:"revocations"`
+	AvgGrantTime string `json:"avg_grant_time,omitempty" yaml:"avg_grant_time,omitempty"`
+
+	grantTime time.Duration
+	timed     int
+}
+
+func (c *grantCounts) addGrantTime(d time.Duration) {
+	c.grantTime += d
+	c.timed++
+	c.AvgGrantTime = (c.grantTime / time.Duration(c.timed)).Round(time.Minute).String()
+}
+
+func (c *grantCounts) row() []string {
+	return []string{strconv.Itoa(c.Requests), strconv.Itoa(c.Grants), strconv.Itoa(c.Revocations), c.AvgGrantTime}
+}
+
+var grantCountsHeader = []string{"REQUESTS", "GRANTS", "REVOCATIONS", "AVG GRANT TIME"}
+
+type monthlyGrantStat struct {
+	Month       string `json:"month" yaml:"month"`
+	grantCounts `yaml:",inline"`
+}
+
+type monthlyGrantStats []*monthlyGrantStat
+
+func (s monthlyGrantStats) Header() []string {
+	return append([]string{"MONTH"}, grantCountsHeader...)
+}
+
+func (s monthlyGrantStats) Rows() [][]string {
+	rows := make([][]string, 0, len(s))
+	for _, stat := range s {
+		rows = append(rows, append([]string{stat.Month}, stat.row()...))
+	}
+	return rows
+}
+
+type cspGrantStat struct {
+	CSP         string `json:"csp" yaml:"csp"`
+	grantCounts `yaml:",inline"`
+}
+
+type cspGrantStats []*cspGrantStat
+
+func (s cspGrantStats) Header() []string {
+	return append([]string{"CSP"}, grantCountsHeader...)
+}
+
+func (s cspGrantStats) Rows() [][]string {
+	rows := make([][]string, 0, len(s))
+	for _, stat := range s {
+		rows = append(rows, append([]string{stat.CSP}, stat.row()...))
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(grantsCmd)
+	grantsCmd.AddCommand(grantsStatsCmd)
+
+	grantsStatsCmd.Flags().StringVar(&grantsStatsOpts.since, "since", "", "Only count requests, grants and revocations since the given date (yyyy-mm-dd) or duration ago (e.g. 36h, 90d).")
+	grantsStatsCmd.Flags().StringVar(&grantsStatsOpts.by, "by", "month", "Group the statistics by month or csp.")
+	grantsStatsCmd.RegisterFlagCompletionFunc("by", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"month", "csp"}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+func grantsStats(cmd *cobra.Command) error {
+	if grantsStatsOpts.by != "month" && grantsStatsOpts.by != "csp" {
+		return configErrorf("grants-stats: Invalid --by '%s': must be month or csp", grantsStatsOpts.by)
+	}
+	var since time.Time
+	if grantsStatsOpts.since != "" {
+		var err error
+		since, err = parseSince(grantsStatsOpts.since)
+		if err != nil {
+			return configErrorf("grants-stats: %w", err)
+		}
+	}
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("grants-stats: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	records, err := newerpol.GetGrantHistory(runCtx, newerpolDb, since)
+	if err != nil {
+		return dbErrorf("grants-stats: %w", err)
+	}
+
+	// Each record is counted under the month or CSP of each event in it, so
+	// a request submitted in one month and granted in the next counts
+	// towards both
+	counts := make(map[string]*grantCounts)
+	countsFor := func(record newerpol.HistoryRecord, t time.Time) *grantCounts {
+		key := record.CSP
+		if grantsStatsOpts.by == "month" {
+			key = t.Format("2006-01")
+		}
+		if counts[key] == nil {
+			counts[key] = &grantCounts{}
+		}
+		return counts[key]
+	}
+	included := func(t sql.NullTime) bool {
+		return t.Valid && !t.Time.Before(since)
+	}
+	for _, record := range records {
+		if included(record.SubmittedWhen) {
+			countsFor(record, record.SubmittedWhen.Time).Requests++
+		}
+		if included(record.GrantedWhen) {
+			c := countsFor(record, record.GrantedWhen.Time)
+			c.Grants++
+			if record.SubmittedWhen.Valid && !record.GrantedWhen.Time.Before(record.SubmittedWhen.Time) {
+				c.addGrantTime(record.GrantedWhen.Time.Sub(record.SubmittedWhen.Time))
+			}
+		}
+		if included(record.RevokedWhen) {
+			countsFor(record, record.RevokedWhen.Time).Revocations++
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result tabular
+	if grantsStatsOpts.by == "month" {
+		stats := make(monthlyGrantStats, 0, len(keys))
+		for _, key := range keys {
+			stats = append(stats, &monthlyGrantStat{Month: key, grantCounts: *counts[key]})
+		}
+		result = stats
+	} else {
+		stats := make(cspGrantStats, 0, len(keys))
+		for _, key := range keys {
+			stats = append(stats, &cspGrantStat{CSP: key, grantCounts: *counts[key]})
+		}
+		result = stats
+	}
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("grants-stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import sites into the cdb",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("import: Subcommand required")
+	},
+}
+
+var importNewerpolCmd = &cobra.Command{
+	Use:   "newerpol",
+	Short: "Build the cdb's sites from the websites in eActivities",
+	Long: `Create a site in the cdb for each website managed in eActivities
+which doesn't already have one, and commit them, e.g. to recover from the
+loss of the cdb or to stand up a fresh environment. Each site is named after
+its website's folder, with its id, the CSP owning it (as pugo sync metadata
+records it), its path, and the logins currently granted access as admins.
+New sites expire on the next 31 July unless --expiry is given.
+
+eActivities doesn't record a contact address for websites, so sites are
+created without one: pugo fsck lists them to be filled in with pugo site set.
+
+Sites already in the cdb are left as they are, unless --rebuild is given, in
+which case their admins and CSP are replaced with those in eActivities.
+Immortal admins are kept, and protected sites and sites excluded by
+cdb.managed_sites are never changed. Websites whose folder is the name of
+another site are skipped and reported, as pugo check does.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return importNewerpol(cmd)
+	},
+}
+
+type importOptions struct {
+	rebuild bool
+	expiry  string
+}
+
+var importOpts importOptions
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importNewerpolCmd)
+	addForceFlag(importNewerpolCmd)
+
+	importNewerpolCmd.Flags().BoolVar(&importOpts.rebuild, "rebuild", false, "Also replace the admins and CSP of sites already in the cdb with those in eActivities.")
+	importNewerpolCmd.Flags().StringVar(&importOpts.expiry, "expiry", "", "Expiry date of new sites (yyyy-mm-dd). Defaults to the next 31 July.")
+	addPlanOutFlag(importNewerpolCmd)
+}
+
+func importNewerpol(cmd *cobra.Command) error {
+	expiry := importOpts.expiry
+	if expiry == "" {
+		expiry = nextYearEnd(time.Now()).Format(cdb.ExpiryFormat)
+	} else if _, err := time.Parse(cdb.ExpiryFormat, expiry); err != nil {
+		return configErrorf("import-newerpol: Invalid --expiry date: %s", expiry)
+	}
+
+	log.Info("import-newerpol: Starting import ...")
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("import-newerpol: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	folders, err := newerpol.GetWebsiteFolders(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("import-newerpol: %w", err)
+	}
+	csps, err := newerpol.GetWebsiteCSPs(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("import-newerpol: %w", err)
+	}
+	granted, err := newerpol.GetGrantedLogins(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("import-newerpol: %w", err)
+	}
+
+	ids := make([]int, 0, len(folders))
+	for id := range folders {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	siteIdsToCommit := make(map[int]bool)
+	added, rebuilt, skipped := 0, 0, 0
+	for _, id := range ids {
+		folder := folders[id]
+		csp := csps[id]
+
+		site, err := cdb.GetSiteById(id)
+		if err != nil {
+			return gitErrorf("import-newerpol: %w", err)
+		}
+		if site != nil {
+			if !importOpts.rebuild || !site.Managed() || site.Protected {
+				continue
+			}
+			if rebuildSite(site, csp, granted[id]) {
+				log.Infof("import-newerpol: Rebuilt %s (%d) from eActivities", site.Name(), id)
+				siteIdsToCommit[id] = true
+				rebuilt++
+			}
+			continue
+		}
+
+		if folder == "" {
+			log.Warnf("import-newerpol: Skipping website %d - it has no folder", id)
+			skipped++
+			continue
+		}
+		site = cdb.NewNamedSite(folder)
+		site.Id = id
+		site.FullName = folder
+		if csp.CSP != "" {
+			site.FullName = csp.CSP
+		}
+		site.Expiry = expiry
+		site.Paths = []string{"/" + folder}
+		site.CSPCode = csp.Code
+		site.Committee = csp.CSP
+		site.OCId = csp.OCId
+		for _, login := range granted[id] {
+			site.AddAdmin(login)
+		}
+		if err := cdb.AddSite(site); err != nil {
+			log.Warnf("import-newerpol: Skipping website %d: %v", id, err)
+			skipped++
+			continue
+		}
+		log.Infof("import-newerpol: Adding %s (%d) with %d admins", site.Name(), id, len(site.Admins))
+		siteIdsToCommit[id] = true
+		added++
+	}
+	if skipped > 0 {
+		log.Warnf("import-newerpol: %d websites skipped", skipped)
+	}
+	if len(siteIdsToCommit) == 0 {
+		log.Info("import-newerpol: Nothing to import")
+		return nil
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will add %d sites and rebuild %d sites from eActivities.", added, rebuilt))
+	if err != nil {
+		return fmt.Errorf("import-newerpol: %w", err)
+	}
+	if !proceed {
+		log.Info("import-newerpol: Aborted")
+		return nil
+	}
+
+	message := fmt.Sprintf("Import %d sites from eActivities", added)
+	if importOpts.rebuild {
+		message = fmt.Sprintf("Import %d sites from eActivities, rebuild %d sites", added, rebuilt)
+	}
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         message,
+		Cmd:             "import newerpol",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if globalOpts.dryRun && planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("import-newerpol: %w", err)
+		}
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("import-newerpol: %w", err)
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("import-newerpol: %w", err)
+	}
+
+	return nil
+}
+
+// rebuildSite replaces a site's admins and CSP with those in eActivities,
+// keeping its immortal admins. Returns whether the site changed.
+func rebuildSite(site *cdb.Site, csp newerpol.WebsiteCSP, logins []string) bool {
+	before := append([]string{}, site.Admins...)
+	site.Admins = []string{}
+	for _, login := range logins {
+		if !site.IsImmortal(login) {
+			site.AddAdmin(login)
+		}
+	}
+	changed := !sameLogins(before, site.Admins)
+	if site.CSPCode != csp.Code || site.Committee != csp.CSP || site.OCId != csp.OCId {
+		site.CSPCode = csp.Code
+		site.Committee = csp.CSP
+		site.OCId = csp.OCId
+		changed = true
+	}
+	if changed {
+		site.MarkAsChanged()
+	} else {
+		site.Admins = before
+	}
+	return changed
+}
+
+// sameLogins reports whether two lists of logins hold the same logins, in
+// any order
+func sameLogins(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, login := range a {
+		counts[cdb.NormalizeLogin(login)]++
+	}
+	for _, login := range b {
+		counts[cdb.NormalizeLogin(login)]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nextYearEnd returns the next 31 July on or after t, the date sites expire
+// at the end of the academic year
+func nextYearEnd(t time.Time) time.Time {
+	end := time.Date(t.Year(), time.July, 31, 0, 0, 0, 0, time.Local)
+	if !t.Before(end.AddDate(0, 0, 1)) {
+		end = end.AddDate(1, 0, 0)
+	}
+	return end
+}
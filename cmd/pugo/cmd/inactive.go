@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// disabledSite is the report output for a site disabled because its CSP is
+// no longer active
+type disabledSite struct {
+	Site string `json:"site" yaml:"site"`
+	Id   int    `json:"id" yaml:"id"`
+	CSP  string `json:"csp" yaml:"csp"`
+	OCId int    `json:"ocid" yaml:"ocid"`
+}
+
+type disabledSiteReport []disabledSite
+
+func (r disabledSiteReport) Header() []string {
+	return []string{"SITE", "ID", "CSP", "OCID"}
+}
+
+func (r disabledSiteReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, d := range r {
+		rows = append(rows, []string{d.Site, strconv.Itoa(d.Id), d.CSP, strconv.Itoa(d.OCId)})
+	}
+	return rows
+}
+
+// disableInactiveCSPSites disables the sites of CSPs which are no longer
+// active in newerpol, adding them to siteIdsToCommit. If opts restricts the
+// sync to particular sites or CSPs only those are considered.
+func disableInactiveCSPSites(newerpolDb *sqlx.DB, opts *newerpol.GetGrantsOptions, siteIdsToCommit map[int]bool) (disabledSiteReport, error) {
+	inactive, err := newerpol.GetInactiveCSPWebsites(runCtx, newerpolDb)
+	if err != nil {
+		return nil, err
+	}
+
+	inScope := func(csp newerpol.WebsiteCSP) bool {
+		if len(opts.WebsiteIds) == 0 && len(opts.OCIds) == 0 {
+			return true
+		}
+		for _, id := range opts.WebsiteIds {
+			if id == csp.WebsiteId {
+				return true
+			}
+		}
+		for _, id := range opts.OCIds {
+			if id == csp.OCId {
+				return true
+			}
+		}
+		return false
+	}
+
+	var report disabledSiteReport
+	for id, csp := range inactive {
+		if !inScope(csp) {
+			continue
+		}
+		site, err := cdb.GetSiteById(id)
+		if err != nil {
+			return nil, err
+		}
+		if site == nil || site.Disabled {
+			continue
+		}
+		if !site.Managed() {
+			log.Warnf("sync: Not disabling %s - CSP %s (%d) is no longer active, but the site is excluded by cdb.managed_sites", site.Name(), csp.CSP, csp.OCId)
+			continue
+		}
+		if site.Protected {
+			log.Warnf("sync: Not disabling %s - CSP %s (%d) is no longer active, but the site is protected", site.Name(), csp.CSP, csp.OCId)
+			continue
+		}
+
+		log.Infof("sync: Disabling %s - CSP %s (%d) is no longer active", site.Name(), csp.CSP, csp.OCId)
+		site.Disabled = true
+		site.DisabledReason = fmt.Sprintf("CSP %s no longer active", csp.CSP)
+		site.MarkAsChanged()
+		siteIdsToCommit[site.Id] = true
+		report = append(report, disabledSite{Site: site.Name(), Id: site.Id, CSP: csp.CSP, OCId: csp.OCId})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Site < report[j].Site
+	})
+
+	return report, nil
+}
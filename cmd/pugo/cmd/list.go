@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List sites in cdb",
+	Long: `List sites in the configuration database, optionally restricted
+to those matching one or more filters. Filters take the form field=value,
+where field is one of id, name, email, admin, expiry, or disabled. Name and
+email values may be shell glob patterns, and names also match sites' aliases.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listSites(cmd)
+	},
+}
+
+type listOptions struct {
+	filters []string
+}
+
+var listOpts listOptions
+
+// siteSummary is a single row of list output
+type siteSummary struct {
+	Id       int    `json:"id" yaml:"id"`
+	Name     string `json:"name" yaml:"name"`
+	FullName string `json:"full_name" yaml:"full_name"`
+	Email    string `json:"email" yaml:"email"`
+	Admins   int    `json:"admins" yaml:"admins"`
+	Expiry   string `json:"expiry" yaml:"expiry"`
+	Disabled bool   `json:"disabled" yaml:"disabled"`
+}
+
+type siteSummaries []siteSummary
+
+func (s siteSummaries) Header() []string {
+	return []string{"ID", "NAME", "FULL NAME", "EMAIL", "ADMINS", "EXPIRY", "DISABLED"}
+}
+
+func (s siteSummaries) Rows() [][]string {
+	rows := make([][]string, 0, len(s))
+	for _, site := range s {
+		rows = append(rows, []string{
+			strconv.Itoa(site.Id),
+			site.Name,
+			site.FullName,
+			site.Email,
+			strconv.Itoa(site.Admins),
+			site.Expiry,
+			strconv.FormatBool(site.Disabled),
+		})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringArrayVar(&listOpts.filters, "filter", nil, "Only list sites matching field=value. May be repeated.")
+	listCmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+}
+
+func listSites(cmd *cobra.Command) error {
+	filters, err := parseSiteFilters(listOpts.filters)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("list: Getting all sites: %w", err)
+	}
+	sites = filterSites(sites, filters)
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name() < sites[j].Name()
+	})
+
+	result := make(siteSummaries, 0, len(sites))
+	for _, site := range sites {
+		result = append(result, siteSummary{
+			Id:       site.Id,
+			Name:     site.Name(),
+			FullName: site.FullName,
+			Email:    site.Email,
+			Admins:   len(site.Admins),
+			Expiry:   site.Expiry,
+			Disabled: site.Disabled,
+		})
+	}
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// runId uniquely identifies a single invocation of pugo. It is attached to
+// every log entry so the entries for a run can be correlated once shipped to
+// log aggregation
+var runId string
+
+// runIdHook adds the run id to every log entry
+type runIdHook struct{}
+
+func (h *runIdHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *runIdHook) Fire(entry *log.Entry) error {
+	entry.Data["run_id"] = runId
+	return nil
+}
+
+func newRunId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// How often a warning being suppressed is logged again with the number of
+// repeats since
+const repeatInterval = time.Minute
+
+// Numbers in warnings (ids, counts) are ignored when deciding whether a
+// warning repeats an earlier one
+var repeatDigits = regexp.MustCompile(`[0-9]+`)
+
+// repeatedWarning tracks the occurrences of a warning
+type repeatedWarning struct {
+	message    string
+	count      int
+	suppressed int
+	reported   time.Time
+}
+
+// dedupFormatter wraps the log formatter to collapse repeated warnings, so
+// e.g. a warning for every grant of a large --all sync doesn't bury the rest
+// of the log. The first limit occurrences of a warning are logged as usual;
+// after that it is logged once every repeatInterval with the number of
+// repeats since, and the total is logged and recorded in the run summary
+// when the command finishes.
+type dedupFormatter struct {
+	log.Formatter
+	limit    int
+	mu       sync.Mutex
+	warnings map[string]*repeatedWarning
+	order    []string
+}
+
+var logDedup = &dedupFormatter{warnings: make(map[string]*repeatedWarning)}
+
+func init() {
+	viper.SetDefault("log.repeat_limit", 5)
+}
+
+// configure sets the formatter wrapped and the number of times a warning is
+// logged before it is suppressed
+func (f *dedupFormatter) configure(formatter log.Formatter, limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Formatter = formatter
+	f.limit = limit
+}
+
+func (f *dedupFormatter) Format(entry *log.Entry) ([]byte, error) {
+	f.mu.Lock()
+	formatter := f.Formatter
+	if entry.Level != log.WarnLevel || f.limit <= 0 {
+		f.mu.Unlock()
+		return formatter.Format(entry)
+	}
+	key := repeatDigits.ReplaceAllString(entry.Message, "#")
+	w, ok := f.warnings[key]
+	if !ok {
+		w = &repeatedWarning{}
+		f.warnings[key] = w
+		f.order = append(f.order, key)
+	}
+	w.message = entry.Message
+	w.count++
+
+	var suffix string
+	switch {
+	case w.count < f.limit:
+	case w.count == f.limit:
+		suffix = " (further repeats suppressed)"
+		w.reported = time.Now()
+	case time.Since(w.reported) >= repeatInterval:
+		suffix = fmt.Sprintf(" (repeated %d times since)", w.suppressed+1)
+		w.suppressed = 0
+		w.reported = time.Now()
+	default:
+		w.suppressed++
+		f.mu.Unlock()
+		return nil, nil
+	}
+	f.mu.Unlock()
+
+	if suffix == "" {
+		return formatter.Format(entry)
+	}
+	message := entry.Message
+	entry.Message += suffix
+	defer func() { entry.Message = message }()
+	return formatter.Format(entry)
+}
+
+// suppressedWarning is a warning which was suppressed after repeating, with
+// its last occurrence and total count
+type suppressedWarning struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+// finish stops suppressing warnings, logs the total of each suppressed
+// warning, and returns them
+func (f *dedupFormatter) finish() []suppressedWarning {
+	f.mu.Lock()
+	limit := f.limit
+	f.limit = 0
+	var suppressed []suppressedWarning
+	var pending []*repeatedWarning
+	for _, key := range f.order {
+		w := f.warnings[key]
+		if limit > 0 && w.count > limit {
+			suppressed = append(suppressed, suppressedWarning{Message: w.message, Count: w.count})
+		}
+		if w.suppressed > 0 {
+			pending = append(pending, w)
+		}
+	}
+	f.mu.Unlock()
+
+	sort.SliceStable(suppressed, func(i, j int) bool {
+		return suppressed[i].Count > suppressed[j].Count
+	})
+	for _, w := range pending {
+		log.Warnf("%s (repeated %d times since, %d in total)", w.message, w.suppressed, w.count)
+	}
+	return suppressed
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var syncMetadataCmd = &cobra.Command{
+	Use:   "metadata",
+	Short: "Record the CSP owning each site in its file",
+	Long: `Look up the CSP owning each site in eActivities and record its code,
+committee name and OC id in the site's file (csp-code, committee and ocid),
+committing the sites which changed. Sites no longer managed in eActivities
+have the fields cleared.
+
+Reports, emails and generated files then label and group sites by the
+recorded CSP without needing a connection to newerpol. Protected sites, and
+sites excluded by cdb.managed_sites, are left as they are.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doSyncMetadata(cmd)
+	},
+}
+
+func init() {
+	syncCmd.AddCommand(syncMetadataCmd)
+
+	addPlanOutFlag(syncMetadataCmd)
+}
+
+func doSyncMetadata(cmd *cobra.Command) error {
+	log.Info("sync-metadata: Starting metadata sync ...")
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("sync-metadata: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	csps, err := newerpol.GetWebsiteCSPs(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("sync-metadata: %w", err)
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("sync-metadata: Getting all sites: %w", err)
+	}
+	sites = withoutProtected("sync-metadata", sites)
+
+	siteIdsToCommit := make(map[int]bool)
+	for _, site := range sites {
+		if !site.Managed() {
+			continue
+		}
+		csp := csps[site.Id]
+		if site.CSPCode == csp.Code && site.Committee == csp.CSP && site.OCId == csp.OCId {
+			continue
+		}
+		if csp.OCId == 0 {
+			log.Infof("sync-metadata: %s: No longer managed in eActivities, clearing CSP %s", site.Name(), site.Committee)
+		} else {
+			log.Infof("sync-metadata: %s: CSP %s (%d)", site.Name(), csp.CSP, csp.OCId)
+		}
+		site.CSPCode = csp.Code
+		site.Committee = csp.CSP
+		site.OCId = csp.OCId
+		site.MarkAsChanged()
+		siteIdsToCommit[site.Id] = true
+	}
+	if len(siteIdsToCommit) == 0 {
+		log.Info("sync-metadata: Metadata up to date")
+		return nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         "Update CSP metadata",
+		Cmd:             "sync metadata",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if globalOpts.dryRun && planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("sync-metadata: %w", err)
+		}
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("sync-metadata: %w", err)
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("sync-metadata: %w", err)
+	}
+
+	return nil
+}
+
+// siteCSPs returns the CSP recorded in each site's file by sync metadata,
+// keyed by site id, in the form newerpol returns them
+func siteCSPs(sites []*cdb.Site) map[int]newerpol.WebsiteCSP {
+	csps := make(map[int]newerpol.WebsiteCSP)
+	for _, site := range sites {
+		if site.OCId != 0 {
+			csps[site.Id] = newerpol.WebsiteCSP{
+				WebsiteId: site.Id,
+				OCId:      site.OCId,
+				CSP:       site.Committee,
+				Code:      site.CSPCode,
+			}
+		}
+	}
+	return csps
+}
+
+// siteCSPName returns the name of the CSP owning a site to use in emails:
+// the committee recorded by sync metadata, or the site's full name
+func siteCSPName(site *cdb.Site) string {
+	if site.Committee != "" {
+		return site.Committee
+	}
+	return site.FullName
+}
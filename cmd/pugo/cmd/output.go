@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tabular is implemented by the results of query commands so that they can
+// be rendered as a table or CSV. For JSON and YAML output the result value
+// itself is marshalled.
+type tabular interface {
+	Header() []string
+	Rows() [][]string
+}
+
+var outputFormats = map[string]bool{
+	"table": true,
+	"json":  true,
+	"yaml":  true,
+	"csv":   true,
+}
+
+// writeOutput renders the result of a query command to w in the format
+// selected with --output
+func writeOutput(w io.Writer, result tabular) error {
+	switch globalOpts.output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(result)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(result.Header()); err != nil {
+			return err
+		}
+		if err := cw.WriteAll(result.Rows()); err != nil {
+			return err
+		}
+		return cw.Error()
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(result.Header(), "\t"))
+		for _, row := range result.Rows() {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format '%s'", globalOpts.output)
+	}
+}
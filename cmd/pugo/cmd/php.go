@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var phpCmd = &cobra.Command{
+	Use:   "php",
+	Short: "Manage the PHP versions of sites",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("php: Subcommand required")
+	},
+}
+
+var phpMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move sites from one PHP version to another",
+	Long: `Update the PHP version of every site using the --from version to the
+--to version. --from matches a version or a major version, so --from 7
+matches sites on 7.3 and 7.4. Sites using the default PHP version (php: true)
+or with PHP disabled are never matched. The sites migrated can be further
+restricted with --filter, which takes the same filters as pugo list.
+
+The --to version must be one of cdb.php_versions. Webserver configuration is
+regenerated from the cdb by the usual post_push hooks. With --notify the
+admins of each migrated site are emailed about the change, using the
+php-migration template.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return phpMigrate(cmd)
+	},
+}
+
+type phpMigrateOptions struct {
+	from    string
+	to      string
+	filters []string
+	notify  bool
+}
+
+var phpMigrateOpts phpMigrateOptions
+
+// migratedSite records a site's previous PHP version so its admins can be
+// notified
+type migratedSite struct {
+	site *cdb.Site
+	from string
+}
+
+func init() {
+	rootCmd.AddCommand(phpCmd)
+	phpCmd.AddCommand(phpMigrateCmd)
+	addForceFlag(phpMigrateCmd)
+
+	phpMigrateCmd.Flags().StringVar(&phpMigrateOpts.from, "from", "", "PHP version, or major version, to migrate sites from.")
+	phpMigrateCmd.Flags().StringVar(&phpMigrateOpts.to, "to", "", "PHP version to migrate sites to.")
+	phpMigrateCmd.Flags().StringArrayVar(&phpMigrateOpts.filters, "filter", nil, "Only migrate sites matching field=value. May be repeated.")
+	phpMigrateCmd.Flags().BoolVar(&phpMigrateOpts.notify, "notify", false, "Email the admins of migrated sites. Implied off by dry-run.")
+	phpMigrateCmd.MarkFlagRequired("from")
+	phpMigrateCmd.MarkFlagRequired("to")
+	phpMigrateCmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+	addPlanOutFlag(phpMigrateCmd)
+}
+
+func phpMigrate(cmd *cobra.Command) error {
+	if err := validateOneOf(conf.Cdb.PhpVersions...)(phpMigrateOpts.to); err != nil {
+		return configErrorf("php-migrate: --to %v", err)
+	}
+	filters, err := parseSiteFilters(phpMigrateOpts.filters)
+	if err != nil {
+		return configErrorf("php-migrate: %w", err)
+	}
+
+	log.Infof("php-migrate: Starting migration from PHP %s to %s ...", phpMigrateOpts.from, phpMigrateOpts.to)
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("php-migrate: Getting all sites: %w", err)
+	}
+	sites = withoutProtected("php-migrate", sites)
+
+	var matched []*cdb.Site
+	for _, site := range filterSites(sites, filters) {
+		version := phpVersion(site)
+		if version == "" || version == phpMigrateOpts.to {
+			continue
+		}
+		if version == phpMigrateOpts.from || strings.HasPrefix(version, phpMigrateOpts.from+".") {
+			matched = append(matched, site)
+		}
+	}
+
+	if len(matched) == 0 {
+		log.Infof("php-migrate: No sites found using PHP %s", phpMigrateOpts.from)
+		return nil
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will migrate %d sites from PHP %s to %s.", len(matched), phpMigrateOpts.from, phpMigrateOpts.to))
+	if err != nil {
+		return fmt.Errorf("php-migrate: %w", err)
+	}
+	if !proceed {
+		log.Info("php-migrate: Aborted")
+		return nil
+	}
+
+	// Update sites
+	siteIdsToCommit := make(map[int]bool)
+	var migrated []migratedSite
+	for _, site := range matched {
+		from := phpVersion(site)
+		log.Infof("php-migrate: Migrating %s from PHP %s to %s", site.Name(), from, phpMigrateOpts.to)
+		site.Php = phpMigrateOpts.to
+		site.MarkAsChanged()
+		siteIdsToCommit[site.Id] = true
+		migrated = append(migrated, migratedSite{site: site, from: from})
+	}
+
+	// Commit changes to repo
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         fmt.Sprintf("Migrate sites from PHP %s to %s", phpMigrateOpts.from, phpMigrateOpts.to),
+		Cmd:             "php migrate",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("php-migrate: %w", err)
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("php-migrate: %w", err)
+	}
+
+	var emails []*email.EmailOptions
+	if phpMigrateOpts.notify && (!globalOpts.dryRun || planOut != "") {
+		if emails, err = phpMigrationEmails(migrated); err != nil {
+			// cdb changes have already been committed unless this is a
+			// dry run
+			if globalOpts.dryRun {
+				return dbErrorf("php-migrate: %w", err)
+			}
+			return partialFailureErrorf("php-migrate: %w", err)
+		}
+	}
+
+	if globalOpts.dryRun {
+		if planOut != "" {
+			if err := writePlan(cmd.CommandPath(), commitOpts, nil, emails); err != nil {
+				return fmt.Errorf("php-migrate: %w", err)
+			}
+		}
+		if len(emails) > 0 {
+			log.Info("php-migrate: Performing dry run - emails will not be sent.")
+		}
+		return nil
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+
+	// Notify site admins
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return partialFailureErrorf("php-migrate: Unable to start email worker, emails will not be sent: %w", err)
+	}
+	defer email.ShutdownWorker()
+
+	for _, emailOpts := range emails {
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.WithFields(log.Fields{
+				"emailOpts": emailOpts,
+			}).Warnf("php-migrate: Error attempting to send email: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// phpVersion returns the PHP version set for a site, or an empty string if
+// the site uses the default version or has PHP disabled
+func phpVersion(site *cdb.Site) string {
+	switch v := site.Php.(type) {
+	case nil, bool:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// phpMigrationEmails looks up the admins of migrated sites in newerpol,
+// returning the emails to send them
+func phpMigrationEmails(migrated []migratedSite) ([]*email.EmailOptions, error) {
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	var logins []string
+	for _, m := range migrated {
+		logins = append(logins, m.site.Admins...)
+	}
+	people, err := newerpol.LookupPeople(runCtx, newerpolDb, logins)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*email.EmailOptions
+	for _, m := range migrated {
+		for _, login := range m.site.Admins {
+			person, ok := people[login]
+			if !ok || person.Email == "" {
+				log.Warnf("php-migrate: No email address for %s - skipping email", login)
+				continue
+			}
+			emails = append(emails, &email.EmailOptions{
+				FirstName: person.FirstName,
+				EmailName: person.LookupName,
+				Email:     person.Email,
+				CSP:       siteCSPName(m.site),
+				Folder:    m.site.Name(),
+				Subject:   "Website PHP Version Changed",
+				Type:      "php-migration",
+				PhpFrom:   m.from,
+				PhpTo:     phpMigrateOpts.to,
+			})
+		}
+	}
+
+	return emails, nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/plan"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// planOut is the file to write a plan of intended changes to, set by
+// --plan-out on commands which support it. Setting it implies --dry-run.
+var planOut string
+
+func addPlanOutFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&planOut, "plan-out", "", "Write a JSON plan of the intended changes (site fields, grants to finish, emails to send) to the given file. Implies --dry-run.")
+}
+
+// writePlan writes the plan of changes for a dry run to planOut. The site
+// changes are taken from the sites which would have been committed with
+// commitOpts.
+func writePlan(command string, commitOpts *cdb.CommitSitesOptions, grants []newerpol.AccessRecord, emails []*email.EmailOptions) error {
+	p := plan.New(runId, command, commitOpts.Message, commitOpts.Cmd)
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return err
+	}
+	for _, site := range sites {
+		if commitOpts.Ids != nil && !commitOpts.Ids[site.Id] {
+			continue
+		}
+		if !site.Changed() {
+			continue
+		}
+		if err := p.AddSite(site); err != nil {
+			return err
+		}
+	}
+	sort.Slice(p.Sites, func(i, j int) bool {
+		return p.Sites[i].Name < p.Sites[j].Name
+	})
+
+	if approvalReason != "" {
+		p.ApprovalReason = approvalReason
+		p.RequestedBy = currentUsername()
+	}
+
+	p.Grants = append(p.Grants, grants...)
+	p.Emails = append(p.Emails, emails...)
+
+	if err := p.Save(planOut); err != nil {
+		return err
+	}
+	log.Infof("Plan of %d site changes, %d grants and %d emails written to %s", len(p.Sites), len(p.Grants), len(p.Emails), planOut)
+	return nil
+}
+
+// checkPlanOut validates --plan-out against the global options, and makes
+// it imply --dry-run
+func checkPlanOut() error {
+	if planOut == "" {
+		return nil
+	}
+	if globalOpts.forceUpdateTree {
+		return fmt.Errorf("--plan-out cannot be used with --force-update-tree")
+	}
+	globalOpts.dryRun = true
+	return nil
+}
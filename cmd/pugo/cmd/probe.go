@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/probe"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var probeCmd = &cobra.Command{
+	Use:   "probe [site...]",
+	Short: "Check enabled sites are being served",
+	Long: `Request the primary URL of each enabled site, or of the given
+sites, and report the response status, the redirects followed, and when the
+TLS certificate expires. A site's primary URL is its first external domain,
+or otherwise its first path under probe.base_url.
+
+Up to probe.concurrency sites are requested at once, each waiting at most
+probe.timeout. The command exits with a non-zero status if any site fails to
+respond, responds with an error status, or has a certificate expiring within
+--tls-warn, for use as a monitoring check.`,
+	ValidArgsFunction: completeSiteNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return probeSites(cmd, args)
+	},
+}
+
+type probeOptions struct {
+	tlsWarn time.Duration
+}
+
+var probeOpts probeOptions
+
+// siteHealth is a single row of probe output
+type siteHealth struct {
+	Site      string   `json:"site" yaml:"site"`
+	URL       string   `json:"url" yaml:"url"`
+	Status    int      `json:"status" yaml:"status"`
+	TLSExpiry string   `json:"tls_expiry,omitempty" yaml:"tls_expiry,omitempty"`
+	Redirects []string `json:"redirects,omitempty" yaml:"redirects,omitempty"`
+	Error     string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type siteHealthReport []siteHealth
+
+func (r siteHealthReport) Header() []string {
+	return []string{"SITE", "URL", "STATUS", "TLS EXPIRY", "REDIRECTS", "ERROR"}
+}
+
+func (r siteHealthReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, h := range r {
+		rows = append(rows, []string{
+			h.Site,
+			h.URL,
+			strconv.Itoa(h.Status),
+			h.TLSExpiry,
+			strings.Join(h.Redirects, " -> "),
+			h.Error,
+		})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+
+	probeCmd.Flags().DurationVar(&probeOpts.tlsWarn, "tls-warn", 14*24*time.Hour, "Fail sites whose TLS certificate expires within this duration. 0 disables.")
+}
+
+func probeSites(cmd *cobra.Command, names []string) error {
+	var sites []*cdb.Site
+	if len(names) > 0 {
+		for _, name := range names {
+			site, err := lookupSite(name)
+			if err != nil {
+				return fmt.Errorf("probe: %w", err)
+			}
+			sites = append(sites, site)
+		}
+	} else {
+		all, err := cdb.GetAllSites()
+		if err != nil {
+			return gitErrorf("probe: Getting all sites: %w", err)
+		}
+		for _, site := range all {
+			if !site.Disabled {
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	baseURL := viper.GetString("probe.base_url")
+	timeout := viper.GetDuration("probe.timeout")
+	concurrency := viper.GetInt("probe.concurrency")
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var result siteHealthReport
+	for _, site := range sites {
+		url := probe.URL(site, baseURL)
+		if url == "" {
+			log.Warnf("probe: %s has no domains or paths, or probe.base_url isn't set - skipping", site.Name())
+			continue
+		}
+		result = append(result, siteHealth{Site: site.Name(), URL: url})
+	}
+
+	failed := 0
+	var mu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range result {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h *siteHealth) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			r := probe.Probe(runCtx, h.URL, timeout)
+			h.Status = r.StatusCode
+			h.Redirects = r.Redirects
+			if r.Err != nil {
+				h.Error = r.Err.Error()
+			}
+			ok := r.OK()
+			if !r.TLSExpiry.IsZero() {
+				h.TLSExpiry = r.TLSExpiry.Format("2006-01-02")
+				if probeOpts.tlsWarn > 0 && time.Until(r.TLSExpiry) < probeOpts.tlsWarn {
+					h.Error = "certificate expires soon"
+					ok = false
+				}
+			}
+			if !ok {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(&result[i])
+	}
+	wg.Wait()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Site < result[j].Site
+	})
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+
+	if failed > 0 {
+		return newExitError(exitCheckFailed, "probe: %d of %d sites failed", failed, len(result))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Promote the changes on the staging branch to production",
+	Long: `Bring the changes pugo sync has committed to cdb.staging_branch into
+cdb.branch and push it to origin, once they have been reviewed. The commits
+to be promoted are listed before asking for confirmation; with --dry-run
+nothing more is done.
+
+If cdb.branch hasn't changed since the staging branch left it, it is
+fast-forwarded to the staging branch. Otherwise the two are merged, unless
+they both changed the same site file, in which case they must be merged by
+hand. The staging branch is then moved to the promoted commit, so the next
+sync carries on from production. The grants promoted are finished, and users
+notified, by the next sync.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doPromote(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(promoteCmd)
+	addForceFlag(promoteCmd)
+}
+
+func doPromote(cmd *cobra.Command) error {
+	pending, err := cdb.Promote(runCtx, &cdb.PromoteOptions{DryRun: true})
+	if errors.Is(err, cdb.ErrNoStagingBranch) {
+		return configErrorf("promote: %w", err)
+	}
+	if err != nil {
+		return gitErrorf("promote: %w", err)
+	}
+	if len(pending.Commits) == 0 {
+		log.Infof("promote: Nothing to promote, %s is up to date", conf.Cdb.Branch)
+		return nil
+	}
+	lines := make([]string, 0, len(pending.Commits))
+	for _, commit := range pending.Commits {
+		lines = append(lines, fmt.Sprintf("%s %s", commit.Hash[:7], strings.SplitN(commit.Message, "\n", 2)[0]))
+	}
+	log.Infof("promote: %d commits on %s to promote:\n  %s", len(lines), conf.Cdb.StagingBranch, strings.Join(lines, "\n  "))
+	if globalOpts.dryRun {
+		return nil
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will promote %d commits from %s to %s.", len(lines), conf.Cdb.StagingBranch, conf.Cdb.Branch))
+	if err != nil {
+		return fmt.Errorf("promote: %w", err)
+	}
+	if !proceed {
+		log.Info("promote: Aborted")
+		return nil
+	}
+
+	result, err := cdb.Promote(runCtx, &cdb.PromoteOptions{NoPush: globalOpts.noPush})
+	if len(result.Commits) > 0 {
+		runSummary.recordCommit(&cdb.CommitSitesResult{Commit: result.Commit, Pushed: result.Pushed, RemotePushes: result.RemotePushes})
+	}
+	if err != nil {
+		return gitErrorf("promote: %w", err)
+	}
+	if len(result.Commits) > 0 {
+		log.Infof("promote: Promoted %d commits to %s (%s)", len(result.Commits), conf.Cdb.Branch, result.Commit)
+		log.Info("promote: The grants promoted will be finished by the next sync")
+	}
+	return nil
+}
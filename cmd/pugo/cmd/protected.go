@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// withoutProtected returns sites without those marked protected, logging
+// each one skipped. Bulk and automated commands never change protected
+// sites.
+func withoutProtected(logPrefix string, sites []*cdb.Site) []*cdb.Site {
+	kept := make([]*cdb.Site, 0, len(sites))
+	for _, site := range sites {
+		if site.Protected {
+			log.Infof("%s: Skipping %s - site is protected", logPrefix, site.Name())
+			continue
+		}
+		kept = append(kept, site)
+	}
+	return kept
+}
+
+// checkNotProtected returns an error if site is protected and force isn't
+// set, for commands changing a single site named explicitly
+func checkNotProtected(site *cdb.Site, force bool) error {
+	if site.Protected && !force {
+		return fmt.Errorf("%s is protected, use --force to change it anyway", site.Name())
+	}
+	return nil
+}
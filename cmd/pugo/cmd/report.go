@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/report"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Generate an access report",
+	Long: `Generate an access report giving a per-CSP breakdown of sites,
+their admins, pending access requests and revocations, and disabled sites.
+The report can be written as HTML and/or CSV, and emailed (with both
+attached) to the governance contacts configured in report.recipients.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doReport(cmd)
+	},
+}
+
+type reportOptions struct {
+	htmlFile string
+	csvFile  string
+	email    bool
+}
+
+var reportOpts reportOptions
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+
+	reportCmd.Flags().StringVar(&reportOpts.htmlFile, "html", "", "Write the HTML report to the given file.")
+	reportCmd.Flags().StringVar(&reportOpts.csvFile, "csv", "", "Write the CSV report to the given file.")
+	reportCmd.Flags().BoolVar(&reportOpts.email, "email", false, "Email the report to the recipients in report.recipients. Implied off by dry-run.")
+}
+
+func doReport(cmd *cobra.Command) error {
+	if reportOpts.htmlFile == "" && reportOpts.csvFile == "" && !reportOpts.email {
+		return fmt.Errorf("report: At least one of --html, --csv, or --email is required")
+	}
+	if reportOpts.email && len(viper.GetStringSlice("report.recipients")) == 0 {
+		return configErrorf("report: report.recipients missing in config")
+	}
+
+	log.Info("report: Generating report ...")
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("report: Getting all sites: %w", err)
+	}
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("report: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	csps, err := newerpol.GetWebsiteCSPs(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("report: %w", err)
+	}
+	getGrantsOpts := &newerpol.GetGrantsOptions{}
+	pendingGrants, pendingRevocations, err := newerpol.GetGrants(runCtx, newerpolDb, getGrantsOpts)
+	if err != nil {
+		return dbErrorf("report: %w", err)
+	}
+
+	r := report.Build(sites, csps, pendingGrants, pendingRevocations)
+
+	var htmlBuff, csvBuff bytes.Buffer
+	if err := r.WriteHTML(&htmlBuff); err != nil {
+		return err
+	}
+	if err := r.WriteCSV(&csvBuff); err != nil {
+		return err
+	}
+
+	if reportOpts.htmlFile != "" {
+		if err := ioutil.WriteFile(reportOpts.htmlFile, htmlBuff.Bytes(), 0644); err != nil {
+			return fmt.Errorf("report: %w", err)
+		}
+		log.Infof("report: HTML report written to %s", reportOpts.htmlFile)
+	}
+	if reportOpts.csvFile != "" {
+		if err := ioutil.WriteFile(reportOpts.csvFile, csvBuff.Bytes(), 0644); err != nil {
+			return fmt.Errorf("report: %w", err)
+		}
+		log.Infof("report: CSV report written to %s", reportOpts.csvFile)
+	}
+
+	if !reportOpts.email {
+		return nil
+	}
+	if globalOpts.dryRun {
+		log.Info("report: Performing dry run - report will not be emailed.")
+		return nil
+	}
+
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+	defer email.ShutdownWorker()
+
+	date := r.Generated.Format("2006-01-02")
+	reportEmailOpts := &email.ReportOptions{
+		Recipients: viper.GetStringSlice("report.recipients"),
+		Subject:    fmt.Sprintf("Website access report %s", date),
+		Body:       htmlBuff.String(),
+		Attachments: map[string][]byte{
+			fmt.Sprintf("access-report-%s.html", date): htmlBuff.Bytes(),
+			fmt.Sprintf("access-report-%s.csv", date):  csvBuff.Bytes(),
+		},
+	}
+	if err := email.SendReport(reportEmailOpts); err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+
+	return nil
+}
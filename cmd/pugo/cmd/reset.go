@@ -1,6 +1,11 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -10,11 +15,82 @@ var resetCmd = &cobra.Command{
 	Short: "Reset various elements of cdb",
 	Long: `Reset things in cdb, such as clearing admins from all sites
 or resetting the user expiry date.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		log.Fatal("reset: Must be run with subcommand")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("reset: Must be run with subcommand")
 	},
 }
 
+// resetOptions restrict a reset to some of the sites it would otherwise
+// apply to
+type resetOptions struct {
+	sites   []string
+	filters []string
+}
+
+var resetOpts resetOptions
+
+// Sites named in commit messages by a scoped reset, beyond which they are
+// counted instead
+const resetNamedSites = 5
+
 func init() {
 	rootCmd.AddCommand(resetCmd)
 }
+
+func addResetScopeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&resetOpts.sites, "site", nil, "Only reset the given site (name or id). May be repeated.")
+	cmd.Flags().StringArrayVar(&resetOpts.filters, "filter", nil, "Only reset sites matching field=value, as for pugo list. May be repeated.")
+	cmd.RegisterFlagCompletionFunc("site", completeSiteNames)
+	cmd.RegisterFlagCompletionFunc("filter", completeSiteFilters)
+}
+
+// resetScoped reports whether a reset is restricted with --site or --filter
+func resetScoped() bool {
+	return len(resetOpts.sites) > 0 || len(resetOpts.filters) > 0
+}
+
+// scopeResetSites restricts the sites a reset applies to to those named with
+// --site, if any, which match every --filter. Named sites which the reset
+// wouldn't otherwise apply to are skipped with a warning.
+func scopeResetSites(logPrefix string, sites []*cdb.Site) ([]*cdb.Site, error) {
+	filters, err := parseSiteFilters(resetOpts.filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(resetOpts.sites) > 0 {
+		named := make(map[int]*cdb.Site)
+		for _, nameOrId := range resetOpts.sites {
+			site, err := lookupSite(nameOrId)
+			if err != nil {
+				return nil, err
+			}
+			named[site.Id] = site
+		}
+		candidates := make(map[int]bool)
+		for _, site := range sites {
+			candidates[site.Id] = true
+		}
+		for id, site := range named {
+			if !candidates[id] {
+				log.Warnf("%s: Skipping %s - not one of the sites being reset", logPrefix, site.Name())
+			}
+		}
+		filters = append(filters, func(site *cdb.Site) bool {
+			return named[site.Id] != nil
+		})
+	}
+	return filterSites(sites, filters), nil
+}
+
+// resetScopeDescription describes the sites a scoped reset applies to, for
+// commit messages: their names, or how many there are if there are many
+func resetScopeDescription(sites []*cdb.Site) string {
+	if len(sites) > resetNamedSites {
+		return fmt.Sprintf("%d selected sites", len(sites))
+	}
+	names := make([]string, 0, len(sites))
+	for _, site := range sites {
+		names = append(names, site.Name())
+	}
+	return strings.Join(names, ", ")
+}
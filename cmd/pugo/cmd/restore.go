@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore archived items to the cdb",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("restore: Subcommand required")
+	},
+}
+
+var restoreSiteCmd = &cobra.Command{
+	Use:   "site <name>",
+	Short: "Restore an archived site",
+	Long: `Move a site archived with pugo site remove --archive back into the
+cdb and commit the change. The site can't be restored if another site now
+has its name or id.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeArchivedSiteNames,
+	Annotations:       map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return restoreSite(cmd, args[0])
+	},
+}
+
+var restoreSiteReason string
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.AddCommand(restoreSiteCmd)
+
+	restoreSiteCmd.Flags().StringVar(&restoreSiteReason, "reason", "", "Reason for the change, recorded in the commit message.")
+}
+
+func restoreSite(cmd *cobra.Command, name string) error {
+	commitOpts := &cdb.CommitSitesOptions{
+		Message: attributedMessage(fmt.Sprintf("Restore %s", name), restoreSiteReason),
+		Cmd:     "restore site",
+		DryRun:  globalOpts.dryRun,
+		NoPush:  globalOpts.noPush,
+	}
+	site, commitResult, err := cdb.RestoreSite(runCtx, name, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("restore-site: %w", err)
+	}
+	if !globalOpts.dryRun {
+		log.Infof("restore-site: Restored %s (id %d)", site.Name(), site.Id)
+	}
+
+	return nil
+}
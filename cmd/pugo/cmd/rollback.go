@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <commit>",
+	Short: "Revert the cdb changes made by a pugo commit",
+	Long: `Revert the changes made to sites by a pugo commit, e.g. when a sync
+applied bad data. Admins added by the commit are removed and admins removed
+are added back, without disturbing admins changed by later commits. Other
+fields are restored unless they have since been changed again, in which case
+they are reported as conflicts and left alone.
+
+With --reset-grants the corresponding newerpol records are moved back to
+pending so they will be re-processed by the next sync. A report of what was
+undone is written on completion.`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doRollback(cmd, args[0])
+	},
+}
+
+type rollbackOptions struct {
+	resetGrants bool
+}
+
+var rollbackOpts rollbackOptions
+
+// rollbackAction is a single line of the rollback report
+type rollbackAction struct {
+	Site   string `json:"site" yaml:"site"`
+	Action string `json:"action" yaml:"action"`
+	Detail string `json:"detail" yaml:"detail"`
+}
+
+type rollbackReport []rollbackAction
+
+func (r rollbackReport) Header() []string {
+	return []string{"SITE", "ACTION", "DETAIL"}
+}
+
+func (r rollbackReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, a := range r {
+		rows = append(rows, []string{a.Site, a.Action, a.Detail})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+	addForceFlag(rollbackCmd)
+
+	rollbackCmd.Flags().BoolVar(&rollbackOpts.resetGrants, "reset-grants", false, "Move the newerpol records for the admins changed back to pending.")
+}
+
+func doRollback(cmd *cobra.Command, hash string) error {
+	info, changes, err := cdb.GetCommitChanges(runCtx, hash)
+	if err != nil {
+		return gitErrorf("rollback: %w", err)
+	}
+	if !info.Pugo {
+		return fmt.Errorf("rollback: %s is not a pugo commit: %s", info.Hash, info.Message)
+	}
+	if info.Run != "" {
+		log.Infof("rollback: Rolling back %s made by run %s: %s", info.Hash, info.Run, info.Message)
+	} else {
+		log.Infof("rollback: Rolling back %s: %s", info.Hash, info.Message)
+	}
+
+	var report rollbackReport
+	conflicts := 0
+	siteIdsToCommit := make(map[int]bool)
+	for i := range changes {
+		change := &changes[i]
+		site, err := cdb.GetSiteByName(change.Name)
+		if err != nil {
+			return gitErrorf("rollback: %w", err)
+		}
+		if site == nil {
+			report = append(report, rollbackAction{change.Name, "conflict", "site no longer exists"})
+			conflicts++
+			continue
+		}
+
+		reverted, conflicted := site.Revert(change)
+		for _, field := range reverted {
+			if field != "Admins" {
+				report = append(report, rollbackAction{site.Name(), "revert-field", field})
+				continue
+			}
+			for _, admin := range change.AdminsAdded() {
+				report = append(report, rollbackAction{site.Name(), "remove-admin", admin})
+			}
+			for _, admin := range change.AdminsRemoved() {
+				report = append(report, rollbackAction{site.Name(), "restore-admin", admin})
+			}
+		}
+		for _, field := range conflicted {
+			report = append(report, rollbackAction{site.Name(), "conflict", field})
+			conflicts++
+		}
+		if site.Changed() {
+			siteIdsToCommit[site.Id] = true
+		}
+	}
+
+	summary := fmt.Sprintf("This will revert changes to %d sites made by %s.", len(siteIdsToCommit), info.Hash[:8])
+	if rollbackOpts.resetGrants {
+		summary += " The corresponding newerpol records will be moved back to pending."
+	}
+	proceed, err := confirm(summary)
+	if err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+	if !proceed {
+		log.Info("rollback: Aborted")
+		return nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         fmt.Sprintf("Roll back %s", info.Hash[:8]),
+		Cmd:             "rollback",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("rollback: %w", err)
+	}
+
+	// Flip newerpol records back to pending
+	resetFailures := 0
+	if rollbackOpts.resetGrants && !globalOpts.dryRun {
+		newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+		if err != nil {
+			// cdb changes have already been committed at this point
+			return partialFailureErrorf("rollback: Connecting to newerpol: %w", err)
+		}
+		defer newerpolDb.Close()
+
+		for i := range changes {
+			change := &changes[i]
+			site, _ := cdb.GetSiteByName(change.Name)
+			if site == nil || change.Before == nil || change.After == nil {
+				continue
+			}
+			resetGrants := func(admins []string, granted bool) {
+				for _, admin := range admins {
+					updated, err := newerpol.ResetGrant(runCtx, newerpolDb, site.Id, admin, granted)
+					switch {
+					case err != nil:
+						log.Warnf("rollback: %v", err)
+						report = append(report, rollbackAction{site.Name(), "reset-grant-failed", admin})
+						resetFailures++
+					case !updated:
+						report = append(report, rollbackAction{site.Name(), "no-grant-found", admin})
+					default:
+						report = append(report, rollbackAction{site.Name(), "reset-grant", admin})
+					}
+				}
+			}
+			resetGrants(change.AdminsAdded(), true)
+			resetGrants(change.AdminsRemoved(), false)
+		}
+	}
+
+	if err := writeOutput(os.Stdout, report); err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+
+	if conflicts > 0 || resetFailures > 0 {
+		return partialFailureErrorf("rollback: %d conflicts and %d grant reset failures, see report", conflicts, resetFailures)
+	}
+	return nil
+}
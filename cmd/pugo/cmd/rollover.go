@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Roll sites over to a new academic year",
+	Long: `Perform the annual rollover for the academic year starting in --year
+as a single audited operation, in place of running reset admins and reset
+expiry by hand:
+
+  1. The admins of sites managed through eActivities are removed.
+  2. The expiry date of every site is set to 31 July of the following year.
+  3. Both changes are committed together, and the commit is tagged
+     rollover-<year>.
+  4. A report of every site's changes is written, and with --email-report
+     sent to the recipients in report.recipients.
+  5. With --notify the removed admins are sent the standard access removed
+     email.
+
+Immortal admins are unaffected, and sites not managed through eActivities
+keep their admins.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doRollover(cmd)
+	},
+}
+
+type rolloverOptions struct {
+	year        int
+	reportFile  string
+	emailReport bool
+	notify      bool
+}
+
+var rolloverOpts rolloverOptions
+
+// rolledOverSite is the rollover report output for a single site
+type rolledOverSite struct {
+	Site          string   `json:"site" yaml:"site"`
+	Id            int      `json:"id" yaml:"id"`
+	Managed       bool     `json:"managed" yaml:"managed"`
+	AdminsRemoved []string `json:"admins_removed" yaml:"admins_removed"`
+	OldExpiry     string   `json:"old_expiry" yaml:"old_expiry"`
+	NewExpiry     string   `json:"new_expiry" yaml:"new_expiry"`
+}
+
+type rolloverReport []rolledOverSite
+
+func (r rolloverReport) Header() []string {
+	return []string{"SITE", "ID", "MANAGED", "ADMINS REMOVED", "OLD EXPIRY", "NEW EXPIRY"}
+}
+
+func (r rolloverReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, s := range r {
+		rows = append(rows, []string{s.Site, strconv.Itoa(s.Id), strconv.FormatBool(s.Managed), strings.Join(s.AdminsRemoved, " "), s.OldExpiry, s.NewExpiry})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(rolloverCmd)
+	addForceFlag(rolloverCmd)
+
+	rolloverCmd.Flags().IntVar(&rolloverOpts.year, "year", 0, "The year in which the new academic year starts, e.g. 2025 for 2025-26.")
+	rolloverCmd.Flags().StringVar(&rolloverOpts.reportFile, "report-file", "", "Write the rollover report to the given file instead of standard output.")
+	rolloverCmd.Flags().BoolVar(&rolloverOpts.emailReport, "email-report", false, "Email the rollover report to the recipients in report.recipients. Implied off by dry-run.")
+	rolloverCmd.Flags().BoolVar(&rolloverOpts.notify, "notify", false, "Email admins removed from sites. Implied off by dry-run.")
+	rolloverCmd.MarkFlagRequired("year")
+	addPlanOutFlag(rolloverCmd)
+}
+
+func doRollover(cmd *cobra.Command) error {
+	if rolloverOpts.year < 2000 || rolloverOpts.year > 2100 {
+		return configErrorf("rollover: Invalid --year %d", rolloverOpts.year)
+	}
+	if rolloverOpts.emailReport && len(viper.GetStringSlice("report.recipients")) == 0 {
+		return configErrorf("rollover: report.recipients missing in config")
+	}
+	expiry := fmt.Sprintf("%d-07-31", rolloverOpts.year+1)
+	tag := fmt.Sprintf("rollover-%d", rolloverOpts.year)
+	academicYear := fmt.Sprintf("%d-%02d", rolloverOpts.year, (rolloverOpts.year+1)%100)
+
+	log.Infof("rollover: Starting rollover to %s ...", academicYear)
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return dbErrorf("rollover: Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	managedSiteIds, err := newerpol.GetManagedSiteIds(runCtx, newerpolDb)
+	if err != nil {
+		return dbErrorf("rollover: Getting managed site ids: %w", err)
+	}
+	managed := make(map[int]bool)
+	for _, id := range managedSiteIds {
+		managed[id] = true
+	}
+
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("rollover: Getting all sites: %w", err)
+	}
+	sites = withoutProtected("rollover", sites)
+
+	totalAdmins := 0
+	for _, site := range sites {
+		if managed[site.Id] {
+			totalAdmins += len(site.Admins)
+		}
+	}
+	proceed, err := confirm(fmt.Sprintf("This will remove %d admins from %d eActivities managed sites, set the expiry date of all %d sites to %s, and tag the cdb %s.", totalAdmins, len(managedSiteIds), len(sites), expiry, tag))
+	if err != nil {
+		return fmt.Errorf("rollover: %w", err)
+	}
+	if !proceed {
+		log.Info("rollover: Aborted")
+		return nil
+	}
+
+	// Update sites
+	var report rolloverReport
+	var removed []removedAdmin
+	siteIdsToCommit := make(map[int]bool)
+	for _, site := range sites {
+		entry := rolledOverSite{
+			Site:          site.Name(),
+			Id:            site.Id,
+			Managed:       managed[site.Id],
+			AdminsRemoved: []string{},
+			OldExpiry:     site.Expiry,
+			NewExpiry:     expiry,
+		}
+		if entry.Managed {
+			for _, login := range site.Admins {
+				entry.AdminsRemoved = append(entry.AdminsRemoved, login)
+				removed = append(removed, removedAdmin{login: login, site: site})
+			}
+			site.Admins = []string{}
+		}
+		site.Expiry = expiry
+		site.MarkAsChanged()
+		siteIdsToCommit[site.Id] = true
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Site < report[j].Site
+	})
+
+	// Commit changes to repo and tag
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             siteIdsToCommit,
+		Message:         fmt.Sprintf("Rollover to %s: reset admins (eActivities managed sites only) and set expiry date to %s", academicYear, expiry),
+		Cmd:             "rollover",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("rollover: %w", err)
+	}
+
+	// From here on the cdb changes have been committed, so failures are
+	// partial
+	var failures []string
+	tagOpts := &cdb.TagOptions{
+		Name:    tag,
+		Message: fmt.Sprintf("Rollover to %s (run %s)", academicYear, runId),
+		DryRun:  globalOpts.dryRun,
+		NoPush:  globalOpts.noPush,
+	}
+	if err := cdb.TagHead(runCtx, tagOpts); err != nil {
+		log.Errorf("rollover: %v", err)
+		failures = append(failures, "tagging the cdb")
+	}
+
+	if err := writeRolloverReport(report); err != nil {
+		log.Errorf("rollover: Writing report: %v", err)
+		failures = append(failures, "writing the report")
+	}
+
+	var emails []*email.EmailOptions
+	if rolloverOpts.notify && len(removed) > 0 && (!globalOpts.dryRun || planOut != "") {
+		if emails, err = removedAdminEmails("rollover", removed); err != nil {
+			if globalOpts.dryRun {
+				return dbErrorf("rollover: %w", err)
+			}
+			log.Errorf("rollover: %v", err)
+			failures = append(failures, "looking up removed admins")
+		}
+	}
+
+	if globalOpts.dryRun {
+		if planOut != "" {
+			if err := writePlan(cmd.CommandPath(), commitOpts, nil, emails); err != nil {
+				return fmt.Errorf("rollover: %w", err)
+			}
+		}
+		if len(emails) > 0 || rolloverOpts.emailReport {
+			log.Info("rollover: Performing dry run - emails will not be sent.")
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("rollover: Failed %s", strings.Join(failures, ", "))
+		}
+		return nil
+	}
+
+	if len(emails) > 0 || rolloverOpts.emailReport {
+		if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+			return partialFailureErrorf("rollover: Unable to start email worker, emails will not be sent: %w", err)
+		}
+		defer email.ShutdownWorker()
+	}
+	if rolloverOpts.emailReport {
+		if err := emailRolloverReport(academicYear, tag, expiry, report); err != nil {
+			log.Errorf("rollover: Emailing report: %v", err)
+			failures = append(failures, "emailing the report")
+		}
+	}
+	for _, emailOpts := range emails {
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.WithFields(log.Fields{
+				"emailOpts": emailOpts,
+			}).Warnf("rollover: Error attempting to send email: %v", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return partialFailureErrorf("rollover: Sites rolled over, but failed %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// writeRolloverReport writes the report to --report-file if set, otherwise
+// standard output, in the --output format
+func writeRolloverReport(report rolloverReport) error {
+	if rolloverOpts.reportFile == "" {
+		return writeOutput(os.Stdout, report)
+	}
+
+	f, err := os.Create(rolloverOpts.reportFile)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput(f, report); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Infof("rollover: Report written to %s", rolloverOpts.reportFile)
+	return nil
+}
+
+// emailRolloverReport sends a digest of the rollover to the report
+// recipients, with the full report attached as CSV
+func emailRolloverReport(academicYear string, tag string, expiry string, report rolloverReport) error {
+	var csvBuff bytes.Buffer
+	cw := csv.NewWriter(&csvBuff)
+	cw.Write(report.Header())
+	cw.WriteAll(report.Rows())
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	managedSites, adminsRemoved := 0, 0
+	for _, s := range report {
+		if s.Managed {
+			managedSites++
+		}
+		adminsRemoved += len(s.AdminsRemoved)
+	}
+	body := fmt.Sprintf(`<p>The website rollover to %s has been completed (tag %s, run %s).</p>
+<ul>
+<li>Sites: %d</li>
+<li>eActivities managed sites reset: %d</li>
+<li>Admins removed: %d</li>
+<li>New expiry date: %s</li>
+</ul>
+<p>The attached report lists the changes made to each site.</p>`,
+		html.EscapeString(academicYear), html.EscapeString(tag), html.EscapeString(runId),
+		len(report), managedSites, adminsRemoved, html.EscapeString(expiry))
+
+	return email.SendReport(&email.ReportOptions{
+		Recipients: viper.GetStringSlice("report.recipients"),
+		Subject:    fmt.Sprintf("Website rollover %s", academicYear),
+		Body:       body,
+		Attachments: map[string][]byte{
+			fmt.Sprintf("rollover-%s-%s.csv", academicYear, time.Now().Format("2006-01-02")): csvBuff.Bytes(),
+		},
+	})
+}
@@ -1,27 +1,93 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/hooks"
+	"github.com/icunion/pugo/progress"
+	"github.com/icunion/pugo/secrets"
+	"github.com/icunion/pugo/state"
+	"github.com/icunion/pugo/tracing"
+	"github.com/icunion/pugo/webhooks"
 
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
 )
 
 type globalOptions struct {
 	dryRun          bool
 	forceUpdateTree bool
 	noPush          bool
+	yes             bool
+	output          string
+	timeout         time.Duration
+	forceUnlock     bool
 }
 
 var cfgFile string
 var LogQuiet bool
 var LogVerbose bool
+var LogFormat string
 
 var globalOpts globalOptions
 
+// conf is the configuration loaded and validated when the command starts
+var conf = &config.Config{}
+
+// configInitErr records any error encountered by initConfig, which can't
+// return errors itself. It is returned before any command runs.
+var configInitErr error
+
+// runCtx is cancelled when pugo receives SIGINT or SIGTERM, or when the
+// --timeout deadline passes. Commands pass it to all cdb, newerpol, and
+// email operations so a stuck run can be cleanly interrupted.
+var runCtx context.Context = context.Background()
+var runCancel context.CancelFunc = func() {}
+
+// Commands which change the cdb or newerpol are annotated with
+// annotationRunLock so that only one runs at a time. releaseRunLock releases
+// the lock once the command completes.
+const annotationRunLock = "pugo/run-lock"
+
+var releaseRunLock = func() {}
+
+// Commands which don't need a valid configuration are annotated with
+// annotationNoConfig so they still run if it is invalid
+const annotationNoConfig = "pugo/no-config"
+
+// Commands which carry on past sites which fail, reporting them together, are
+// annotated with annotationContinueOnError so that site files which can't be
+// loaded are skipped and reported rather than stopping them
+const annotationContinueOnError = "pugo/continue-on-error"
+
+// Commands which don't read or write the cdb are annotated with
+// annotationNoCdb so that it isn't checked out or cloned for them
+const annotationNoCdb = "pugo/no-cdb"
+
+// Commands which only touch the sites named on the command line are annotated
+// with annotationLazySites so that sites are loaded as they are looked up
+// rather than all at once
+const annotationLazySites = "pugo/lazy-sites"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "pugo",
@@ -30,22 +96,103 @@ var rootCmd = &cobra.Command{
 to perform the following tasks:
 
 * Sync access requests and revocations from eActivities to icu-cdb
+* List and inspect sites in icu-cdb
 * Make a new site
 * Fix file permissions
 `,
+	SilenceErrors: true,
+	// Usage is only useful for errors in arguments, so silence it once
+	// arguments have been validated
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := loadConfig(cmd); err != nil {
+			return err
+		}
+		if err := checkPlanOut(); err != nil {
+			return err
+		}
+		if cmd.Annotations[annotationLazySites] != "" {
+			cdb.EnableLazyLoading()
+		}
+		// A malformed site file only stops commands which change the cdb
+		// and can't carry on without it
+		if cmd.Annotations[annotationRunLock] == "" || cmd.Annotations[annotationContinueOnError] != "" {
+			cdb.EnableTolerantLoading()
+		}
+		if cmd.Annotations[annotationRunLock] != "" {
+			if err := acquireRunLock(cmd); err != nil {
+				return err
+			}
+		}
+		// pugo serve runs until interrupted, so --timeout doesn't apply
+		timeout := globalOpts.timeout
+		if cmd == serveCmd {
+			timeout = 0
+		}
+		initRunContext(timeout)
+		// With cdb.bare or --ephemeral, the cdb is checked out afresh for
+		// each run of a command which uses it. Otherwise it is cloned into
+		// cdb.path if it isn't there yet, except by pugo cdb clone, which
+		// does so itself.
+		if usesCdb(cmd) {
+			if err := cdb.OpenTemporaryWorktree(runCtx); err != nil {
+				return gitErrorf("%w", err)
+			}
+			if cmd != cdbCloneCmd {
+				if _, err := cdb.EnsureRepo(runCtx); err != nil {
+					return gitErrorf("%w", err)
+				}
+			}
+		}
+		if err := startTracing(cmd); err != nil {
+			log.Warn(err)
+		}
+		runSummary.start(cmd, args)
+		hooks.SetRunInfo(map[string]interface{}{
+			"run_id":  runId,
+			"command": cmd.CommandPath(),
+			"dry_run": globalOpts.dryRun,
+		})
+		audit.SetRun(runId, cmd.CommandPath())
+		audit.SetClient(os.Getenv(apiClientEnv))
+		webhooks.SetRun(runId, cmd.CommandPath())
+		cdb.SetRunId(runId)
+		email.SetRunId(runId)
+		return nil
+	},
+}
+
+// usesCdb reports whether cmd reads or writes the cdb, so needs it checking
+// out or cloning first. Shell completion uses the cdb as it is.
+func usesCdb(cmd *cobra.Command) bool {
+	switch {
+	case cmd.Annotations[annotationNoCdb] != "", cmd.Annotations[annotationNoConfig] != "":
+		return false
+	case cmd.Parent() == configCmd, cmd.Name() == "help", cmd.Name() == cobra.ShellCompRequestCmd, cmd.Name() == cobra.ShellCompNoDescRequestCmd:
+		return false
+	}
+	return true
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Errors returned by commands are logged and mapped to an exit code here
+// rather than being handled (and exited on) deep inside command helpers.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	err := rootCmd.Execute()
+	finishTracing(err)
+	runCancel()
+	cdb.RemoveTemporaryWorktree()
+	releaseRunLock()
+	runSummary.finish(err)
+	if err != nil {
+		log.Error(err)
+		os.Exit(exitCode(err))
 	}
 }
 
 func init() {
-	cobra.OnInitialize(initLog, initConfig)
+	cobra.OnInitialize(initConfig, initLog)
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
@@ -54,10 +201,22 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.pugo.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&LogQuiet, "quiet", "q", false, "quiet output (warnings only). Ignored if verbose is enabled.")
 	rootCmd.PersistentFlags().BoolVarP(&LogVerbose, "verbose", "v", false, "verbose output (debug level)")
+	rootCmd.PersistentFlags().StringVar(&LogFormat, "log-format", "text", "log output format: text or json")
+	viper.BindPFlag("log.format", rootCmd.PersistentFlags().Lookup("log-format"))
 
 	rootCmd.PersistentFlags().BoolVar(&globalOpts.dryRun, "dry-run", false, "Perform dry run: don't commit to cdb, update Newerpol, or send emails.")
 	rootCmd.PersistentFlags().BoolVar(&globalOpts.forceUpdateTree, "force-update-tree", false, "Force the cdb tree to be updated when performing a dry run (e.g. to inspect changes in repo before manually committing).")
 	rootCmd.PersistentFlags().BoolVar(&globalOpts.noPush, "no-push", false, "Don't push to origin after committing. Implied by dry-run.")
+	rootCmd.PersistentFlags().DurationVar(&globalOpts.timeout, "timeout", 0, "Abort the run if it has not completed within the given duration (e.g. 5m). Zero means no timeout.")
+	rootCmd.PersistentFlags().StringVarP(&globalOpts.output, "output", "o", "table", "Output format for query commands: table, json, yaml, or csv.")
+	rootCmd.PersistentFlags().BoolVarP(&globalOpts.yes, "yes", "y", false, "Don't prompt for confirmation before performing destructive operations.")
+	rootCmd.PersistentFlags().Int("concurrency", 0, "Number of sites to save to the cdb working tree at once (default cdb.concurrency, or the number of CPUs).")
+	viper.BindPFlag("cdb.concurrency", rootCmd.PersistentFlags().Lookup("concurrency"))
+	rootCmd.PersistentFlags().Bool("strict", false, "Treat unknown fields in site files as errors rather than ignoring them (default cdb.strict).")
+	viper.BindPFlag("cdb.strict", rootCmd.PersistentFlags().Lookup("strict"))
+	rootCmd.PersistentFlags().Bool("ephemeral", false, "Clone the cdb from cdb.url into a temporary directory for the run, rather than using cdb.path (default cdb.ephemeral).")
+	viper.BindPFlag("cdb.ephemeral", rootCmd.PersistentFlags().Lookup("ephemeral"))
+	rootCmd.PersistentFlags().BoolVar(&globalOpts.forceUnlock, "force-unlock", false, "Break the run lock if it is held by another process, e.g. one which crashed on another host.")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -69,23 +228,213 @@ func initConfig() {
 		// Find home directory.
 		home, err := homedir.Dir()
 		if err != nil {
-			log.Fatal(err)
+			configInitErr = configErrorf("Finding home directory: %w", err)
+		} else {
+			// Search config in home directory with name ".pugo" (without extension).
+			viper.AddConfigPath(home)
+			viper.SetConfigName(".pugo")
 		}
-
-		// Search config in home directory with name ".pugo" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".pugo")
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		log.Info("Using config file:", viper.ConfigFileUsed())
+	// If a config file is found, read it in. Logging is initialised after
+	// config is read so the config file used is reported by initLog
+	if viper.ReadInConfig() == nil {
+		file, err := readConfigFile()
+		if err == nil {
+			err = file.install()
+		}
+		configInitErr = errors.Join(configInitErr, err)
 	}
 }
 
-// initLog initialises logging (i.e. setting the required log level etc)
+// configFile is the config file as read by readConfigFile
+type configFile struct {
+	// The settings, with secrets resolved
+	settings map[string]interface{}
+	// The keys whose values were resolved from references to secrets
+	resolved map[string]bool
+	// The resolver for references found later, e.g. in tracing.headers
+	resolver *secrets.Resolver
+}
+
+// currentConfigFile is the config file installed in viper, if any
+var currentConfigFile = &configFile{resolver: &secrets.Resolver{}}
+
+// readConfigFile reads the config file in use and resolves the secrets in
+// it, without changing the configuration in use, so that a reloaded config
+// file can be checked before it replaces the current one
+func readConfigFile() (*configFile, error) {
+	raw := viper.New()
+	raw.SetConfigFile(viper.ConfigFileUsed())
+	if err := raw.ReadInConfig(); err != nil {
+		return nil, configErrorf("Reading config: %w", err)
+	}
+	return resolveSecrets(raw.AllSettings())
+}
+
+// install makes the settings the config file layer of viper, replacing any
+// installed before, and configures the secrets resolver. Resolved secrets
+// are part of that layer rather than viper overrides, so they are replaced
+// along with the rest of the file when it is reloaded.
+func (f *configFile) install() error {
+	data, err := yaml.Marshal(f.settings)
+	if err != nil {
+		return configErrorf("Installing config: %w", err)
+	}
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		return configErrorf("Installing config: %w", err)
+	}
+	secrets.Configure(f.resolver)
+	currentConfigFile = f
+	return nil
+}
+
+// resolveSecrets returns a copy of settings with references to secrets held
+// outside the config file (env:, file:, exec:, vault:) resolved, so the rest
+// of pugo only sees resolved values, and the resolver to use for any found
+// later. Any value, or item of a list, may be encrypted (age:), but only
+// secrets may reference external sources. vault.address and vault.token are
+// resolved first, as other secrets may be read from Vault, then the rest in
+// order of key. All secrets which can't be resolved are reported together.
+func resolveSecrets(settings map[string]interface{}) (*configFile, error) {
+	s := &secretResolution{resolver: &secrets.Resolver{}, resolved: make(map[string]bool)}
+	if section, ok := settings["secrets"].(map[string]interface{}); ok {
+		s.resolver.IdentityFile, _ = section["identity_file"].(string)
+	}
+
+	resolved := make(map[string]interface{}, len(settings))
+	if vault, ok := settings["vault"]; ok {
+		resolved["vault"] = s.resolve("vault", vault)
+		if section, ok := resolved["vault"].(map[string]interface{}); ok {
+			s.resolver.VaultAddress, _ = section["address"].(string)
+			s.resolver.VaultToken, _ = section["token"].(string)
+		}
+	}
+	for _, name := range sortedSettings(settings) {
+		if name != "vault" {
+			resolved[name] = s.resolve(name, settings[name])
+		}
+	}
+
+	if len(s.problems) > 0 {
+		return nil, configErrorf("Resolving secrets: %s", strings.Join(s.problems, "; "))
+	}
+	return &configFile{settings: resolved, resolved: s.resolved, resolver: s.resolver}, nil
+}
+
+// secretResolution tracks the resolution of the secrets in the config file
+type secretResolution struct {
+	resolver *secrets.Resolver
+	resolved map[string]bool
+	problems []string
+}
+
+// resolve returns value, the setting for key, with any secrets resolved
+func (s *secretResolution) resolve(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+		for _, name := range sortedSettings(v) {
+			resolved[name] = s.resolve(key+"."+name, v[name])
+		}
+		return resolved
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved[i] = s.resolve(key, item)
+		}
+		return resolved
+	case string:
+		if !configKeys[key].secret && !strings.HasPrefix(v, secrets.EncryptedPrefix) {
+			return v
+		}
+		secret, err := s.resolver.Resolve(context.Background(), v)
+		if err != nil {
+			s.problems = append(s.problems, fmt.Sprintf("%s: %v", key, err))
+			return v
+		}
+		if secret != v {
+			s.resolved[key] = true
+		}
+		return secret
+	}
+	return value
+}
+
+func sortedSettings(settings map[string]interface{}) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadConfig loads and validates the configuration before the command runs,
+// and configures the cdb. Config commands must still work so problems can
+// be fixed, so only warn about them, and commands which don't need a valid
+// configuration ignore them.
+func loadConfig(cmd *cobra.Command) error {
+	loaded, err := config.Load()
+	if loaded != nil {
+		conf = loaded
+	}
+	cdb.Configure(&conf.Cdb)
+	webhooks.Configure(&conf.Webhooks)
+
+	if configInitErr != nil {
+		err = configInitErr
+	} else if err != nil {
+		err = configErrorf("%w", err)
+	}
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case cmd.Parent() == configCmd:
+		log.Warn(err)
+	case cmd.Annotations[annotationNoConfig] != "", cmd.Name() == "help", cmd.Name() == cobra.ShellCompRequestCmd:
+	default:
+		return err
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file, e.g. on SIGHUP in pugo serve. The
+// new config is read, its secrets resolved, and validated before it is used,
+// so if any of that fails the error is returned and the previous config is
+// kept. Otherwise the cdb is reconfigured, discarding any sites already
+// loaded so they are read afresh, and the logging settings are reapplied.
+func reloadConfig() error {
+	file, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	previous := currentConfigFile
+	if err := file.install(); err != nil {
+		return err
+	}
+	loaded, err := config.Load()
+	if err != nil {
+		if err := previous.install(); err != nil {
+			log.Error(err)
+		}
+		return configErrorf("%w", err)
+	}
+	conf = loaded
+	cdb.Configure(&conf.Cdb)
+	webhooks.Configure(&conf.Webhooks)
+	applyLogConfig()
+	return nil
+}
+
+// initLog initialises logging (i.e. setting the required log level, output
+// format, etc). Must be run after initConfig so log.format from the config
+// file is honoured
 func initLog() {
 	if LogVerbose {
 		LogQuiet = false
@@ -94,4 +443,116 @@ func initLog() {
 	if LogQuiet {
 		log.SetLevel(log.WarnLevel)
 	}
+
+	applyLogConfig()
+
+	runId = newRunId()
+	log.AddHook(&runIdHook{})
+
+	if viper.ConfigFileUsed() != "" {
+		log.Info("Using config file:", viper.ConfigFileUsed())
+	}
+}
+
+// applyLogConfig applies the logging settings which may be set in the
+// config file, i.e. the output format and the repeat limit of warnings. Run
+// again when the config is reloaded.
+func applyLogConfig() {
+	var formatter log.Formatter = &log.TextFormatter{}
+	switch viper.GetString("log.format") {
+	case "json":
+		formatter = &log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime:  "timestamp",
+				log.FieldKeyLevel: "level",
+				log.FieldKeyMsg:   "message",
+			},
+		}
+	case "text", "":
+	default:
+		log.Warnf("Unknown log format '%s', using text", viper.GetString("log.format"))
+	}
+	logDedup.configure(formatter, viper.GetInt("log.repeat_limit"))
+	log.SetFormatter(logDedup)
+
+	progress.SetInteractive(isTerminal(os.Stderr) && viper.GetString("log.format") != "json" && !LogQuiet)
+}
+
+// acquireRunLock takes the run lock for cmd, breaking any existing lock
+// first if --force-unlock is set
+func acquireRunLock(cmd *cobra.Command) error {
+	if globalOpts.forceUnlock {
+		holder, err := state.ReadRunLock()
+		if err != nil {
+			return err
+		}
+		if holder != nil {
+			log.Warnf("Breaking run lock held by %s", holder)
+			if err := state.Unlock(); err != nil {
+				return err
+			}
+		}
+	}
+
+	release, err := state.AcquireRunLock(runId, cmd.CommandPath())
+	if err != nil {
+		return newExitError(exitLocked, "%w. Use pugo unlock or --force-unlock if it is no longer running", err)
+	}
+	releaseRunLock = release
+	return nil
+}
+
+// runSpan is the span covering the whole command, the parent of all others
+var runSpan trace.Span
+
+// startTracing configures tracing and starts the span for the command,
+// making it the parent of everything done with runCtx
+func startTracing(cmd *cobra.Command) error {
+	err := tracing.Init()
+	runCtx, runSpan = tracing.Start(runCtx, cmd.CommandPath(),
+		attribute.String("pugo.run_id", runId),
+		attribute.Bool("pugo.dry_run", globalOpts.dryRun),
+	)
+	return err
+}
+
+// finishTracing ends the command span and exports any spans not yet sent
+func finishTracing(err error) {
+	if runSpan == nil {
+		return
+	}
+	runSpan.SetAttributes(attribute.Int("pugo.exit_code", exitCode(err)))
+	tracing.End(runSpan, &err)
+	if err := tracing.Shutdown(); err != nil {
+		log.Warn(err)
+	}
+}
+
+// initRunContext creates the run context, cancelled on SIGINT / SIGTERM or
+// when the timeout (if any) expires. A second signal terminates pugo
+// immediately.
+func initRunContext(timeout time.Duration) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Warnf("Received %v, stopping. Send again to terminate immediately", sig)
+			signal.Stop(sigs)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigs)
+		}
+	}()
+
+	runCtx = ctx
+	runCancel = cancel
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/icunion/pugo/cdb"
+
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Output a JSON Schema for site files",
+	Long: `Output a JSON Schema describing the site files in icu-cdb, so editors
+and CI can validate hand-edited sites against what pugo expects. The allowed
+PHP versions are taken from cdb.php_versions.
+
+For example, to validate sites in CI with check-jsonschema:
+
+  pugo schema > site.schema.json
+  check-jsonschema --schemafile site.schema.json sites/*.yaml`,
+	Annotations: map[string]string{annotationNoConfig: "true"},
+	Args:        cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return outputSchema()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
+
+func outputSchema() error {
+	data, err := json.MarshalIndent(cdb.Schema(conf.Cdb.PhpVersions), "", "  ")
+	if err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout, string(data)); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/icunion/pugo/confirmation"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the pages people follow to confirm access, and the API",
+	Long: `Run an HTTP server on serve.listen for the confirmation links
+emailed when sync.confirm_access is set. Confirming only records the
+confirmation: the grant is applied by the next sync. serve.base_url must be
+the public URL the server is reached at, e.g. behind a reverse proxy, as
+serve.listen is on localhost by default.
+
+The links are the only credential, so each can be used once, and expires
+after confirm.expiry (7 days by default). Expired confirmations are removed
+when the server starts and hourly, as well as by sync.
+
+The API under /api/ lets clients list sites, trigger syncs, and change
+site admins. Each client is given a token in serve.tokens, as name=token
+(the token may be a secret reference such as env:NAME), which it sends as a
+bearer token, and the scopes it needs, by listing its name in
+serve.scopes.read, serve.scopes.sync or serve.scopes.admin. Alternatively
+clients are given a role, in serve.roles.viewer (the read scope),
+serve.roles.operator (read and sync) or serve.roles.admin (every scope):
+
+  GET    /api/sites                          read   pugo list
+  GET    /api/sites/<site>                   read   pugo show <site>
+  GET    /api/sites/<site>/admins            read   pugo admins list <site>
+  POST   /api/sync[?site=<site>...]          sync   pugo sync
+  PUT    /api/sites/<site>/admins/<login>    admin  pugo admins add
+  DELETE /api/sites/<site>/admins/<login>    admin  pugo admins remove
+
+Each request runs the pugo command shown, with the config file in use and
+--yes, and responds with its JSON output. Changes take the run lock, so a
+request made while another run holds it fails with 409 Conflict. A reason
+for an admin change may be given with ?reason=. Each request is recorded in
+the audit log, and the changes it makes are attributed to the client, in
+the audit log and in commit messages.
+
+The server runs until pugo is interrupted, whatever --timeout. On SIGHUP the config file is
+reloaded and cached sites discarded, once requests in progress have
+finished, without restarting the server. Secrets are resolved again, so
+rotated credentials are picked up, and the logging settings reapplied. A
+changed serve.listen only takes effect on restart, and if the new config
+can't be read or is invalid the old one is kept.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return serve(cmd)
+	},
+}
+
+// How long to wait for requests in progress when shutting down
+const serveShutdownTimeout = 10 * time.Second
+
+// How often expired confirmations are removed
+const servePruneInterval = time.Hour
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	viper.SetDefault("serve.listen", "127.0.0.1:8080")
+}
+
+func serve(cmd *cobra.Command) error {
+	// Requests hold a read lock on the config, so a reload waits for those
+	// in progress and new ones wait for the reload
+	var configMu sync.RWMutex
+	api := &apiServer{}
+	if err := api.configure(); err != nil {
+		return configErrorf("serve: %w", err)
+	}
+	handler := http.NewServeMux()
+	handler.Handle("/confirm/", confirmation.Handler())
+	handler.Handle("/api/", api.handler())
+	server := &http.Server{
+		Addr: viper.GetString("serve.listen"),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			configMu.RLock()
+			defer configMu.RUnlock()
+			handler.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("serve: Listening on %s", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	pruneConfirmations()
+	prune := time.NewTicker(servePruneInterval)
+	defer prune.Stop()
+
+	for running := true; running; {
+		select {
+		case err := <-errs:
+			return fmt.Errorf("serve: %w", err)
+		case <-hups:
+			log.Info("serve: Received SIGHUP, reloading config")
+			configMu.Lock()
+			err := reloadConfig()
+			listen := viper.GetString("serve.listen")
+			var apiErr error
+			if err == nil {
+				apiErr = api.configure()
+			}
+			configMu.Unlock()
+			if err != nil {
+				log.Errorf("serve: Keeping previous config: %v", err)
+				break
+			}
+			if apiErr != nil {
+				log.Errorf("serve: Keeping previous API tokens: %v", apiErr)
+			}
+			if listen != server.Addr {
+				log.Warnf("serve: serve.listen changed to %s, which takes effect on restart", listen)
+			}
+			log.Info("serve: Config reloaded")
+		case <-prune.C:
+			configMu.RLock()
+			pruneConfirmations()
+			configMu.RUnlock()
+		case <-runCtx.Done():
+			running = false
+		}
+	}
+
+	log.Info("serve: Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	return nil
+}
+
+// pruneConfirmations removes expired confirmations, logging any problem
+func pruneConfirmations() {
+	removed, err := confirmation.Prune()
+	if err != nil {
+		log.Warnf("serve: %v", err)
+	}
+	if removed > 0 {
+		log.Infof("serve: Removed %d expired confirmations", removed)
+	}
+}
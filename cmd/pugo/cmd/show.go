@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/spf13/cobra"
+)
+
+var showCmd = &cobra.Command{
+	Use:   "show <site>",
+	Short: "Show details of a site",
+	Long: `Show the configuration of a single site. The site may be
+specified by name, by one of its aliases (former names), or by id.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showSite(cmd, args[0])
+	},
+}
+
+// siteDetail is the show output for a site
+type siteDetail struct {
+	Id             int               `json:"id" yaml:"id"`
+	Name           string            `json:"name" yaml:"name"`
+	FullName       string            `json:"full_name" yaml:"full_name"`
+	Email          string            `json:"email" yaml:"email"`
+	DisplayEmail   string            `json:"display_email,omitempty" yaml:"display_email,omitempty"`
+	Admins         []string          `json:"admins" yaml:"admins"`
+	ImmortalAdmins []string          `json:"immortal_admins,omitempty" yaml:"immortal_admins,omitempty"`
+	Expiry         string            `json:"expiry" yaml:"expiry"`
+	Paths          []string          `json:"paths" yaml:"paths"`
+	Aliases        []string          `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Domains        []interface{}     `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Disabled       bool              `json:"disabled" yaml:"disabled"`
+	DisabledReason string            `json:"disabled_reason,omitempty" yaml:"disabled_reason,omitempty"`
+	Php            interface{}       `json:"php,omitempty" yaml:"php,omitempty"`
+	Passenger      bool              `json:"passenger" yaml:"passenger"`
+	Subpaths       bool              `json:"subpaths" yaml:"subpaths"`
+	Env            map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Quota          int               `json:"quota,omitempty" yaml:"quota,omitempty"`
+	Protected      bool              `json:"protected" yaml:"protected"`
+	CSPCode        string            `json:"csp_code,omitempty" yaml:"csp_code,omitempty"`
+	Committee      string            `json:"committee,omitempty" yaml:"committee,omitempty"`
+	OCId           int               `json:"ocid,omitempty" yaml:"ocid,omitempty"`
+}
+
+func (d *siteDetail) Header() []string {
+	return []string{"FIELD", "VALUE"}
+}
+
+func (d *siteDetail) Rows() [][]string {
+	return [][]string{
+		{"id", strconv.Itoa(d.Id)},
+		{"name", d.Name},
+		{"full-name", d.FullName},
+		{"email", d.Email},
+		{"display-email", d.DisplayEmail},
+		{"admins", strings.Join(d.Admins, ",")},
+		{"immortal-admins", strings.Join(d.ImmortalAdmins, ",")},
+		{"expiry", d.Expiry},
+		{"paths", strings.Join(d.Paths, ",")},
+		{"aliases", strings.Join(d.Aliases, ",")},
+		{"domains", fmt.Sprint(d.Domains)},
+		{"disabled", strconv.FormatBool(d.Disabled)},
+		{"disabled_reason", d.DisabledReason},
+		{"php", fmt.Sprint(d.Php)},
+		{"passenger", strconv.FormatBool(d.Passenger)},
+		{"subpaths", strconv.FormatBool(d.Subpaths)},
+		{"env", formatEnv(d.Env)},
+		{"quota", strconv.Itoa(d.Quota)},
+		{"protected", strconv.FormatBool(d.Protected)},
+		{"csp-code", d.CSPCode},
+		{"committee", d.Committee},
+		{"ocid", strconv.Itoa(d.OCId)},
+	}
+}
+
+// formatEnv formats a site's env as sorted name=value pairs
+func formatEnv(env map[string]string) string {
+	pairs := make([]string, 0, len(env))
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+}
+
+func showSite(cmd *cobra.Command, nameOrId string) error {
+	site, err := lookupSite(nameOrId)
+	if err != nil {
+		return fmt.Errorf("show: %w", err)
+	}
+
+	result := newSiteDetail(site)
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("show: %w", err)
+	}
+
+	return nil
+}
+
+func newSiteDetail(site *cdb.Site) *siteDetail {
+	return &siteDetail{
+		Id:             site.Id,
+		Name:           site.Name(),
+		FullName:       site.FullName,
+		Email:          site.Email,
+		DisplayEmail:   site.DisplayEmail,
+		Admins:         site.Admins,
+		ImmortalAdmins: site.ImmortalAdmins,
+		Expiry:         site.Expiry,
+		Paths:          site.Paths,
+		Aliases:        site.Aliases,
+		Domains:        site.Domains,
+		Disabled:       site.Disabled,
+		DisabledReason: site.DisabledReason,
+		Php:            site.Php,
+		Passenger:      site.Passenger,
+		Subpaths:       site.Subpaths,
+		Env:            site.Env,
+		Quota:          site.Quota,
+		Protected:      site.Protected,
+		CSPCode:        site.CSPCode,
+		Committee:      site.Committee,
+		OCId:           site.OCId,
+	}
+}
+
+// lookupSite finds a site by name, falling back to treating the argument as
+// a site id. Returns an error if no matching site exists.
+func lookupSite(nameOrId string) (*cdb.Site, error) {
+	site, err := cdb.GetSiteByName(nameOrId)
+	if err != nil {
+		return nil, err
+	}
+	if site != nil {
+		return site, nil
+	}
+
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		site, err = cdb.GetSiteById(id)
+		if err != nil {
+			return nil, err
+		}
+		if site != nil {
+			return site, nil
+		}
+	}
+
+	return nil, fmt.Errorf("site '%s' not found in cdb", nameOrId)
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var siteCmd = &cobra.Command{
+	Use:   "site",
+	Short: "Edit individual sites",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("site: Subcommand required")
+	},
+}
+
+var siteSetCmd = &cobra.Command{
+	Use:   "set <site> <field>=<value>...",
+	Short: "Set fields of a site",
+	Long: `Set one or more fields of a single site and commit the change. Fields
+are named as in the site YAML files, e.g.
+
+  pugo site set mysite expiry=2025-07-31 php=8.2
+  pugo site set mysite paths=/mysite,/mysite-old
+
+Lists are given as comma separated values, and an empty value clears the
+field. Values are validated before anything is changed: expiry must be a
+date (YYYY-MM-DD), email addresses must be valid, and php must be true,
+false, or one of the versions in cdb.php_versions. Admins are managed with
+pugo admins add and pugo admins remove rather than set.`,
+	Args:              cobra.MinimumNArgs(2),
+	ValidArgsFunction: completeSiteSet,
+	Annotations:       map[string]string{annotationRunLock: "true", annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doSiteSet(cmd, args[0], args[1:])
+	},
+}
+
+var siteSetReason string
+var siteSetForce bool
+
+// siteFieldValidators validate the values given for particular fields by
+// site set, in addition to the type checking done when parsing them
+var siteFieldValidators = map[string]func(site *cdb.Site, value string) error{
+	"id":            validateSiteId,
+	"full-name":     anySite(validateNonEmpty),
+	"email":         anySite(validateEmail),
+	"display-email": anySite(validateOptional(validateEmail)),
+	"admins": func(site *cdb.Site, value string) error {
+		return fmt.Errorf("use pugo admins add or pugo admins remove to change admins")
+	},
+	"expiry": anySite(validateOptional(func(value string) error {
+		if _, err := time.Parse(cdb.ExpiryFormat, value); err != nil {
+			return fmt.Errorf("'%s' is not a date in the format YYYY-MM-DD", value)
+		}
+		return nil
+	})),
+	"php": func(site *cdb.Site, value string) error {
+		allowed := append([]string{"true", "false"}, conf.Cdb.PhpVersions...)
+		return validateOneOf(allowed...)(value)
+	},
+	"aliases": validateSiteAliases,
+	"last-modified": func(site *cdb.Site, value string) error {
+		return fmt.Errorf("last-modified is recorded by pugo when saving sites")
+	},
+	"quota": anySite(func(value string) error {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("'%s' must be a whole number of MiB, or 0 for no quota", value)
+		}
+		return nil
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(siteCmd)
+	siteCmd.AddCommand(siteSetCmd)
+
+	siteSetCmd.Flags().StringVar(&siteSetReason, "reason", "", "Reason for the change, recorded in the commit message.")
+	siteSetCmd.Flags().BoolVar(&siteSetForce, "force", false, "Change the site even if it is protected.")
+	addPlanOutFlag(siteSetCmd)
+	addNoCommitFlag(siteSetCmd)
+}
+
+func doSiteSet(cmd *cobra.Command, nameOrId string, assignments []string) error {
+	site, err := lookupSite(nameOrId)
+	if err != nil {
+		return fmt.Errorf("site-set: %w", err)
+	}
+	if err := checkNotProtected(site, siteSetForce); err != nil {
+		return fmt.Errorf("site-set: %w", err)
+	}
+
+	// Validate everything before changing anything, so a bad value doesn't
+	// leave the site partially updated
+	type assignment struct {
+		field string
+		value string
+	}
+	var parsed []assignment
+	var invalid []string
+	for _, a := range assignments {
+		field, value, ok := cutAssignment(a)
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf("'%s' is not of the form field=value", a))
+			continue
+		}
+		if err := validateSiteField(site, field, value); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", field, err))
+			continue
+		}
+		parsed = append(parsed, assignment{field, value})
+	}
+	if len(invalid) > 0 {
+		return configErrorf("site-set: Invalid changes to %s:\n  %s", site.Name(), strings.Join(invalid, "\n  "))
+	}
+
+	var changes []string
+	for _, a := range parsed {
+		value, err := cdb.ParseField(a.field, a.value)
+		if err != nil {
+			return fmt.Errorf("site-set: %w", err)
+		}
+		before, err := site.Field(a.field)
+		if err != nil {
+			return fmt.Errorf("site-set: %w", err)
+		}
+		if err := site.SetField(a.field, value); err != nil {
+			return fmt.Errorf("site-set: %w", err)
+		}
+		after, err := site.Field(a.field)
+		if err != nil {
+			return fmt.Errorf("site-set: %w", err)
+		}
+		if !jsonEqual(before, after) {
+			log.Infof("site-set: %s: %s %s -> %s", site.Name(), a.field, before, after)
+			changes = append(changes, a.field+"="+a.value)
+		}
+	}
+	if len(changes) == 0 {
+		log.Infof("site-set: No change to %s", site.Name())
+		return nil
+	}
+
+	proceed, err := confirm(fmt.Sprintf("This will set %s on %s.", strings.Join(changes, ", "), site.Name()))
+	if err != nil {
+		return fmt.Errorf("site-set: %w", err)
+	}
+	if !proceed {
+		log.Info("site-set: Aborted")
+		return nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             map[int]bool{site.Id: true},
+		Message:         attributedMessage(fmt.Sprintf("Set %s on %s", strings.Join(changes, ", "), site.Name()), siteSetReason),
+		Cmd:             "site set",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+		NoCommit:        noCommit,
+		AllowProtected:  siteSetForce,
+	}
+	if globalOpts.dryRun && planOut != "" {
+		if err := writePlan(cmd.CommandPath(), commitOpts, nil, nil); err != nil {
+			return fmt.Errorf("site-set: %w", err)
+		}
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("site-set: %w", err)
+	}
+
+	return nil
+}
+
+func cutAssignment(s string) (field string, value string, ok bool) {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// validateSiteField checks field is a settable site field and value is
+// valid for it
+func validateSiteField(site *cdb.Site, field string, value string) error {
+	if _, err := cdb.ParseField(field, value); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "cdb: "))
+	}
+	if validate, ok := siteFieldValidators[field]; ok {
+		return validate(site, value)
+	}
+	return nil
+}
+
+// validateOptional allows an empty value, otherwise applying validate
+func validateOptional(validate func(string) error) func(string) error {
+	return func(value string) error {
+		if value == "" {
+			return nil
+		}
+		return validate(value)
+	}
+}
+
+// anySite adapts a validator which doesn't depend on the site being changed
+func anySite(validate func(string) error) func(*cdb.Site, string) error {
+	return func(site *cdb.Site, value string) error {
+		return validate(value)
+	}
+}
+
+func validateSiteId(site *cdb.Site, value string) error {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 1 {
+		return fmt.Errorf("'%s' is not a valid id", value)
+	}
+	other, err := cdb.GetSiteById(id)
+	if err != nil {
+		return err
+	}
+	if other != nil && other != site {
+		return fmt.Errorf("id %d is already used by %s", id, other.Name())
+	}
+	return nil
+}
+
+// validateSiteAliases checks each alias could be a site name and isn't
+// already the name or an alias of another site
+func validateSiteAliases(site *cdb.Site, value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, alias := range strings.Split(value, ",") {
+		if alias == "" || strings.ContainsAny(alias, `/\`) || strings.HasPrefix(alias, ".") {
+			return fmt.Errorf("'%s' is not a valid site name", alias)
+		}
+		if alias == site.Name() {
+			return fmt.Errorf("'%s' is the site's own name", alias)
+		}
+		other, err := cdb.GetSiteByName(alias)
+		if err != nil {
+			return err
+		}
+		if other != nil && other != site {
+			return fmt.Errorf("'%s' is already used by %s", alias, other.Name())
+		}
+	}
+	return nil
+}
+
+func completeSiteSet(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeSiteNames(cmd, args, toComplete)
+	}
+
+	var fields []string
+	for _, name := range cdb.FieldNames() {
+		if strings.HasPrefix(name, toComplete) {
+			fields = append(fields, name+"=")
+		}
+	}
+	sort.Strings(fields)
+
+	return fields, cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveNoSpace
+}
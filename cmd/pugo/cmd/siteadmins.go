@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var siteAdminsCmd = &cobra.Command{
+	Use:   "admins",
+	Short: "Manage the admins of a site directly",
+	Long: `List, add or remove the admins of a site directly. Adding and
+removing admins bypasses eActivities, and is intended for emergency access
+changes: routine changes should be made in eActivities and applied with pugo
+sync.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("admins: Subcommand required")
+	},
+}
+
+var siteAdminsAddCmd = &cobra.Command{
+	Use:               "add <site> <login>",
+	Short:             "Add an admin to a site",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationRunLock: "true", annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doSiteAdmins(cmd, args[0], args[1], true)
+	},
+}
+
+var siteAdminsRemoveCmd = &cobra.Command{
+	Use:               "remove <site> <login>",
+	Short:             "Remove an admin from a site",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationRunLock: "true", annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doSiteAdmins(cmd, args[0], args[1], false)
+	},
+}
+
+var siteAdminsListCmd = &cobra.Command{
+	Use:   "list <site>",
+	Short: "List the admins of a site",
+	Long: `List a site's admins and immortal admins. With --resolve each login
+is looked up in newerpol to show the person's name and email address.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationLazySites: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listSiteAdmins(cmd, args[0])
+	},
+}
+
+type siteAdminsOptions struct {
+	reason  string
+	notify  bool
+	resolve bool
+	force   bool
+}
+
+// siteAdmin is the admins list output for a single admin
+type siteAdmin struct {
+	Login    string `json:"login" yaml:"login"`
+	Immortal bool   `json:"immortal" yaml:"immortal"`
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`
+	Email    string `json:"email,omitempty" yaml:"email,omitempty"`
+}
+
+type siteAdminList []siteAdmin
+
+func (l siteAdminList) Header() []string {
+	return []string{"LOGIN", "IMMORTAL", "NAME", "EMAIL"}
+}
+
+func (l siteAdminList) Rows() [][]string {
+	rows := make([][]string, 0, len(l))
+	for _, a := range l {
+		rows = append(rows, []string{a.Login, strconv.FormatBool(a.Immortal), a.Name, a.Email})
+	}
+	return rows
+}
+
+var siteAdminsOpts siteAdminsOptions
+
+func init() {
+	rootCmd.AddCommand(siteAdminsCmd)
+	siteAdminsCmd.AddCommand(siteAdminsAddCmd)
+	siteAdminsCmd.AddCommand(siteAdminsRemoveCmd)
+	siteAdminsCmd.AddCommand(siteAdminsListCmd)
+
+	for _, c := range []*cobra.Command{siteAdminsAddCmd, siteAdminsRemoveCmd} {
+		c.Flags().StringVar(&siteAdminsOpts.reason, "reason", "", "Reason for the change, recorded in the commit message.")
+		c.Flags().BoolVar(&siteAdminsOpts.notify, "notify", false, "Send the standard access granted / removed email to the admin. Implied off by dry-run.")
+		c.Flags().BoolVar(&siteAdminsOpts.force, "force", false, "Change the site's admins even if it is protected.")
+		addNoCommitFlag(c)
+	}
+	siteAdminsListCmd.Flags().BoolVar(&siteAdminsOpts.resolve, "resolve", false, "Look up each admin's name and email address in newerpol.")
+}
+
+func listSiteAdmins(cmd *cobra.Command, nameOrId string) error {
+	site, err := lookupSite(nameOrId)
+	if err != nil {
+		return fmt.Errorf("admins-list: %w", err)
+	}
+
+	var result siteAdminList
+	for _, login := range site.ImmortalAdmins {
+		result = append(result, siteAdmin{Login: login, Immortal: true})
+	}
+	for _, login := range site.Admins {
+		result = append(result, siteAdmin{Login: login})
+	}
+
+	if siteAdminsOpts.resolve && len(result) > 0 {
+		newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+		if err != nil {
+			return dbErrorf("admins-list: Connecting to newerpol: %w", err)
+		}
+		defer newerpolDb.Close()
+
+		logins := make([]string, 0, len(result))
+		for _, a := range result {
+			logins = append(logins, a.Login)
+		}
+		people, err := newerpol.LookupPeople(runCtx, newerpolDb, logins)
+		if err != nil {
+			return dbErrorf("admins-list: %w", err)
+		}
+		for i := range result {
+			if person, ok := people[result[i].Login]; ok {
+				result[i].Name = person.LookupName
+				result[i].Email = person.Email
+			}
+		}
+	}
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("admins-list: %w", err)
+	}
+
+	return nil
+}
+
+func doSiteAdmins(cmd *cobra.Command, nameOrId string, login string, add bool) error {
+	logPrefix := "admins-add"
+	if !add {
+		logPrefix = "admins-remove"
+	}
+	if noCommit && siteAdminsOpts.notify {
+		return configErrorf("%s: --notify can't be used with --no-commit, as the change may never be committed", logPrefix)
+	}
+
+	site, err := lookupSite(nameOrId)
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if err := checkNotProtected(site, siteAdminsOpts.force); err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if !add && site.IsImmortal(login) {
+		return fmt.Errorf("%s: %s is an immortal admin of %s and can't be removed", logPrefix, login, site.Name())
+	}
+
+	changed, err := changeSiteAdmin(site, login, add, siteAdminsOpts.reason, cmd.Parent().Name()+" "+cmd.Name())
+	if err != nil {
+		return gitErrorf("%s: %w", logPrefix, err)
+	}
+	if !changed {
+		log.Infof("%s: No change to %s", logPrefix, site.Name())
+		return nil
+	}
+
+	if !siteAdminsOpts.notify {
+		return nil
+	}
+	if globalOpts.dryRun {
+		log.Infof("%s: Performing dry run - email will not be sent.", logPrefix)
+		return nil
+	}
+	if err := notifySiteAdmin(site, login, add); err != nil {
+		// The cdb change has already been committed at this point
+		return partialFailureErrorf("%s: %w", logPrefix, err)
+	}
+
+	return nil
+}
+
+// changeSiteAdmin adds or removes login from a site and commits the change
+// with a message attributing it to the user running pugo. cmdName is
+// recorded as the command in the commit. Returns whether the site changed.
+// Immortal admins can't be removed, and protected sites are only changed
+// with --force.
+func changeSiteAdmin(site *cdb.Site, login string, add bool, reason string, cmdName string) (bool, error) {
+	if err := checkNotProtected(site, siteAdminsOpts.force); err != nil {
+		return false, err
+	}
+	var message string
+	if add {
+		site.AddAdmin(login)
+		message = fmt.Sprintf("Add %s to %s", login, site.Name())
+	} else {
+		if site.RemoveAdminChecked(login) == cdb.AdminImmortal {
+			return false, fmt.Errorf("%s is an immortal admin of %s and can't be removed", login, site.Name())
+		}
+		message = fmt.Sprintf("Remove %s from %s", login, site.Name())
+	}
+	if !site.Changed() {
+		return false, nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             map[int]bool{site.Id: true},
+		Message:         attributedMessage(message, reason),
+		Cmd:             cmdName,
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+		NoCommit:        noCommit,
+		AllowProtected:  siteAdminsOpts.force,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	return true, err
+}
+
+// attributedMessage appends the user running pugo, the API client it runs
+// for if any, and the reason for the change if given, to a commit message
+// for a manual change
+func attributedMessage(message string, reason string) string {
+	by := currentUsername()
+	if client := os.Getenv(apiClientEnv); client != "" {
+		by = fmt.Sprintf("%s for API client %s", by, client)
+	}
+	if reason != "" {
+		return fmt.Sprintf("%s (by %s: %s)", message, by, reason)
+	}
+	return fmt.Sprintf("%s (by %s)", message, by)
+}
+
+// currentUsername returns the name of the user running pugo
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown user"
+}
+
+// notifySiteAdmin sends the standard access granted or removed email to
+// login, looking up their name and email address in newerpol
+func notifySiteAdmin(site *cdb.Site, login string, add bool) error {
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+	if err != nil {
+		return fmt.Errorf("Connecting to newerpol: %w", err)
+	}
+	defer newerpolDb.Close()
+
+	people, err := newerpol.LookupPeople(runCtx, newerpolDb, []string{login})
+	if err != nil {
+		return err
+	}
+	person, ok := people[login]
+	if !ok || person.Email == "" {
+		return fmt.Errorf("No email address for %s", login)
+	}
+
+	emailOpts := &email.EmailOptions{
+		FirstName: person.FirstName,
+		EmailName: person.LookupName,
+		Email:     person.Email,
+		CSP:       siteCSPName(site),
+		Folder:    site.Name(),
+		Subject:   "Website Access Granted",
+		Type:      "granted",
+	}
+	if !add {
+		emailOpts.Subject = "Website Access Removed"
+		emailOpts.Type = "revoked"
+	}
+
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return err
+	}
+	defer email.ShutdownWorker()
+
+	return email.SendEmail(emailOpts)
+}
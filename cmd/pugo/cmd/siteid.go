@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	"github.com/spf13/cobra"
+)
+
+var siteNextIdCmd = &cobra.Command{
+	Use:   "next-id",
+	Short: "Print the id to give a new site",
+	Long: `Print the next free site id: one more than the highest id used by a
+site in the cdb, an archived site, or a website in eActivities (including
+deleted websites), so a site created by hand never collides with an existing
+record. Sites managed in eActivities must instead use their website's id.
+
+With --offline eActivities isn't consulted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return siteNextId(cmd)
+	},
+}
+
+var siteNextIdOffline bool
+
+func init() {
+	siteCmd.AddCommand(siteNextIdCmd)
+
+	siteNextIdCmd.Flags().BoolVar(&siteNextIdOffline, "offline", false, "Don't reserve the ids of websites in eActivities.")
+}
+
+func siteNextId(cmd *cobra.Command) error {
+	var reserved []int
+	if !siteNextIdOffline {
+		newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
+		if err != nil {
+			return dbErrorf("site-next-id: Connecting to newerpol: %w", err)
+		}
+		defer newerpolDb.Close()
+		if reserved, err = newerpol.GetWebsiteIds(runCtx, newerpolDb); err != nil {
+			return dbErrorf("site-next-id: %w", err)
+		}
+	}
+
+	id, err := cdb.NextFreeId(reserved)
+	if err != nil {
+		return gitErrorf("site-next-id: %w", err)
+	}
+	fmt.Println(id)
+	return nil
+}
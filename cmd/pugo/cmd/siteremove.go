@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var siteRemoveCmd = &cobra.Command{
+	Use:   "remove <site>...",
+	Short: "Remove sites from the cdb",
+	Long: `Remove one or more sites from the cdb and commit the change. With
+--archive each site's file is moved to the archive directory of the cdb
+rather than deleted, keeping its history in one place, and the site can be
+brought back later with pugo restore site.`,
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: completeSiteNames,
+	Annotations:       map[string]string{annotationRunLock: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return removeSites(cmd, args)
+	},
+}
+
+type siteRemoveOptions struct {
+	archive bool
+	reason  string
+	force   bool
+}
+
+var siteRemoveOpts siteRemoveOptions
+
+func init() {
+	siteCmd.AddCommand(siteRemoveCmd)
+
+	siteRemoveCmd.Flags().BoolVar(&siteRemoveOpts.archive, "archive", false, "Move the sites to the archive rather than deleting them.")
+	siteRemoveCmd.Flags().StringVar(&siteRemoveOpts.reason, "reason", "", "Reason for the change, recorded in the commit message.")
+	siteRemoveCmd.Flags().BoolVar(&siteRemoveOpts.force, "force", false, "Remove the sites even if they are protected.")
+}
+
+func removeSites(cmd *cobra.Command, names []string) error {
+	var sites []*cdb.Site
+	var siteNames []string
+	seen := make(map[*cdb.Site]bool)
+	for _, name := range names {
+		site, err := lookupSite(name)
+		if err != nil {
+			return fmt.Errorf("site-remove: %w", err)
+		}
+		if err := checkNotProtected(site, siteRemoveOpts.force); err != nil {
+			return fmt.Errorf("site-remove: %w", err)
+		}
+		if !seen[site] {
+			seen[site] = true
+			sites = append(sites, site)
+			siteNames = append(siteNames, site.Name())
+		}
+	}
+
+	verb := "Remove"
+	if siteRemoveOpts.archive {
+		verb = "Archive"
+	}
+	proceed, err := confirm(fmt.Sprintf("This will %s %s.", strings.ToLower(verb), strings.Join(siteNames, ", ")))
+	if err != nil {
+		return fmt.Errorf("site-remove: %w", err)
+	}
+	if !proceed {
+		log.Info("site-remove: Aborted")
+		return nil
+	}
+
+	commitOpts := &cdb.CommitSitesOptions{
+		Message:        attributedMessage(fmt.Sprintf("%s %s", verb, strings.Join(siteNames, ", ")), siteRemoveOpts.reason),
+		Cmd:            "site remove",
+		DryRun:         globalOpts.dryRun,
+		NoPush:         globalOpts.noPush,
+		AllowProtected: siteRemoveOpts.force,
+	}
+	commitResult, err := cdb.RemoveSites(runCtx, sites, siteRemoveOpts.archive, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("site-remove: %w", err)
+	}
+
+	return nil
+}
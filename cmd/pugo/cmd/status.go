@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/state"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of the last successful sync",
+	Long: `Show when the last successful sync completed, the last commit it
+made, and the change marker used by incremental syncs, along with the
+number of site files which can't be loaded (see pugo validate), unless
+cdb.bare or cdb.ephemeral is set. With --max-age the command exits with a
+non-zero status if the last successful sync is older than the given
+duration, for use as a monitoring check.`,
+	Annotations: map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showStatus(cmd)
+	},
+}
+
+type statusOptions struct {
+	maxAge time.Duration
+}
+
+var statusOpts statusOptions
+
+// syncStatus is the status output
+type syncStatus struct {
+	LastSync      string `json:"last_sync" yaml:"last_sync"`
+	Age           string `json:"age" yaml:"age"`
+	LastSyncRunId string `json:"last_sync_run_id" yaml:"last_sync_run_id"`
+	LastCommit    string `json:"last_commit" yaml:"last_commit"`
+	LastAccessId  int    `json:"last_access_id" yaml:"last_access_id"`
+	SiteErrors    int    `json:"site_errors" yaml:"site_errors"`
+}
+
+func (s *syncStatus) Header() []string {
+	return []string{"FIELD", "VALUE"}
+}
+
+func (s *syncStatus) Rows() [][]string {
+	return [][]string{
+		{"last_sync", s.LastSync},
+		{"age", s.Age},
+		{"last_sync_run_id", s.LastSyncRunId},
+		{"last_commit", s.LastCommit},
+		{"last_access_id", strconv.Itoa(s.LastAccessId)},
+		{"site_errors", strconv.Itoa(s.SiteErrors)},
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().DurationVar(&statusOpts.maxAge, "max-age", 0, "Fail if the last successful sync is older than the given duration (e.g. 2h).")
+}
+
+func showStatus(cmd *cobra.Command) error {
+	st, err := state.Load()
+	if err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+
+	result := &syncStatus{
+		LastSyncRunId: st.LastSyncRunId,
+		LastCommit:    st.LastCommit,
+		LastAccessId:  st.LastAccessId,
+	}
+	var age time.Duration
+	if !st.LastSync.IsZero() {
+		age = time.Since(st.LastSync)
+		result.LastSync = st.LastSync.Format(time.RFC3339)
+		result.Age = age.Round(time.Second).String()
+	}
+
+	// Status is used for monitoring, so report sites which can't be loaded
+	// but don't fail if the cdb can't be read at all. With cdb.bare or
+	// cdb.ephemeral there is no checkout to read, as status doesn't make one
+	if conf.Cdb.Bare == "" && !conf.Cdb.Ephemeral {
+		if _, err := cdb.GetAllSites(); err != nil {
+			log.Warnf("status: Getting all sites: %v", err)
+		}
+		result.SiteErrors = len(cdb.LoadErrors())
+	}
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+
+	if statusOpts.maxAge > 0 {
+		if st.LastSync.IsZero() {
+			return newExitError(exitCheckFailed, "status: No successful sync recorded")
+		}
+		if age > statusOpts.maxAge {
+			return newExitError(exitCheckFailed, "status: Last successful sync was %s ago, more than %s", result.Age, statusOpts.maxAge)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/metrics"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// runSummaryStruct is a durable, parseable record of a single invocation of
+// pugo, written to summary.dir (if configured) when the command finishes
+type runSummaryStruct struct {
+	RunId           string            `json:"run_id"`
+	Command         string            `json:"command"`
+	Args            []string          `json:"args"`
+	Options         map[string]string `json:"options"`
+	Started         time.Time         `json:"started"`
+	Finished        time.Time         `json:"finished"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	SitesChanged    int               `json:"sites_changed"`
+	Commit          string            `json:"commit,omitempty"`
+	Pushed          bool              `json:"pushed"`
+	ReviewURL       string            `json:"review_url,omitempty"`
+	RemotePushes    []cdb.RemotePush  `json:"push_remotes,omitempty"`
+	GrantsProcessed int               `json:"grants_processed"`
+	SitesDisabled   []string          `json:"sites_disabled,omitempty"`
+	Conflicts       []grantConflict   `json:"conflicts,omitempty"`
+	Failures        failureReport     `json:"failures,omitempty"`
+	EmailsSent      int               `json:"emails_sent"`
+	EmailsFailed    int               `json:"emails_failed"`
+	// Warnings suppressed after repeating log.repeat_limit times
+	SuppressedWarnings []suppressedWarning `json:"suppressed_warnings,omitempty"`
+	Errors             []string            `json:"errors"`
+	ExitCode           int                 `json:"exit_code"`
+	mu                 sync.Mutex
+}
+
+var runSummary = &runSummaryStruct{
+	Options: make(map[string]string),
+	Errors:  []string{},
+}
+
+// start records the command being run and the options explicitly set
+func (s *runSummaryStruct) start(cmd *cobra.Command, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.RunId = runId
+	s.Command = cmd.CommandPath()
+	s.Args = args
+	s.Started = time.Now()
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		s.Options[f.Name] = f.Value.String()
+	})
+}
+
+// recordCommit records the outcome of cdb.CommitSites
+func (s *runSummaryStruct) recordCommit(result *cdb.CommitSitesResult) {
+	if result == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.SitesChanged += result.SitesChanged
+	if result.Commit != "" {
+		s.Commit = result.Commit
+	}
+	s.Pushed = s.Pushed || result.Pushed
+	if result.ReviewURL != "" {
+		s.ReviewURL = result.ReviewURL
+	}
+	s.RemotePushes = append(s.RemotePushes, result.RemotePushes...)
+}
+
+func (s *runSummaryStruct) addGrantsProcessed(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.GrantsProcessed += n
+}
+
+// recordDisabled records sites disabled by the command
+func (s *runSummaryStruct) recordDisabled(report disabledSiteReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range report {
+		s.SitesDisabled = append(s.SitesDisabled, d.Site)
+	}
+}
+
+// grantConflict is a grant which contradicts the cdb and was left pending
+// for manual review rather than applied
+type grantConflict struct {
+	AccessId int    `json:"access_id"`
+	Login    string `json:"login"`
+	Site     string `json:"site"`
+	Reason   string `json:"reason"`
+}
+
+// recordConflict records a grant left pending because it conflicts with the
+// cdb
+func (s *runSummaryStruct) recordConflict(c grantConflict) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Conflicts = append(s.Conflicts, c)
+}
+
+// recordFailure records a site or grant which the command failed to process
+func (s *runSummaryStruct) recordFailure(f runFailure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Failures = append(s.Failures, f)
+}
+
+// failures returns the failures recorded so far
+func (s *runSummaryStruct) failures() failureReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append(failureReport{}, s.Failures...)
+}
+
+// finish completes the summary with the result of the command and writes it
+// to summary.dir. Failure to write the summary is logged but does not affect
+// the exit code. Likewise run metrics are pushed if a metrics sink is
+// configured.
+func (s *runSummaryStruct) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Commands which failed argument validation never started
+	if s.Started.IsZero() {
+		return
+	}
+
+	s.SuppressedWarnings = logDedup.finish()
+
+	s.Finished = time.Now()
+	s.DurationSeconds = s.Finished.Sub(s.Started).Seconds()
+	s.EmailsSent, s.EmailsFailed = email.Stats()
+	if err != nil {
+		s.Errors = append(s.Errors, err.Error())
+	}
+	s.ExitCode = exitCode(err)
+
+	if dir := viper.GetString("summary.dir"); dir != "" {
+		if err := s.write(dir); err != nil {
+			log.Warnf("Unable to write run summary: %v", err)
+		}
+	}
+
+	if metrics.Enabled() {
+		run := &metrics.Run{
+			Command:         strings.TrimPrefix(s.Command, "pugo "),
+			Duration:        s.Finished.Sub(s.Started),
+			ExitCode:        s.ExitCode,
+			SitesChanged:    s.SitesChanged,
+			GrantsProcessed: s.GrantsProcessed,
+			EmailsSent:      s.EmailsSent,
+			EmailsFailed:    s.EmailsFailed,
+			Errors:          len(s.Errors),
+			Finished:        s.Finished,
+		}
+		if stats := cdb.GetLoadStats(); stats != nil {
+			run.CdbLoaded = true
+			run.CdbSites = stats.Sites
+			run.CdbLoadScan = stats.Scan
+			run.CdbLoadParse = stats.Parse
+			run.CdbLoadIndex = stats.Index
+			if len(stats.Slowest) > 0 {
+				run.CdbSlowestFile = stats.Slowest[0].Duration
+			}
+		}
+		// The run context may have been cancelled, but the metrics should
+		// still be pushed
+		if err := metrics.Push(context.Background(), run); err != nil {
+			log.Warnf("Unable to push run metrics: %v", err)
+		}
+	}
+}
+
+func (s *runSummaryStruct) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(dir, fmt.Sprintf("pugo-%s-%s.json", s.Started.Format("20060102T150405"), s.RunId))
+	if err := ioutil.WriteFile(fn, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Debugf("Run summary written to %s", fn)
+
+	return nil
+}
@@ -2,15 +2,29 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/icunion/pugo/audit"
 	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/confirmation"
 	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/hooks"
 	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/plugins"
+	"github.com/icunion/pugo/progress"
+	"github.com/icunion/pugo/state"
+	"github.com/icunion/pugo/tracing"
 
+	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // syncCmd represents the sync command
@@ -20,9 +34,92 @@ var syncCmd = &cobra.Command{
 	Long: `Process pending access requests and revocations from
 eActivities. The requests will be committed into the configuration database,
 and if this succeeds (and the push to the remote succeeds), eActivities will
-be updated and the users in question notified.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		doSync(cmd)
+be updated and the users in question notified.
+
+The sync can be restricted to particular sites with --site (by name or id)
+and to the sites of particular CSPs with --csp (by OCID). Grants for other
+sites are neither applied nor finished, and no emails are sent for them.
+
+When replaying all grants with --all, --since restricts the replay to grants
+submitted on or after the given date, e.g. to avoid re-processing years of
+historical records after a cdb rebuild. Alternatively --since-last restricts
+the replay to grants newer than those seen by the last successful sync.
+
+With --grant-id only the single WebserverAccess record with the given id is
+fetched and processed, whether or not it is still pending, e.g. to reproduce
+a problem with a particular request or to handle an urgent grant between
+scheduled runs. Its site is changed and committed, and if the record is
+pending it is finished and the user emailed, as in a normal sync. A record
+superseded by a newer request for the same person and site isn't processed.
+
+Any configured plugins are invoked during the sync: grant processors may skip
+grants, validators may reject changed sites (aborting the sync before
+anything is committed), and notifiers are told of each grant finished.
+
+A revocation of one of a site's immortal admins contradicts the cdb, so it
+isn't applied: the admin is kept, the grant is left pending in eActivities,
+and the conflict is logged and recorded in the run summary for manual review.
+
+Grants which would give a site more than sync.max_admins admins (not counting
+immortal admins, and counting admins revoked in the same sync as removed) are
+left pending and recorded as conflicts, in order of request. pugo audit admins
+lists sites already over the limit.
+
+Grants for sites excluded by cdb.managed_sites are likewise left pending and
+recorded as conflicts, as pugo never changes those sites. So are grants for
+sites marked protected: true, which are only changed by hand.
+
+Grants to logins matching an entry of sync.blocklist, such as service accounts
+and leavers, are never applied. They too are left pending, logged, and
+recorded as conflicts in the run summary and the audit log, by the first sync
+to see them; they are then held in the state file, and later syncs skip them
+quietly. Entries are logins or shell patterns, e.g. svc-*.
+
+With sync.confirm_access set, new admins must confirm their access before
+they are added: the first sync to see a grant emails the person a link served
+by pugo serve at serve.base_url, and the grant is left pending until a later
+sync finds it confirmed. Links which expire unused (see confirm.expiry) are
+removed, and the next sync sends a new one.
+
+With sync.change_tracking set, scheduled syncs use SQL Server change tracking
+on WebserverAccess to fetch only the grants changed since the last successful
+sync, plus those it left pending, rather than querying every pending grant.
+Every sync.full_scan_interval (24h by default) a sync queries in full, so
+grants not seen when they changed, e.g. as the person had no login yet, are
+picked up. A sync with --all, --site, --csp or --grant-id always queries in
+full.
+
+With --notify-site-admins (or email.notify_site_admins in config) the
+existing admins of each site whose membership changed are sent a summary of
+who was added and removed.
+
+With --disable-inactive-csps (or sync.disable_inactive_csps in config) sites
+whose CSP is no longer active in eActivities are disabled in the same commit,
+and a report of the sites disabled is written for manual review.
+
+With cdb.staging_branch set, the sync commits to that branch rather than
+cdb.branch, creating it from cdb.branch if need be, so the changes can be
+reviewed before pugo promote brings them into production. Grants are left
+pending, and finished and users notified by the first sync after they have
+been promoted.
+
+With --review (or sync.review in config) the sync commits to a new branch
+named after cdb.review.branch_prefix, pushes it, and opens a pull request
+(GitHub) or merge request (GitLab) into cdb.branch, as configured by
+cdb.review, for cdbs which require changes to be reviewed. While a request
+is open, later requests are stacked on its branch so they don't conflict with
+it; merge them in order. Grants are left pending until the request is merged,
+then finished and users notified by the first sync to find them in the ledger
+on cdb.branch. Syncs meanwhile don't propose them again; --all processes them
+afresh, e.g. if the request was closed without being merged.
+
+A site which can't be loaded, or a grant which can't be finished once the
+cdb is committed, doesn't stop the sync: its grants are left pending for the
+next sync, the rest are processed, and a report of the failures is written
+before exiting with the partial failure exit code.`,
+	Annotations: map[string]string{annotationRunLock: "true", annotationContinueOnError: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doSync(cmd)
 	},
 }
 
@@ -31,6 +128,11 @@ type syncOptions struct {
 	noPush            bool
 	noEmail           bool
 	recipientOverride string
+	sites             []string
+	csps              []int
+	since             string
+	sinceLast         bool
+	grantId           int
 }
 
 var syncOpts syncOptions
@@ -41,6 +143,19 @@ func init() {
 	syncCmd.Flags().BoolVar(&syncOpts.all, "all", false, "Sync all grants, including ones that have already been processed.")
 	syncCmd.Flags().BoolVar(&syncOpts.noEmail, "no-email", false, "Don't send emails. Implied by dry-run.")
 	syncCmd.Flags().StringVar(&syncOpts.recipientOverride, "recipient-override-email", "", "If set, sends all generated emails to the specified address instead of the real recipients.")
+	syncCmd.Flags().StringArrayVar(&syncOpts.sites, "site", nil, "Only sync grants for the given site (name or id). May be repeated.")
+	syncCmd.Flags().IntSliceVar(&syncOpts.csps, "csp", nil, "Only sync grants for sites belonging to the given CSP (OCID). May be repeated.")
+	syncCmd.Flags().StringVar(&syncOpts.since, "since", "", "With --all, only sync grants submitted on or after the given date (yyyy-mm-dd).")
+	syncCmd.Flags().BoolVar(&syncOpts.sinceLast, "since-last", false, "With --all, only sync grants newer than those processed by the last successful sync.")
+	syncCmd.Flags().IntVar(&syncOpts.grantId, "grant-id", 0, "Only sync the grant with the given WebserverAccess id, whether or not it is pending.")
+	syncCmd.Flags().Bool("notify-site-admins", false, "Email the existing admins of each site whose membership changed.")
+	viper.BindPFlag("email.notify_site_admins", syncCmd.Flags().Lookup("notify-site-admins"))
+	syncCmd.Flags().Bool("disable-inactive-csps", false, "Disable the sites of CSPs which are no longer active.")
+	viper.BindPFlag("sync.disable_inactive_csps", syncCmd.Flags().Lookup("disable-inactive-csps"))
+	syncCmd.Flags().Bool("review", false, "Commit to a new branch and open a pull or merge request for it, rather than pushing to cdb.branch.")
+	viper.BindPFlag("sync.review", syncCmd.Flags().Lookup("review"))
+	addPlanOutFlag(syncCmd)
+	syncCmd.RegisterFlagCompletionFunc("site", completeSiteNames)
 	syncCmd.Flags().String("branch", "master", "Commit to the named branch instead of the default or config specified branch.")
 	viper.BindPFlag("cdb.branch", syncCmd.Flags().Lookup("branch"))
 }
@@ -48,56 +163,472 @@ func init() {
 func doSync(cmd *cobra.Command) error {
 	log.Info("sync: Starting sync ...")
 
-	newerpolDb, err := newerpol.Connect()
+	// Changes are reviewed on the staging branch before pugo promote, and
+	// other commands run afterwards (e.g. from the TUI) commit as usual
+	staging := cdb.UseStagingBranch()
+	if staging {
+		defer cdb.Configure(&conf.Cdb)
+	}
+	// Grants committed to the staging branch or for review are only
+	// finished once a later sync sees them on cdb.branch
+	deferFinish := staging || viper.GetBool("sync.review")
+
+	var since time.Time
+	if syncOpts.since != "" {
+		if !syncOpts.all {
+			return fmt.Errorf("sync: --since can only be used with --all")
+		}
+		var err error
+		since, err = time.ParseInLocation("2006-01-02", syncOpts.since, time.Local)
+		if err != nil {
+			return fmt.Errorf("sync: Invalid --since date: %s", syncOpts.since)
+		}
+		log.Infof("sync: Only syncing grants submitted since %s", since.Format("2006-01-02"))
+	}
+
+	var afterAccessId int
+	if syncOpts.sinceLast {
+		if !syncOpts.all {
+			return fmt.Errorf("sync: --since-last can only be used with --all")
+		}
+		st, err := state.Load()
+		if err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		afterAccessId = st.LastAccessId
+		log.Infof("sync: Only syncing grants after access id %d (last sync %s)", afterAccessId, st.LastSync.Format(time.RFC3339))
+	}
+
+	if syncOpts.grantId != 0 {
+		if syncOpts.all || len(syncOpts.sites) > 0 || len(syncOpts.csps) > 0 {
+			return fmt.Errorf("sync: --grant-id can't be used with --all, --site or --csp")
+		}
+		if syncOpts.grantId < 0 {
+			return fmt.Errorf("sync: Invalid --grant-id: %d", syncOpts.grantId)
+		}
+		log.Infof("sync: Only syncing grant %d", syncOpts.grantId)
+	}
+
+	newerpolDb, err := newerpol.Connect(runCtx, &conf.Newerpol)
 	if err != nil {
-		log.Fatal(fmt.Errorf("sync: ", err))
+		return dbErrorf("sync: Connecting to newerpol: %w", err)
 	}
 	defer newerpolDb.Close()
 
 	getGrantsOpts := &newerpol.GetGrantsOptions{
-		IncludeNonPending: syncOpts.all,
+		IncludeNonPending: syncOpts.all || syncOpts.grantId > 0,
+		OCIds:             syncOpts.csps,
+		SubmittedSince:    since,
+		AfterAccessId:     afterAccessId,
+		AccessId:          syncOpts.grantId,
+	}
+	for _, nameOrId := range syncOpts.sites {
+		site, err := lookupSite(nameOrId)
+		if err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		getGrantsOpts.WebsiteIds = append(getGrantsOpts.WebsiteIds, site.Id)
+	}
+	if len(getGrantsOpts.WebsiteIds) > 0 || len(getGrantsOpts.OCIds) > 0 {
+		log.WithFields(log.Fields{
+			"WebsiteIds": getGrantsOpts.WebsiteIds,
+			"OCIds":      getGrantsOpts.OCIds,
+		}).Info("sync: Sync restricted to selected sites / CSPs")
+	}
+
+	// With sync.change_tracking, a scheduled sync only fetches grants changed
+	// since the last, and those it left pending. The version is read before
+	// fetching grants, so changes made meanwhile are seen by the next sync
+	var changeVersions *newerpol.ChangeVersions
+	scoped := len(getGrantsOpts.WebsiteIds) > 0 || len(getGrantsOpts.OCIds) > 0 || getGrantsOpts.AccessId > 0
+	if viper.GetBool("sync.change_tracking") && !syncOpts.all && !scoped {
+		changeVersions, err = newerpol.GetChangeVersions(runCtx, newerpolDb)
+		if err != nil {
+			return dbErrorf("sync: %w", err)
+		}
+		st, err := state.Load()
+		if err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		switch {
+		case st.LastChangeVersion == 0:
+			log.Info("sync: No change tracking version recorded yet - fetching all pending grants")
+		case st.LastChangeVersion < changeVersions.MinValid:
+			log.Warnf("sync: Changes since version %d are no longer retained (oldest %d) - fetching all pending grants", st.LastChangeVersion, changeVersions.MinValid)
+		case fullScanDue(st.LastFullScan):
+			// Grants whose person or website wasn't resolved when they
+			// changed, e.g. as the person had no login yet, aren't fetched
+			// by the query and so aren't held, so are only seen in full
+			log.Infof("sync: No full fetch of pending grants since %s - fetching all pending grants", st.LastFullScan.Format(time.RFC3339))
+		default:
+			getGrantsOpts.ChangedSince = st.LastChangeVersion
+			getGrantsOpts.HeldAccessIds = st.HeldAccessIds
+			log.Infof("sync: Only fetching grants changed since version %d, and %d held by the last sync", st.LastChangeVersion, len(st.HeldAccessIds))
+		}
 	}
 
+	// Get grants to add and revoke grouped by site id
 	grants := make(map[string]map[int][]newerpol.AccessRecord)
-	// Get grants to add grouped by site id
-	grants["add"], err = newerpol.GetGrantsToAdd(newerpolDb, getGrantsOpts)
+	grants["add"], grants["revoke"], err = newerpol.GetGrants(runCtx, newerpolDb, getGrantsOpts)
 	if err != nil {
-		log.Fatal(fmt.Errorf("sync: ", err))
+		return dbErrorf("sync: %w", err)
 	}
 	log.WithFields(log.Fields{
-		"grantsToAdd": grants["add"],
-	}).Debug("sync: Got grants to add")
+		"grantsToAdd":    grants["add"],
+		"grantsToRevoke": grants["revoke"],
+	}).Debug("sync: Got grants")
 
-	// Get grants to revoke grouped by site id
-	grants["revoke"], err = newerpol.GetGrantsToRevoke(newerpolDb, getGrantsOpts)
+	// Normalize logins as the cdb does, so grants for the same login written
+	// differently are treated alike. Note the pending grants fetched: those
+	// not finished are held for the next incremental sync
+	var fetchedPending []int
+	for _, verb := range []string{"add", "revoke"} {
+		for _, grantRecords := range grants[verb] {
+			for i := range grantRecords {
+				grantRecords[i].Login = cdb.NormalizeLogin(grantRecords[i].Login)
+				if grantRecords[i].IsPending() {
+					fetchedPending = append(fetchedPending, grantRecords[i].AccessId)
+				}
+			}
+		}
+	}
+
+	// Grants awaiting promotion or the merge of their review request aren't
+	// processed again: those which have reached cdb.branch are finished, and
+	// the rest left pending. --all processes them again, e.g. after a
+	// request is closed without being merged
+	lastState, err := state.Load()
 	if err != nil {
-		log.Fatal(fmt.Errorf("sync: ", err))
+		return fmt.Errorf("sync: %w", err)
+	}
+	awaiting := make(map[int]bool)
+	for _, id := range lastState.AwaitingAccessIds {
+		awaiting[id] = true
+	}
+	// Why grants were held back rather than processed, reported if the grant
+	// synced with --grant-id is held
+	heldReasons := make(map[int]string)
+	awaitingFetched := make(map[int]bool)
+	var stillAwaiting []int
+	var promoted []newerpol.AccessRecord
+	if !syncOpts.all {
+		for _, verb := range []string{"add", "revoke"} {
+			for _, grantRecords := range grants[verb] {
+				for _, accessRecord := range grantRecords {
+					if awaiting[accessRecord.AccessId] && accessRecord.IsPending() {
+						awaitingFetched[accessRecord.AccessId] = true
+					}
+				}
+			}
+		}
+	}
+	if len(awaitingFetched) > 0 {
+		inProduction, err := cdb.ProductionGrantIds(runCtx)
+		if err != nil {
+			return gitErrorf("sync: %w", err)
+		}
+		for _, verb := range []string{"add", "revoke"} {
+			for id, grantRecords := range grants[verb] {
+				kept := grantRecords[:0]
+				for _, accessRecord := range grantRecords {
+					switch {
+					case !awaitingFetched[accessRecord.AccessId]:
+						kept = append(kept, accessRecord)
+					case inProduction[accessRecord.AccessId]:
+						promoted = append(promoted, accessRecord)
+					default:
+						log.Infof("sync: Not processing grant %d (%s %s on site %d) - awaiting promotion or merge into %s. Leaving grant pending", accessRecord.AccessId, verb, accessRecord.Login, id, conf.Cdb.Branch)
+						stillAwaiting = append(stillAwaiting, accessRecord.AccessId)
+						heldReasons[accessRecord.AccessId] = "awaiting promotion or merge into " + conf.Cdb.Branch
+					}
+				}
+				grants[verb][id] = kept
+			}
+		}
+		log.Infof("sync: %d grants awaiting promotion or merge have reached %s, %d still awaiting", len(promoted), conf.Cdb.Branch, len(stillAwaiting))
 	}
-	log.WithFields(log.Fields{
-		"grantsToRevoke": grants["revoke"],
-	}).Debug("sync: Got grants to revoke")
 
-	// Determine total number of grants pending
+	// Grants in a plan awaiting approval with pugo approve aren't planned
+	// again by later syncs. --all plans them afresh, e.g. after the plan is
+	// rejected
+	awaitingApproval := make(map[int]bool)
+	for _, id := range lastState.ApprovalAccessIds {
+		awaitingApproval[id] = true
+	}
+	var stillApproval []int
+	if !syncOpts.all && len(awaitingApproval) > 0 {
+		for _, verb := range []string{"add", "revoke"} {
+			for id, grantRecords := range grants[verb] {
+				kept := grantRecords[:0]
+				for _, accessRecord := range grantRecords {
+					if !awaitingApproval[accessRecord.AccessId] || !accessRecord.IsPending() {
+						kept = append(kept, accessRecord)
+						continue
+					}
+					log.Infof("sync: Not processing grant %d (%s %s on site %d) - in a plan awaiting approval. Leaving grant pending", accessRecord.AccessId, verb, accessRecord.Login, id)
+					stillApproval = append(stillApproval, accessRecord.AccessId)
+					heldReasons[accessRecord.AccessId] = "in a plan awaiting approval with pugo approve"
+				}
+				grants[verb][id] = kept
+			}
+		}
+	}
+
+	// Site files which can't be loaded are reported as failures, and grants
+	// for the sites in them left pending, rather than abandoning the sync
+	if err := recordLoadFailures("sync"); err != nil {
+		return err
+	}
+
+	// Logins on the blocklist are never granted access. As newerpol has no
+	// failed state their grants are left pending, reported for review once,
+	// and held in the state file so later syncs skip them quietly
+	alreadyBlocked := make(map[int]bool)
+	for _, id := range lastState.BlockedAccessIds {
+		alreadyBlocked[id] = true
+	}
+	var blockedNow []int
+	for id, grantRecords := range grants["add"] {
+		kept := grantRecords[:0]
+		for _, accessRecord := range grantRecords {
+			pattern, blocked := blockedLogin(accessRecord.Login)
+			if !blocked {
+				kept = append(kept, accessRecord)
+				continue
+			}
+			heldReasons[accessRecord.AccessId] = "login matches blocklist entry " + pattern
+			// Grants no longer pending, e.g. fetched by --all, aren't left
+			// pending so aren't reported
+			if !accessRecord.IsPending() {
+				log.Debugf("sync: Skipping grant %d for blocklisted login %s, not pending", accessRecord.AccessId, accessRecord.Login)
+				continue
+			}
+			blockedNow = append(blockedNow, accessRecord.AccessId)
+			if alreadyBlocked[accessRecord.AccessId] {
+				log.Debugf("sync: Skipping grant %d for blocklisted login %s, already reported", accessRecord.AccessId, accessRecord.Login)
+				continue
+			}
+			siteName := siteNameById(id)
+			log.Warnf("sync: Not adding %s to %s (grant %d) - login matches blocklist entry %s. Leaving grant pending", accessRecord.Login, siteName, accessRecord.AccessId, pattern)
+			runSummary.recordConflict(grantConflict{
+				AccessId: accessRecord.AccessId,
+				Login:    accessRecord.Login,
+				Site:     siteName,
+				Reason:   "blocklisted login (" + pattern + ")",
+			})
+			audit.Record(audit.Event{
+				Action: audit.ActionGrantBlock,
+				Site:   siteName,
+				Login:  accessRecord.Login,
+				Detail: fmt.Sprintf("access id %d, blocklist entry %s", accessRecord.AccessId, pattern),
+			})
+		}
+		grants["add"][id] = kept
+	}
+
+	// With sync.confirm_access new admins must confirm their access by
+	// following an emailed link before they are added. Grants awaiting
+	// confirmation are left pending, and those without a confirmation yet
+	// are sent one once the grants are finished. Grants for protected and
+	// unmanaged sites are flagged when processed, so aren't confirmed
+	var toConfirm []newerpol.AccessRecord
+	confirmed := make(map[int]*confirmation.Confirmation)
+	if viper.GetBool("sync.confirm_access") {
+		if viper.GetString("serve.base_url") == "" {
+			return configErrorf("sync: sync.confirm_access is set, but serve.base_url isn't")
+		}
+		var accessIds []int
+		for _, grantRecords := range grants["add"] {
+			for _, accessRecord := range grantRecords {
+				accessIds = append(accessIds, accessRecord.AccessId)
+			}
+		}
+		if removed, err := confirmation.Prune(); err != nil {
+			log.Warnf("sync: %v", err)
+		} else if removed > 0 {
+			log.Infof("sync: Removed %d expired confirmations", removed)
+		}
+		confirmations, err := confirmation.ForAccessIds(accessIds)
+		if err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		for id, grantRecords := range grants["add"] {
+			site, err := cdb.GetSiteById(id)
+			if err != nil {
+				return gitErrorf("sync: %w", err)
+			}
+			kept := grantRecords[:0]
+			for _, accessRecord := range grantRecords {
+				c := confirmations[accessRecord.AccessId]
+				switch {
+				case site == nil || site.Protected || !site.Managed() || !accessRecord.IsPending() || site.HasAdmin(accessRecord.Login):
+					kept = append(kept, accessRecord)
+				case c != nil && c.Confirmed != nil:
+					confirmed[accessRecord.AccessId] = c
+					kept = append(kept, accessRecord)
+				case c != nil:
+					log.Infof("sync: Not adding %s to %s (grant %d) - awaiting confirmation", accessRecord.Login, site.Name(), accessRecord.AccessId)
+					heldReasons[accessRecord.AccessId] = "awaiting confirmation"
+				default:
+					toConfirm = append(toConfirm, accessRecord)
+					heldReasons[accessRecord.AccessId] = "awaiting confirmation, which is sent once this sync finishes"
+				}
+			}
+			grants["add"][id] = kept
+		}
+	}
+
+	// Sites may have at most sync.max_admins admins. Grants which would take
+	// a site over the limit are left pending and reported, counting admins
+	// revoked by this sync as freeing places
+	if maxAdmins := viper.GetInt("sync.max_admins"); maxAdmins > 0 {
+		for id, grantRecords := range grants["add"] {
+			site, err := cdb.GetSiteById(id)
+			if err != nil {
+				return gitErrorf("sync: %w", err)
+			}
+			// Grants for protected and unmanaged sites are flagged when
+			// processed
+			if site == nil || site.Protected || !site.Managed() {
+				continue
+			}
+			admins := make(map[string]bool)
+			for _, login := range site.Admins {
+				admins[cdb.NormalizeLogin(login)] = true
+			}
+			for _, accessRecord := range grants["revoke"][id] {
+				if !site.IsImmortal(accessRecord.Login) {
+					delete(admins, accessRecord.Login)
+				}
+			}
+
+			sort.Slice(grantRecords, func(i, j int) bool {
+				return grantRecords[i].AccessId < grantRecords[j].AccessId
+			})
+			kept := grantRecords[:0]
+			for _, accessRecord := range grantRecords {
+				if admins[accessRecord.Login] || len(admins) < maxAdmins {
+					admins[accessRecord.Login] = true
+					kept = append(kept, accessRecord)
+					continue
+				}
+				log.Warnf("sync: Not adding %s to %s (grant %d) - the site already has the maximum of %d admins. Leaving grant pending", accessRecord.Login, site.Name(), accessRecord.AccessId, maxAdmins)
+				heldReasons[accessRecord.AccessId] = fmt.Sprintf("%s already has the maximum of %d admins", site.Name(), maxAdmins)
+				runSummary.recordConflict(grantConflict{
+					AccessId: accessRecord.AccessId,
+					Login:    accessRecord.Login,
+					Site:     site.Name(),
+					Reason:   fmt.Sprintf("admin limit (%d)", maxAdmins),
+				})
+				audit.Record(audit.Event{
+					Action: audit.ActionGrantBlock,
+					Site:   site.Name(),
+					Login:  accessRecord.Login,
+					Detail: fmt.Sprintf("access id %d, admin limit %d", accessRecord.AccessId, maxAdmins),
+				})
+			}
+			grants["add"][id] = kept
+		}
+	}
+
+	// Determine total number of grants pending, and the highest access id
+	// seen to use as the change marker for the next incremental sync
 	var totalGrants int
+	lastAccessId := afterAccessId
 	for _, verb := range []string{"add", "revoke"} {
 		for _, grantRecords := range grants[verb] {
 			totalGrants += len(grantRecords)
+			for _, accessRecord := range grantRecords {
+				if accessRecord.AccessId > lastAccessId {
+					lastAccessId = accessRecord.AccessId
+				}
+			}
+		}
+	}
+	// A grant held back is still recorded, and confirmations sent, by the
+	// rest of the sync. A grant which has reached cdb.branch is finished.
+	if syncOpts.grantId > 0 && totalGrants == 0 && len(promoted) == 0 {
+		reason, ok := heldReasons[syncOpts.grantId]
+		if !ok {
+			return fmt.Errorf("sync: Grant %d not found, or superseded by a newer request", syncOpts.grantId)
+		}
+		log.Warnf("sync: Grant %d not processed - %s", syncOpts.grantId, reason)
+	}
+
+	// Let grant processor plugins skip grants. Skipped grants are left
+	// pending in newerpol
+	var allGrants []newerpol.AccessRecord
+	for _, verb := range []string{"add", "revoke"} {
+		for _, grantRecords := range grants[verb] {
+			allGrants = append(allGrants, grantRecords...)
+		}
+	}
+	skip, err := plugins.ProcessGrants(runCtx, allGrants)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	if len(skip) > 0 {
+		for _, verb := range []string{"add", "revoke"} {
+			for id, grantRecords := range grants[verb] {
+				kept := grantRecords[:0]
+				for _, accessRecord := range grantRecords {
+					if reason, ok := skip[accessRecord.AccessId]; ok {
+						log.Infof("sync: Skipping grant %d (%s on site %d): %s", accessRecord.AccessId, accessRecord.Login, id, reason)
+						totalGrants--
+						continue
+					}
+					kept = append(kept, accessRecord)
+				}
+				grants[verb][id] = kept
+			}
 		}
 	}
 
 	// Process grants
+	_, processSpan := tracing.Start(runCtx, "sync.process_grants", attribute.Int("grants", totalGrants))
 	var wg sync.WaitGroup
 	siteIdsChanged := make(chan int, totalGrants)
 	grantsProcessed := make(chan newerpol.AccessRecord, totalGrants)
+	var ledgerMu sync.Mutex
+	var ledger []cdb.LedgerEntry
+	processing := progress.New("sync: Processing grants", totalGrants)
 	for _, verb := range []string{"add", "revoke"} {
 		log.Infof("sync: Processing grants to %s for %d sites", verb, len(grants[verb]))
 		for id, grantRecords := range grants[verb] {
 			site, err := cdb.GetSiteById(id)
 			if err != nil {
-				log.Fatalf("sync: %v", err)
+				return gitErrorf("sync: %w", err)
 			}
 			if site == nil {
-				log.Warnf("sync: Unable to %s grants for site %d - site not found in cdb. Skipping", verb, id)
+				log.Warnf("sync: Unable to %s grants for site %d - site not found in cdb%s. Skipping", verb, id, orUnloadable())
+				continue
+			}
+			if !site.Managed() {
+				// Leave grants for sites pugo mustn't change pending for
+				// manual handling
+				for _, accessRecord := range grantRecords {
+					log.Warnf("sync: Not processing grant %d (%s %s) - %s is excluded by cdb.managed_sites. Leaving grant pending", accessRecord.AccessId, verb, accessRecord.Login, site.Name())
+					runSummary.recordConflict(grantConflict{
+						AccessId: accessRecord.AccessId,
+						Login:    accessRecord.Login,
+						Site:     site.Name(),
+						Reason:   "unmanaged site",
+					})
+				}
+				continue
+			}
+			if site.Protected {
+				// Protected sites are only changed by hand, so their
+				// grants are flagged for manual handling
+				for _, accessRecord := range grantRecords {
+					log.Warnf("sync: Not processing grant %d (%s %s) - %s is protected. Leaving grant pending for manual handling", accessRecord.AccessId, verb, accessRecord.Login, site.Name())
+					runSummary.recordConflict(grantConflict{
+						AccessId: accessRecord.AccessId,
+						Login:    accessRecord.Login,
+						Site:     site.Name(),
+						Reason:   "protected site",
+					})
+				}
 				continue
 			}
 
@@ -119,15 +650,32 @@ func doSync(cmd *cobra.Command) error {
 						site.AddAdmin(accessRecord.Login)
 					case "revoke":
 						log.Infof("sync: Revoking %s from %s", accessRecord.Login, site.Name())
-						site.RemoveAdmin(accessRecord.Login)
+						if site.RemoveAdminChecked(accessRecord.Login) == cdb.AdminImmortal {
+							// Leave the revocation pending for someone to
+							// resolve by hand rather than finishing it while
+							// the login keeps access
+							log.Warnf("sync: Not revoking %s from %s (grant %d) - %s is an immortal admin. Leaving grant pending", accessRecord.Login, site.Name(), accessRecord.AccessId, accessRecord.Login)
+							runSummary.recordConflict(grantConflict{
+								AccessId: accessRecord.AccessId,
+								Login:    accessRecord.Login,
+								Site:     site.Name(),
+								Reason:   "immortal admin",
+							})
+							processing.Add(1)
+							continue
+						}
 					}
 					if site.Changed() {
 						log.Debugf("sync: %s changed", site.Name())
 						siteIdsChanged <- site.Id
 					}
 					if accessRecord.IsPending() {
+						ledgerMu.Lock()
+						ledger = append(ledger, ledgerEntry(accessRecord, site))
+						ledgerMu.Unlock()
 						grantsProcessed <- accessRecord
 					}
+					processing.Add(1)
 				}
 				wg.Done()
 			}(verb, site, grantRecords)
@@ -143,6 +691,33 @@ func doSync(cmd *cobra.Command) error {
 	for id := range siteIdsChanged {
 		siteIdsToCommit[id] = true
 	}
+	processing.Finish()
+	processSpan.End()
+
+	var disabled disabledSiteReport
+	if viper.GetBool("sync.disable_inactive_csps") && syncOpts.grantId == 0 {
+		if disabled, err = disableInactiveCSPSites(newerpolDb, getGrantsOpts, siteIdsToCommit); err != nil {
+			return dbErrorf("sync: %w", err)
+		}
+		log.Infof("sync: %d sites of inactive CSPs to disable", len(disabled))
+	}
+
+	// Let validator plugins check the changed sites before committing
+	var sitesToCommit []*cdb.Site
+	for id := range siteIdsToCommit {
+		site, err := cdb.GetSiteById(id)
+		if err != nil {
+			return gitErrorf("sync: %w", err)
+		}
+		sitesToCommit = append(sitesToCommit, site)
+	}
+	problems, err := plugins.ValidateSites(runCtx, sitesToCommit)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("sync: Plugin validation failed for %d sites:%s", len(problems), plugins.FormatProblems(problems))
+	}
 
 	// Commit changes to repo
 	commitOpts := &cdb.CommitSitesOptions{
@@ -152,17 +727,34 @@ func doSync(cmd *cobra.Command) error {
 		DryRun:          globalOpts.dryRun,
 		ForceUpdateTree: globalOpts.forceUpdateTree,
 		NoPush:          globalOpts.noPush,
+		Ledger:          ledger,
+		ReviewMode:      viper.GetBool("sync.review"),
+		AllowLoadErrors: true,
+	}
+	if len(disabled) > 0 {
+		commitOpts.Message = "Update admins, disable sites of inactive CSPs"
+	}
+	if err := requireApproval(commitOpts); err != nil {
+		return fmt.Errorf("sync: %w", err)
 	}
 	log.WithFields(log.Fields{
 		"Ids":             siteIdsToCommit,
-		"Message":         "Update admins",
+		"Message":         commitOpts.Message,
 		"Cmd":             "sync",
 		"DryRun":          globalOpts.dryRun,
 		"ForceUpdateTree": globalOpts.forceUpdateTree,
 		"NoPush":          globalOpts.noPush,
 	}).Debugf("sync: Committing sites")
-	if err = cdb.CommitSites(commitOpts); err != nil {
-		log.Fatalf("sync: %v", err)
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	if err != nil {
+		return gitErrorf("sync: %w", err)
+	}
+	if len(disabled) > 0 {
+		runSummary.recordDisabled(disabled)
+		if err := writeOutput(os.Stdout, disabled); err != nil {
+			log.Warnf("sync: Unable to write report of disabled sites: %v", err)
+		}
 	}
 
 	// Update eActivities and email user when access granted
@@ -171,16 +763,46 @@ func doSync(cmd *cobra.Command) error {
 		if syncOpts.recipientOverride != "" {
 			log.Infof("sync: Email override in effect - all emails will be sent to %s", syncOpts.recipientOverride)
 		}
-		if err := email.StartWorker(); err != nil {
-			log.Warn("sync: %v", err)
+		if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+			log.Warnf("sync: %v", err)
 			log.Warn("sync: Unable to start email worker, emails will not be sent")
 			sendEmails = false
+		} else {
+			// Send queued emails even if finishing grants fails part way
+			defer email.ShutdownWorker()
 		}
 	} else {
 		log.Info("sync: Performing dry run or --no-email in effect - emails will not be sent.")
 	}
 
+	var events []plugins.Event
+	var planned []newerpol.AccessRecord
+	defer func() {
+		plugins.Notify(runCtx, events)
+	}()
+
+	// Grants just committed to the staging branch or for review wait until
+	// they reach cdb.branch, while those which have are finished now
+	toFinish := promoted
+	var deferred []int
 	for accessRecord := range grantsProcessed {
+		if deferFinish {
+			deferred = append(deferred, accessRecord.AccessId)
+			continue
+		}
+		toFinish = append(toFinish, accessRecord)
+	}
+	if len(deferred) > 0 {
+		log.Infof("sync: %d grants will be finished, and users notified, by the first sync after they reach %s", len(deferred), conf.Cdb.Branch)
+	}
+
+	finishing := progress.New("sync: Finishing grants", len(toFinish))
+	defer finishing.Finish()
+	_, finishSpan := tracing.Start(runCtx, "sync.finish_grants", attribute.Int("grants", len(toFinish)))
+	defer finishSpan.End()
+	finished := make(map[int]bool)
+	for _, accessRecord := range toFinish {
+		finishing.Add(1)
 		log.WithFields(log.Fields{
 			"accessRecord": accessRecord,
 		}).Debug("sync: Finishing grant")
@@ -189,32 +811,62 @@ func doSync(cmd *cobra.Command) error {
 			log.WithFields(log.Fields{
 				"accessRecord": accessRecord,
 			}).Debug("sync: Dry run, skipping newerpol.FinishGrant")
+			planned = append(planned, accessRecord)
 			continue
 		}
 
-		updated, err := accessRecord.FinishGrant(newerpolDb)
+		updated, err := accessRecord.FinishGrant(runCtx, newerpolDb)
 		if err != nil {
-			log.Fatalf("sync: %v", err)
+			// cdb changes have already been committed at this point, so
+			// carry on finishing the rest unless the run was cancelled. The
+			// grant stays pending and is finished by the next sync
+			if runCtx.Err() != nil {
+				return partialFailureErrorf("sync: %w", err)
+			}
+			recordFailure("sync", runFailure{
+				Site:     siteNameById(accessRecord.WebsiteId),
+				AccessId: accessRecord.AccessId,
+				Stage:    "finish",
+				Error:    err.Error(),
+			})
+			continue
+		}
+		finished[accessRecord.AccessId] = true
+		if !updated {
+			continue
+		}
+		runSummary.addGrantsProcessed(1)
+		if c := confirmed[accessRecord.AccessId]; c != nil {
+			if err := c.Remove(); err != nil {
+				log.Warnf("sync: %v", err)
+			}
 		}
 
-		if updated && sendEmails {
+		site, err := cdb.GetSiteById(accessRecord.WebsiteId)
+		if err == nil && site != nil {
+			event := plugins.Event{
+				Action:    "grant",
+				Login:     accessRecord.Login,
+				Site:      site.Name(),
+				AccessId:  accessRecord.AccessId,
+				WebsiteId: accessRecord.WebsiteId,
+			}
+			if accessRecord.RequestStatus == newerpol.AccessRevokePending {
+				event.Action = "revoke"
+			}
+			events = append(events, event)
+		}
+
+		if sendEmails {
 			// Perpare options ...
-			site, err := cdb.GetSiteById(accessRecord.WebsiteId)
 			if err != nil || site == nil {
 				log.WithFields(log.Fields{
 					"accessRecord": accessRecord,
-				}).Warn("sync: Unable to load site %d - skipping email", accessRecord.WebsiteId)
+				}).Warnf("sync: Unable to load site %d - skipping email", accessRecord.WebsiteId)
 				continue
 			}
 
-			emailOpts := &email.EmailOptions{
-				FirstName: accessRecord.FirstName,
-				EmailName: accessRecord.LookupName,
-				Email:     accessRecord.Email,
-				CSP:       accessRecord.CSP,
-				Folder:    site.Name(),
-			}
-
+			emailOpts := grantEmail(accessRecord, site)
 			if emailOpts.Email == "" {
 				log.WithFields(log.Fields{
 					"emailOpts": emailOpts,
@@ -222,15 +874,6 @@ func doSync(cmd *cobra.Command) error {
 				continue
 			}
 
-			switch accessRecord.RequestStatus {
-			case newerpol.AccessGrantPending:
-				emailOpts.Subject = "Website Access Granted"
-				emailOpts.Type = "granted"
-			case newerpol.AccessRevokePending:
-				emailOpts.Subject = "Website Access Removed"
-				emailOpts.Type = "revoked"
-			}
-
 			if syncOpts.recipientOverride != "" {
 				emailOpts.Email = syncOpts.recipientOverride
 			}
@@ -239,15 +882,338 @@ func doSync(cmd *cobra.Command) error {
 			if err := email.SendEmail(emailOpts); err != nil {
 				log.WithFields(log.Fields{
 					"emailOpts": emailOpts,
-				}).Warn("sync: Error attempting to send email: %v", err)
+				}).Warnf("sync: Error attempting to send email: %v", err)
 				continue
 			}
 		}
 	}
 
+	if sendEmails && conf.Email.NotifySiteAdmins {
+		notifySiteAdmins(newerpolDb, events)
+	}
+
+	if len(toConfirm) > 0 {
+		if sendEmails {
+			sendConfirmations(toConfirm)
+		} else {
+			log.Infof("sync: %d grants need confirming - the emails will be sent by the next sync sending emails", len(toConfirm))
+		}
+	}
+
 	if sendEmails {
 		email.ShutdownWorker()
 	}
 
-	return nil
+	if len(runSummary.Conflicts) > 0 {
+		log.Errorf("sync: %d grants conflicted with the cdb or access policy and were left pending in eActivities for manual review", len(runSummary.Conflicts))
+	}
+
+	// A scoped sync only sees some of the grants awaiting or blocked, so
+	// keeps the rest
+	fetched := make(map[int]bool)
+	for _, id := range fetchedPending {
+		fetched[id] = true
+	}
+	approvalNow := stillApproval
+	for _, id := range lastState.ApprovalAccessIds {
+		if scoped && !fetched[id] {
+			approvalNow = append(approvalNow, id)
+		}
+	}
+
+	// Record the successful sync. A scoped sync doesn't see every grant, so
+	// it mustn't advance the change marker
+	if globalOpts.dryRun {
+		if planOut != "" {
+			if err := writePlan(cmd.CommandPath(), commitOpts, planned, plannedEmails(planned)); err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+		}
+		// Only the grants in the plan are held for approval: nothing else
+		// about a dry run is recorded
+		if approvalReason != "" {
+			for _, accessRecord := range planned {
+				approvalNow = append(approvalNow, accessRecord.AccessId)
+			}
+			err := state.Update(func(st *state.State) {
+				st.ApprovalAccessIds = approvalNow
+			})
+			if err != nil {
+				log.Warnf("sync: Unable to update state file: %v", err)
+			}
+		}
+		return reportFailures("sync")
+	}
+	var held []int
+	for _, id := range fetchedPending {
+		if !finished[id] {
+			held = append(held, id)
+		}
+	}
+	for _, id := range lastState.BlockedAccessIds {
+		if scoped && !fetched[id] {
+			blockedNow = append(blockedNow, id)
+		}
+	}
+	awaitingNow := append(stillAwaiting, deferred...)
+	listed := make(map[int]bool)
+	for _, id := range awaitingNow {
+		listed[id] = true
+	}
+	for _, id := range lastState.AwaitingAccessIds {
+		if scoped && !listed[id] && !awaitingFetched[id] && !finished[id] {
+			awaitingNow = append(awaitingNow, id)
+		}
+	}
+	err = state.Update(func(st *state.State) {
+		st.LastSync = time.Now()
+		st.LastSyncRunId = runId
+		if !scoped && lastAccessId > st.LastAccessId {
+			st.LastAccessId = lastAccessId
+		}
+		if changeVersions != nil {
+			st.LastChangeVersion = changeVersions.Current
+			st.HeldAccessIds = held
+			if getGrantsOpts.ChangedSince == 0 {
+				st.LastFullScan = time.Now()
+			}
+		}
+		if commitResult.Commit != "" {
+			st.LastCommit = commitResult.Commit
+		}
+		st.AwaitingAccessIds = awaitingNow
+		st.BlockedAccessIds = blockedNow
+		st.ApprovalAccessIds = approvalNow
+	})
+	if err != nil {
+		log.Warnf("sync: Unable to update state file: %v", err)
+	}
+
+	err = hooks.Run(runCtx, hooks.PostSync, map[string]interface{}{
+		"sites_changed":    commitResult.SitesChanged,
+		"commit":           commitResult.Commit,
+		"pushed":           commitResult.Pushed,
+		"grants_processed": runSummary.GrantsProcessed,
+		"conflicts":        len(runSummary.Conflicts),
+	})
+	if err != nil {
+		log.Warnf("sync: %v", err)
+	}
+
+	return reportFailures("sync")
+}
+
+// fullScanDue reports whether an incremental sync should fetch every pending
+// grant, as sync.full_scan_interval has passed since one last did. An
+// interval of zero never forces a full fetch.
+func fullScanDue(last time.Time) bool {
+	interval := viper.GetDuration("sync.full_scan_interval")
+	return interval > 0 && time.Since(last) >= interval
+}
+
+// siteNameById returns the name of the site with the given id, or the id if
+// the site can't be loaded
+func siteNameById(id int) string {
+	if site, err := cdb.GetSiteById(id); err == nil && site != nil {
+		return site.Name()
+	}
+	return strconv.Itoa(id)
+}
+
+// blockedLogin returns the entry of sync.blocklist which login matches, if
+// any. Entries are normalized as logins are.
+func blockedLogin(login string) (string, bool) {
+	for _, pattern := range viper.GetStringSlice("sync.blocklist") {
+		if matched, _ := path.Match(cdb.NormalizeLogin(pattern), login); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// sendConfirmations creates confirmations for grants and emails the links to
+// the people being granted access. Grants which can't be emailed get no
+// confirmation, so the next sync tries again.
+func sendConfirmations(grantRecords []newerpol.AccessRecord) {
+	for _, accessRecord := range grantRecords {
+		site, err := cdb.GetSiteById(accessRecord.WebsiteId)
+		if err != nil || site == nil {
+			log.Warnf("sync: Unable to load site %d - skipping confirmation of grant %d", accessRecord.WebsiteId, accessRecord.AccessId)
+			continue
+		}
+		if accessRecord.Email == "" {
+			log.Warnf("sync: No email address for %s - unable to confirm grant %d", accessRecord.Login, accessRecord.AccessId)
+			continue
+		}
+
+		c, err := confirmation.New(accessRecord.AccessId, accessRecord.WebsiteId, site.Name(), accessRecord.Login)
+		if err != nil {
+			log.Warnf("sync: %v", err)
+			continue
+		}
+		emailOpts := &email.EmailOptions{
+			FirstName:  accessRecord.FirstName,
+			EmailName:  accessRecord.LookupName,
+			Email:      accessRecord.Email,
+			CSP:        accessRecord.CSP,
+			Folder:     site.Name(),
+			Type:       "confirm",
+			Subject:    "Confirm Website Access",
+			ConfirmURL: c.URL(),
+		}
+		if syncOpts.recipientOverride != "" {
+			emailOpts.Email = syncOpts.recipientOverride
+		}
+		if err := email.SendEmail(emailOpts); err != nil {
+			log.Warnf("sync: Error attempting to send confirmation email for grant %d: %v", accessRecord.AccessId, err)
+			if err := c.Remove(); err != nil {
+				log.Warnf("sync: %v", err)
+			}
+			continue
+		}
+		log.Infof("sync: Asked %s to confirm access to %s (grant %d)", accessRecord.Login, site.Name(), accessRecord.AccessId)
+	}
+}
+
+// ledgerEntry returns the entry recording a grant in the cdb's access ledger
+func ledgerEntry(accessRecord newerpol.AccessRecord, site *cdb.Site) cdb.LedgerEntry {
+	entry := cdb.LedgerEntry{
+		Action:  cdb.LedgerGrant,
+		Login:   accessRecord.Login,
+		Site:    site.Name(),
+		GrantId: accessRecord.AccessId,
+	}
+	if accessRecord.RequestStatus == newerpol.AccessRevokePending {
+		entry.Action = cdb.LedgerRevoke
+	}
+	return entry
+}
+
+// grantEmail returns the options for the email notifying the user of a
+// finished grant
+func grantEmail(accessRecord newerpol.AccessRecord, site *cdb.Site) *email.EmailOptions {
+	emailOpts := &email.EmailOptions{
+		FirstName: accessRecord.FirstName,
+		EmailName: accessRecord.LookupName,
+		Email:     accessRecord.Email,
+		CSP:       accessRecord.CSP,
+		Folder:    site.Name(),
+	}
+
+	switch accessRecord.RequestStatus {
+	case newerpol.AccessGrantPending:
+		emailOpts.Subject = "Website Access Granted"
+		emailOpts.Type = "granted"
+	case newerpol.AccessRevokePending:
+		emailOpts.Subject = "Website Access Removed"
+		emailOpts.Type = "revoked"
+	}
+
+	return emailOpts
+}
+
+// plannedEmails returns the emails which would be sent for grants finished
+// by a sync
+func plannedEmails(grants []newerpol.AccessRecord) []*email.EmailOptions {
+	var emails []*email.EmailOptions
+	if syncOpts.noEmail {
+		return emails
+	}
+	for _, accessRecord := range grants {
+		site, err := cdb.GetSiteById(accessRecord.WebsiteId)
+		if err != nil || site == nil {
+			continue
+		}
+		emailOpts := grantEmail(accessRecord, site)
+		if emailOpts.Email == "" {
+			continue
+		}
+		if syncOpts.recipientOverride != "" {
+			emailOpts.Email = syncOpts.recipientOverride
+		}
+		emails = append(emails, emailOpts)
+	}
+	return emails
+}
+
+// notifySiteAdmins emails the current admins of each site changed by the
+// sync a summary of who was added and removed, excluding anyone whose own
+// access changed
+func notifySiteAdmins(newerpolDb *sqlx.DB, events []plugins.Event) {
+	added := make(map[string][]string)
+	removed := make(map[string][]string)
+	var siteNames []string
+	for _, event := range events {
+		if len(added[event.Site]) == 0 && len(removed[event.Site]) == 0 {
+			siteNames = append(siteNames, event.Site)
+		}
+		if event.Action == "revoke" {
+			removed[event.Site] = append(removed[event.Site], event.Login)
+		} else {
+			added[event.Site] = append(added[event.Site], event.Login)
+		}
+	}
+
+	for _, name := range siteNames {
+		site, err := cdb.GetSiteByName(name)
+		if err != nil || site == nil {
+			log.Warnf("sync: Unable to load site %s - skipping site admin notification", name)
+			continue
+		}
+
+		// Logins are compared normalized, as admins may be written
+		// differently in the cdb and newerpol. Admins added or removed
+		// aren't notified, nor anyone twice.
+		skip := make(map[string]bool)
+		for _, login := range append(added[name], removed[name]...) {
+			skip[cdb.NormalizeLogin(login)] = true
+		}
+		var recipients []string
+		for _, login := range site.Admins {
+			login = cdb.NormalizeLogin(login)
+			if !skip[login] {
+				skip[login] = true
+				recipients = append(recipients, login)
+			}
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+
+		found, err := newerpol.LookupPeople(runCtx, newerpolDb, recipients)
+		if err != nil {
+			log.Warnf("sync: Unable to look up admins of %s - skipping site admin notification: %v", name, err)
+			continue
+		}
+		people := make(map[string]newerpol.Person)
+		for login, person := range found {
+			people[cdb.NormalizeLogin(login)] = person
+		}
+		for _, login := range recipients {
+			person, ok := people[login]
+			if !ok || person.Email == "" {
+				log.Warnf("sync: No email address for %s - skipping site admin notification", login)
+				continue
+			}
+			emailOpts := &email.EmailOptions{
+				FirstName: person.FirstName,
+				EmailName: person.LookupName,
+				Email:     person.Email,
+				CSP:       site.FullName,
+				Folder:    site.Name(),
+				Subject:   "Website Access Changes",
+				Type:      "membership",
+				Added:     added[name],
+				Removed:   removed[name],
+			}
+			if syncOpts.recipientOverride != "" {
+				emailOpts.Email = syncOpts.recipientOverride
+			}
+			if err := email.SendEmail(emailOpts); err != nil {
+				log.WithFields(log.Fields{
+					"emailOpts": emailOpts,
+				}).Warnf("sync: Error attempting to send email: %v", err)
+			}
+		}
+	}
 }
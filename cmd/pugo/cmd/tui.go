@@ -0,0 +1,570 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+	"github.com/icunion/pugo/progress"
+	"github.com/icunion/pugo/state"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Browse sites and pending grants interactively",
+	Long: `Present browsable lists of sites and pending grants with keyboard
+driven actions for viewing sites, adding and removing admins, approving
+individual grants and triggering a sync.
+
+Changes are committed in the same way as the equivalent CLI commands, and
+--dry-run and --no-push are honoured. The run lock is only taken while a
+change is made, so the TUI can be left open without holding up scheduled
+syncs, and sites are reloaded first in case another run changed them. Log
+output is held back while the TUI is running and written out when it exits.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runTui(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tuiCmd)
+}
+
+type tuiView int
+
+const (
+	tuiViewSites tuiView = iota
+	tuiViewSite
+	tuiViewGrants
+)
+
+// tuiGrant is a pending grant shown in the grants view
+type tuiGrant struct {
+	verb   string
+	record newerpol.AccessRecord
+	site   *cdb.Site
+}
+
+type tuiSitesMsg struct {
+	sites []*cdb.Site
+	err   error
+}
+
+type tuiGrantsMsg struct {
+	grants []tuiGrant
+	err    error
+}
+
+type tuiDoneMsg struct {
+	status string
+	err    error
+	// The sites as reloaded after the change, if they could be
+	sites []*cdb.Site
+}
+
+type tuiModel struct {
+	cmd *cobra.Command
+	// Connection to newerpol, made when first needed
+	db       *sqlx.DB
+	view     tuiView
+	sites    []*cdb.Site
+	grants   []tuiGrant
+	site     *cdb.Site
+	siteList table.Model
+	grantTab table.Model
+	// Prompt for an admin login, when prompting is set
+	prompting string
+	input     textinput.Model
+	// Pending confirmation, when confirmAction is set
+	confirmText   string
+	confirmAction tea.Cmd
+	busy          bool
+	status        string
+}
+
+func runTui(cmd *cobra.Command) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return fmt.Errorf("tui: Not running in a terminal")
+	}
+
+	// Hold back log output so it doesn't corrupt the display
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	progress.SetInteractive(false)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		os.Stderr.Write(logs.Bytes())
+	}()
+
+	input := textinput.New()
+	input.Placeholder = "login"
+
+	m := &tuiModel{
+		cmd:      cmd,
+		siteList: newTuiTable([]table.Column{{Title: "NAME", Width: 24}, {Title: "ID", Width: 6}, {Title: "FULL NAME", Width: 36}, {Title: "ADMINS", Width: 6}, {Title: "EXPIRY", Width: 10}}),
+		grantTab: newTuiTable([]table.Column{{Title: "ACCESS ID", Width: 9}, {Title: "ACTION", Width: 6}, {Title: "LOGIN", Width: 12}, {Title: "SITE", Width: 24}, {Title: "CSP", Width: 30}}),
+		input:    input,
+		status:   "Loading sites ...",
+	}
+
+	_, err := tea.NewProgram(m, tea.WithAltScreen()).Run()
+	if m.db != nil {
+		m.db.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("tui: %w", err)
+	}
+	return nil
+}
+
+func newTuiTable(columns []table.Column) table.Model {
+	t := table.New(table.WithColumns(columns), table.WithFocused(true))
+	styles := table.DefaultStyles()
+	styles.Header = styles.Header.Bold(true)
+	t.SetStyles(styles)
+	return t
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tuiLoadSites
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.siteList.SetHeight(msg.Height - 4)
+		m.grantTab.SetHeight(msg.Height - 4)
+		return m, nil
+
+	case tuiSitesMsg:
+		m.busy = false
+		if msg.err != nil {
+			m.status = fmt.Sprintf("Error loading sites: %v", msg.err)
+			return m, nil
+		}
+		m.sites = msg.sites
+		m.refreshSites()
+		m.status = fmt.Sprintf("%d sites", len(m.sites))
+		return m, nil
+
+	case tuiGrantsMsg:
+		m.busy = false
+		if msg.err != nil {
+			m.status = fmt.Sprintf("Error loading grants: %v", msg.err)
+			return m, nil
+		}
+		m.grants = msg.grants
+		rows := make([]table.Row, 0, len(m.grants))
+		for _, g := range m.grants {
+			rows = append(rows, table.Row{strconv.Itoa(g.record.AccessId), g.verb, g.record.Login, g.site.Name(), g.record.CSP})
+		}
+		m.grantTab.SetRows(rows)
+		m.status = fmt.Sprintf("%d pending grants", len(m.grants))
+		return m, nil
+
+	case tuiDoneMsg:
+		m.busy = false
+		if msg.err != nil {
+			m.status = fmt.Sprintf("Error: %v", msg.err)
+		} else {
+			m.status = msg.status
+		}
+		if msg.sites != nil {
+			m.sites = msg.sites
+			if m.site != nil {
+				for _, site := range m.sites {
+					if site.Id == m.site.Id {
+						m.site = site
+					}
+				}
+			}
+		}
+		m.refreshSites()
+		if m.view == tuiViewGrants {
+			m.busy = true
+			return m, m.loadGrants
+		}
+		return m, nil
+
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		if m.prompting != "" {
+			return m.updatePrompt(msg)
+		}
+		if m.confirmAction != nil {
+			action := m.confirmAction
+			m.confirmAction = nil
+			if msg.String() != "y" {
+				m.status = "Cancelled"
+				return m, nil
+			}
+			m.busy = true
+			m.status = "Working ..."
+			return m, action
+		}
+		if m.busy {
+			return m, nil
+		}
+		return m.updateKey(msg)
+	}
+
+	return m, nil
+}
+
+func (m *tuiModel) updateKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "q":
+		return m, tea.Quit
+	case "esc":
+		m.view = tuiViewSites
+		return m, nil
+	case "g":
+		m.view = tuiViewGrants
+		m.busy = true
+		m.status = "Loading pending grants ..."
+		return m, m.loadGrants
+	case "s":
+		m.confirmText = "Run a sync of all pending grants?"
+		m.confirmAction = func() tea.Msg { return m.locked(m.sync) }
+		return m, nil
+	}
+
+	switch m.view {
+	case tuiViewSites, tuiViewSite:
+		switch msg.String() {
+		case "enter":
+			if site := m.selectedSite(); site != nil {
+				m.site = site
+				m.view = tuiViewSite
+			}
+			return m, nil
+		case "a", "d":
+			if site := m.selectedSite(); site != nil {
+				m.site = site
+				m.prompting = msg.String()
+				m.input.SetValue("")
+				m.input.Focus()
+			}
+			return m, nil
+		case "r":
+			m.busy = true
+			m.status = "Reloading sites ..."
+			return m, tuiLoadSites
+		}
+		if m.view == tuiViewSites {
+			var cmd tea.Cmd
+			m.siteList, cmd = m.siteList.Update(msg)
+			return m, cmd
+		}
+
+	case tuiViewGrants:
+		switch msg.String() {
+		case "enter", "y":
+			if i := m.grantTab.Cursor(); i >= 0 && i < len(m.grants) {
+				g := m.grants[i]
+				m.confirmText = fmt.Sprintf("Approve grant %d (%s %s on %s)?", g.record.AccessId, g.verb, g.record.Login, g.site.Name())
+				m.confirmAction = func() tea.Msg {
+					return m.locked(func() tuiDoneMsg { return m.approveGrant(g) })
+				}
+			}
+			return m, nil
+		case "r":
+			m.busy = true
+			m.status = "Reloading pending grants ..."
+			return m, m.loadGrants
+		}
+		var cmd tea.Cmd
+		m.grantTab, cmd = m.grantTab.Update(msg)
+		return m, cmd
+	}
+
+	return m, nil
+}
+
+func (m *tuiModel) updatePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.prompting = ""
+		m.status = "Cancelled"
+		return m, nil
+	case "enter":
+		verb := m.prompting
+		login := strings.TrimSpace(m.input.Value())
+		site := m.site
+		m.prompting = ""
+		if login == "" {
+			m.status = "Cancelled"
+			return m, nil
+		}
+		m.busy = true
+		m.status = "Working ..."
+		return m, func() tea.Msg {
+			return m.locked(func() tuiDoneMsg { return tuiChangeAdmin(verb, site.Id, login) })
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+
+	switch m.view {
+	case tuiViewSites:
+		b.WriteString("Sites\n\n")
+		b.WriteString(m.siteList.View())
+	case tuiViewSite:
+		b.WriteString(fmt.Sprintf("Site %s\n\n", m.site.Name()))
+		b.WriteString(tuiSiteDetail(m.site))
+	case tuiViewGrants:
+		b.WriteString("Pending grants\n\n")
+		b.WriteString(m.grantTab.View())
+	}
+	b.WriteString("\n")
+
+	switch {
+	case m.prompting == "a":
+		b.WriteString(fmt.Sprintf("Add admin to %s: %s", m.site.Name(), m.input.View()))
+	case m.prompting == "d":
+		b.WriteString(fmt.Sprintf("Remove admin from %s: %s", m.site.Name(), m.input.View()))
+	case m.confirmAction != nil:
+		b.WriteString(m.confirmText + " [y/N]")
+	default:
+		b.WriteString(m.status)
+	}
+	b.WriteString("\n")
+
+	switch m.view {
+	case tuiViewGrants:
+		b.WriteString("enter approve • r reload • s sync • esc sites • q quit")
+	default:
+		b.WriteString("enter view • a add admin • d remove admin • r reload • g grants • s sync • esc back • q quit")
+	}
+
+	return b.String()
+}
+
+func (m *tuiModel) refreshSites() {
+	rows := make([]table.Row, 0, len(m.sites))
+	for _, site := range m.sites {
+		rows = append(rows, table.Row{site.Name(), strconv.Itoa(site.Id), site.FullName, strconv.Itoa(len(site.Admins)), site.Expiry})
+	}
+	m.siteList.SetRows(rows)
+}
+
+func (m *tuiModel) selectedSite() *cdb.Site {
+	if m.view == tuiViewSite {
+		return m.site
+	}
+	if i := m.siteList.Cursor(); i >= 0 && i < len(m.sites) {
+		return m.sites[i]
+	}
+	return nil
+}
+
+// locked makes a change holding the run lock, so it doesn't overlap another
+// run which changes the cdb or newerpol. Sites are discarded first, so the
+// change is made to them as they are now, and reloaded afterwards for the
+// views.
+func (m *tuiModel) locked(change func() tuiDoneMsg) tea.Msg {
+	release, err := state.AcquireRunLock(runId, m.cmd.CommandPath())
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	defer release()
+
+	cdb.Configure(&conf.Cdb)
+	done := change()
+	if msg, ok := tuiLoadSites().(tuiSitesMsg); ok && msg.err == nil {
+		done.sites = msg.sites
+	}
+	return done
+}
+
+// sync runs a sync of all pending grants as `pugo sync` would
+func (m *tuiModel) sync() tuiDoneMsg {
+	syncOpts = syncOptions{}
+	if err := doSync(m.cmd); err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	return tuiDoneMsg{status: "Sync complete"}
+}
+
+// approveGrant applies a single pending grant, commits it, finishes it in
+// newerpol and emails the user, as a sync would
+func (m *tuiModel) approveGrant(g tuiGrant) tuiDoneMsg {
+	site, err := cdb.GetSiteById(g.site.Id)
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	if site == nil {
+		return tuiDoneMsg{err: fmt.Errorf("Site %d not found in cdb - grant %d left pending", g.site.Id, g.record.AccessId)}
+	}
+	g.site = site
+
+	switch g.verb {
+	case "add":
+		g.site.AddAdmin(g.record.Login)
+	case "revoke":
+		if g.site.RemoveAdminChecked(g.record.Login) == cdb.AdminImmortal {
+			return tuiDoneMsg{err: fmt.Errorf("%s is an immortal admin of %s - grant %d left pending", g.record.Login, g.site.Name(), g.record.AccessId)}
+		}
+	}
+
+	message := fmt.Sprintf("Approve grant %d", g.record.AccessId)
+	if err := tuiCommit(g.site, message); err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	if globalOpts.dryRun {
+		return tuiDoneMsg{status: fmt.Sprintf("Dry run: grant %d not finished", g.record.AccessId)}
+	}
+
+	newerpolDb, err := m.newerpol()
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+
+	updated, err := g.record.FinishGrant(runCtx, newerpolDb)
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	if !updated {
+		return tuiDoneMsg{status: fmt.Sprintf("Grant %d was already finished", g.record.AccessId)}
+	}
+	runSummary.addGrantsProcessed(1)
+
+	emailOpts := grantEmail(g.record, g.site)
+	if emailOpts.Email == "" {
+		return tuiDoneMsg{status: fmt.Sprintf("Approved grant %d (no email address)", g.record.AccessId)}
+	}
+	if err := email.StartWorker(runCtx, &conf.Email); err != nil {
+		return tuiDoneMsg{status: fmt.Sprintf("Approved grant %d, but unable to send email: %v", g.record.AccessId, err)}
+	}
+	defer email.ShutdownWorker()
+	if err := email.SendEmail(emailOpts); err != nil {
+		return tuiDoneMsg{status: fmt.Sprintf("Approved grant %d, but unable to send email: %v", g.record.AccessId, err)}
+	}
+
+	return tuiDoneMsg{status: fmt.Sprintf("Approved grant %d", g.record.AccessId)}
+}
+
+// tuiChangeAdmin adds or removes an admin from a site and commits the change
+func tuiChangeAdmin(verb string, siteId int, login string) tuiDoneMsg {
+	site, err := cdb.GetSiteById(siteId)
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	if site == nil {
+		return tuiDoneMsg{err: fmt.Errorf("Site %d not found in cdb", siteId)}
+	}
+	changed, err := changeSiteAdmin(site, login, verb == "a", "", "tui")
+	if err != nil {
+		return tuiDoneMsg{err: err}
+	}
+	if !changed {
+		return tuiDoneMsg{status: fmt.Sprintf("%s: no change", site.Name())}
+	}
+	if verb == "a" {
+		return tuiDoneMsg{status: fmt.Sprintf("Added %s to %s", login, site.Name())}
+	}
+	return tuiDoneMsg{status: fmt.Sprintf("Removed %s from %s", login, site.Name())}
+}
+
+func tuiCommit(site *cdb.Site, message string) error {
+	commitOpts := &cdb.CommitSitesOptions{
+		Ids:             map[int]bool{site.Id: true},
+		Message:         message,
+		Cmd:             "tui",
+		DryRun:          globalOpts.dryRun,
+		ForceUpdateTree: globalOpts.forceUpdateTree,
+		NoPush:          globalOpts.noPush,
+	}
+	commitResult, err := cdb.CommitSites(runCtx, commitOpts)
+	runSummary.recordCommit(commitResult)
+	return err
+}
+
+func tuiLoadSites() tea.Msg {
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return tuiSitesMsg{err: err}
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name() < sites[j].Name()
+	})
+	return tuiSitesMsg{sites: sites}
+}
+
+// newerpol returns the connection to newerpol, connecting if necessary
+func (m *tuiModel) newerpol() (*sqlx.DB, error) {
+	if m.db == nil {
+		db, err := newerpol.Connect(runCtx, &conf.Newerpol)
+		if err != nil {
+			return nil, err
+		}
+		m.db = db
+	}
+	return m.db, nil
+}
+
+func (m *tuiModel) loadGrants() tea.Msg {
+	newerpolDb, err := m.newerpol()
+	if err != nil {
+		return tuiGrantsMsg{err: err}
+	}
+
+	opts := &newerpol.GetGrantsOptions{}
+	grants := make(map[string]map[int][]newerpol.AccessRecord)
+	if grants["add"], grants["revoke"], err = newerpol.GetGrants(runCtx, newerpolDb, opts); err != nil {
+		return tuiGrantsMsg{err: err}
+	}
+
+	var pending []tuiGrant
+	for _, verb := range []string{"add", "revoke"} {
+		for id, grantRecords := range grants[verb] {
+			site, err := cdb.GetSiteById(id)
+			if err != nil {
+				return tuiGrantsMsg{err: err}
+			}
+			if site == nil {
+				continue
+			}
+			for _, accessRecord := range grantRecords {
+				pending = append(pending, tuiGrant{verb: verb, record: accessRecord, site: site})
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].record.AccessId < pending[j].record.AccessId
+	})
+
+	return tuiGrantsMsg{grants: pending}
+}
+
+func tuiSiteDetail(site *cdb.Site) string {
+	detail := newSiteDetail(site)
+
+	var b strings.Builder
+	for _, row := range detail.Rows() {
+		fmt.Fprintf(&b, "%-16s %s\n", row[0], row[1])
+	}
+	return b.String()
+}
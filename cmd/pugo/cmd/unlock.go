@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icunion/pugo/state"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Remove the run lock left behind by a crashed run",
+	Long: `Remove the run lock and state file lock, for manual recovery after
+a crash. Locks left by dead processes on this host are broken automatically,
+so this is only needed when the lock was taken on another host (e.g. when the
+state and lock files are on shared storage).
+
+Refuses to remove a lock held by a process which is still running on this
+host unless --force is given.`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{annotationNoCdb: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doUnlock(cmd)
+	},
+}
+
+var unlockForce bool
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+
+	unlockCmd.Flags().BoolVar(&unlockForce, "force", false, "Remove the lock even if the process holding it is still running.")
+}
+
+func doUnlock(cmd *cobra.Command) error {
+	holder, err := state.ReadRunLock()
+	if err != nil {
+		log.Warnf("unlock: %v", err)
+	}
+
+	if holder == nil {
+		log.Info("unlock: Run lock not held")
+	} else {
+		if holder.Local() && !holder.Stale() && !unlockForce {
+			return fmt.Errorf("unlock: Run lock is held by %s, which is still running. Use --force to remove it anyway", holder)
+		}
+		proceed, err := confirm(fmt.Sprintf("This will remove the run lock held by %s.", holder))
+		if err != nil {
+			return fmt.Errorf("unlock: %w", err)
+		}
+		if !proceed {
+			log.Info("unlock: Aborted")
+			return nil
+		}
+	}
+
+	if err := state.Unlock(); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	log.Info("unlock: Locks removed")
+	return nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check every site file in the cdb can be loaded",
+	Long: `Load every site file in the cdb, listing those which can't be
+loaded along with the reason, and those with an invalid expiry date. Sites
+which have expired but still have admins, as pugo expire hasn't been run, are
+listed as warnings. The command exits with a non-zero status if there are any
+errors, for use as a check before committing hand edits or from monitoring.
+
+Read-only commands skip site files which can't be loaded, with a warning,
+while commands which change the cdb refuse to run until they are fixed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return validateSites(cmd)
+	},
+}
+
+// Levels of validate problems
+const (
+	validateError   = "error"
+	validateWarning = "warning"
+)
+
+// siteLoadError is a single row of validate output
+type siteLoadError struct {
+	File  string `json:"file" yaml:"file"`
+	Level string `json:"level" yaml:"level"`
+	Error string `json:"error" yaml:"error"`
+}
+
+type siteLoadErrors []siteLoadError
+
+func (e siteLoadErrors) Header() []string {
+	return []string{"FILE", "LEVEL", "ERROR"}
+}
+
+func (e siteLoadErrors) Rows() [][]string {
+	rows := make([][]string, 0, len(e))
+	for _, loadError := range e {
+		rows = append(rows, []string{loadError.File, loadError.Level, loadError.Error})
+	}
+	return rows
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func validateSites(cmd *cobra.Command) error {
+	sites, err := cdb.GetAllSites()
+	if err != nil {
+		return gitErrorf("validate: Getting all sites: %w", err)
+	}
+
+	loadErrors := cdb.LoadErrors()
+	result := make(siteLoadErrors, 0, len(loadErrors))
+	for _, loadError := range loadErrors {
+		result = append(result, siteLoadError{
+			File:  loadError.FileName,
+			Level: validateError,
+			Error: loadError.Error(),
+		})
+	}
+	invalid := 0
+	for _, site := range sites {
+		fn := path.Base(site.FileNameRepo())
+		if _, err := site.ExpiryTime(); err != nil {
+			result = append(result, siteLoadError{File: fn, Level: validateError, Error: err.Error()})
+			invalid++
+		} else if site.Expired() && !site.Disabled && len(site.Admins) > 0 {
+			result = append(result, siteLoadError{
+				File:  fn,
+				Level: validateWarning,
+				Error: fmt.Sprintf("expired on %s but still has admins", site.Expiry),
+			})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].File < result[j].File
+	})
+
+	if err := writeOutput(os.Stdout, result); err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+
+	if len(loadErrors) > 0 || invalid > 0 {
+		return newExitError(exitCheckFailed, "validate: %d of %d site files could not be loaded, %d have invalid expiry dates", len(loadErrors), len(sites)+len(loadErrors), invalid)
+	}
+	return nil
+}
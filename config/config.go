@@ -0,0 +1,402 @@
+// Package config loads the configuration for the cdb, newerpol, and email
+// into a typed Config. It is loaded and validated once when pugo starts, so
+// missing or malformed settings are reported before any work is done, and
+// passed explicitly to the packages which use it rather than each reading
+// viper.
+package config
+
+import (
+	"fmt"
+	"net/mail"
+	"runtime"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Newerpol Newerpol `mapstructure:"newerpol"`
+	Cdb      Cdb      `mapstructure:"cdb"`
+	Email    Email    `mapstructure:"email"`
+	Webhooks Webhooks `mapstructure:"webhooks"`
+	Serve    Serve    `mapstructure:"serve"`
+}
+
+// Newerpol is the connection to the newerpol database
+type Newerpol struct {
+	// Name identifying the newerpol instance in commit messages. The
+	// database name is used if empty.
+	Name     string `mapstructure:"name"`
+	Host     string `mapstructure:"host"`
+	Instance string `mapstructure:"instance"`
+	// Username and password for SQL Server authentication. Both are empty
+	// for integrated authentication.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Database string `mapstructure:"database"`
+}
+
+// Cdb is the location of the cdb working tree and how to commit to it
+type Cdb struct {
+	Path   string `mapstructure:"path"`
+	Branch string `mapstructure:"branch"`
+	Author Person `mapstructure:"author"`
+	// The remote pulled from and pushed to, and further remotes (names or
+	// URLs), such as mirrors, each commit is also pushed to
+	Remote      string   `mapstructure:"remote"`
+	PushRemotes []string `mapstructure:"push_remotes"`
+	// The branch sync commits to, to be reviewed and promoted to Branch
+	// with pugo promote. Sync commits to Branch if unset.
+	StagingBranch string `mapstructure:"staging_branch"`
+	// A bare clone to check out into a temporary worktree for each run,
+	// in place of a checkout at Path
+	Bare string `mapstructure:"bare"`
+	// Whether to clone URL into a temporary directory for each run, in
+	// place of a checkout at Path
+	Ephemeral bool   `mapstructure:"ephemeral"`
+	URL       string `mapstructure:"url"`
+	// Accepted in place of URL
+	RemoteURL string `mapstructure:"remote_url"`
+	// Credentials for pulling from and pushing to origin over HTTP(S)
+	Auth struct {
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+	} `mapstructure:"auth"`
+	// A GPG secret key file, exported with gpg --export-secret-keys, to
+	// sign commits with, and the passphrase protecting it if any
+	SigningKey        string `mapstructure:"signing_key"`
+	SigningPassphrase string `mapstructure:"signing_passphrase"`
+	// Where changes committed in review mode are proposed as a pull or
+	// merge request
+	Review Review `mapstructure:"review"`
+	// PHP versions sites may be set to use
+	PhpVersions []string `mapstructure:"php_versions"`
+	// Number of sites saved to the working tree at once
+	Concurrency int `mapstructure:"concurrency"`
+	// Values of fields which site files don't set
+	Defaults SiteDefaults `mapstructure:"defaults"`
+	// Whether fields in site files which don't exist are an error rather
+	// than being ignored
+	Strict bool `mapstructure:"strict"`
+	// Whether to record the command and run which last saved each site in
+	// its file
+	Provenance bool `mapstructure:"provenance"`
+	// How logins are normalized before being added to or removed from sites
+	Logins LoginNormalization `mapstructure:"logins"`
+	// The sites pugo may change, by name or id
+	ManagedSites ManagedSites `mapstructure:"managed_sites"`
+	// The source of changes recorded in commit messages, i.e. the newerpol
+	// name or database
+	Source string `mapstructure:"-"`
+}
+
+// Email is the SMTP server and the resources used to build messages
+type Email struct {
+	Host          string `mapstructure:"host"`
+	Port          int    `mapstructure:"port"`
+	Username      string `mapstructure:"username"`
+	Password      string `mapstructure:"password"`
+	ResourcesPath string `mapstructure:"resources_path"`
+	Sender        Person `mapstructure:"sender"`
+	// Whether site admins are notified when admins are added or removed
+	NotifySiteAdmins bool `mapstructure:"notify_site_admins"`
+	// Where messages which couldn't be sent are kept for resending
+	DeadLetterDir string `mapstructure:"dead_letter_dir"`
+}
+
+// Webhooks are the URLs events are posted to, and the secret their bodies
+// are signed with
+type Webhooks struct {
+	URLs   []string `mapstructure:"urls"`
+	Secret string   `mapstructure:"secret"`
+}
+
+// Serve is the clients of the pugo serve API, and what each may do
+type Serve struct {
+	// name=token strings, where the token may be a secret reference such
+	// as env:NAME
+	Tokens []string    `mapstructure:"tokens"`
+	Scopes ServeScopes `mapstructure:"scopes"`
+	Roles  ServeRoles  `mapstructure:"roles"`
+}
+
+// ServeScopes lists the names of the clients given each scope
+type ServeScopes struct {
+	// List sites, and show sites and their admins
+	Read []string `mapstructure:"read"`
+	// Trigger syncs
+	Sync []string `mapstructure:"sync"`
+	// Add and remove site admins
+	Admin []string `mapstructure:"admin"`
+}
+
+// ServeRoles lists the names of the clients given each role, which gives
+// the scopes needed to view sites (read), operate pugo (read and sync), or
+// administer sites (every scope)
+type ServeRoles struct {
+	Viewer   []string `mapstructure:"viewer"`
+	Operator []string `mapstructure:"operator"`
+	Admin    []string `mapstructure:"admin"`
+}
+
+// Review is the GitHub or GitLab project changes committed in review mode
+// are proposed to, as a pull or merge request into the cdb branch
+type Review struct {
+	// github or gitlab
+	Provider string `mapstructure:"provider"`
+	// The API's base URL, for GitHub Enterprise or a self-hosted GitLab.
+	// The public service's is used if empty.
+	APIURL string `mapstructure:"api_url"`
+	// owner/repo on GitHub, or the project's path or id on GitLab
+	Repo  string `mapstructure:"repo"`
+	Token string `mapstructure:"token"`
+	// Prefix of the names of branches committed to for review
+	BranchPrefix string `mapstructure:"branch_prefix"`
+}
+
+// SiteDefaults are the values of site fields which a site's file, and the
+// cdb's shared defaults file, don't set
+type SiteDefaults struct {
+	// true, false, or one of the PHP versions
+	Php       string `mapstructure:"php"`
+	Passenger bool   `mapstructure:"passenger"`
+	Subpaths  bool   `mapstructure:"subpaths"`
+	Disabled  bool   `mapstructure:"disabled"`
+}
+
+// PhpValue returns the default php field value: a boolean, or a version
+func (d *SiteDefaults) PhpValue() interface{} {
+	switch d.Php {
+	case "", "true":
+		return true
+	case "false":
+		return false
+	default:
+		return d.Php
+	}
+}
+
+// LoginNormalization is how logins are normalized, so that the same login
+// written differently isn't listed twice
+type LoginNormalization struct {
+	// Remove leading and trailing whitespace
+	Trim      bool `mapstructure:"trim"`
+	Lowercase bool `mapstructure:"lowercase"`
+	// Suffixes removed from the end of logins, e.g. @ic.ac.uk
+	StripSuffixes []string `mapstructure:"strip_suffixes"`
+}
+
+// ManagedSites restricts the sites pugo changes, protecting specially
+// managed sites from bulk changes and bad data in newerpol. Sites are given
+// by name or id.
+type ManagedSites struct {
+	// If not empty, only these sites are changed
+	Allow []string `mapstructure:"allow"`
+	// These sites are never changed
+	Deny []string `mapstructure:"deny"`
+}
+
+type Person struct {
+	Name  string `mapstructure:"name"`
+	Email string `mapstructure:"email"`
+}
+
+func init() {
+	viper.SetDefault("cdb.branch", "master")
+	viper.SetDefault("cdb.author.name", "pugo")
+	viper.SetDefault("cdb.author.email", "pugo@example.com")
+	viper.SetDefault("cdb.php_versions", []string{"7.4", "8.0", "8.1", "8.2", "8.3"})
+	viper.SetDefault("cdb.concurrency", runtime.NumCPU())
+	viper.SetDefault("cdb.strict", false)
+	viper.SetDefault("cdb.provenance", false)
+	viper.SetDefault("cdb.logins.trim", true)
+	viper.SetDefault("cdb.logins.lowercase", false)
+	viper.SetDefault("cdb.logins.strip_suffixes", []string{})
+	viper.SetDefault("cdb.managed_sites.allow", []string{})
+	viper.SetDefault("cdb.managed_sites.deny", []string{})
+	viper.SetDefault("cdb.remote", "origin")
+	viper.SetDefault("cdb.push_remotes", []string{})
+	viper.SetDefault("cdb.review.branch_prefix", "pugo/")
+	viper.SetDefault("cdb.defaults.php", "true")
+	viper.SetDefault("cdb.defaults.passenger", false)
+	viper.SetDefault("cdb.defaults.subpaths", false)
+	viper.SetDefault("cdb.defaults.disabled", false)
+	viper.SetDefault("sync.full_scan_interval", "24h")
+	viper.SetDefault("probe.timeout", "10s")
+	viper.SetDefault("probe.concurrency", 10)
+	viper.SetDefault("confirm.expiry", "168h")
+	viper.SetDefault("email.host", "localhost")
+	viper.SetDefault("email.port", 25)
+	viper.SetDefault("email.resources_path", "~/pugo/res")
+	viper.SetDefault("email.sender.name", "pugo")
+	viper.SetDefault("email.sender.email", "pugo@example.com")
+}
+
+// Load reads the configuration from viper, i.e. the config file, environment,
+// and any flags bound to config keys, and validates it. If it is invalid the
+// loaded configuration is returned along with the error so that commands
+// which fix the configuration can still run.
+func Load() (*Config, error) {
+	c := &Config{}
+	if err := viper.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	c.Cdb.Source = c.Newerpol.Name
+	if c.Cdb.URL == "" {
+		c.Cdb.URL = c.Cdb.RemoteURL
+	}
+	if c.Cdb.Source == "" {
+		c.Cdb.Source = c.Newerpol.Database
+	}
+
+	var err error
+	if c.Cdb.Path, err = homedir.Expand(c.Cdb.Path); err != nil {
+		return c, fmt.Errorf("config: cdb.path: %v", err)
+	}
+	if c.Cdb.Bare, err = homedir.Expand(c.Cdb.Bare); err != nil {
+		return c, fmt.Errorf("config: cdb.bare: %v", err)
+	}
+	if c.Cdb.SigningKey, err = homedir.Expand(c.Cdb.SigningKey); err != nil {
+		return c, fmt.Errorf("config: cdb.signing_key: %v", err)
+	}
+	if c.Email.ResourcesPath, err = homedir.Expand(c.Email.ResourcesPath); err != nil {
+		return c, fmt.Errorf("config: email.resources_path: %v", err)
+	}
+
+	return c, c.Validate()
+}
+
+// Validate checks required settings are present, values are well formed, and
+// settings don't conflict. All problems are reported together.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	required := func(key string, value string) {
+		if value == "" {
+			problem("%s is required", key)
+		}
+	}
+	email := func(key string, value string) {
+		if _, err := mail.ParseAddress(value); err != nil {
+			problem("%s '%s' is not a valid email address", key, value)
+		}
+	}
+
+	required("newerpol.host", c.Newerpol.Host)
+	required("newerpol.database", c.Newerpol.Database)
+	if (c.Newerpol.Username == "") != (c.Newerpol.Password == "") {
+		problem("newerpol.username and newerpol.password must be set together")
+	}
+
+	switch {
+	case c.Cdb.Ephemeral:
+		required("cdb.url", c.Cdb.URL)
+		if c.Cdb.Bare != "" {
+			problem("cdb.bare and cdb.ephemeral can't both be set")
+		}
+	case c.Cdb.Bare == "":
+		required("cdb.path", c.Cdb.Path)
+	}
+	if c.Cdb.RemoteURL != "" && c.Cdb.RemoteURL != c.Cdb.URL {
+		problem("cdb.url and cdb.remote_url must not both be set")
+	}
+	required("cdb.branch", c.Cdb.Branch)
+	required("cdb.remote", c.Cdb.Remote)
+	if contains(c.Cdb.PushRemotes, c.Cdb.Remote) {
+		problem("cdb.push_remotes must not include cdb.remote '%s'", c.Cdb.Remote)
+	}
+	if c.Cdb.StagingBranch != "" && c.Cdb.StagingBranch == c.Cdb.Branch {
+		problem("cdb.staging_branch must differ from cdb.branch")
+	}
+	if c.Cdb.StagingBranch != "" && (c.Cdb.Bare != "" || c.Cdb.Ephemeral) {
+		problem("cdb.staging_branch can't be used with cdb.bare or cdb.ephemeral")
+	}
+	required("cdb.author.name", c.Cdb.Author.Name)
+	email("cdb.author.email", c.Cdb.Author.Email)
+	if c.Cdb.Auth.Username == "" && c.Cdb.Auth.Password != "" {
+		problem("cdb.auth.password is set without cdb.auth.username")
+	}
+	if c.Cdb.SigningKey == "" && c.Cdb.SigningPassphrase != "" {
+		problem("cdb.signing_passphrase is set without cdb.signing_key")
+	}
+	switch c.Cdb.Review.Provider {
+	case "":
+	case "github", "gitlab":
+		required("cdb.review.repo", c.Cdb.Review.Repo)
+		required("cdb.review.token", c.Cdb.Review.Token)
+	default:
+		problem("cdb.review.provider '%s' must be github or gitlab", c.Cdb.Review.Provider)
+	}
+	if len(c.Cdb.PhpVersions) == 0 {
+		problem("cdb.php_versions must list at least one version")
+	}
+	if c.Cdb.Concurrency < 1 {
+		problem("cdb.concurrency must be at least 1")
+	}
+	if php, ok := c.Cdb.Defaults.PhpValue().(string); ok && !contains(c.Cdb.PhpVersions, php) {
+		problem("cdb.defaults.php '%s' must be true, false, or one of cdb.php_versions", php)
+	}
+
+	required("email.host", c.Email.Host)
+	if c.Email.Port < 1 || c.Email.Port > 65535 {
+		problem("email.port %d is not a valid port", c.Email.Port)
+	}
+	if c.Email.Username == "" && c.Email.Password != "" {
+		problem("email.password is set without email.username")
+	}
+	required("email.resources_path", c.Email.ResourcesPath)
+	email("email.sender.email", c.Email.Sender.Email)
+
+	// Receivers can't verify events signed without a secret
+	if len(c.Webhooks.URLs) > 0 {
+		required("webhooks.secret", c.Webhooks.Secret)
+	}
+
+	// Tokens are never included in problems, as they may be reported
+	clients := make(map[string]bool)
+	for i, token := range c.Serve.Tokens {
+		name, value, ok := strings.Cut(token, "=")
+		switch {
+		case !ok || name == "" || value == "":
+			problem("serve.tokens item %d must be of the form name=token", i+1)
+		case clients[name]:
+			problem("serve.tokens has more than one token for %s", name)
+		}
+		clients[name] = true
+	}
+	for _, scope := range []struct {
+		key   string
+		names []string
+	}{
+		{"serve.scopes.read", c.Serve.Scopes.Read},
+		{"serve.scopes.sync", c.Serve.Scopes.Sync},
+		{"serve.scopes.admin", c.Serve.Scopes.Admin},
+		{"serve.roles.viewer", c.Serve.Roles.Viewer},
+		{"serve.roles.operator", c.Serve.Roles.Operator},
+		{"serve.roles.admin", c.Serve.Roles.Admin},
+	} {
+		for _, name := range scope.names {
+			if !clients[name] {
+				problem("%s names %s, which has no token in serve.tokens", scope.key, name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config: Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
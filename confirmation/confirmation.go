@@ -0,0 +1,214 @@
+// Package confirmation records grants awaiting confirmation by the person
+// being granted access, who confirms by following a link emailed to them.
+// Each confirmation is a JSON file in confirm.dir named by its token, so
+// pugo serve, which records confirmations, and sync, which then applies the
+// grants, share them without further coordination. Links are single use and
+// expire after confirm.expiry, and expired confirmations are removed by
+// Prune.
+package confirmation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+type Confirmation struct {
+	Token     string    `json:"token"`
+	AccessId  int       `json:"access_id"`
+	WebsiteId int       `json:"website_id"`
+	Site      string    `json:"site"`
+	Login     string    `json:"login"`
+	Created   time.Time `json:"created"`
+	// When the person confirmed, nil until they do
+	Confirmed *time.Time `json:"confirmed,omitempty"`
+}
+
+// Tokens are 32 hex digits, which also keeps them safe to use as file names
+var tokenRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Dir returns the directory confirmations are kept in: confirm.dir from
+// config, or .pugo-confirmations in the user's home directory
+func Dir() (string, error) {
+	if dir := viper.GetString("confirm.dir"); dir != "" {
+		return homedir.Expand(dir)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("confirmation: %v", err)
+	}
+	return filepath.Join(home, ".pugo-confirmations"), nil
+}
+
+// New creates and saves a confirmation for a grant
+func New(accessId, websiteId int, site, login string) (*Confirmation, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("confirmation: Generating token: %v", err)
+	}
+	c := &Confirmation{
+		Token:     hex.EncodeToString(b),
+		AccessId:  accessId,
+		WebsiteId: websiteId,
+		Site:      site,
+		Login:     login,
+		Created:   time.Now(),
+	}
+	return c, c.save()
+}
+
+// Get returns the confirmation with the given token, or nil if there is none
+func Get(token string) (*Confirmation, error) {
+	if !tokenRegexp.MatchString(token) {
+		return nil, nil
+	}
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	return load(filepath.Join(dir, token+".json"))
+}
+
+// ForAccessIds returns the confirmations for the given grants, keyed by
+// access id. Expired confirmations are left out, so a new one is sent.
+func ForAccessIds(accessIds []int) (map[int]*Confirmation, error) {
+	wanted := make(map[int]bool)
+	for _, id := range accessIds {
+		wanted[id] = true
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("confirmation: %v", err)
+	}
+	confirmations := make(map[int]*Confirmation)
+	for _, fn := range matches {
+		c, err := load(fn)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil && wanted[c.AccessId] && !c.Expired() {
+			confirmations[c.AccessId] = c
+		}
+	}
+	return confirmations, nil
+}
+
+// Prune removes expired confirmations, e.g. for grants which were never
+// confirmed or were withdrawn, returning how many were removed
+func Prune() (int, error) {
+	dir, err := Dir()
+	if err != nil {
+		return 0, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, fmt.Errorf("confirmation: %v", err)
+	}
+	removed := 0
+	for _, fn := range matches {
+		c, err := load(fn)
+		if err != nil {
+			return removed, err
+		}
+		if c == nil || !c.Expired() {
+			continue
+		}
+		if err := c.Remove(); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Expired reports whether the confirmation is older than confirm.expiry:
+// its link if it hasn't been confirmed, or its confirmation if the grant
+// hasn't been applied since. A zero confirm.expiry never expires them.
+func (c *Confirmation) Expired() bool {
+	expiry := viper.GetDuration("confirm.expiry")
+	if expiry <= 0 {
+		return false
+	}
+	if c.Confirmed != nil {
+		return time.Since(*c.Confirmed) > expiry
+	}
+	return time.Since(c.Created) > expiry
+}
+
+// URL returns the link the person follows to confirm, under serve.base_url
+func (c *Confirmation) URL() string {
+	return strings.TrimSuffix(viper.GetString("serve.base_url"), "/") + "/confirm/" + c.Token
+}
+
+// Confirm records that the person has confirmed
+func (c *Confirmation) Confirm() error {
+	now := time.Now()
+	c.Confirmed = &now
+	return c.save()
+}
+
+// Remove deletes the confirmation once its grant has been applied
+func (c *Confirmation) Remove() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, c.Token+".json")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("confirmation: %v", err)
+	}
+	return nil
+}
+
+// save writes the confirmation atomically, so readers never see a partial
+// file
+func (c *Confirmation) save() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("confirmation: %v", err)
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("confirmation: Marshalling %s: %v", c.Token, err)
+	}
+	fn := filepath.Join(dir, c.Token+".json")
+	if err := ioutil.WriteFile(fn+".tmp", append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("confirmation: Writing %s: %v", fn, err)
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		return fmt.Errorf("confirmation: Replacing %s: %v", fn, err)
+	}
+	return nil
+}
+
+func load(fn string) (*Confirmation, error) {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("confirmation: Reading %s: %v", fn, err)
+	}
+	c := &Confirmation{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("confirmation: Unmarshalling %s: %v", fn, err)
+	}
+	return c, nil
+}
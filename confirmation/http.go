@@ -0,0 +1,80 @@
+package confirmation
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler serves the confirmation pages under /confirm/<token>. Following
+// the link shows a page with a button, and only submitting it confirms, so
+// mail scanners which fetch links don't confirm on the person's behalf. The
+// token is the only credential, so links stop working once used or expired.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/confirm/", handleConfirm)
+	return mux
+}
+
+type pageData struct {
+	Site      string
+	Login     string
+	Confirmed bool
+}
+
+func handleConfirm(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/confirm/")
+	c, err := Get(token)
+	if err != nil {
+		log.Warnf("confirmation: %v", err)
+		http.Error(w, "Unable to look up confirmation", http.StatusInternalServerError)
+		return
+	}
+	if c == nil || c.Expired() {
+		http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	if c.Confirmed != nil {
+		http.Error(w, "This link has already been used", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := c.Confirm(); err != nil {
+			log.Warnf("confirmation: %v", err)
+			http.Error(w, "Unable to record confirmation", http.StatusInternalServerError)
+			return
+		}
+		log.Infof("confirmation: %s confirmed access to %s (grant %d)", c.Login, c.Site, c.AccessId)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := pageData{Site: c.Site, Login: c.Login, Confirmed: c.Confirmed != nil}
+	if err := confirmPage.Execute(w, data); err != nil {
+		log.Warnf("confirmation: Executing page template: %v", err)
+	}
+}
+
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Confirm website access</title>
+<style>body { font-family: sans-serif; max-width: 40em; margin: 2em auto; }</style>
+</head>
+<body>
+<h1>Website access for {{ .Site }}</h1>
+{{ if .Confirmed }}<p>Thank you, {{ .Login }}. Your access to {{ .Site }} will be activated shortly, and you will receive an email when it is.</p>
+{{ else }}<p>Access to the {{ .Site }} website has been requested for {{ .Login }}. Please confirm this is you to activate it.</p>
+<form method="post"><button type="submit">Confirm access</button></form>
+{{ end }}</body>
+</html>
+`))
@@ -0,0 +1,204 @@
+// Package domains verifies that the external domains configured for sites
+// still point at union infrastructure. A domain is verified if its CNAME
+// matches one of domains.cnames or it resolves to an address in one of
+// domains.networks, and, if domains.probe.path is set, fetching that path
+// over HTTP returns domains.probe.token. Domains which no longer resolve have
+// lapsed, and those which resolve elsewhere may have been hijacked; either
+// way they should be removed from the cdb.
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Outcomes of verifying a domain
+const (
+	StatusOK          = "ok"
+	StatusLapsed      = "lapsed"
+	StatusForeign     = "foreign"
+	StatusProbeFailed = "probe-failed"
+	StatusError       = "error"
+)
+
+// The most of a probe response read when looking for the token
+const maxProbeBody = 64 * 1024
+
+type Verifier struct {
+	// CNAME targets belonging to the union. A domain whose canonical name
+	// is a target or a subdomain of one is verified.
+	CNAMEs []string
+	// Networks containing union web servers
+	Networks []*net.IPNet
+	// If set, http://<domain><ProbePath> must return a body containing
+	// ProbeToken
+	ProbePath  string
+	ProbeToken string
+	// How long to wait for each domain's lookups and probe
+	Timeout  time.Duration
+	Resolver *net.Resolver
+	Client   *http.Client
+}
+
+type Result struct {
+	Domain string
+	Status string
+	// Why the domain has the status, e.g. where it points instead
+	Detail string
+}
+
+func init() {
+	viper.SetDefault("domains.timeout", "10s")
+}
+
+// Configured returns a Verifier using the configured CNAME targets, networks,
+// and probe. It returns an error if neither CNAME targets nor networks are
+// configured, as every domain would fail.
+func Configured() (*Verifier, error) {
+	v := &Verifier{
+		CNAMEs:     viper.GetStringSlice("domains.cnames"),
+		ProbePath:  viper.GetString("domains.probe.path"),
+		ProbeToken: viper.GetString("domains.probe.token"),
+		Timeout:    viper.GetDuration("domains.timeout"),
+		Resolver:   net.DefaultResolver,
+		Client:     http.DefaultClient,
+	}
+	for _, cidr := range viper.GetStringSlice("domains.networks") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("domains: domains.networks: %v", err)
+		}
+		v.Networks = append(v.Networks, network)
+	}
+	if len(v.CNAMEs) == 0 && len(v.Networks) == 0 {
+		return nil, errors.New("domains: domains.cnames or domains.networks must be configured")
+	}
+	if v.ProbePath != "" && v.ProbeToken == "" {
+		return nil, errors.New("domains: domains.probe.token must be set with domains.probe.path")
+	}
+	return v, nil
+}
+
+// Verify checks whether domain points at union infrastructure
+func (v *Verifier) Verify(ctx context.Context, domain string) Result {
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	result := Result{Domain: domain}
+
+	cname, err := v.Resolver.LookupCNAME(ctx, domain)
+	if err != nil {
+		return lookupFailed(result, err)
+	}
+	cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+	ours := v.ourCNAME(cname)
+
+	addrs, err := v.Resolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return lookupFailed(result, err)
+	}
+	for _, addr := range addrs {
+		if v.ourAddress(addr.IP) {
+			ours = true
+		}
+	}
+
+	if !ours {
+		result.Status = StatusForeign
+		result.Detail = describeTarget(domain, cname, addrs)
+		return result
+	}
+
+	if v.ProbePath != "" {
+		if err := v.probe(ctx, domain); err != nil {
+			result.Status = StatusProbeFailed
+			result.Detail = err.Error()
+			return result
+		}
+	}
+
+	result.Status = StatusOK
+	result.Detail = describeTarget(domain, cname, addrs)
+	return result
+}
+
+func (v *Verifier) ourCNAME(cname string) bool {
+	for _, target := range v.CNAMEs {
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		if cname == target || strings.HasSuffix(cname, "."+target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Verifier) ourAddress(ip net.IP) bool {
+	for _, network := range v.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe fetches the probe path from domain, checking the token is returned
+func (v *Verifier) probe(ctx context.Context, domain string) error {
+	url := "http://" + domain + v.ProbePath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), v.ProbeToken) {
+		return fmt.Errorf("%s didn't return the probe token", url)
+	}
+	return nil
+}
+
+func lookupFailed(result Result, err error) Result {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		result.Status = StatusLapsed
+		result.Detail = "no such host"
+		return result
+	}
+	result.Status = StatusError
+	result.Detail = err.Error()
+	return result
+}
+
+// describeTarget describes where a domain points, for reports
+func describeTarget(domain string, cname string, addrs []net.IPAddr) string {
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	target := strings.Join(ips, ",")
+	if cname != "" && cname != strings.ToLower(strings.TrimSuffix(domain, ".")) {
+		target = cname + " (" + target + ")"
+	}
+	return target
+}
@@ -0,0 +1,237 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/retry"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/gomail.v2"
+)
+
+// DeadLetter is a message which couldn't be sent, even after retrying. Each
+// is kept as a JSON file in the dead letter directory until it is sent with
+// Resend, so delivery failures can be recovered without re-running the
+// command which sent them.
+type DeadLetter struct {
+	// The file name, without .json
+	Id string `json:"-"`
+	// The envelope sender and recipients
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Failed  time.Time `json:"failed"`
+	Error   string    `json:"error"`
+	// The number of times sending has failed
+	Attempts int `json:"attempts"`
+	// The run which first tried to send the message
+	RunId string `json:"run_id,omitempty"`
+	// The message as sent, headers and body
+	Message []byte `json:"message"`
+
+	path string
+}
+
+// DeadLetterDir returns the directory messages which couldn't be sent are
+// kept in: email.dead_letter_dir, or .pugo-dead-letters in the user's home
+// directory
+func DeadLetterDir(conf *config.Email) (string, error) {
+	if conf.DeadLetterDir != "" {
+		return homedir.Expand(conf.DeadLetterDir)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("email: %v", err)
+	}
+	return filepath.Join(home, ".pugo-dead-letters"), nil
+}
+
+// ListDeadLetters returns the messages in the dead letter directory, oldest
+// first
+func ListDeadLetters(conf *config.Email) ([]*DeadLetter, error) {
+	dir, err := DeadLetterDir(conf)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("email: %v", err)
+	}
+
+	var letters []*DeadLetter
+	for _, fn := range matches {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("email: Reading dead letter: %v", err)
+		}
+		l := &DeadLetter{}
+		if err := json.Unmarshal(data, l); err != nil {
+			return nil, fmt.Errorf("email: Reading dead letter %s: %v", fn, err)
+		}
+		l.Id = strings.TrimSuffix(filepath.Base(fn), ".json")
+		l.path = fn
+		letters = append(letters, l)
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Failed.Before(letters[j].Failed)
+	})
+	return letters, nil
+}
+
+// Remove deletes the message from the dead letter directory
+func (l *DeadLetter) Remove() error {
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("email: Removing dead letter %s: %v", l.Id, err)
+	}
+	return nil
+}
+
+func (l *DeadLetter) write() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("email: Marshalling dead letter: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return fmt.Errorf("email: %v", err)
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("email: Writing dead letter: %v", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("email: Writing dead letter: %v", err)
+	}
+	return nil
+}
+
+// deadLetter writes a message which couldn't be sent to the dead letter
+// directory. Failure to do so is logged, as the message is lost anyway.
+func deadLetter(msg *gomail.Message, sendErr error) {
+	if err := writeDeadLetter(msg, sendErr); err != nil {
+		log.Warnf("email: Unable to keep message to %s for resending: %v", msg.GetHeader("To")[0], err)
+	}
+}
+
+func writeDeadLetter(msg *gomail.Message, sendErr error) error {
+	dir, err := DeadLetterDir(worker.conf)
+	if err != nil {
+		return err
+	}
+
+	l := &DeadLetter{
+		Subject:  msg.GetHeader("Subject")[0],
+		Failed:   time.Now(),
+		Error:    sendErr.Error(),
+		Attempts: 1,
+		RunId:    runId,
+	}
+	from, err := mail.ParseAddress(msg.GetHeader("From")[0])
+	if err != nil {
+		return fmt.Errorf("email: Parsing sender: %v", err)
+	}
+	l.From = from.Address
+	for _, header := range msg.GetHeader("To") {
+		to, err := mail.ParseAddressList(header)
+		if err != nil {
+			return fmt.Errorf("email: Parsing recipients: %v", err)
+		}
+		for _, addr := range to {
+			l.To = append(l.To, addr.Address)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return fmt.Errorf("email: Writing message: %v", err)
+	}
+	l.Message = buf.Bytes()
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("email: %v", err)
+	}
+	l.Id = l.Failed.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+	l.path = filepath.Join(dir, l.Id+".json")
+	if err := l.write(); err != nil {
+		return err
+	}
+	log.Infof("email: Kept message to %s as dead letter %s for resending", strings.Join(l.To, ", "), l.Id)
+	return nil
+}
+
+// Resend sends messages from the dead letter directory, removing each once
+// sent. Messages which fail again are kept with the new error. Returns the
+// number sent.
+func Resend(ctx context.Context, conf *config.Email, letters []*DeadLetter) (int, error) {
+	d := dialer(conf)
+	policy := retry.PolicyFor(retry.SMTP, smtpRetryable)
+	var s gomail.SendCloser
+	open := false
+	defer func() {
+		if open {
+			s.Close()
+		}
+	}()
+
+	sent := 0
+	for _, l := range letters {
+		if err := ctx.Err(); err != nil {
+			return sent, fmt.Errorf("email: Resending: %w", err)
+		}
+		to := strings.Join(l.To, ", ")
+		err := policy.Do(ctx, "email to "+to, func(ctx context.Context) error {
+			var err error
+			if !open {
+				s, err = d.Dial()
+				if err != nil {
+					return fmt.Errorf("Error dialing smtp: %w", err)
+				}
+				open = true
+			}
+			log.Infof("email: Resending %s to %s", l.Id, to)
+			if err = s.Send(l.From, l.To, bytes.NewReader(l.Message)); err == nil {
+				return nil
+			}
+			s.Close()
+			open = false
+			return fmt.Errorf("Error sending message: %w", err)
+		})
+		if err != nil {
+			log.Warnf("email: Resending %s to %s: %v", l.Id, to, err)
+			atomic.AddInt64(&worker.failed, 1)
+			l.Failed = time.Now()
+			l.Error = err.Error()
+			l.Attempts++
+			if err := l.write(); err != nil {
+				log.Warn(err)
+			}
+			continue
+		}
+
+		sent++
+		atomic.AddInt64(&worker.sent, 1)
+		audit.Record(audit.Event{
+			Action: audit.ActionEmailSent,
+			Detail: fmt.Sprintf("%s: %s (resent %s)", to, l.Subject, l.Id),
+		})
+		if err := l.Remove(); err != nil {
+			log.Warn(err)
+		}
+	}
+	return sent, nil
+}
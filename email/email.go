@@ -2,14 +2,24 @@ package email
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"path"
+	"io"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/progress"
+	"github.com/icunion/pugo/retry"
+	"github.com/icunion/pugo/tracing"
+
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"gopkg.in/gomail.v2"
 )
 
@@ -26,70 +36,115 @@ type EmailOptions struct {
 	Folder string
 	// Subject of the email
 	Subject string
-	// The type of email to send. Should be one of "granted", "revoked", or "test"
+	// The type of email to send. Should be one of "granted", "revoked",
+	// "confirm", "membership", "php-migration", "over-quota", or "test"
 	Type string
+	// For membership emails, the logins added to and removed from the site
+	Added   []string
+	Removed []string
+	// For php-migration emails, the site's previous and new PHP versions
+	PhpFrom string
+	PhpTo   string
+	// For over-quota emails, the space used by the site and its quota, in
+	// MiB
+	Size  int
+	Quota int
+	// For confirm emails, the link to follow to confirm access
+	ConfirmURL string
+}
+
+type ReportOptions struct {
+	// The email addresses to send to
+	Recipients []string
+	// Subject of the email
+	Subject string
+	// HTML body of the email
+	Body string
+	// Files to attach, keyed by file name
+	Attachments map[string][]byte
 }
 
 type templateData struct {
-	Name   string
-	CSP    string
-	Folder string
+	Name    string
+	CSP     string
+	Folder  string
+	Added   []string
+	Removed []string
+	PhpFrom string
+	PhpTo   string
+	Size    int
+	Quota   int
+	// The link for confirm emails
+	ConfirmURL string
 }
 
 type workerStruct struct {
+	ctx     context.Context
+	conf    *config.Email
 	msgChan chan *gomail.Message
 	wg      sync.WaitGroup
 	started bool
+	sent    int64
+	failed  int64
 }
 
 var worker workerStruct
 
+// The id of the pugo run, sent in the X-Pugo-Run-Id header, see SetRunId
+var runId string
+
+var errWorkerNotStarted = errors.New("email: Send worker not started")
+
 var allowedTypes = map[string]bool{
-	"granted": true,
-	"revoked": true,
-	"test":    true,
+	"granted":       true,
+	"revoked":       true,
+	"confirm":       true,
+	"membership":    true,
+	"php-migration": true,
+	"over-quota":    true,
+	"test":          true,
 }
 
 func init() {
-	viper.SetDefault("email.host", "localhost")
-	viper.SetDefault("email.port", 25)
-	viper.SetDefault("email.resources_path", "~/pugo/res")
-	viper.SetDefault("email.sender.name", "pugo")
-	viper.SetDefault("email.sender.email", "pugo@example.com")
-
 	worker = workerStruct{
+		ctx:     context.Background(),
 		msgChan: make(chan *gomail.Message, 5),
 	}
 }
 
-func StartWorker() error {
+// StartWorker starts the background worker which sends queued messages using
+// the given SMTP server and sender. Messages which can't be sent are kept in
+// the dead letter directory, as are any still queued if ctx is cancelled and
+// the worker stops.
+func StartWorker(ctx context.Context, conf *config.Email) error {
 	log.Debug("email: Starting send worker ...")
 	if worker.started {
 		log.Debug("email: Send worker already running")
 		return nil
 	}
 
-	d := &gomail.Dialer{
-		Host: viper.GetString("email.host"),
-		Port: viper.GetInt("email.port"),
-	}
-	if smtpUsername := viper.GetString("email.username"); smtpUsername != "" {
-		d.Username = smtpUsername
-		d.Password = viper.GetString("email.password")
-	}
-
-	if s, err := d.Dial(); err != nil {
+	d := dialer(conf)
+	policy := retry.PolicyFor(retry.SMTP, smtpRetryable)
+	err := policy.Do(ctx, "smtp dial", func(ctx context.Context) error {
+		s, err := d.Dial()
+		if err != nil {
+			return err
+		}
+		return s.Close()
+	})
+	if err != nil {
 		return fmt.Errorf("email: Error dialing smtp: %v", err)
-	} else {
-		s.Close()
 	}
 
+	worker.ctx = ctx
+	worker.conf = conf
 	worker.started = true
 	worker.wg.Add(1)
 	go func(d *gomail.Dialer) {
 		var s gomail.SendCloser
 		var err error
 		open := false
+		sent := progress.New("email: Sending", 0)
 
 		log.Info("email: Send worker started")
 		for {
@@ -97,21 +152,66 @@ func StartWorker() error {
 			case msg, ok := <-worker.msgChan:
 				if !ok {
 					log.Info("email: Send worker stopped")
+					sent.Finish()
 					worker.started = false
 					worker.wg.Done()
 					return
 				}
-				if !open {
-					if s, err = d.Dial(); err != nil {
-						log.Warnf("email: Sending to %s: Error dialing smtp: %v", msg.GetHeader("To")[0], err)
-						break
+				to := msg.GetHeader("To")[0]
+				err = policy.Do(ctx, "email to "+to, func(ctx context.Context) error {
+					var err error
+					if !open {
+						_, span := tracing.Start(ctx, "email.dial")
+						s, err = d.Dial()
+						tracing.End(span, &err)
+						if err != nil {
+							return fmt.Errorf("Error dialing smtp: %w", err)
+						}
+						open = true
+					}
+					log.Infof("email: Sending to %s", to)
+					rs := &recordingSender{SendCloser: s}
+					_, span := tracing.Start(ctx, "email.send")
+					err = gomail.Send(rs, msg)
+					tracing.End(span, &err)
+					if err == nil {
+						return nil
+					}
+					// Redial for any retry in case the error left the
+					// connection unusable
+					s.Close()
+					open = false
+					if rs.err == nil {
+						// The message itself is invalid
+						return retry.Permanent(fmt.Errorf("Error sending message: %v", err))
 					}
-					open = true
+					return fmt.Errorf("Error sending message: %w", rs.err)
+				})
+				if err != nil {
+					log.Warnf("email: Sending to %s: %v", to, err)
+					atomic.AddInt64(&worker.failed, 1)
+					deadLetter(msg, err)
+				} else {
+					sent.Add(1)
+					atomic.AddInt64(&worker.sent, 1)
+					audit.Record(audit.Event{
+						Action: audit.ActionEmailSent,
+						Detail: fmt.Sprintf("%s: %s", to, msg.GetHeader("Subject")[0]),
+					})
 				}
-				log.Infof("email: Sending to %s", msg.GetHeader("To")[0])
-				if err := gomail.Send(s, msg); err != nil {
-					log.Warnf("email: Sending to %s: Error sending message: %v", msg.GetHeader("To")[0], err)
+			case <-ctx.Done():
+				log.Warnf("email: Send worker stopped: %v. %d queued messages kept for resending", ctx.Err(), len(worker.msgChan))
+				atomic.AddInt64(&worker.failed, int64(len(worker.msgChan)))
+				for n := len(worker.msgChan); n > 0; n-- {
+					deadLetter(<-worker.msgChan, ctx.Err())
 				}
+				if open {
+					s.Close()
+				}
+				sent.Finish()
+				worker.started = false
+				worker.wg.Done()
+				return
 			// In the unlikely event we're running for a long
 			// time and no email is sent for more than 10
 			// seconds, close the connection
@@ -130,18 +230,57 @@ func StartWorker() error {
 	return nil
 }
 
+// dialer returns the dialer for the SMTP server in conf
+func dialer(conf *config.Email) *gomail.Dialer {
+	d := &gomail.Dialer{
+		Host: conf.Host,
+		Port: conf.Port,
+	}
+	if conf.Username != "" {
+		d.Username = conf.Username
+		d.Password = conf.Password
+	}
+	return d
+}
+
+// ShutdownWorker waits for queued messages to be sent and stops the worker.
+// The worker may be started again afterwards. It does nothing if the worker
+// isn't running, so may be deferred as well as called explicitly.
 func ShutdownWorker() {
+	if !worker.started {
+		return
+	}
 	close(worker.msgChan)
 	worker.wg.Wait()
+	worker.msgChan = make(chan *gomail.Message, 5)
+}
+
+// Stats returns the number of messages sent successfully and the number
+// which failed to send since the program started
+func Stats() (sent int, failed int) {
+	return int(atomic.LoadInt64(&worker.sent)), int(atomic.LoadInt64(&worker.failed))
+}
+
+// Types returns the types of email which can be sent, sorted by name
+func Types() []string {
+	types := make([]string, 0, len(allowedTypes))
+	for t := range allowedTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
 }
 
 func SendEmail(opts *EmailOptions) error {
 	if !allowedTypes[opts.Type] {
 		return fmt.Errorf("email: Unknown message type %s", opts.Type)
 	}
+	if worker.conf == nil {
+		return errWorkerNotStarted
+	}
 
 	msg := gomail.NewMessage()
-	msg.SetAddressHeader("From", viper.GetString("email.sender.email"), viper.GetString("email.sender.name"))
+	msg.SetAddressHeader("From", worker.conf.Sender.Email, worker.conf.Sender.Name)
 	msg.SetAddressHeader("To", opts.Email, opts.EmailName)
 	msg.SetHeader("Subject", opts.Subject)
 	msg.Embed(resourcePath("img", "sysheader.jpg"))
@@ -155,9 +294,17 @@ func SendEmail(opts *EmailOptions) error {
 	bodyBuff := new(bytes.Buffer)
 
 	data := templateData{
-		Name:   opts.FirstName,
-		CSP:    opts.CSP,
-		Folder: opts.Folder,
+		Name:    opts.FirstName,
+		CSP:     opts.CSP,
+		Folder:  opts.Folder,
+		Added:   opts.Added,
+		Removed: opts.Removed,
+		PhpFrom: opts.PhpFrom,
+		PhpTo:   opts.PhpTo,
+		Size:    opts.Size,
+		Quota:   opts.Quota,
+
+		ConfirmURL: opts.ConfirmURL,
 	}
 
 	if err := tpl.ExecuteTemplate(bodyBuff, opts.Type, data); err != nil {
@@ -166,12 +313,56 @@ func SendEmail(opts *EmailOptions) error {
 
 	msg.SetBody("text/html", bodyBuff.String())
 
-	worker.msgChan <- msg
+	return enqueue(msg)
+}
+
+// SendReport sends a report with the given body and attachments to a list
+// of recipients, rather than a templated message to a single user
+func SendReport(opts *ReportOptions) error {
+	if len(opts.Recipients) == 0 {
+		return fmt.Errorf("email: No recipients for report")
+	}
+	if worker.conf == nil {
+		return errWorkerNotStarted
+	}
+
+	msg := gomail.NewMessage()
+	msg.SetAddressHeader("From", worker.conf.Sender.Email, worker.conf.Sender.Name)
+	msg.SetHeader("To", opts.Recipients...)
+	msg.SetHeader("Subject", opts.Subject)
+	msg.SetBody("text/html", opts.Body)
+	for name, data := range opts.Attachments {
+		data := data
+		msg.Attach(name, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}))
+	}
+
+	return enqueue(msg)
+}
+
+// SetRunId sets the id of the pugo run sent in the X-Pugo-Run-Id header of
+// every email, so a message can be traced back to the run which sent it
+func SetRunId(id string) {
+	runId = id
+}
+
+// enqueue passes a message to the send worker
+func enqueue(msg *gomail.Message) error {
+	if runId != "" {
+		msg.SetHeader("X-Pugo-Run-Id", runId)
+	}
+	select {
+	case worker.msgChan <- msg:
+	case <-worker.ctx.Done():
+		return fmt.Errorf("email: Not sending to %s: %v", msg.GetHeader("To")[0], worker.ctx.Err())
+	}
 
 	return nil
 }
 
 func resourcePath(elements ...string) string {
-	elements = append([]string{viper.GetString("email.resources_path")}, elements...)
-	return path.Join(elements...)
+	elements = append([]string{worker.conf.ResourcesPath}, elements...)
+	return filepath.Join(elements...)
 }
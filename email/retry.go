@@ -0,0 +1,32 @@
+package email
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+
+	"gopkg.in/gomail.v2"
+)
+
+// recordingSender records the error returned by the underlying sender, which
+// gomail.Send only returns formatted as a string
+type recordingSender struct {
+	gomail.SendCloser
+	err error
+}
+
+func (s *recordingSender) Send(from string, to []string, msg io.WriterTo) error {
+	s.err = s.SendCloser.Send(from, to, msg)
+	return s.err
+}
+
+// smtpRetryable reports whether an SMTP error is worth retrying. Permanent
+// (5xx) replies such as an unknown recipient or failed authentication are
+// not; transient (4xx) replies and connection errors are.
+func smtpRetryable(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 == 4
+	}
+	return true
+}
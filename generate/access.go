@@ -0,0 +1,72 @@
+package generate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// Formats of access-control files generated from sites' admins
+const (
+	// A single Apache group file with a group per site
+	AccessHTGroup = "htgroup"
+	// A file per site of Apache Require directives
+	AccessRequire = "require"
+)
+
+// AccessFormats are the supported access-control formats
+var AccessFormats = []string{AccessHTGroup, AccessRequire}
+
+// accessPrincipals returns the principals allowed access to a site: those of
+// its admins and immortal admins
+func accessPrincipals(site *cdb.Site, principals *Principals) []string {
+	var allowed []string
+	for _, login := range siteLogins(site) {
+		allowed = append(allowed, principals.Principal(login))
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+// WriteHTGroup writes an Apache group file with a group for each site, named
+// after the site, whose members are its admins' principals. Sites without
+// admins, and disabled and expired sites, are omitted, as Apache rejects
+// empty groups.
+func WriteHTGroup(w io.Writer, sites []*cdb.Site, principals *Principals) error {
+	sorted := append([]*cdb.Site{}, sites...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+
+	if _, err := fmt.Fprintln(w, Header+" from the admins of each site"); err != nil {
+		return fmt.Errorf("generate: %v", err)
+	}
+	for _, site := range sorted {
+		allowed := accessPrincipals(site, principals)
+		if len(allowed) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", site.Name(), strings.Join(allowed, " ")); err != nil {
+			return fmt.Errorf("generate: %v", err)
+		}
+	}
+	return nil
+}
+
+// WriteRequire writes Apache Require directives allowing a site's admins'
+// principals. A site without admins, or which is disabled or expired, is
+// denied to everyone.
+func WriteRequire(w io.Writer, site *cdb.Site, principals *Principals) error {
+	directive := "Require all denied"
+	if allowed := accessPrincipals(site, principals); len(allowed) > 0 {
+		directive = "Require user " + strings.Join(allowed, " ")
+	}
+	_, err := fmt.Fprintf(w, Header+" from the admins of %s\n%s\n", site.Name(), directive)
+	if err != nil {
+		return fmt.Errorf("generate: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package generate
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// Formats of environment files generated from sites' env
+const (
+	// PHP-FPM pool directives, included in the site's pool
+	EnvFPM = "fpm"
+	// Apache SetEnv directives, e.g. for Passenger apps
+	EnvApache = "apache"
+	// A dotenv file of NAME="value" lines
+	EnvDotenv = "dotenv"
+)
+
+// EnvFormats are the supported environment file formats
+var EnvFormats = []string{EnvFPM, EnvApache, EnvDotenv}
+
+// EnvFileName returns the name of the environment file generated for a site
+// in format
+func EnvFileName(site *cdb.Site, format string) string {
+	if format == EnvDotenv {
+		return site.Name() + ".env"
+	}
+	return site.Name() + ".conf"
+}
+
+var envNameRegexp = regexp.MustCompile(cdb.EnvNamePattern)
+
+// WriteEnv writes a site's env in format. A file is written even if the env
+// is empty, so variables removed from the cdb are removed from the site.
+// Fails without writing anything if a variable's name isn't valid, as it
+// could otherwise inject directives into the file.
+func WriteEnv(w io.Writer, site *cdb.Site, format string) error {
+	var line string
+	switch format {
+	case EnvFPM:
+		line = "env[%s] = %s\n"
+	case EnvApache:
+		line = "SetEnv %s %s\n"
+	case EnvDotenv:
+		line = "%s=%s\n"
+	default:
+		return fmt.Errorf("generate: Unknown env format '%s', must be %s", format, strings.Join(EnvFormats, ", "))
+	}
+
+	names := make([]string, 0, len(site.Env))
+	for name := range site.Env {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("generate: %s has invalid env variable name '%s', must match %s", site.Name(), name, cdb.EnvNamePattern)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if _, err := fmt.Fprintf(w, Header+" from the env of %s\n", site.Name()); err != nil {
+		return fmt.Errorf("generate: %v", err)
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, line, name, quoteEnvValue(site.Env[name])); err != nil {
+			return fmt.Errorf("generate: %v", err)
+		}
+	}
+	return nil
+}
+
+var envValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// quoteEnvValue double quotes a value, escaping backslashes, quotes and line
+// breaks so it can't escape onto a line of its own
+func quoteEnvValue(value string) string {
+	return `"` + envValueReplacer.Replace(value) + `"`
+}
@@ -0,0 +1,7 @@
+// Package generate renders artefacts derived from the cdb, such as a
+// browsable directory of sites for the sysadmin portal, from templates
+package generate
+
+// Header starts the first line of every file generated from the cdb, so
+// generated files can be told apart from files written by hand
+const Header = "# Generated by pugo"
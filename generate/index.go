@@ -0,0 +1,149 @@
+package generate
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+)
+
+// Sites not associated with a CSP in newerpol are listed under this name
+const unmanagedCSP = "(Not managed in eActivities)"
+
+// Index is a directory of the sites in the cdb grouped by the CSP which owns
+// them, rendered with a template. Templates are executed with the Index as
+// their data.
+type Index struct {
+	Generated time.Time
+	CSPs      []IndexSection
+	Sites     int
+}
+
+type IndexSection struct {
+	CSP   string
+	Sites []IndexSite
+}
+
+type IndexSite struct {
+	Name     string
+	FullName string
+	// The site's external domains as https URLs, then its paths under the
+	// base URL
+	URLs []string
+	// The site's contact address: its display email if set, otherwise its
+	// email
+	Email    string
+	Disabled bool
+}
+
+// BuildIndex creates an index of sites, grouped using the CSP owning each
+// website. Paths are turned into URLs under baseURL, and omitted if it is
+// empty.
+func BuildIndex(sites []*cdb.Site, csps map[int]newerpol.WebsiteCSP, baseURL string) *Index {
+	index := &Index{Generated: time.Now()}
+
+	sections := make(map[string]*IndexSection)
+	for _, site := range sites {
+		cspName := unmanagedCSP
+		if csp, ok := csps[site.Id]; ok {
+			cspName = csp.CSP
+		}
+		section := sections[cspName]
+		if section == nil {
+			section = &IndexSection{CSP: cspName}
+			sections[cspName] = section
+		}
+
+		entry := IndexSite{
+			Name:     site.Name(),
+			FullName: site.FullName,
+			Email:    site.Email,
+			Disabled: site.Disabled,
+		}
+		if site.DisplayEmail != "" {
+			entry.Email = site.DisplayEmail
+		}
+		for _, domain := range site.DomainNames() {
+			entry.URLs = append(entry.URLs, "https://"+domain+"/")
+		}
+		if baseURL != "" {
+			for _, p := range site.Paths {
+				entry.URLs = append(entry.URLs, strings.TrimSuffix(baseURL, "/")+p)
+			}
+		}
+		section.Sites = append(section.Sites, entry)
+	}
+
+	for _, section := range sections {
+		sort.Slice(section.Sites, func(i, j int) bool {
+			return section.Sites[i].Name < section.Sites[j].Name
+		})
+		index.CSPs = append(index.CSPs, *section)
+		index.Sites += len(section.Sites)
+	}
+	sort.Slice(index.CSPs, func(i, j int) bool {
+		return index.CSPs[i].CSP < index.CSPs[j].CSP
+	})
+
+	return index
+}
+
+// Write renders the index with tmpl, or the default template if nil
+func (index *Index) Write(w io.Writer, tmpl *template.Template) error {
+	if tmpl == nil {
+		tmpl = defaultIndexTemplate
+	}
+	if err := tmpl.Execute(w, index); err != nil {
+		return fmt.Errorf("generate: Executing index template: %v", err)
+	}
+	return nil
+}
+
+// ParseTemplate reads an HTML template from a file
+func ParseTemplate(fn string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("generate: %v", err)
+	}
+	tmpl, err := template.New(fn).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("generate: Parsing %s: %v", fn, err)
+	}
+	return tmpl, nil
+}
+
+var defaultIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Student websites</title>
+<style>
+body { font-family: sans-serif; }
+nav ul { columns: 3; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+tr.disabled { color: #999; }
+</style>
+</head>
+<body>
+<h1>Student websites</h1>
+<p>{{ .Sites }} sites, generated {{ .Generated.Format "2006-01-02 15:04" }}.</p>
+<nav><ul>
+{{ range $i, $csp := .CSPs }}<li><a href="#csp-{{ $i }}">{{ $csp.CSP }}</a></li>
+{{ end }}</ul></nav>
+{{ range $i, $csp := .CSPs }}
+<h2 id="csp-{{ $i }}">{{ $csp.CSP }}</h2>
+<table>
+<tr><th>Site</th><th>Name</th><th>URLs</th><th>Contact</th></tr>
+{{ range $csp.Sites }}<tr{{ if .Disabled }} class="disabled"{{ end }}><td>{{ .Name }}{{ if .Disabled }} (disabled){{ end }}</td><td>{{ .FullName }}</td><td>{{ range .URLs }}<a href="{{ . }}">{{ . }}</a><br>{{ end }}</td><td>{{ if .Email }}<a href="mailto:{{ .Email }}">{{ .Email }}</a>{{ end }}</td></tr>
+{{ end }}</table>
+{{ end }}
+</body>
+</html>
+`))
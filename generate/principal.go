@@ -0,0 +1,43 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// The placeholder in a principal format replaced by the login
+const loginPlaceholder = "{login}"
+
+func init() {
+	viper.SetDefault("principals.format", loginPlaceholder)
+}
+
+// Principals maps college logins to the principals webservers authenticate
+// users as, e.g. login@IC.AC.UK for Kerberos or an eppn for Shibboleth
+type Principals struct {
+	format string
+}
+
+// NewPrincipals returns a mapping using format, in which {login} is
+// replaced by the login
+func NewPrincipals(format string) (*Principals, error) {
+	if !strings.Contains(format, loginPlaceholder) {
+		return nil, fmt.Errorf("generate: Principal format '%s' doesn't contain %s", format, loginPlaceholder)
+	}
+	return &Principals{format: format}, nil
+}
+
+// ConfiguredPrincipals returns the mapping configured in principals.format
+func ConfiguredPrincipals() (*Principals, error) {
+	return NewPrincipals(viper.GetString("principals.format"))
+}
+
+// Principal returns the principal for login
+func (p *Principals) Principal(login string) string {
+	if p == nil {
+		return login
+	}
+	return strings.ReplaceAll(p.format, loginPlaceholder, login)
+}
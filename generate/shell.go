@@ -0,0 +1,148 @@
+package generate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// Formats of shell access files generated from sites' admins
+const (
+	// A file per site of its admins' SSH keys, installed as the
+	// authorized_keys of the site's account
+	ShellAuthorizedKeys = "authorized-keys"
+	// A single map of each login to the sites they may reach over SFTP
+	ShellSFTPMap = "sftp-map"
+)
+
+// ShellFormats are the supported shell access formats
+var ShellFormats = []string{ShellAuthorizedKeys, ShellSFTPMap}
+
+// KeyStore holds the SSH public keys of logins, read from a directory of
+// <login>.pub files in authorized_keys format
+type KeyStore struct {
+	keys map[string][]string
+}
+
+// LoadKeyStore reads the keys in dir. Blank lines and comments are ignored,
+// and file names are normalized as logins are.
+func LoadKeyStore(dir string) (*KeyStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("generate: Key store: %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, fmt.Errorf("generate: %v", err)
+	}
+
+	ks := &KeyStore{keys: make(map[string][]string)}
+	for _, fn := range matches {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("generate: %v", err)
+		}
+		login := cdb.NormalizeLogin(strings.TrimSuffix(filepath.Base(fn), ".pub"))
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				ks.keys[login] = append(ks.keys[login], line)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("generate: Reading %s: %v", fn, err)
+		}
+	}
+	return ks, nil
+}
+
+// Keys returns the keys of login, if any
+func (ks *KeyStore) Keys(login string) []string {
+	return ks.keys[cdb.NormalizeLogin(login)]
+}
+
+// siteLogins returns the logins allowed access to a site, its admins and
+// immortal admins, sorted. Disabled and expired sites allow no one.
+func siteLogins(site *cdb.Site) []string {
+	if site.Disabled || site.Expired() {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var logins []string
+	for _, login := range append(append([]string{}, site.ImmortalAdmins...), site.Admins...) {
+		if login != "" && !seen[login] {
+			seen[login] = true
+			logins = append(logins, login)
+		}
+	}
+	sort.Strings(logins)
+	return logins
+}
+
+// WriteAuthorizedKeys writes the SSH keys of a site's admins in
+// authorized_keys format, each prefixed with options (e.g. restrict) if
+// given. Disabled and expired sites get no keys. Returns the admins who have
+// no keys in the store, who are left out.
+func WriteAuthorizedKeys(w io.Writer, site *cdb.Site, keys *KeyStore, options string) ([]string, error) {
+	if _, err := fmt.Fprintf(w, Header+" from the admins of %s\n", site.Name()); err != nil {
+		return nil, fmt.Errorf("generate: %v", err)
+	}
+	var missing []string
+	for _, login := range siteLogins(site) {
+		loginKeys := keys.Keys(login)
+		if len(loginKeys) == 0 {
+			missing = append(missing, login)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n", login); err != nil {
+			return nil, fmt.Errorf("generate: %v", err)
+		}
+		for _, key := range loginKeys {
+			if options != "" {
+				key = options + " " + key
+			}
+			if _, err := fmt.Fprintln(w, key); err != nil {
+				return nil, fmt.Errorf("generate: %v", err)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// WriteSFTPMap writes a line for each admin of any of sites, giving their
+// login followed by the names of the sites they may access, e.g. for an SFTP
+// server to chroot them to the sites' docroots. Disabled and expired sites
+// are left out.
+func WriteSFTPMap(w io.Writer, sites []*cdb.Site) error {
+	access := make(map[string][]string)
+	for _, site := range sites {
+		for _, login := range siteLogins(site) {
+			access[login] = append(access[login], site.Name())
+		}
+	}
+	logins := make([]string, 0, len(access))
+	for login := range access {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	if _, err := fmt.Fprintln(w, Header+" from the admins of each site"); err != nil {
+		return fmt.Errorf("generate: %v", err)
+	}
+	for _, login := range logins {
+		names := access[login]
+		sort.Strings(names)
+		if _, err := fmt.Fprintf(w, "%s %s\n", login, strings.Join(names, " ")); err != nil {
+			return fmt.Errorf("generate: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package hooks runs external commands configured for named points in a pugo
+// run (e.g. hooks.pre_commit), allowing deployments to wire in cache purges,
+// config reloads, or custom notifications. Each command is run with sh -c
+// and receives a JSON payload describing the run context on stdin.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Hook names
+const (
+	PreCommit = "pre_commit"
+	PostPush  = "post_push"
+	PostSync  = "post_sync"
+)
+
+// How long a single hook command may run for
+const hookTimeout = 5 * time.Minute
+
+var runInfo = map[string]interface{}{}
+
+// SetRunInfo sets fields included in the payload of every hook, such as the
+// run id and command
+func SetRunInfo(info map[string]interface{}) {
+	runInfo = info
+}
+
+// Commands returns the commands configured for a hook. The config value may
+// be a single command or a list of commands.
+func Commands(name string) []string {
+	switch v := viper.Get("hooks." + name).(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	default:
+		return viper.GetStringSlice("hooks." + name)
+	}
+}
+
+// Run runs the commands configured for hook name in order, passing payload
+// merged with the run info as JSON on stdin. Returns an error from the first
+// command which fails; later commands are not run.
+func Run(ctx context.Context, name string, payload map[string]interface{}) error {
+	commands := Commands(name)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	merged := map[string]interface{}{
+		"hook": name,
+	}
+	for k, v := range runInfo {
+		merged[k] = v
+	}
+	for k, v := range payload {
+		merged[k] = v
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("hooks: Marshalling %s payload: %v", name, err)
+	}
+
+	for _, command := range commands {
+		log.Infof("hooks: Running %s hook: %s", name, command)
+
+		cmdCtx, cancel := context.WithTimeout(ctx, hookTimeout)
+		c := exec.CommandContext(cmdCtx, "sh", "-c", command)
+		c.Stdin = bytes.NewReader(data)
+		c.Env = append(os.Environ(), "PUGO_HOOK="+name)
+		out, err := c.CombinedOutput()
+		cancel()
+
+		if len(out) > 0 {
+			log.WithFields(log.Fields{
+				"hook":    name,
+				"command": command,
+			}).Debugf("hooks: Output: %s", out)
+		}
+		if err != nil {
+			return fmt.Errorf("hooks: %s hook '%s' failed: %v", name, command, err)
+		}
+	}
+
+	return nil
+}
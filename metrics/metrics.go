@@ -0,0 +1,184 @@
+// Package metrics pushes metrics describing a pugo run at the end of the
+// run, for cron-driven invocations where there is no long running process to
+// scrape. Metrics can be pushed to a Prometheus pushgateway
+// (metrics.pushgateway) and/or a StatsD server (metrics.statsd).
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// How long to wait for each sink before giving up
+const pushTimeout = 10 * time.Second
+
+type Run struct {
+	// The command run, e.g. "sync" or "reset admins"
+	Command         string
+	Duration        time.Duration
+	ExitCode        int
+	SitesChanged    int
+	GrantsProcessed int
+	EmailsSent      int
+	EmailsFailed    int
+	Errors          int
+	Finished        time.Time
+
+	// How long loading the cdb took, by phase, if the run loaded every site
+	CdbLoaded      bool
+	CdbSites       int
+	CdbLoadScan    time.Duration
+	CdbLoadParse   time.Duration
+	CdbLoadIndex   time.Duration
+	CdbSlowestFile time.Duration
+}
+
+type metric struct {
+	name  string
+	help  string
+	value float64
+}
+
+func init() {
+	viper.SetDefault("metrics.prefix", "pugo")
+	viper.SetDefault("metrics.job", "pugo")
+}
+
+// Enabled reports whether any metrics sink is configured
+func Enabled() bool {
+	return viper.GetString("metrics.pushgateway") != "" || viper.GetString("metrics.statsd") != ""
+}
+
+// Push sends the metrics for a run to each configured sink. Errors from
+// each sink are combined.
+func Push(ctx context.Context, r *Run) error {
+	var errs []string
+	if gw := viper.GetString("metrics.pushgateway"); gw != "" {
+		if err := pushGateway(ctx, gw, r); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if addr := viper.GetString("metrics.statsd"); addr != "" {
+		if err := pushStatsd(addr, r); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("metrics: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *Run) metrics() []metric {
+	success := 0.0
+	if r.ExitCode == 0 {
+		success = 1
+	}
+	metrics := []metric{
+		{"run_duration_seconds", "Duration of the last run", r.Duration.Seconds()},
+		{"run_success", "Whether the last run succeeded", success},
+		{"run_exit_code", "Exit code of the last run", float64(r.ExitCode)},
+		{"run_finished_timestamp_seconds", "When the last run finished", float64(r.Finished.Unix())},
+		{"sites_changed", "Sites changed by the last run", float64(r.SitesChanged)},
+		{"grants_processed", "Grants finished by the last run", float64(r.GrantsProcessed)},
+		{"emails_sent", "Emails sent by the last run", float64(r.EmailsSent)},
+		{"emails_failed", "Emails which failed to send in the last run", float64(r.EmailsFailed)},
+		{"errors", "Errors in the last run", float64(r.Errors)},
+	}
+	if r.CdbLoaded {
+		metrics = append(metrics,
+			metric{"cdb_sites_loaded", "Sites loaded from the cdb by the last run", float64(r.CdbSites)},
+			metric{"cdb_load_duration_seconds", "Time taken to load the cdb in the last run", (r.CdbLoadScan + r.CdbLoadParse + r.CdbLoadIndex).Seconds()},
+			metric{"cdb_load_scan_duration_seconds", "Time taken to list the site files in the last run", r.CdbLoadScan.Seconds()},
+			metric{"cdb_load_parse_duration_seconds", "Time taken to read and parse the site files in the last run", r.CdbLoadParse.Seconds()},
+			metric{"cdb_load_index_duration_seconds", "Time taken to index the sites loaded in the last run", r.CdbLoadIndex.Seconds()},
+			metric{"cdb_load_slowest_file_duration_seconds", "Time taken to read and parse the slowest site file in the last run", r.CdbSlowestFile.Seconds()},
+		)
+	}
+	return metrics
+}
+
+// commandLabel returns the command as a single word, e.g. reset_admins
+func (r *Run) commandLabel() string {
+	return strings.ReplaceAll(strings.TrimSpace(r.Command), " ", "_")
+}
+
+// pushGateway replaces the metrics for the job and command in a Prometheus
+// pushgateway
+func pushGateway(ctx context.Context, gw string, r *Run) error {
+	prefix := viper.GetString("metrics.prefix")
+	var body bytes.Buffer
+	for _, m := range r.metrics() {
+		name := prefix + "_" + m.name
+		fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, m.help, name, name, formatValue(m.value))
+	}
+
+	u := fmt.Sprintf("%s/metrics/job/%s/command/%s", strings.TrimRight(gw, "/"),
+		url.PathEscape(viper.GetString("metrics.job")), url.PathEscape(r.commandLabel()))
+
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, &body)
+	if err != nil {
+		return fmt.Errorf("pushgateway: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushgateway: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway: %s returned %s", u, resp.Status)
+	}
+	return nil
+}
+
+// pushStatsd sends the metrics as StatsD gauges named
+// <prefix>.<command>.<metric>, with timers for durations and counters for
+// runs and failures
+func pushStatsd(addr string, r *Run) error {
+	conn, err := net.DialTimeout("udp", addr, pushTimeout)
+	if err != nil {
+		return fmt.Errorf("statsd: %v", err)
+	}
+	defer conn.Close()
+
+	prefix := viper.GetString("metrics.prefix") + "." + r.commandLabel() + "."
+	var lines []string
+	for _, m := range r.metrics() {
+		if strings.HasSuffix(m.name, "_duration_seconds") {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|ms", prefix, strings.TrimSuffix(m.name, "_seconds"), int64(math.Round(m.value*1000))))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s%s:%s|g", prefix, m.name, formatValue(m.value)))
+	}
+	lines = append(lines, prefix+"runs:1|c")
+	if r.ExitCode != 0 {
+		lines = append(lines, prefix+"failures:1|c")
+	}
+
+	// Send one metric per packet to stay within the UDP payload size
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return fmt.Errorf("statsd: %v", err)
+		}
+	}
+	return nil
+}
+
+// formatValue formats a value without an exponent, which not all StatsD
+// servers accept
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -1,13 +1,20 @@
 package newerpol
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
+	"sync"
+	"time"
+
+	"github.com/icunion/pugo/audit"
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/tracing"
 
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/jmoiron/sqlx"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type AccessRecord struct {
@@ -21,8 +28,63 @@ type AccessRecord struct {
 	CSP           string
 }
 
+type Person struct {
+	FirstName  string
+	LookupName string
+	Login      string
+	Email      string
+}
+
+type WebsiteCSP struct {
+	WebsiteId int
+	OCId      int
+	CSP       string
+	// The CSP's short code, if it has one
+	Code string
+}
+
+// HistoryRecord is a single access record with the times it was requested
+// and finished, for reporting on past grants and revocations
+type HistoryRecord struct {
+	AccessId      int
+	WebsiteId     int
+	RequestStatus int
+	CSP           string
+	SubmittedWhen sql.NullTime
+	GrantedWhen   sql.NullTime
+	RevokedWhen   sql.NullTime
+}
+
 type GetGrantsOptions struct {
+	// Include grants which have already been processed
 	IncludeNonPending bool
+	// If set, only return grants for the given website ids
+	WebsiteIds []int
+	// If set, only return grants for websites belonging to the given CSPs
+	// (identified by OCID)
+	OCIds []int
+	// If non-zero, only return grants submitted on or after this time
+	SubmittedSince time.Time
+	// If non-zero, only return grants with an access id greater than this
+	AfterAccessId int
+	// If non-zero, only return the grant with this access id
+	AccessId int
+	// If non-zero, only return grants changed since this SQL Server change
+	// tracking version, or listed in HeldAccessIds
+	ChangedSince int64
+	// With ChangedSince, grants to return even if unchanged, such as those
+	// left pending by the last sync
+	HeldAccessIds []int
+}
+
+// ChangeVersions are the SQL Server change tracking versions of
+// dbo.WebserverAccess
+type ChangeVersions struct {
+	// The version of the latest change committed
+	Current int64
+	// The oldest version changes are still retained since. Changes since an
+	// older version can't be queried.
+	MinValid int64
 }
 
 // These are the statuses from dbo.WebserverAccessStatii
@@ -58,6 +120,23 @@ const grantsLookupQuery = `SELECT dbo.WebserverAccess.ID AS accessid,
 		AND newer.SubmittedWhen > dbo.WebserverAccess.SubmittedWhen
 	)`
 
+// Every access record, including those for deleted websites, with the times
+// it was submitted, granted and revoked. Unlike grantsLookupQuery older
+// records superseded by newer ones are included, as each is a request made.
+const grantHistoryQuery = `SELECT dbo.WebserverAccess.ID AS accessid,
+	dbo.WebserverAccess.WebsiteId AS websiteid,
+	dbo.WebserverAccess.RequestStatus AS requeststatus,
+	dbo.AllCentres.Committee AS csp,
+	dbo.WebserverAccess.SubmittedWhen AS submittedwhen,
+	dbo.WebserverAccess.GrantedWhen AS grantedwhen,
+	dbo.WebserverAccess.RevokedWhen AS revokedwhen
+	FROM dbo.WebserverAccess
+	INNER JOIN dbo.Websites ON dbo.WebserverAccess.WebsiteID = dbo.Websites.ID
+	INNER JOIN dbo.AllCentres ON dbo.Websites.OCID = dbo.AllCentres.OCID`
+
+const changeVersionsQuery = `SELECT CHANGE_TRACKING_CURRENT_VERSION() AS currentversion,
+	CHANGE_TRACKING_MIN_VALID_VERSION(OBJECT_ID('dbo.WebserverAccess')) AS minvalidversion`
+
 const grantPendingToGrantedQuery = `UPDATE dbo.WebserverAccess SET RequestStatus = 2,
 	GrantedWhen = GETDATE()
 	WHERE dbo.WebserverAccess.ID = ?
@@ -72,127 +151,489 @@ const managedSitesLookupQuery = `SELECT dbo.Websites.ID AS id
 	FROM dbo.Websites
 	WHERE Deleted = 0`
 
-var grantPendingToGrantedQueryPrepared *sql.Stmt
-var revokePendingToRevokedQueryPrepared *sql.Stmt
+// The folder of each website managed in eActivities, which should be the
+// name of its site in the cdb
+const websiteFoldersLookupQuery = `SELECT dbo.Websites.ID AS websiteid,
+	dbo.Websites.Folder AS folder
+	FROM dbo.Websites
+	WHERE Deleted = 0`
+
+// Every website id ever allocated, including deleted websites
+const websiteIdsLookupQuery = `SELECT dbo.Websites.ID AS id
+	FROM dbo.Websites`
+
+const websiteCSPsLookupQuery = `SELECT dbo.Websites.ID AS websiteid,
+	dbo.AllCentres.OCID AS ocid,
+	dbo.AllCentres.Committee AS csp,
+	ISNULL(dbo.AllCentres.Code, '') AS code
+	FROM dbo.Websites
+	INNER JOIN dbo.AllCentres ON dbo.Websites.OCID = dbo.AllCentres.OCID
+	WHERE Deleted = 0`
+
+// Websites still managed in eActivities whose owning CSP is no longer active
+const inactiveCSPWebsitesLookupQuery = `SELECT dbo.Websites.ID AS websiteid,
+	dbo.AllCentres.OCID AS ocid,
+	dbo.AllCentres.Committee AS csp
+	FROM dbo.Websites
+	INNER JOIN dbo.AllCentres ON dbo.Websites.OCID = dbo.AllCentres.OCID
+	WHERE Deleted = 0
+	AND dbo.AllCentres.Active = 0`
+
+const peopleLookupQuery = `SELECT dbo.PeopleLookup.FName AS firstname,
+	dbo.PeopleLookup.LookupName AS lookupname,
+	dbo.PeopleLookup.Login AS login,
+	ISNULL(dbo.PeopleLookup.PrimaryEmail, '') AS email
+	FROM dbo.PeopleLookup
+	WHERE dbo.PeopleLookup.Login IN (?)`
+
+const accessStatusLookupQuery = `SELECT dbo.WebserverAccess.ID AS accessid,
+	dbo.WebserverAccess.RequestStatus AS requeststatus
+	FROM dbo.WebserverAccess
+	WHERE dbo.WebserverAccess.ID IN (?)`
+
+// Moves the latest record for a person and website from a finished state
+// back to the corresponding pending state
+const resetGrantQuery = `UPDATE dbo.WebserverAccess SET RequestStatus = ?,
+	GrantedWhen = CASE WHEN ? = 1 THEN NULL ELSE GrantedWhen END,
+	RevokedWhen = CASE WHEN ? = 3 THEN NULL ELSE RevokedWhen END
+	WHERE dbo.WebserverAccess.ID = (
+		SELECT TOP 1 latest.ID
+		FROM dbo.WebserverAccess latest
+		INNER JOIN dbo.PeopleLookup ON latest.PeopleId = dbo.PeopleLookup.ID
+		WHERE latest.WebsiteID = ?
+		AND dbo.PeopleLookup.Login = ?
+		ORDER BY latest.SubmittedWhen DESC
+	)
+	AND dbo.WebserverAccess.RequestStatus = ?`
+
+// Prepared statements, keyed by connection then query
+var prepared = make(map[*sqlx.DB]map[string]*sql.Stmt)
+var preparedMu sync.Mutex
+
+// Connect to the Newerpol database using the given connection settings
+func Connect(ctx context.Context, conf *config.Newerpol) (_ *sqlx.DB, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.Connect")
+	defer tracing.End(span, &err)
 
-// Connect to the Newerpol database using the Newerpol connection settings
-// from configuration
-func Connect() (*sqlx.DB, error) {
 	query := url.Values{}
-	query.Add("database", viper.GetString("newerpol.database"))
+	query.Add("database", conf.Database)
 
 	u := &url.URL{
 		Scheme:   "sqlserver",
-		User:     url.UserPassword(viper.GetString("newerpol.username"), viper.GetString("newerpol.password")),
-		Host:     viper.GetString("newerpol.host"),
-		Path:     viper.GetString("newerpol.instance"),
+		User:     url.UserPassword(conf.Username, conf.Password),
+		Host:     conf.Host,
+		Path:     conf.Instance,
 		RawQuery: query.Encode(),
 	}
 
-	return sqlx.Connect("sqlserver", u.String())
+	var db *sqlx.DB
+	err = retryPolicy().Do(ctx, "newerpol connect", func(ctx context.Context) error {
+		db, err = sqlx.ConnectContext(ctx, "sqlserver", u.String())
+		return err
+	})
+	return db, err
 }
 
-// Get grants to add
-func GetGrantsToAdd(db *sqlx.DB, opts *GetGrantsOptions) (map[int][]AccessRecord, error) {
-	accessRecordsByWebsite := make(map[int][]AccessRecord)
-
-	states := []int{AccessGrantPending}
+// GetGrants returns both the grants to add and the grants to remove, each
+// grouped by website id, fetching them with a single query
+func GetGrants(ctx context.Context, db *sqlx.DB, opts *GetGrantsOptions) (toAdd map[int][]AccessRecord, toRevoke map[int][]AccessRecord, err error) {
+	states := []int{AccessGrantPending, AccessRevokePending}
 	if opts.IncludeNonPending {
-		states = append(states, AccessGranted)
+		states = append(states, AccessGranted, AccessRevoked)
 	}
-	query, args, err := sqlx.In(grantsLookupQuery, states)
+	grants, err := lookupGrants(ctx, db, states, opts)
 	if err != nil {
-		return nil, fmt.Errorf("newerpol: Performing grantsLookupQuery IN subsitution: %v", err)
-	}
-	rows, err := db.Queryx(db.Rebind(query), args...)
-	if err != nil {
-		return nil, fmt.Errorf("newerpol: Performing grantsLookupQuery: %v", err)
+		return nil, nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var grant AccessRecord
-		if err = rows.StructScan(&grant); err != nil {
-			return nil, err
+	var adds, revokes []AccessRecord
+	for _, grant := range grants {
+		switch grant.RequestStatus {
+		case AccessGrantPending, AccessGranted:
+			adds = append(adds, grant)
+		case AccessRevokePending, AccessRevoked:
+			revokes = append(revokes, grant)
 		}
-		accessRecordsByWebsite[grant.WebsiteId] = append(accessRecordsByWebsite[grant.WebsiteId], grant)
 	}
-
-	return accessRecordsByWebsite, nil
+	return byWebsite(adds), byWebsite(revokes), nil
 }
 
-// Get grants to remove
-func GetGrantsToRevoke(db *sqlx.DB, opts *GetGrantsOptions) (map[int][]AccessRecord, error) {
+// byWebsite groups grants by website id
+func byWebsite(grants []AccessRecord) map[int][]AccessRecord {
 	accessRecordsByWebsite := make(map[int][]AccessRecord)
+	for _, grant := range grants {
+		accessRecordsByWebsite[grant.WebsiteId] = append(accessRecordsByWebsite[grant.WebsiteId], grant)
+	}
+	return accessRecordsByWebsite
+}
 
-	states := []int{AccessRevokePending}
-	if opts.IncludeNonPending {
-		states = append(states, AccessRevoked)
+// Look up grants in the given states, applying any restrictions from opts
+func lookupGrants(ctx context.Context, db *sqlx.DB, states []int, opts *GetGrantsOptions) (_ []AccessRecord, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.lookupGrants")
+	defer tracing.End(span, &err)
+
+	query := grantsLookupQuery
+	queryArgs := []interface{}{states}
+	if len(opts.WebsiteIds) > 0 {
+		query += "\n\tAND dbo.WebserverAccess.WebsiteID IN (?)"
+		queryArgs = append(queryArgs, opts.WebsiteIds)
+	}
+	if len(opts.OCIds) > 0 {
+		query += "\n\tAND dbo.AllCentres.OCID IN (?)"
+		queryArgs = append(queryArgs, opts.OCIds)
+	}
+	if !opts.SubmittedSince.IsZero() {
+		query += "\n\tAND dbo.WebserverAccess.SubmittedWhen >= ?"
+		queryArgs = append(queryArgs, opts.SubmittedSince)
+	}
+	if opts.AfterAccessId > 0 {
+		query += "\n\tAND dbo.WebserverAccess.ID > ?"
+		queryArgs = append(queryArgs, opts.AfterAccessId)
+	}
+	if opts.AccessId > 0 {
+		query += "\n\tAND dbo.WebserverAccess.ID = ?"
+		queryArgs = append(queryArgs, opts.AccessId)
+	}
+	if opts.ChangedSince == 0 {
+		return selectGrants(ctx, db, query, queryArgs)
+	}
+
+	// Grants changed since the version, then those held, in batches as
+	// there may be many. A grant may be both, so is only returned once
+	grants, err := selectGrants(ctx, db,
+		query+"\n\tAND dbo.WebserverAccess.ID IN (SELECT CT.ID FROM CHANGETABLE(CHANGES dbo.WebserverAccess, ?) AS CT)",
+		append(queryArgs, opts.ChangedSince))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool, len(grants))
+	for _, grant := range grants {
+		seen[grant.AccessId] = true
+	}
+	held := uniqueInts(opts.HeldAccessIds)
+	for start := 0; start < len(held); start += maxInParams {
+		batch := held[start:min(start+maxInParams, len(held))]
+		heldArgs := append(append([]interface{}{}, queryArgs...), batch)
+		rows, err := selectGrants(ctx, db, query+"\n\tAND dbo.WebserverAccess.ID IN (?)", heldArgs)
+		if err != nil {
+			return nil, err
+		}
+		for _, grant := range rows {
+			if !seen[grant.AccessId] {
+				seen[grant.AccessId] = true
+				grants = append(grants, grant)
+			}
+		}
 	}
-	query, args, err := sqlx.In(grantsLookupQuery, states)
+	return grants, nil
+}
+
+// selectGrants performs grantsLookupQuery, extended with restrictions, after
+// substituting any IN (?) lists in args
+func selectGrants(ctx context.Context, db *sqlx.DB, query string, queryArgs []interface{}) ([]AccessRecord, error) {
+	query, args, err := sqlx.In(query, queryArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("newerpol: Performing grantsLookupQuery IN subsitution: %v", err)
 	}
-	rows, err := db.Queryx(db.Rebind(query), args...)
+	var grants []AccessRecord
+	err = retryPolicy().Do(ctx, "newerpol grantsLookupQuery", func(ctx context.Context) error {
+		grants = nil
+		return db.SelectContext(ctx, &grants, db.Rebind(query), args...)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("newerpol: Performing grantsLookupQuery: %v", err)
 	}
-	defer rows.Close()
+	return grants, nil
+}
 
-	for rows.Next() {
-		var grant AccessRecord
-		if err = rows.StructScan(&grant); err != nil {
-			return nil, err
-		}
-		accessRecordsByWebsite[grant.WebsiteId] = append(accessRecordsByWebsite[grant.WebsiteId], grant)
+// GetGrantHistory returns the access records submitted, granted or revoked
+// since the given time, or every access record if since is zero
+func GetGrantHistory(ctx context.Context, db *sqlx.DB, since time.Time) (_ []HistoryRecord, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetGrantHistory")
+	defer tracing.End(span, &err)
+
+	query := grantHistoryQuery
+	var args []interface{}
+	if !since.IsZero() {
+		query += `
+	WHERE dbo.WebserverAccess.SubmittedWhen >= ?
+	OR dbo.WebserverAccess.GrantedWhen >= ?
+	OR dbo.WebserverAccess.RevokedWhen >= ?`
+		args = append(args, since, since, since)
 	}
 
-	return accessRecordsByWebsite, nil
+	var records []HistoryRecord
+	err = retryPolicy().Do(ctx, "newerpol grantHistoryQuery", func(ctx context.Context) error {
+		records = nil
+		return db.SelectContext(ctx, &records, db.Rebind(query), args...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing grantHistoryQuery: %v", err)
+	}
+	return records, nil
+}
+
+// GetChangeVersions returns the change tracking versions of
+// dbo.WebserverAccess, which are only available if change tracking is
+// enabled for the database and table
+func GetChangeVersions(ctx context.Context, db *sqlx.DB) (_ *ChangeVersions, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetChangeVersions")
+	defer tracing.End(span, &err)
+
+	var row struct {
+		CurrentVersion  sql.NullInt64
+		MinValidVersion sql.NullInt64
+	}
+	err = retryPolicy().Do(ctx, "newerpol changeVersionsQuery", func(ctx context.Context) error {
+		return db.GetContext(ctx, &row, changeVersionsQuery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing changeVersionsQuery: %v", err)
+	}
+	if !row.CurrentVersion.Valid || !row.MinValidVersion.Valid {
+		return nil, fmt.Errorf("newerpol: Change tracking isn't enabled for dbo.WebserverAccess")
+	}
+	return &ChangeVersions{Current: row.CurrentVersion.Int64, MinValid: row.MinValidVersion.Int64}, nil
 }
 
 // Get IDs of all sites managed in eActivities
-func GetManagedSiteIds(db *sqlx.DB) ([]int, error) {
+func GetManagedSiteIds(ctx context.Context, db *sqlx.DB) (_ []int, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetManagedSiteIds")
+	defer tracing.End(span, &err)
+
 	var siteIds []int
 
-	if err := db.Select(&siteIds, managedSitesLookupQuery); err != nil {
+	err = retryPolicy().Do(ctx, "newerpol managedSitesLookupQuery", func(ctx context.Context) error {
+		return db.SelectContext(ctx, &siteIds, managedSitesLookupQuery)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("newerpol: Performing managedSitesLookupQuery: %v", err)
 	}
 
 	return siteIds, nil
 }
 
+// Get the IDs of all websites in eActivities, including deleted ones
+func GetWebsiteIds(ctx context.Context, db *sqlx.DB) (_ []int, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetWebsiteIds")
+	defer tracing.End(span, &err)
+
+	var websiteIds []int
+
+	err = retryPolicy().Do(ctx, "newerpol websiteIdsLookupQuery", func(ctx context.Context) error {
+		return db.SelectContext(ctx, &websiteIds, websiteIdsLookupQuery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing websiteIdsLookupQuery: %v", err)
+	}
+
+	return websiteIds, nil
+}
+
+// Get the folder of each website managed in eActivities, keyed by website id
+func GetWebsiteFolders(ctx context.Context, db *sqlx.DB) (_ map[int]string, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetWebsiteFolders")
+	defer tracing.End(span, &err)
+
+	var rows []struct {
+		WebsiteId int
+		Folder    sql.NullString
+	}
+	err = retryPolicy().Do(ctx, "newerpol websiteFoldersLookupQuery", func(ctx context.Context) error {
+		rows = nil
+		return db.SelectContext(ctx, &rows, websiteFoldersLookupQuery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing websiteFoldersLookupQuery: %v", err)
+	}
+
+	folders := make(map[int]string)
+	for _, row := range rows {
+		folders[row.WebsiteId] = row.Folder.String
+	}
+
+	return folders, nil
+}
+
+// Get the logins currently granted access to each website, keyed by website
+// id
+func GetGrantedLogins(ctx context.Context, db *sqlx.DB) (_ map[int][]string, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetGrantedLogins")
+	defer tracing.End(span, &err)
+
+	grants, err := lookupGrants(ctx, db, []int{AccessGranted}, &GetGrantsOptions{})
+	if err != nil {
+		return nil, err
+	}
+	logins := make(map[int][]string)
+	for _, grant := range grants {
+		logins[grant.WebsiteId] = append(logins[grant.WebsiteId], grant.Login)
+	}
+	return logins, nil
+}
+
+// Get the CSP owning each website managed in eActivities, keyed by website id
+func GetWebsiteCSPs(ctx context.Context, db *sqlx.DB) (_ map[int]WebsiteCSP, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetWebsiteCSPs")
+	defer tracing.End(span, &err)
+
+	var rows []WebsiteCSP
+	err = retryPolicy().Do(ctx, "newerpol websiteCSPsLookupQuery", func(ctx context.Context) error {
+		return db.SelectContext(ctx, &rows, websiteCSPsLookupQuery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing websiteCSPsLookupQuery: %v", err)
+	}
+
+	csps := make(map[int]WebsiteCSP)
+	for _, row := range rows {
+		csps[row.WebsiteId] = row
+	}
+
+	return csps, nil
+}
+
+// Get the websites managed in eActivities whose CSP is no longer active,
+// keyed by website id
+func GetInactiveCSPWebsites(ctx context.Context, db *sqlx.DB) (_ map[int]WebsiteCSP, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetInactiveCSPWebsites")
+	defer tracing.End(span, &err)
+
+	var rows []WebsiteCSP
+	err = retryPolicy().Do(ctx, "newerpol inactiveCSPWebsitesLookupQuery", func(ctx context.Context) error {
+		return db.SelectContext(ctx, &rows, inactiveCSPWebsitesLookupQuery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Performing inactiveCSPWebsitesLookupQuery: %v", err)
+	}
+
+	csps := make(map[int]WebsiteCSP)
+	for _, row := range rows {
+		csps[row.WebsiteId] = row
+	}
+
+	return csps, nil
+}
+
+// Look up people by login. Logins not found in newerpol are omitted from the
+// returned map
+func LookupPeople(ctx context.Context, db *sqlx.DB, logins []string) (_ map[string]Person, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.LookupPeople", attribute.Int("logins", len(logins)))
+	defer tracing.End(span, &err)
+
+	people := make(map[string]Person)
+	logins = uniqueStrings(logins)
+	for start := 0; start < len(logins); start += maxInParams {
+		batch := logins[start:min(start+maxInParams, len(logins))]
+		query, args, err := sqlx.In(peopleLookupQuery, batch)
+		if err != nil {
+			return nil, fmt.Errorf("newerpol: Performing peopleLookupQuery IN subsitution: %v", err)
+		}
+		var rows []Person
+		err = retryPolicy().Do(ctx, "newerpol peopleLookupQuery", func(ctx context.Context) error {
+			rows = nil
+			return db.SelectContext(ctx, &rows, db.Rebind(query), args...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("newerpol: Performing peopleLookupQuery: %v", err)
+		}
+		for _, person := range rows {
+			people[person.Login] = person
+		}
+	}
+
+	return people, nil
+}
+
+// Look up the current status of access records by id. Records not found are
+// omitted from the returned map
+func GetAccessStatuses(ctx context.Context, db *sqlx.DB, accessIds []int) (_ map[int]int, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.GetAccessStatuses", attribute.Int("access_ids", len(accessIds)))
+	defer tracing.End(span, &err)
+
+	statuses := make(map[int]int)
+	accessIds = uniqueInts(accessIds)
+	for start := 0; start < len(accessIds); start += maxInParams {
+		batch := accessIds[start:min(start+maxInParams, len(accessIds))]
+		query, args, err := sqlx.In(accessStatusLookupQuery, batch)
+		if err != nil {
+			return nil, fmt.Errorf("newerpol: Performing accessStatusLookupQuery IN subsitution: %v", err)
+		}
+		var rows []AccessRecord
+		err = retryPolicy().Do(ctx, "newerpol accessStatusLookupQuery", func(ctx context.Context) error {
+			rows = nil
+			return db.SelectContext(ctx, &rows, db.Rebind(query), args...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("newerpol: Performing accessStatusLookupQuery: %v", err)
+		}
+		for _, row := range rows {
+			statuses[row.AccessId] = row.RequestStatus
+		}
+	}
+
+	return statuses, nil
+}
+
+// SQL Server allows at most 2100 parameters in a query, so lists of values
+// for IN (?) are queried in batches of at most maxInParams
+const maxInParams = 1000
+
+// uniqueStrings returns values without duplicates, in their original order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// uniqueInts returns values without duplicates, in their original order
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	unique := make([]int, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
 func (a *AccessRecord) IsPending() bool {
 	return a.RequestStatus == AccessGrantPending || a.RequestStatus == AccessRevokePending
 }
 
 // Move a grant from a pending state to a done state. Returns whether the grant updated and any error
-func (a *AccessRecord) FinishGrant(db *sqlx.DB) (bool, error) {
+func (a *AccessRecord) FinishGrant(ctx context.Context, db *sqlx.DB) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.FinishGrant", attribute.Int("access_id", a.AccessId))
+	defer tracing.End(span, &err)
+
 	if a.RequestStatus == AccessGranted || a.RequestStatus == AccessRevoked {
 		return false, fmt.Errorf("newerpol: Cannot finish grant, already in finished state: %+v", a)
 	}
 
-	var stmt *sql.Stmt
-	var err error
-
+	query := revokePendingToRevokedQuery
 	if a.RequestStatus == AccessGrantPending {
-		if grantPendingToGrantedQueryPrepared == nil {
-			grantPendingToGrantedQueryPrepared, err = db.Prepare(db.Rebind(grantPendingToGrantedQuery))
-			if err != nil {
-				return false, fmt.Errorf("newerpol: Preparing grantPendingToGrantedQuery: %v", err)
-			}
-		}
-		stmt = grantPendingToGrantedQueryPrepared
-	} else {
-		if revokePendingToRevokedQueryPrepared == nil {
-			revokePendingToRevokedQueryPrepared, err = db.Prepare(db.Rebind(revokePendingToRevokedQuery))
-			if err != nil {
-				return false, fmt.Errorf("newerpol: Preparing revokePendingToRevokedQuery: %v", err)
-			}
-		}
-		stmt = revokePendingToRevokedQueryPrepared
+		query = grantPendingToGrantedQuery
+	}
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return false, err
 	}
 
-	result, err := stmt.Exec(a.AccessId, a.RequestStatus)
+	// The update only matches a record still in its pending state, so is safe
+	// to retry
+	var result sql.Result
+	err = retryPolicy().Do(ctx, "newerpol finish grant", func(ctx context.Context) error {
+		result, err = stmt.ExecContext(ctx, a.AccessId, a.RequestStatus)
+		return err
+	})
 	if err != nil {
 		return false, fmt.Errorf("newerpol: Finishing grant %+v: %v", a, err)
 	}
@@ -200,5 +641,69 @@ func (a *AccessRecord) FinishGrant(db *sqlx.DB) (bool, error) {
 	if ra, _ := result.RowsAffected(); ra == 0 {
 		return false, nil
 	}
+	audit.Record(audit.Event{
+		Action: audit.ActionGrantFinish,
+		Login:  a.Login,
+		Detail: fmt.Sprintf("access id %d, website id %d, status %d", a.AccessId, a.WebsiteId, a.RequestStatus),
+	})
+	return true, nil
+}
+
+// ResetGrant moves the latest access record for login on a website from
+// finished back to pending so it will be processed by the next sync. If
+// granted is set a grant is reset, otherwise a revocation. Returns whether a
+// record was updated and any error
+func ResetGrant(ctx context.Context, db *sqlx.DB, websiteId int, login string, granted bool) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "newerpol.ResetGrant", attribute.Int("website_id", websiteId))
+	defer tracing.End(span, &err)
+
+	pending, finished := AccessRevokePending, AccessRevoked
+	if granted {
+		pending, finished = AccessGrantPending, AccessGranted
+	}
+
+	stmt, err := prepare(ctx, db, resetGrantQuery)
+	if err != nil {
+		return false, err
+	}
+	// As with FinishGrant the update only matches a record still in its
+	// finished state, so is safe to retry
+	var result sql.Result
+	err = retryPolicy().Do(ctx, "newerpol reset grant", func(ctx context.Context) error {
+		result, err = stmt.ExecContext(ctx, pending, pending, pending, websiteId, login, finished)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("newerpol: Resetting grant for %s on website %d: %v", login, websiteId, err)
+	}
+
+	if ra, _ := result.RowsAffected(); ra == 0 {
+		return false, nil
+	}
+	audit.Record(audit.Event{
+		Action: audit.ActionGrantReset,
+		Login:  login,
+		Detail: fmt.Sprintf("website id %d, status %d", websiteId, pending),
+	})
 	return true, nil
 }
+
+// prepare returns a prepared statement for query on db, preparing it the
+// first time it's used with that connection
+func prepare(ctx context.Context, db *sqlx.DB, query string) (*sql.Stmt, error) {
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+
+	if stmt, ok := prepared[db][query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, db.Rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("newerpol: Preparing query: %v", err)
+	}
+	if prepared[db] == nil {
+		prepared[db] = make(map[string]*sql.Stmt)
+	}
+	prepared[db][query] = stmt
+	return stmt, nil
+}
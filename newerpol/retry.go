@@ -0,0 +1,45 @@
+package newerpol
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/icunion/pugo/retry"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// SQL Server errors which are transient: deadlock victim, and the database
+// being unavailable, busy, or failing over
+var transientSQLErrors = map[int32]bool{
+	1205:  true,
+	4060:  true,
+	4221:  true,
+	40143: true,
+	40197: true,
+	40501: true,
+	40613: true,
+	49918: true,
+	49919: true,
+	49920: true,
+}
+
+// retryPolicy returns the policy for newerpol queries. Connection failures
+// and transient server errors are retried; other SQL errors are not.
+func retryPolicy() *retry.Policy {
+	return retry.PolicyFor(retry.Newerpol, retryable)
+}
+
+func retryable(err error) bool {
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) {
+		return transientSQLErrors[sqlErr.Number]
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
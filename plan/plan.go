@@ -0,0 +1,101 @@
+// Package plan describes the changes a pugo command intends to make, so
+// they can be saved during a dry run, reviewed, and later applied exactly.
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/email"
+	"github.com/icunion/pugo/newerpol"
+)
+
+// Version of the plan file format
+const Version = 1
+
+type Plan struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	RunId   string    `json:"run_id"`
+	// The command which made the plan (e.g. "sync")
+	Command string `json:"command"`
+	// The message snippet and command recorded in the cdb commit
+	Message string `json:"message"`
+	Cmd     string `json:"cmd"`
+	// Per-site field changes
+	Sites []SiteChange `json:"sites"`
+	// Grants to finish in newerpol once the changes are committed
+	Grants []newerpol.AccessRecord `json:"grants"`
+	// Emails to send once the grants are finished
+	Emails []*email.EmailOptions `json:"emails"`
+	// Why the changes need approval by a second sysadmin, and who made
+	// them. Plans needing approval can only be applied with pugo approve.
+	ApprovalReason string `json:"approval_reason,omitempty"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+type SiteChange struct {
+	Name    string            `json:"name"`
+	Id      int               `json:"id"`
+	Changes []cdb.FieldChange `json:"changes"`
+}
+
+// New creates an empty plan
+func New(runId, command, message, cmd string) *Plan {
+	return &Plan{
+		Version: Version,
+		Created: time.Now(),
+		RunId:   runId,
+		Command: command,
+		Message: message,
+		Cmd:     cmd,
+		Sites:   []SiteChange{},
+		Grants:  []newerpol.AccessRecord{},
+		Emails:  []*email.EmailOptions{},
+	}
+}
+
+// AddSite records the pending changes to a site. Sites without changes are
+// ignored.
+func (p *Plan) AddSite(site *cdb.Site) error {
+	changes, err := site.PendingChanges()
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	p.Sites = append(p.Sites, SiteChange{Name: site.Name(), Id: site.Id, Changes: changes})
+	return nil
+}
+
+// Save writes the plan to a file
+func (p *Plan) Save(fn string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("plan: Marshalling plan: %v", err)
+	}
+	if err := ioutil.WriteFile(fn, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("plan: Writing %s: %v", fn, err)
+	}
+	return nil
+}
+
+// Load reads a plan from a file
+func Load(fn string) (*Plan, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("plan: Reading %s: %v", fn, err)
+	}
+	p := &Plan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("plan: Unmarshalling %s: %v", fn, err)
+	}
+	if p.Version != Version {
+		return nil, fmt.Errorf("plan: %s has unsupported version %d", fn, p.Version)
+	}
+	return p, nil
+}
@@ -0,0 +1,249 @@
+// Package plugins lets deployments register external programs which pugo
+// invokes at defined points during sync, keeping site-specific logic out of
+// the core. Plugins are configured as a list under the plugins key:
+//
+//	plugins:
+//	  - name: check-logins
+//	    command: /usr/local/bin/pugo-check-logins
+//	    points: [grants, validate]
+//
+// For each point a plugin is registered for, pugo runs its command once,
+// writing a JSON request to stdin and reading a JSON response from stdout.
+// Requests take the form {"version": 1, "point": "<point>", ...} with point
+// specific fields as follows:
+//
+//	grants    request:  {"grants": [<grant>, ...]}
+//	          response: {"skip": {"<access id>": "<reason>", ...}}
+//	validate  request:  {"sites": [<site>, ...]}
+//	          response: {"errors": {"<site name>": ["<error>", ...], ...}}
+//	notify    request:  {"events": [<event>, ...]}
+//	          response: ignored
+//
+// Grant processors may skip grants: skipped grants are neither applied to
+// the cdb nor finished in newerpol. Validators may reject sites, which
+// aborts the sync before anything is committed. Notifiers are informed of
+// each grant finished.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Points at which plugins may be invoked
+const (
+	PointGrants   = "grants"
+	PointValidate = "validate"
+	PointNotify   = "notify"
+)
+
+// Version of the JSON protocol
+const protocolVersion = 1
+
+// How long a single plugin invocation may run for
+const pluginTimeout = 5 * time.Minute
+
+type Plugin struct {
+	Name    string
+	Command string
+	Points  []string
+}
+
+// Event describes a grant which has been finished
+type Event struct {
+	Action    string `json:"action"`
+	Login     string `json:"login"`
+	Site      string `json:"site"`
+	AccessId  int    `json:"access_id"`
+	WebsiteId int    `json:"website_id"`
+}
+
+// Load returns the plugins configured for a point
+func Load(point string) ([]Plugin, error) {
+	var all []Plugin
+	if err := viper.UnmarshalKey("plugins", &all); err != nil {
+		return nil, fmt.Errorf("plugins: Invalid plugins config: %v", err)
+	}
+
+	var plugins []Plugin
+	for _, p := range all {
+		if p.Command == "" {
+			return nil, fmt.Errorf("plugins: Plugin '%s' has no command", p.Name)
+		}
+		for _, pt := range p.Points {
+			if pt == point {
+				plugins = append(plugins, p)
+				break
+			}
+		}
+	}
+	return plugins, nil
+}
+
+// ProcessGrants passes grants to each grant processor plugin in turn,
+// returning the reasons for any grants to skip keyed by access id
+func ProcessGrants(ctx context.Context, grants []newerpol.AccessRecord) (map[int]string, error) {
+	skip := make(map[int]string)
+
+	plugins, err := Load(PointGrants)
+	if err != nil || len(plugins) == 0 || len(grants) == 0 {
+		return skip, err
+	}
+
+	for _, p := range plugins {
+		var resp struct {
+			Skip map[string]string `json:"skip"`
+		}
+		if err := p.invoke(ctx, PointGrants, map[string]interface{}{"grants": grants}, &resp); err != nil {
+			return nil, err
+		}
+		for id, reason := range resp.Skip {
+			accessId, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, fmt.Errorf("plugins: %s: Invalid access id '%s' in response", p.Name, id)
+			}
+			skip[accessId] = fmt.Sprintf("%s: %s", p.Name, reason)
+		}
+	}
+
+	return skip, nil
+}
+
+// ValidateSites passes sites to each validator plugin, returning any errors
+// reported keyed by site name
+func ValidateSites(ctx context.Context, sites []*cdb.Site) (map[string][]string, error) {
+	problems := make(map[string][]string)
+
+	plugins, err := Load(PointValidate)
+	if err != nil || len(plugins) == 0 || len(sites) == 0 {
+		return problems, err
+	}
+
+	siteData := make([]map[string]interface{}, 0, len(sites))
+	for _, site := range sites {
+		data, err := siteMap(site)
+		if err != nil {
+			return nil, err
+		}
+		siteData = append(siteData, data)
+	}
+
+	for _, p := range plugins {
+		var resp struct {
+			Errors map[string][]string `json:"errors"`
+		}
+		if err := p.invoke(ctx, PointValidate, map[string]interface{}{"sites": siteData}, &resp); err != nil {
+			return nil, err
+		}
+		for name, errs := range resp.Errors {
+			for _, e := range errs {
+				problems[name] = append(problems[name], fmt.Sprintf("%s: %s", p.Name, e))
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// Notify passes events to each notifier plugin. Failures are logged rather
+// than returned as notifications are best effort.
+func Notify(ctx context.Context, events []Event) {
+	plugins, err := Load(PointNotify)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	for _, p := range plugins {
+		if err := p.invoke(ctx, PointNotify, map[string]interface{}{"events": events}, nil); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// invoke runs the plugin with a request for point, decoding the response
+// into resp (unless nil)
+func (p *Plugin) invoke(ctx context.Context, point string, fields map[string]interface{}, resp interface{}) error {
+	req := map[string]interface{}{
+		"version": protocolVersion,
+		"point":   point,
+	}
+	for k, v := range fields {
+		req[k] = v
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("plugins: %s: Marshalling request: %v", p.Name, err)
+	}
+
+	log.Debugf("plugins: Invoking %s for %s", p.Name, point)
+
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "sh", "-c", p.Command)
+	c.Stdin = bytes.NewReader(data)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("plugins: %s: %v: %s", p.Name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), resp); err != nil {
+		return fmt.Errorf("plugins: %s: Invalid response: %v", p.Name, err)
+	}
+
+	return nil
+}
+
+// siteMap converts a site to a map using the same field names as the cdb
+// YAML files, plus its name
+func siteMap(site *cdb.Site) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(site)
+	if err != nil {
+		return nil, fmt.Errorf("plugins: Marshalling %s: %v", site.Name(), err)
+	}
+	m := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("plugins: Unmarshalling %s: %v", site.Name(), err)
+	}
+	m["name"] = site.Name()
+	return m, nil
+}
+
+// FormatProblems formats validation problems for display, one per line
+func FormatProblems(problems map[string][]string) string {
+	names := make([]string, 0, len(problems))
+	for name := range problems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buff bytes.Buffer
+	for _, name := range names {
+		for _, problem := range problems[name] {
+			fmt.Fprintf(&buff, "\n  %s: %s", name, problem)
+		}
+	}
+	return buff.String()
+}
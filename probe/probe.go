@@ -0,0 +1,81 @@
+// Package probe checks sites are being served, by requesting each site's
+// primary URL and recording the response status, the redirects followed, and
+// when the TLS certificate expires.
+package probe
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+)
+
+// The most redirects followed before giving up
+const maxRedirects = 10
+
+type Result struct {
+	URL        string
+	StatusCode int
+	// URLs redirected to, in order
+	Redirects []string
+	// When the certificate of the final response expires, zero if not
+	// served over TLS
+	TLSExpiry time.Time
+	Err       error
+}
+
+// OK reports whether the site responded without error
+func (r *Result) OK() bool {
+	return r.Err == nil && r.StatusCode < 400
+}
+
+// URL returns the primary URL of a site: its first external domain, or
+// otherwise its first path under baseURL (e.g. https://union.ic.ac.uk).
+// Returns an empty string if the site has neither.
+func URL(site *cdb.Site, baseURL string) string {
+	if domains := site.DomainNames(); len(domains) > 0 {
+		return "https://" + domains[0] + "/"
+	}
+	if len(site.Paths) > 0 && baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/") + site.Paths[0]
+	}
+	return ""
+}
+
+// Probe requests url, following redirects, waiting at most timeout for the
+// whole exchange
+func Probe(ctx context.Context, url string, timeout time.Duration) *Result {
+	result := &Result{URL: url}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			result.Redirects = append(result.Redirects, req.URL.String())
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("User-Agent", "pugo-probe")
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		result.TLSExpiry = resp.TLS.PeerCertificates[0].NotAfter
+	}
+	return result
+}
@@ -0,0 +1,116 @@
+// Package progress reports the progress of long running operations. When
+// attached to an interactive terminal a progress line is redrawn in place,
+// otherwise progress is periodically logged.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	barWidth         = 30
+	redrawInterval   = 100 * time.Millisecond
+	logEveryInterval = 5 * time.Second
+)
+
+var interactive bool
+var output io.Writer = os.Stderr
+
+// SetInteractive selects whether progress is drawn as an in-place progress
+// line (true) or periodically logged (false, the default)
+func SetInteractive(enabled bool) {
+	interactive = enabled
+}
+
+// Reporter tracks progress of a single operation. It is safe for concurrent
+// use.
+type Reporter struct {
+	label      string
+	total      int
+	done       int
+	started    time.Time
+	lastReport time.Time
+	mu         sync.Mutex
+}
+
+// New creates a Reporter for an operation with total steps. If total is not
+// known in advance pass 0 and only the count of completed steps is shown.
+func New(label string, total int) *Reporter {
+	now := time.Now()
+	return &Reporter{
+		label:      label,
+		total:      total,
+		started:    now,
+		lastReport: now,
+	}
+}
+
+// Add records n further steps as complete
+func (r *Reporter) Add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done += n
+
+	interval := logEveryInterval
+	if interactive {
+		interval = redrawInterval
+	}
+	if time.Since(r.lastReport) >= interval {
+		r.report(false)
+	}
+}
+
+// Finish reports final progress. The Reporter should not be used afterwards
+func (r *Reporter) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.report(true)
+}
+
+func (r *Reporter) report(final bool) {
+	r.lastReport = time.Now()
+
+	// Nothing to report for operations which had nothing to do
+	if final && r.done == 0 && r.total == 0 {
+		return
+	}
+
+	if !interactive {
+		if final {
+			log.Infof("%s: %s in %s", r.label, r.count(), time.Since(r.started).Round(time.Millisecond))
+		} else {
+			log.Infof("%s: %s", r.label, r.count())
+		}
+		return
+	}
+
+	line := fmt.Sprintf("%s: %s", r.label, r.count())
+	if r.total > 0 {
+		filled := barWidth * r.done / r.total
+		if filled > barWidth {
+			filled = barWidth
+		}
+		line = fmt.Sprintf("%s [%s%s] %3d%%", line, strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), 100*r.done/r.total)
+	}
+	if final {
+		fmt.Fprintf(output, "\r\033[K%s\n", line)
+	} else {
+		fmt.Fprintf(output, "\r\033[K%s", line)
+	}
+}
+
+func (r *Reporter) count() string {
+	if r.total > 0 {
+		return fmt.Sprintf("%d/%d", r.done, r.total)
+	}
+	return fmt.Sprintf("%d", r.done)
+}
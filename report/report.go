@@ -0,0 +1,166 @@
+// Package report generates access reports summarising the sites in the cdb
+// grouped by the CSP which owns them
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/icunion/pugo/cdb"
+	"github.com/icunion/pugo/newerpol"
+)
+
+// Sites not associated with a CSP in newerpol are grouped under this name
+const unmanagedCSP = "(Not managed in eActivities)"
+
+type SiteRow struct {
+	Id                 int
+	Name               string
+	FullName           string
+	Admins             int
+	PendingGrants      int
+	PendingRevocations int
+	Expiry             string
+	Disabled           bool
+	DisabledReason     string
+}
+
+type CSPSection struct {
+	CSP           string
+	Sites         []SiteRow
+	Admins        int
+	Pending       int
+	DisabledSites int
+}
+
+type Report struct {
+	Generated     time.Time
+	CSPs          []CSPSection
+	Sites         int
+	Admins        int
+	Pending       int
+	DisabledSites int
+}
+
+// Build creates a report from the cdb sites, the CSP owning each website,
+// and pending grants / revocations keyed by website id
+func Build(sites []*cdb.Site, csps map[int]newerpol.WebsiteCSP, pendingGrants, pendingRevocations map[int][]newerpol.AccessRecord) *Report {
+	r := &Report{
+		Generated: time.Now(),
+	}
+
+	sections := make(map[string]*CSPSection)
+	for _, site := range sites {
+		cspName := unmanagedCSP
+		if csp, ok := csps[site.Id]; ok {
+			cspName = csp.CSP
+		}
+		section := sections[cspName]
+		if section == nil {
+			section = &CSPSection{CSP: cspName}
+			sections[cspName] = section
+		}
+
+		row := SiteRow{
+			Id:                 site.Id,
+			Name:               site.Name(),
+			FullName:           site.FullName,
+			Admins:             len(site.Admins),
+			PendingGrants:      len(pendingGrants[site.Id]),
+			PendingRevocations: len(pendingRevocations[site.Id]),
+			Expiry:             site.Expiry,
+			Disabled:           site.Disabled,
+			DisabledReason:     site.DisabledReason,
+		}
+		section.Sites = append(section.Sites, row)
+		section.Admins += row.Admins
+		section.Pending += row.PendingGrants + row.PendingRevocations
+		if row.Disabled {
+			section.DisabledSites++
+		}
+	}
+
+	for _, section := range sections {
+		sort.Slice(section.Sites, func(i, j int) bool {
+			return section.Sites[i].Name < section.Sites[j].Name
+		})
+		r.CSPs = append(r.CSPs, *section)
+		r.Sites += len(section.Sites)
+		r.Admins += section.Admins
+		r.Pending += section.Pending
+		r.DisabledSites += section.DisabledSites
+	}
+	sort.Slice(r.CSPs, func(i, j int) bool {
+		return r.CSPs[i].CSP < r.CSPs[j].CSP
+	})
+
+	return r
+}
+
+// WriteHTML renders the report as a standalone HTML document
+func (r *Report) WriteHTML(w io.Writer) error {
+	if err := htmlTemplate.Execute(w, r); err != nil {
+		return fmt.Errorf("report: Executing HTML template: %v", err)
+	}
+	return nil
+}
+
+// WriteCSV writes one row per site, including the owning CSP
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"csp", "id", "name", "full_name", "admins", "pending_grants", "pending_revocations", "expiry", "disabled", "disabled_reason"})
+	for _, section := range r.CSPs {
+		for _, site := range section.Sites {
+			cw.Write([]string{
+				section.CSP,
+				strconv.Itoa(site.Id),
+				site.Name,
+				site.FullName,
+				strconv.Itoa(site.Admins),
+				strconv.Itoa(site.PendingGrants),
+				strconv.Itoa(site.PendingRevocations),
+				site.Expiry,
+				strconv.FormatBool(site.Disabled),
+				site.DisabledReason,
+			})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("report: Writing CSV: %v", err)
+	}
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Website access report {{ .Generated.Format "2006-01-02" }}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+tr.disabled { color: #999; }
+</style>
+</head>
+<body>
+<h1>Website access report</h1>
+<p>Generated {{ .Generated.Format "2006-01-02 15:04" }}.
+{{ .Sites }} sites, {{ .Admins }} admins, {{ .Pending }} pending requests, {{ .DisabledSites }} disabled sites.</p>
+{{ range .CSPs }}
+<h2>{{ .CSP }}</h2>
+<p>{{ len .Sites }} sites, {{ .Admins }} admins, {{ .Pending }} pending requests, {{ .DisabledSites }} disabled sites.</p>
+<table>
+<tr><th>Site</th><th>Name</th><th>Admins</th><th>Pending grants</th><th>Pending revocations</th><th>Expiry</th><th>Disabled</th></tr>
+{{ range .Sites }}<tr{{ if .Disabled }} class="disabled"{{ end }}><td>{{ .Name }}</td><td>{{ .FullName }}</td><td>{{ .Admins }}</td><td>{{ .PendingGrants }}</td><td>{{ .PendingRevocations }}</td><td>{{ .Expiry }}</td><td>{{ if .Disabled }}{{ .DisabledReason }}{{ if not .DisabledReason }}yes{{ end }}{{ end }}</td></tr>
+{{ end }}</table>
+{{ end }}
+</body>
+</html>
+`))
@@ -0,0 +1,141 @@
+// Package retry retries operations which fail transiently, such as network
+// calls to the cdb remote, newerpol, the SMTP server, and webhooks. Each subsystem has
+// its own policy, configured under retry.<subsystem> with the keys attempts,
+// backoff, max_backoff, and jitter, e.g.
+//
+//	retry:
+//	  git:
+//	    attempts: 5
+//	    backoff: 2s
+//
+// Whether an error is worth retrying is decided by the caller's classifier;
+// errors wrapped with Permanent and context errors are never retried.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Subsystems with retry policies
+const (
+	Git      = "git"
+	Newerpol = "newerpol"
+	SMTP     = "smtp"
+	Webhook  = "webhook"
+)
+
+type Policy struct {
+	// Maximum number of attempts, including the first. 1 disables retries.
+	Attempts int
+	// Delay before the first retry, doubling for each subsequent retry up to
+	// MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Fraction of each delay which is randomised, so concurrent runs don't
+	// retry in lockstep
+	Jitter float64
+	// Reports whether an error is worth retrying. If nil every error other
+	// than permanent and context errors is retried.
+	Retryable func(error) bool
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func init() {
+	for _, subsystem := range []string{Git, Newerpol, SMTP, Webhook} {
+		viper.SetDefault("retry."+subsystem+".attempts", 3)
+		viper.SetDefault("retry."+subsystem+".backoff", "1s")
+		viper.SetDefault("retry."+subsystem+".max_backoff", "30s")
+		viper.SetDefault("retry."+subsystem+".jitter", 0.2)
+	}
+}
+
+// Permanent marks an error as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// PolicyFor returns the configured policy for a subsystem, using retryable
+// to classify errors
+func PolicyFor(subsystem string, retryable func(error) bool) *Policy {
+	key := "retry." + subsystem + "."
+	return &Policy{
+		Attempts:   viper.GetInt(key + "attempts"),
+		Backoff:    viper.GetDuration(key + "backoff"),
+		MaxBackoff: viper.GetDuration(key + "max_backoff"),
+		Jitter:     viper.GetFloat64(key + "jitter"),
+		Retryable:  retryable,
+	}
+}
+
+// Do calls fn until it succeeds, returns an error which isn't retryable, or
+// the attempts are exhausted, returning the last error. name describes the
+// operation when logging retries.
+func (p *Policy) Do(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt >= p.Attempts || !p.retryable(ctx, err) {
+			return err
+		}
+
+		delay := p.jitter(backoff)
+		log.Warnf("retry: %s failed (attempt %d of %d), retrying in %v: %v", name, attempt, p.Attempts, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (retry abandoned: %v)", err, ctx.Err())
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p *Policy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable == nil {
+		return true
+	}
+	return p.Retryable(err)
+}
+
+func (p *Policy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	spread := float64(d) * p.Jitter
+	return time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+}
@@ -0,0 +1,204 @@
+// Package review opens pull requests on GitHub and merge requests on GitLab,
+// so that changes pugo commits in review mode can go through the same code
+// review as any other change to the cdb. The project and credentials are
+// taken from cdb.review.
+package review
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/config"
+)
+
+// How long opening a request may take
+const requestTimeout = 30 * time.Second
+
+// The public services' API base URLs
+const (
+	gitHubAPIURL = "https://api.github.com"
+	gitLabAPIURL = "https://gitlab.com/api/v4"
+)
+
+// Request is a pull or merge request to open
+type Request struct {
+	Title       string
+	Description string
+	// The branch with the changes, and the branch to merge them into
+	Branch string
+	Base   string
+}
+
+// Open opens a pull request (GitHub) or merge request (GitLab) and returns
+// its URL
+func Open(ctx context.Context, conf *config.Review, r *Request) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	switch conf.Provider {
+	case "github":
+		return openGitHub(ctx, conf, r)
+	case "gitlab":
+		return openGitLab(ctx, conf, r)
+	case "":
+		return "", fmt.Errorf("review: cdb.review.provider isn't set")
+	default:
+		return "", fmt.Errorf("review: Unknown provider '%s'", conf.Provider)
+	}
+}
+
+func openGitHub(ctx context.Context, conf *config.Review, r *Request) (string, error) {
+	body := map[string]string{
+		"title": r.Title,
+		"body":  r.Description,
+		"head":  r.Branch,
+		"base":  r.Base,
+	}
+	endpoint := fmt.Sprintf("%s/repos/%s/pulls", apiURL(conf, gitHubAPIURL), conf.Repo)
+	headers := map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer " + conf.Token,
+	}
+	var resp struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := post(ctx, endpoint, headers, body, &resp); err != nil {
+		return "", fmt.Errorf("review: Opening pull request on %s: %v", conf.Repo, err)
+	}
+	return resp.HTMLURL, nil
+}
+
+func openGitLab(ctx context.Context, conf *config.Review, r *Request) (string, error) {
+	body := map[string]string{
+		"title":         r.Title,
+		"description":   r.Description,
+		"source_branch": r.Branch,
+		"target_branch": r.Base,
+	}
+	endpoint := fmt.Sprintf("%s/projects/%s/merge_requests", apiURL(conf, gitLabAPIURL), url.PathEscape(conf.Repo))
+	headers := map[string]string{
+		"PRIVATE-TOKEN": conf.Token,
+	}
+	var resp struct {
+		WebURL string `json:"web_url"`
+	}
+	if err := post(ctx, endpoint, headers, body, &resp); err != nil {
+		return "", fmt.Errorf("review: Opening merge request on %s: %v", conf.Repo, err)
+	}
+	return resp.WebURL, nil
+}
+
+// OpenBranches returns the branches of the requests still open into base
+// whose names start with prefix, i.e. the changes pugo has proposed which
+// haven't yet been merged or closed
+func OpenBranches(ctx context.Context, conf *config.Review, base string, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var branches []string
+	switch conf.Provider {
+	case "github":
+		query := url.Values{"state": {"open"}, "base": {base}, "per_page": {"100"}}
+		endpoint := fmt.Sprintf("%s/repos/%s/pulls?%s", apiURL(conf, gitHubAPIURL), conf.Repo, query.Encode())
+		headers := map[string]string{
+			"Accept":        "application/vnd.github+json",
+			"Authorization": "Bearer " + conf.Token,
+		}
+		var resp []struct {
+			Head struct {
+				Ref string `json:"ref"`
+			} `json:"head"`
+		}
+		if err := get(ctx, endpoint, headers, &resp); err != nil {
+			return nil, fmt.Errorf("review: Listing pull requests on %s: %v", conf.Repo, err)
+		}
+		for _, pr := range resp {
+			branches = append(branches, pr.Head.Ref)
+		}
+	case "gitlab":
+		query := url.Values{"state": {"opened"}, "target_branch": {base}, "per_page": {"100"}}
+		endpoint := fmt.Sprintf("%s/projects/%s/merge_requests?%s", apiURL(conf, gitLabAPIURL), url.PathEscape(conf.Repo), query.Encode())
+		headers := map[string]string{
+			"PRIVATE-TOKEN": conf.Token,
+		}
+		var resp []struct {
+			SourceBranch string `json:"source_branch"`
+		}
+		if err := get(ctx, endpoint, headers, &resp); err != nil {
+			return nil, fmt.Errorf("review: Listing merge requests on %s: %v", conf.Repo, err)
+		}
+		for _, mr := range resp {
+			branches = append(branches, mr.SourceBranch)
+		}
+	case "":
+		return nil, fmt.Errorf("review: cdb.review.provider isn't set")
+	default:
+		return nil, fmt.Errorf("review: Unknown provider '%s'", conf.Provider)
+	}
+
+	var open []string
+	for _, branch := range branches {
+		if strings.HasPrefix(branch, prefix) {
+			open = append(open, branch)
+		}
+	}
+	return open, nil
+}
+
+func apiURL(conf *config.Review, public string) string {
+	if conf.APIURL != "" {
+		return strings.TrimRight(conf.APIURL, "/")
+	}
+	return public
+}
+
+// post sends body as JSON and decodes the JSON response into result
+func post(ctx context.Context, endpoint string, headers map[string]string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, headers, result)
+}
+
+// get decodes the JSON response to a GET request into result
+func get(ctx context.Context, endpoint string, headers map[string]string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	return do(req, headers, result)
+}
+
+// do sends req with headers and decodes the JSON response into result
+func do(req *http.Request, headers map[string]string, result interface{}) error {
+	req.Header.Set("User-Agent", "pugo")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// The APIs explain what was wrong, e.g. a request already being
+		// open for the branch, in the body
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,245 @@
+// Package secrets resolves references to sensitive values so that they
+// needn't be stored in plain text in the pugo config file. A value may take
+// one of the following forms:
+//
+//	env:NAME              the value of environment variable NAME
+//	file:/path/to/file    the contents of a file
+//	exec:command args     the output of a command, run with sh -c
+//	vault:path#field      a field of a secret read from HashiCorp Vault
+//	age:base64            a value encrypted with age (see Encrypt)
+//
+// Trailing newlines are removed from file contents and command output. Any
+// other value is returned unchanged. The age identities and Vault server used
+// are set with Configure, as they may themselves be taken from secrets.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Prefix of values encrypted with Encrypt
+const EncryptedPrefix = "age:"
+
+// The identity file used if Resolver.IdentityFile isn't set
+const defaultIdentityFile = "~/.pugo-age-key.txt"
+
+// Resolver resolves references with the given age identities and Vault
+// server
+type Resolver struct {
+	// The host's age identities, as generated by age-keygen. The default is
+	// ~/.pugo-age-key.txt.
+	IdentityFile string
+	// Vault's address and token, falling back to the standard VAULT_ADDR
+	// and VAULT_TOKEN environment variables
+	VaultAddress string
+	VaultToken   string
+}
+
+// The resolver used by Resolve and Encrypt
+var defaultResolver = &Resolver{}
+
+// Configure sets the resolver used by Resolve and Encrypt
+func Configure(r *Resolver) {
+	defaultResolver = r
+}
+
+// Resolve returns the value referred to by ref, using the resolver set by
+// Configure
+func Resolve(ctx context.Context, ref string) (string, error) {
+	return defaultResolver.Resolve(ctx, ref)
+}
+
+// Resolve returns the value referred to by ref
+func (r *Resolver) Resolve(ctx context.Context, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secrets: Environment variable %s not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		fn := strings.TrimPrefix(ref, "file:")
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", fmt.Errorf("secrets: Reading %s: %v", fn, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(ref, "exec:"):
+		command := strings.TrimPrefix(ref, "exec:")
+		out, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return "", fmt.Errorf("secrets: Running '%s': %v", command, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	case strings.HasPrefix(ref, "vault:"):
+		return r.resolveVault(ctx, strings.TrimPrefix(ref, "vault:"))
+	case strings.HasPrefix(ref, EncryptedPrefix):
+		return r.decrypt(strings.TrimPrefix(ref, EncryptedPrefix))
+	}
+	return ref, nil
+}
+
+// resolveVault reads a field from a Vault secret. ref takes the form
+// path#field, e.g. secret/data/pugo#newerpol_password. Both KV version 1 and
+// version 2 secrets engines are supported.
+func (r *Resolver) resolveVault(ctx context.Context, ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("secrets: Invalid vault reference '%s': must be of the form path#field", ref)
+	}
+	secretPath, field := parts[0], parts[1]
+
+	address := r.VaultAddress
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := r.VaultToken
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" || token == "" {
+		return "", fmt.Errorf("secrets: Vault address and token required to resolve '%s'", ref)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	url := strings.TrimRight(address, "/") + "/v1/" + strings.TrimLeft(secretPath, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("secrets: Reading %s from vault: %v", secretPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secrets: Reading %s from vault: %s", secretPath, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("secrets: Decoding vault response for %s: %v", secretPath, err)
+	}
+
+	// KV version 2 nests the secret's fields inside a further data key
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secrets: Field %s not found in vault secret %s", field, secretPath)
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+// Encrypt encrypts a value to the recipient of the host key (and any
+// additional recipients) so it can be stored in the config file. The
+// returned value has EncryptedPrefix and is decrypted by Resolve.
+func Encrypt(value string, extraRecipients ...string) (string, error) {
+	identities, err := defaultResolver.loadIdentities()
+	if err != nil {
+		return "", err
+	}
+
+	var recipients []age.Recipient
+	for _, identity := range identities {
+		if x, ok := identity.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	for _, r := range extraRecipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return "", fmt.Errorf("secrets: Parsing recipient %s: %v", r, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("secrets: No recipients to encrypt to")
+	}
+
+	var buff bytes.Buffer
+	w, err := age.Encrypt(&buff, recipients...)
+	if err != nil {
+		return "", fmt.Errorf("secrets: Encrypting: %v", err)
+	}
+	if _, err := w.Write([]byte(value)); err != nil {
+		return "", fmt.Errorf("secrets: Encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("secrets: Encrypting: %v", err)
+	}
+
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+func (r *Resolver) decrypt(encoded string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("secrets: Decoding encrypted value: %v", err)
+	}
+
+	identities, err := r.loadIdentities()
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", fmt.Errorf("secrets: Decrypting value: %v", err)
+	}
+	plaintext, err := ioutil.ReadAll(plain)
+	if err != nil {
+		return "", fmt.Errorf("secrets: Decrypting value: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// loadIdentities reads the host's age identities from IdentityFile
+func (r *Resolver) loadIdentities() ([]age.Identity, error) {
+	fn := r.IdentityFile
+	if fn == "" {
+		fn = defaultIdentityFile
+	}
+	fn, err := homedir.Expand(fn)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %v", err)
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: Opening identity file: %v", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: Parsing identity file %s: %v", fn, err)
+	}
+
+	return identities, nil
+}
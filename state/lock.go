@@ -0,0 +1,264 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// LockInfo is recorded in a lock file to identify the process holding it
+type LockInfo struct {
+	Pid      int       `json:"pid"`
+	Host     string    `json:"host"`
+	Acquired time.Time `json:"acquired"`
+	RunId    string    `json:"run_id,omitempty"`
+	Command  string    `json:"command,omitempty"`
+}
+
+// ErrLocked is returned when a lock is held by another process
+var ErrLocked = errors.New("state: Locked by another pugo process")
+
+func newLockInfo(runId, command string) *LockInfo {
+	host, _ := os.Hostname()
+	return &LockInfo{
+		Pid:      os.Getpid(),
+		Host:     host,
+		Acquired: time.Now(),
+		RunId:    runId,
+		Command:  command,
+	}
+}
+
+func (l *LockInfo) String() string {
+	s := fmt.Sprintf("pid %d on %s since %s", l.Pid, l.Host, l.Acquired.Format(time.RFC3339))
+	if l.Command != "" {
+		s += fmt.Sprintf(" (%s, run %s)", l.Command, l.RunId)
+	}
+	return s
+}
+
+// Local reports whether the lock was taken on this host
+func (l *LockInfo) Local() bool {
+	host, _ := os.Hostname()
+	return l.Host == host
+}
+
+// Stale reports whether the lock holder is known to have exited, i.e. the
+// lock was taken on this host by a process which no longer exists. Locks
+// taken on other hosts are never considered stale.
+func (l *LockInfo) Stale() bool {
+	if l.Pid == 0 || !l.Local() {
+		return false
+	}
+	return !processExists(l.Pid)
+}
+
+// RunLockFileName returns the path of the run lock: lock.file from config,
+// or .pugo.lock in the user's home directory
+func RunLockFileName() (string, error) {
+	if fn := viper.GetString("lock.file"); fn != "" {
+		return homedir.Expand(fn)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("state: %v", err)
+	}
+	return filepath.Join(home, ".pugo.lock"), nil
+}
+
+// AcquireRunLock takes the run lock, which ensures only one pugo run which
+// changes the cdb or newerpol happens at a time. It doesn't wait: if the
+// lock is held by a live process an error wrapping ErrLocked is returned.
+// Locks left behind by processes which have died are broken automatically.
+// Returns a function which releases the lock.
+func AcquireRunLock(runId, command string) (func(), error) {
+	fn, err := RunLockFileName()
+	if err != nil {
+		return nil, err
+	}
+	return lock(fn, 0, newLockInfo(runId, command))
+}
+
+// ReadRunLock returns the holder of the run lock, or nil if it isn't held
+func ReadRunLock() (*LockInfo, error) {
+	fn, err := RunLockFileName()
+	if err != nil {
+		return nil, err
+	}
+	info, err := readLock(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// Unlock removes the run lock and the state file lock regardless of who
+// holds them, for recovery after a crash. Any process still holding them
+// doesn't remove a lock taken since when it finishes.
+func Unlock() error {
+	runLock, err := RunLockFileName()
+	if err != nil {
+		return err
+	}
+	stateFile, err := FileName()
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range []string{runLock, runLock + ".guard", stateFile + ".lock", stateFile + ".lock.guard"} {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("state: Removing lock %s: %v", fn, err)
+		}
+	}
+	return nil
+}
+
+// How long a process breaking or releasing a lock may hold its guard,
+// after which the guard is assumed to have been left behind by a crash
+const guardTimeout = time.Minute
+
+// lock creates a lock file exclusively, recording info in it, and waiting up
+// to timeout for any existing lock to be released. Stale locks are broken.
+// Returns a function which releases the lock, as long as it is still held by
+// info, i.e. it hasn't been broken and taken by another process since.
+func lock(lockFile string, timeout time.Duration, info *LockInfo) (func(), error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("state: Marshalling lock info: %v", err)
+	}
+	release := func() {
+		if err := removeLock(lockFile, info); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			f.Close()
+			if err != nil {
+				os.Remove(lockFile)
+				return nil, fmt.Errorf("state: Writing lock %s: %v", lockFile, err)
+			}
+			return release, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("state: Creating lock %s: %v", lockFile, err)
+		}
+
+		// An unreadable lock may be being written, so only break locks
+		// whose holder is known to be gone
+		holder, err := readLock(lockFile)
+		if os.IsNotExist(err) {
+			// Released since it couldn't be created, so try again
+			// rather than waiting, even with no timeout
+			continue
+		}
+		if err == nil && holder.Stale() {
+			log.Warnf("state: Breaking stale lock %s held by %s", lockFile, holder)
+			if err := removeLock(lockFile, holder); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			if holder != nil {
+				return nil, fmt.Errorf("%w: %s is held by %s", ErrLocked, lockFile, holder)
+			}
+			return nil, fmt.Errorf("%w: Timed out waiting for lock %s", ErrLocked, lockFile)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// removeLock removes lockFile if it is still held by holder. Otherwise, e.g.
+// if another process broke the lock and took it since holder was read, it is
+// left alone. Checking and removing the lock isn't atomic, so processes
+// doing so take turns, holding lockFile.guard while they do.
+func removeLock(lockFile string, holder *LockInfo) error {
+	guard := lockFile + ".guard"
+	deadline := time.Now().Add(guardTimeout)
+	for {
+		f, err := os.OpenFile(guard, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("state: Creating lock guard %s: %v", guard, err)
+		}
+		// The guard is only held for a moment, so one much older than
+		// that was left behind by a process which crashed holding it
+		if fi, err := os.Stat(guard); err == nil && time.Since(fi.ModTime()) > guardTimeout {
+			log.Warnf("state: Removing lock guard %s left since %s", guard, fi.ModTime().Format(time.RFC3339))
+			os.Remove(guard)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("state: Timed out waiting for lock guard %s", guard)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer os.Remove(guard)
+
+	current, err := readLock(lockFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !current.sameHolder(holder) {
+		log.Debugf("state: Not removing lock %s, now held by %s", lockFile, current)
+		return nil
+	}
+	if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("state: Removing lock %s: %v", lockFile, err)
+	}
+	return nil
+}
+
+// sameHolder reports whether l and other record the same taking of a lock
+func (l *LockInfo) sameHolder(other *LockInfo) bool {
+	return l.Pid == other.Pid && l.Host == other.Host && l.RunId == other.RunId && l.Acquired.Equal(other.Acquired)
+}
+
+func readLock(lockFile string) (*LockInfo, error) {
+	data, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("state: Unmarshalling lock %s: %v", lockFile, err)
+	}
+	return info, nil
+}
+
+// processExists reports whether a process with the given pid is running on
+// this host
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails on Windows if the process doesn't exist
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,129 @@
+// Package state persists a small amount of state between runs of pugo, such
+// as when the last successful sync happened. The state file is only updated
+// after a successful run, and writes are guarded by a lock file so that
+// concurrent runs cannot clobber each other's updates. The package also
+// provides the run lock, which stops runs that change the cdb or newerpol
+// from overlapping.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// How long to wait for another process to release the state file lock
+// before giving up
+const lockTimeout = 10 * time.Second
+
+type State struct {
+	// When the last successful sync completed
+	LastSync time.Time `json:"last_sync"`
+	// The run id of the last successful sync
+	LastSyncRunId string `json:"last_sync_run_id,omitempty"`
+	// The highest WebserverAccess id processed by a successful sync. Used
+	// as a change marker by incremental syncs.
+	LastAccessId int `json:"last_access_id"`
+	// The last cdb commit made by a successful sync
+	LastCommit string `json:"last_commit,omitempty"`
+	// With sync.change_tracking, the newerpol change tracking version seen
+	// by the last successful sync, and the pending grants it left pending.
+	// Incremental syncs only fetch grants changed since, and those held.
+	LastChangeVersion int64 `json:"last_change_version,omitempty"`
+	HeldAccessIds     []int `json:"held_access_ids,omitempty"`
+	// With sync.change_tracking, when a sync last fetched every pending
+	// grant, which it does every sync.full_scan_interval
+	LastFullScan time.Time `json:"last_full_scan,omitempty"`
+	// Grants committed to the staging branch or for review, left pending
+	// until a later sync sees them on cdb.branch and finishes them
+	AwaitingAccessIds []int `json:"awaiting_access_ids,omitempty"`
+	// Grants for blocklisted logins, left pending in newerpol, which has no
+	// rejected state. They are reported by the sync which first sees them,
+	// then skipped quietly.
+	BlockedAccessIds []int `json:"blocked_access_ids,omitempty"`
+	// Grants in a plan written by a sync for approval with pugo approve,
+	// left pending and not planned again by later syncs
+	ApprovalAccessIds []int `json:"approval_access_ids,omitempty"`
+}
+
+// FileName returns the path of the state file: state.file from config, or
+// .pugo-state.json in the user's home directory
+func FileName() (string, error) {
+	if fn := viper.GetString("state.file"); fn != "" {
+		return homedir.Expand(fn)
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("state: %v", err)
+	}
+	return filepath.Join(home, ".pugo-state.json"), nil
+}
+
+// Load reads the state file. If the file doesn't exist yet an empty State is
+// returned.
+func Load() (*State, error) {
+	fn, err := FileName()
+	if err != nil {
+		return nil, err
+	}
+	return load(fn)
+}
+
+// Update applies fn to the current state and saves the result. The state
+// file is locked for the duration so concurrent updates are serialised, and
+// written atomically so readers never see a partial file.
+func Update(fn func(s *State)) error {
+	stateFile, err := FileName()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lock(stateFile+".lock", lockTimeout, newLockInfo("", ""))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := load(stateFile)
+	if err != nil {
+		return err
+	}
+	fn(s)
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("state: Marshalling state: %v", err)
+	}
+	tmpFile := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("state: Writing %s: %v", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, stateFile); err != nil {
+		return fmt.Errorf("state: Replacing %s: %v", stateFile, err)
+	}
+
+	return nil
+}
+
+func load(fn string) (*State, error) {
+	s := &State{}
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("state: Reading %s: %v", fn, err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("state: Unmarshalling %s: %v", fn, err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,110 @@
+// Package tracing exports OpenTelemetry spans for pugo runs, so that slow
+// runs can be broken down into time spent pulling and pushing the cdb,
+// querying newerpol, and sending email. Tracing is disabled unless
+// tracing.endpoint is configured, in which case spans are sent to it with
+// OTLP over HTTP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/icunion/pugo/secrets"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/icunion/pugo"
+
+// How long to wait for spans to be exported when pugo exits
+const shutdownTimeout = 5 * time.Second
+
+var provider *sdktrace.TracerProvider
+
+func init() {
+	viper.SetDefault("tracing.service_name", "pugo")
+}
+
+// Init configures the exporter from tracing.endpoint. Headers to send with
+// each export (e.g. for authentication) are given in tracing.headers as
+// name=value strings, where the value may be a secret reference such as
+// env:NAME. If no endpoint is configured spans are discarded.
+func Init() error {
+	endpoint := viper.GetString("tracing.endpoint")
+	if endpoint == "" {
+		return nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	if headers := viper.GetStringSlice("tracing.headers"); len(headers) > 0 {
+		h := make(map[string]string)
+		for _, header := range headers {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("tracing: Invalid header '%s': must be of the form name=value", header)
+			}
+			value, err := secrets.Resolve(context.Background(), parts[1])
+			if err != nil {
+				return fmt.Errorf("tracing: Header %s: %v", parts[0], err)
+			}
+			h[parts[0]] = value
+		}
+		opts = append(opts, otlptracehttp.WithHeaders(h))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("tracing: Creating exporter: %v", err)
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", viper.GetString("tracing.service_name")),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return nil
+}
+
+// Shutdown exports any spans not yet sent. It is safe to call if tracing
+// isn't enabled.
+func Shutdown() error {
+	if provider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("tracing: Exporting spans: %v", err)
+	}
+	return nil
+}
+
+// Start starts a span, as a child of any span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span, recording the error pointed to by err if there is one. It
+// is intended to be deferred with a named error result, i.e.
+//
+//	ctx, span := tracing.Start(ctx, "name")
+//	defer tracing.End(span, &err)
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
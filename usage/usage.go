@@ -0,0 +1,57 @@
+// Package usage measures the disk space used by sites' docroots. Docroots are
+// read through the local filesystem at the path given by du.docroot, so pugo
+// must run on the webserver, or with the webserver's docroots mounted.
+package usage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/icunion/pugo/cdb"
+
+	"github.com/spf13/viper"
+)
+
+// MiB is the unit of site quotas
+const MiB = 1024 * 1024
+
+// Docroot returns the docroot of a site: du.docroot with {site} replaced by
+// the site's name
+func Docroot(site *cdb.Site) (string, error) {
+	docroot := viper.GetString("du.docroot")
+	if docroot == "" {
+		return "", errors.New("usage: du.docroot must be configured")
+	}
+	return strings.ReplaceAll(docroot, "{site}", site.Name()), nil
+}
+
+// Measure returns the total size in bytes of the regular files under dir.
+// Symbolic links aren't followed, so files outside the docroot aren't counted.
+func Measure(ctx context.Context, dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// OverQuota reports whether size bytes exceeds a site's quota. Sites without
+// a quota are never over it.
+func OverQuota(site *cdb.Site, size int64) bool {
+	return site.Quota > 0 && size > int64(site.Quota)*MiB
+}
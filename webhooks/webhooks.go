@@ -0,0 +1,143 @@
+// Package webhooks posts a JSON event to each of the configured
+// webhooks.urls for every admin added or removed and every commit pugo makes,
+// so other systems can react to access changes without polling the cdb.
+// Each body is signed with an HMAC-SHA256 of webhooks.secret, sent in the
+// X-Pugo-Signature header as sha256=<hex>. Delivery is best effort: failures
+// are logged but never fail the change being reported.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/icunion/pugo/config"
+	"github.com/icunion/pugo/retry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events sent
+const (
+	EventAdminAdd    = "admin-add"
+	EventAdminRemove = "admin-remove"
+	EventCommit      = "commit"
+)
+
+// How long a single delivery may take
+const deliveryTimeout = 10 * time.Second
+
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// The run id and command of the pugo invocation making the change
+	RunId   string `json:"run_id,omitempty"`
+	Command string `json:"command,omitempty"`
+	// For admin events, the site and login affected
+	Site  string `json:"site,omitempty"`
+	Login string `json:"login,omitempty"`
+	// The commit making the change, and for commit events its message,
+	// the sites it changed, and whether it was pushed
+	Commit  string   `json:"commit"`
+	Message string   `json:"message,omitempty"`
+	Sites   []string `json:"sites,omitempty"`
+	Pushed  bool     `json:"pushed,omitempty"`
+}
+
+var conf = &config.Webhooks{}
+
+// Configure sets the URLs events are sent to and the secret they are signed
+// with
+func Configure(c *config.Webhooks) {
+	conf = c
+}
+
+var run struct {
+	mu      sync.Mutex
+	runId   string
+	command string
+}
+
+// SetRun sets the run id and command sent with subsequent events
+func SetRun(runId string, command string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.runId = runId
+	run.command = command
+}
+
+// Send delivers events, in order, to each of webhooks.urls, filling in the
+// time and run
+func Send(ctx context.Context, events []Event) {
+	urls := conf.URLs
+	if len(urls) == 0 || len(events) == 0 {
+		return
+	}
+
+	run.mu.Lock()
+	runId, command := run.runId, run.command
+	run.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range events {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		e.RunId = runId
+		e.Command = command
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Warnf("webhooks: Marshalling %s event: %v", e.Event, err)
+			continue
+		}
+		for _, url := range urls {
+			err := retry.PolicyFor(retry.Webhook, nil).Do(ctx, "webhook "+url, func(ctx context.Context) error {
+				return deliver(ctx, url, e.Event, body)
+			})
+			if err != nil {
+				log.Warnf("webhooks: Unable to send %s event to %s: %v", e.Event, url, err)
+			}
+		}
+	}
+}
+
+// Sign returns the signature of body sent in the X-Pugo-Signature header
+func Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(conf.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliver(ctx context.Context, url string, event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pugo")
+	req.Header.Set("X-Pugo-Event", event)
+	req.Header.Set("X-Pugo-Signature", Sign(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	default:
+		return retry.Permanent(fmt.Errorf("%s returned %s", url, resp.Status))
+	}
+}